@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// methodRule restricts the requests whose path matches to the listed HTTP
+// methods (-allowed-methods).
+type methodRule struct {
+	path    *regexp.Regexp
+	methods []string
+}
+
+// parseMethodRule parses a rule given as path-regex=METHOD[,METHOD...]. The
+// path may contain =, the methods never do.
+func parseMethodRule(rule string) (methodRule, error) {
+	i := strings.LastIndex(rule, "=")
+	if i <= 0 || strings.TrimSpace(rule[i+1:]) == "" {
+		return methodRule{}, fmt.Errorf("must be path-regex=METHOD[,METHOD...]")
+	}
+	path, err := regexp.Compile(rule[:i])
+	if err != nil {
+		return methodRule{}, err
+	}
+	r := methodRule{path: path}
+	for _, method := range strings.Split(rule[i+1:], ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			return methodRule{}, fmt.Errorf("must be path-regex=METHOD[,METHOD...]")
+		}
+		r.methods = append(r.methods, method)
+	}
+	return r, nil
+}
+
+// allows reports whether method may be used. HEAD is allowed wherever GET is.
+func (r methodRule) allows(method string) bool {
+	for _, m := range r.methods {
+		if m == method || (m == "GET" && method == "HEAD") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethods returns the rule deciding which methods may be used for the
+// request's path: the first one whose regex matches it. Paths no rule matches
+// are not restricted.
+func (p *OAuthProxy) allowedMethods(req *http.Request) (methodRule, bool) {
+	for _, r := range p.methodRules {
+		if r.path.MatchString(req.URL.Path) {
+			return r, true
+		}
+	}
+	return methodRule{}, false
+}
+
+// serveUpstream passes the request on to the upstreams, unless -allowed-methods
+// restricts its path to other methods, in which case it is answered with 405
+// Method Not Allowed.
+func (p *OAuthProxy) serveUpstream(rw http.ResponseWriter, req *http.Request) {
+	if r, ok := p.allowedMethods(req); ok && !r.allows(req.Method) {
+		log.Printf("%s method %s not allowed for %s", getRemoteAddr(req), req.Method, req.URL.Path)
+		rw.Header().Set("Allow", strings.Join(r.methods, ", "))
+		p.ErrorPage(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed",
+			fmt.Sprintf("%s requests are not allowed here.", req.Method))
+		return
+	}
+	p.serveMux.ServeHTTP(rw, req)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+// requestWithAllowedMethods sends an authenticated request through a proxy
+// configured with the given -allowed-methods rules and returns the response
+// and whether the upstream was reached.
+func requestWithAllowedMethods(t *testing.T, rules []string, method string, path string) (*httptest.ResponseRecorder, bool) {
+	reached := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.AllowedMethods = rules
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &providers.SessionState{
+		Email: "jdoe@example.com", AccessToken: "my_access_token",
+		ExpiresOn: time.Now().Add(time.Hour)}))
+	cookies := requestWithCookies(rw)
+	req, _ = http.NewRequest(method, path, nil)
+	req.RequestURI = path
+	req.Header = cookies.Header
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	return rw, reached
+}
+
+var reportRules = []string{"^/reports(/|$)=GET", "^/api/=get, post"}
+
+func TestAllowedMethodsAllowed(t *testing.T) {
+	rw, reached := requestWithAllowedMethods(t, reportRules, "GET", "/reports/2018")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, true, reached)
+
+	rw, reached = requestWithAllowedMethods(t, reportRules, "HEAD", "/reports")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, true, reached)
+
+	rw, reached = requestWithAllowedMethods(t, reportRules, "POST", "/api/items")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, true, reached)
+}
+
+func TestAllowedMethodsBlocked(t *testing.T) {
+	rw, reached := requestWithAllowedMethods(t, reportRules, "POST", "/reports/2018")
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, false, reached)
+	assert.Equal(t, "GET", rw.Header().Get("Allow"))
+	assert.Contains(t, rw.Body.String(), "POST requests are not allowed here.")
+
+	rw, reached = requestWithAllowedMethods(t, reportRules, "DELETE", "/api/items")
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, false, reached)
+	assert.Equal(t, "GET, POST", rw.Header().Get("Allow"))
+}
+
+func TestAllowedMethodsUnrestrictedPath(t *testing.T) {
+	rw, reached := requestWithAllowedMethods(t, reportRules, "POST", "/reportsarchive")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, true, reached)
+}
+
+func TestAllowedMethodsBeforeAuthenticationIsNotRevealed(t *testing.T) {
+	opts := testOptions()
+	opts.AllowedMethods = reportRules
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/reports", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Allow"))
+}
+
+func TestAllowedMethodsOptions(t *testing.T) {
+	o := testOptions()
+	o.AllowedMethods = []string{"^/a=b=GET,post"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "^/a=b", o.methodRules[0].path.String())
+	assert.Equal(t, []string{"GET", "POST"}, o.methodRules[0].methods)
+
+	for _, rule := range []string{"/reports", "=GET", "/reports=", "/reports=GET,", "/reports[=GET"} {
+		o = testOptions()
+		o.AllowedMethods = []string{rule}
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, rule)
+		if err != nil {
+			assert.Contains(t, err.Error(), "invalid setting: allowed-methods=", rule)
+		}
+	}
+}
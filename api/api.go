@@ -11,7 +11,12 @@ import (
 )
 
 func Request(req *http.Request) (*simplejson.Json, error) {
-	resp, err := http.DefaultClient.Do(req)
+	return RequestWithClient(http.DefaultClient, req)
+}
+
+// RequestWithClient is Request, sending req with the given client.
+func RequestWithClient(c *http.Client, req *http.Request) (*simplejson.Json, error) {
+	resp, err := c.Do(req)
 	if err != nil {
 		log.Printf("%s %s %s", req.Method, req.URL, err)
 		return nil, err
@@ -33,7 +38,12 @@ func Request(req *http.Request) (*simplejson.Json, error) {
 }
 
 func RequestJson(req *http.Request, v interface{}) error {
-	resp, err := http.DefaultClient.Do(req)
+	return RequestJsonWithClient(http.DefaultClient, req, v)
+}
+
+// RequestJsonWithClient is RequestJson, sending req with the given client.
+func RequestJsonWithClient(c *http.Client, req *http.Request, v interface{}) error {
+	resp, err := c.Do(req)
 	if err != nil {
 		log.Printf("%s %s %s", req.Method, req.URL, err)
 		return err
@@ -51,11 +61,17 @@ func RequestJson(req *http.Request, v interface{}) error {
 }
 
 func RequestUnparsedResponse(url string, header http.Header) (resp *http.Response, err error) {
+	return RequestUnparsedResponseWithClient(http.DefaultClient, url, header)
+}
+
+// RequestUnparsedResponseWithClient is RequestUnparsedResponse, sending the
+// request with the given client.
+func RequestUnparsedResponseWithClient(c *http.Client, url string, header http.Header) (resp *http.Response, err error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = header
 
-	return http.DefaultClient.Do(req)
+	return c.Do(req)
 }
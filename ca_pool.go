@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadCAPool reads the PEM encoded CA certificates in files into a pool. The
+// pool starts out with the system roots if withSystemRoots is set, and empty
+// otherwise, so that only the given CAs are trusted. kind names the files in
+// errors, e.g. "upstream".
+func loadCAPool(kind string, files []string, withSystemRoots bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if withSystemRoots {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("could not load the system roots: %v", err)
+		}
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s CA file: %v", kind, err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s CA file %s", kind, file)
+		}
+	}
+	return pool, nil
+}
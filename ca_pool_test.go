@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCA writes a CA certificate to a temporary file and returns it with
+// a server certificate for 127.0.0.1 issued by it.
+func newTestCA(t *testing.T) (caFile string, serverCert tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "oauth2_proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return writeTestPEM(t, "CERTIFICATE", caDER), serverCert
+}
+
+// startTLSWithCert returns a function starting TLS test servers that present
+// cert, for startDiscoveryServer.
+func startTLSWithCert(cert tls.Certificate) func(http.Handler) *httptest.Server {
+	return func(h http.Handler) *httptest.Server {
+		server := httptest.NewUnstartedServer(h)
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		return server
+	}
+}
+
+func TestLoadCAPool(t *testing.T) {
+	caFile, _ := newTestCA(t)
+	defer os.Remove(caFile)
+	otherCAFile, _ := newTestCA(t)
+	defer os.Remove(otherCAFile)
+
+	pool, err := loadCAPool("provider", []string{caFile, otherCAFile}, false)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(pool.Subjects()))
+
+	_, err = loadCAPool("provider", []string{caFile, "/nonexistent/ca.pem"}, false)
+	assert.Contains(t, err.Error(), "could not read provider CA file")
+
+	keyFile := writeTestPEM(t, "EC PRIVATE KEY", []byte("not a certificate"))
+	defer os.Remove(keyFile)
+	_, err = loadCAPool("provider", []string{keyFile}, false)
+	assert.Equal(t, "no certificates found in provider CA file "+keyFile, err.Error())
+}
+
+func TestProviderCAFile(t *testing.T) {
+	caFile, serverCert := newTestCA(t)
+	defer os.Remove(caFile)
+	otherCAFile, _ := newTestCA(t)
+	defer os.Remove(otherCAFile)
+	server := startDiscoveryServer(startTLSWithCert(serverCert))
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.ProviderCAFiles = []string{otherCAFile}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "x509")
+
+	o = testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.ProviderCAFiles = []string{otherCAFile, caFile}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, server.URL+"/token", o.provider.Data().RedeemURL.String())
+	client := o.provider.Data().HTTPClient
+	assert.Equal(t, false, client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+}
+
+func TestProviderCAFileOptionErrors(t *testing.T) {
+	o := testOptions()
+	o.ProviderCAFiles = []string{"/nonexistent/ca.pem"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: could not read provider CA file")
+
+	o.SSLInsecureSkipVerify = true
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: provider-ca-file and ssl-insecure-skip-verify are mutually exclusive")
+}
+
+func TestUpstreamCAFile(t *testing.T) {
+	caFile, serverCert := newTestCA(t)
+	defer os.Remove(caFile)
+	otherCAFile, _ := newTestCA(t)
+	defer os.Remove(otherCAFile)
+	upstream := startTLSWithCert(serverCert)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	for _, tt := range []struct {
+		caFiles  []string
+		expected int
+	}{
+		{nil, http.StatusBadGateway},
+		{[]string{otherCAFile}, http.StatusBadGateway},
+		{[]string{otherCAFile, caFile}, http.StatusOK},
+	} {
+		opts := testOptions()
+		opts.Upstreams = []string{upstream.URL}
+		opts.SkipAuthRegex = []string{"/.*"}
+		opts.UpstreamCAFiles = tt.caFiles
+		rw := requestTLSUpstream(t, upstream, opts)
+		assert.Equal(t, tt.expected, rw.Code, "%v", tt.caFiles)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressionTypes are the text based content types worth compressing;
+// images, archives and the like are compressed already.
+var defaultCompressionTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// CompressionHandler compresses the responses of h with gzip, or deflate for
+// clients that don't accept gzip, if the response is at least minSize bytes,
+// has one of contentTypes and isn't encoded already. A content type ending in
+// /* matches all subtypes.
+func CompressionHandler(h http.Handler, minSize int, contentTypes []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := acceptedEncoding(req.Header.Get("Accept-Encoding"))
+		if encoding == "" || req.Method == "HEAD" || websocketUpgradeRequest(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        minSize,
+			contentTypes:   contentTypes,
+		}
+		defer cw.Close()
+		h.ServeHTTP(cw, req)
+	})
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// ignoring codings the client refuses with q=0.
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[name] = true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+					accepted[name] = false
+				}
+			}
+		}
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressResponseWriter buffers the start of a response until minSize bytes
+// are written, the handler flushes or it returns, and then decides whether to
+// compress it.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding     string
+	minSize      int
+	contentTypes []string
+
+	status  int
+	buf     []byte
+	decided bool
+	writer  io.WriteCloser
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the header, compressing the response if it is eligible, and
+// then the buffered body.
+func (w *compressResponseWriter) decide() error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	header := w.Header()
+	if header.Get("Content-Type") == "" && len(w.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if w.compressible() {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		header.Add("Vary", "Accept-Encoding")
+		if w.encoding == "gzip" {
+			w.writer = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.writer, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.writer != nil {
+		_, err := w.writer.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *compressResponseWriter) compressible() bool {
+	header := w.Header()
+	if len(w.buf) < w.minSize || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range w.contentTypes {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush sends what was written so far, so that streamed responses such as
+// server-sent events aren't held back by the buffer.
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if gz, ok := w.writer.(*gzip.Writer); ok {
+		gz.Flush()
+	} else if fl, ok := w.writer.(*flate.Writer); ok {
+		fl.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close completes the response once the handler returned.
+func (w *compressResponseWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// nothing was written; let the server send its default response
+			return nil
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.writer != nil {
+		return w.writer.Close()
+	}
+	return nil
+}
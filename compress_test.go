@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var largeJSON = `{"items": [` + strings.Repeat(`{"id": 1, "name": "item"}, `, 100) + `{}]}`
+
+func compressTest(acceptEncoding string, h http.HandlerFunc) *httptest.ResponseRecorder {
+	handler := CompressionHandler(h, 1024, defaultCompressionTypes)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/items", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func jsonHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(body))
+	}
+}
+
+func TestCompressionGzip(t *testing.T) {
+	rw := compressTest("gzip, deflate", jsonHandler(largeJSON))
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "gzip", rw.HeaderMap.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rw.HeaderMap.Get("Vary"))
+	assert.Equal(t, true, rw.Body.Len() < len(largeJSON))
+
+	r, err := gzip.NewReader(rw.Body)
+	assert.Equal(t, nil, err)
+	body, err := ioutil.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, largeJSON, string(body))
+}
+
+func TestCompressionDeflate(t *testing.T) {
+	rw := compressTest("deflate, gzip;q=0", jsonHandler(largeJSON))
+	assert.Equal(t, "deflate", rw.HeaderMap.Get("Content-Encoding"))
+
+	body, err := ioutil.ReadAll(flate.NewReader(rw.Body))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, largeJSON, string(body))
+}
+
+func TestCompressionWrittenInPieces(t *testing.T) {
+	rw := compressTest("gzip", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusCreated)
+		for _, line := range strings.SplitAfter(largeJSON, ",") {
+			w.Write([]byte(line))
+		}
+	})
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	assert.Equal(t, "gzip", rw.HeaderMap.Get("Content-Encoding"))
+
+	r, err := gzip.NewReader(rw.Body)
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(r)
+	assert.Equal(t, largeJSON, string(body))
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		handler        http.HandlerFunc
+	}{
+		{"client without gzip", "", jsonHandler(largeJSON)},
+		{"gzip refused", "gzip;q=0", jsonHandler(largeJSON)},
+		{"small response", "gzip", jsonHandler(`{"id": 1}`)},
+		{"content type not allowed", "gzip", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(largeJSON))
+		}},
+		{"already encoded", "gzip", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(largeJSON))
+		}},
+		{"range response", "gzip", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Range", "bytes 0-2099/5000")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(largeJSON))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := compressTest(tt.acceptEncoding, tt.handler)
+			assert.NotEqual(t, "gzip", rw.HeaderMap.Get("Content-Encoding"))
+			assert.Equal(t, "", rw.HeaderMap.Get("Vary"))
+			assert.Equal(t, true, bytes.Contains(rw.Body.Bytes(), []byte(`{"id": 1`)))
+		})
+	}
+}
+
+func TestCompressionRedirectWithoutBody(t *testing.T) {
+	rw := compressTest("gzip", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/sign_in", http.StatusFound)
+	})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/sign_in", rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "", rw.HeaderMap.Get("Content-Encoding"))
+}
+
+func TestCompressionContentTypeWildcard(t *testing.T) {
+	handler := CompressionHandler(jsonHandler(largeJSON), 0, []string{"application/*"})
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, "gzip", rw.HeaderMap.Get("Content-Encoding"))
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"GZIP":                    "gzip",
+		"deflate, gzip;q=1.0, br": "gzip",
+		"deflate":                 "deflate",
+		"gzip;q=0, deflate":       "deflate",
+		"br, identity":            "",
+		"gzip; q=0":               "",
+	} {
+		assert.Equal(t, expected, acceptedEncoding(header), header)
+	}
+}
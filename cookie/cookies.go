@@ -126,3 +126,40 @@ func (c *Cipher) Decrypt(s string) (string, error) {
 
 	return string(encrypted), nil
 }
+
+// Seal encrypts and authenticates a value with AES-GCM, so that it can be
+// neither read nor modified without the secret.
+func (c *Cipher) Seal(value string) (string, error) {
+	gcm, err := cipher.NewGCM(c.Block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce %s", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed by Seal, failing if it has been tampered with.
+func (c *Cipher) Open(s string) (string, error) {
+	sealed, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+	}
+	gcm, err := cipher.NewGCM(c.Block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted cookie value should be "+
+			"at least %d bytes, but is only %d bytes",
+			gcm.NonceSize(), len(sealed))
+	}
+	value, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+	}
+	return string(value), nil
+}
@@ -2,6 +2,7 @@ package cookie
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,3 +41,72 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestSealAndOpen(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	const session = "email:user@domain.com user:user|token|id_token|1500000000|refresh"
+	c, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+
+	sealed, err := c.Seal(session)
+	assert.Equal(t, nil, err)
+	assert.NotContains(t, sealed, "user@domain.com")
+
+	// every seal uses a fresh nonce
+	sealed2, err := c.Seal(session)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, sealed, sealed2)
+
+	opened, err := c.Open(sealed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, session, opened)
+}
+
+func TestOpenDetectsTampering(t *testing.T) {
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+	sealed, err := c.Seal("email:user@domain.com user:user")
+	assert.Equal(t, nil, err)
+
+	raw, err := base64.URLEncoding.DecodeString(sealed)
+	assert.Equal(t, nil, err)
+	raw[len(raw)-1] ^= 1
+	_, err = c.Open(base64.URLEncoding.EncodeToString(raw))
+	assert.NotEqual(t, nil, err)
+
+	_, err = c.Open(sealed[:8])
+	assert.NotEqual(t, nil, err)
+
+	_, err = c.Open("not base64!")
+	assert.NotEqual(t, nil, err)
+
+	other, err := NewCipher([]byte("0000000000abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+	_, err = other.Open(sealed)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869 test case 3, truncated to the hash length
+	secret := make([]byte, 22)
+	for i := range secret {
+		secret[i] = 0x0b
+	}
+	assert.Equal(t, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d",
+		hex.EncodeToString(hkdfSHA256(secret, nil)))
+}
+
+func TestDeriveKey(t *testing.T) {
+	key := DeriveKey([]byte("a passphrase of any length"))
+	assert.Equal(t, "0540cce2c84fd669da8b55da83f09831fab74cf953815cbee8c21e6081922623",
+		hex.EncodeToString(key))
+	assert.NotEqual(t, key, DeriveKey([]byte("another passphrase")))
+
+	c, err := NewCipher(key)
+	assert.Equal(t, nil, err)
+	encoded, err := c.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+	decoded, err := c.Decrypt(encoded)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my access token", decoded)
+}
@@ -0,0 +1,27 @@
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const keyInfo = "oauth2_proxy cookie encryption key"
+
+// DeriveKey derives a 32 byte AES-256 key for NewCipher from a secret of any
+// length, so a passphrase can be used as cookie secret.
+func DeriveKey(secret []byte) []byte {
+	return hkdfSHA256(secret, []byte(keyInfo))
+}
+
+// hkdfSHA256 is HKDF (RFC 5869) with SHA-256, no salt and an output of one
+// hash length, which is all a single AES key needs.
+func hkdfSHA256(secret, info []byte) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultCORSMethods are the methods cross-origin requests may use unless
+// -cors-allowed-method is given.
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// corsPolicy answers CORS preflight requests on behalf of the upstreams
+// (-cors-allowed-origin). Browsers send preflights without cookies, so they
+// can't be authenticated, and can't follow the redirect to the provider.
+type corsPolicy struct {
+	// origins are the allowed origins, lowercased; "*" allows any origin.
+	origins          []string
+	methods          []string
+	headers          []string
+	allowCredentials bool
+}
+
+// newCORSPolicy checks the allowed origins, which are either * or
+// scheme://host[:port], and normalizes the methods and headers.
+func newCORSPolicy(origins, methods, headers []string, allowCredentials bool) (*corsPolicy, error) {
+	c := &corsPolicy{allowCredentials: allowCredentials}
+	for _, origin := range origins {
+		if origin == "*" {
+			if allowCredentials {
+				return nil, fmt.Errorf("cors-allowed-origin=* can't be used with cors-allow-credentials")
+			}
+			c.origins = append(c.origins, origin)
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("cors-allowed-origin=%q must be * or scheme://host[:port]", origin)
+		}
+		c.origins = append(c.origins, strings.ToLower(origin))
+	}
+	for _, method := range methods {
+		c.methods = append(c.methods, strings.ToUpper(strings.TrimSpace(method)))
+	}
+	for _, header := range headers {
+		c.headers = append(c.headers, http.CanonicalHeaderKey(strings.TrimSpace(header)))
+	}
+	return c, nil
+}
+
+// corsPreflightRequest reports whether req is a CORS preflight, as opposed to
+// any other OPTIONS request.
+func corsPreflightRequest(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (c *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *corsPolicy) allowsMethod(method string) bool {
+	for _, m := range c.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether all headers of an
+// Access-Control-Request-Headers value are allowed.
+func (c *corsPolicy) allowsHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		allowed := false
+		for _, a := range c.headers {
+			if strings.EqualFold(a, h) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// CORSPreflight answers a CORS preflight with 204 and the CORS headers when
+// its origin, method and headers are allowed, and with 403 otherwise. The
+// request never reaches the upstream.
+func (p *OAuthProxy) CORSPreflight(rw http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	headers := req.Header.Get("Access-Control-Request-Headers")
+	rw.Header().Add("Vary", "Origin")
+	rw.Header().Add("Vary", "Access-Control-Request-Method")
+	rw.Header().Add("Vary", "Access-Control-Request-Headers")
+	if !p.cors.allowsOrigin(origin) || !p.cors.allowsMethod(method) || !p.cors.allowsHeaders(headers) {
+		log.Printf("%s CORS preflight denied: origin=%q method=%q headers=%q",
+			getRemoteAddr(req), origin, method, headers)
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	rw.Header().Set("Access-Control-Allow-Methods", strings.Join(p.cors.methods, ", "))
+	if len(p.cors.headers) > 0 {
+		rw.Header().Set("Access-Control-Allow-Headers", strings.Join(p.cors.headers, ", "))
+	}
+	if p.cors.allowCredentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
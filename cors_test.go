@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCORSTestProxy returns a proxy answering preflights from
+// https://app.example.com, its upstream and whether the upstream was reached.
+func newCORSTestProxy(t *testing.T) (*OAuthProxy, *httptest.Server, *bool) {
+	reached := new(bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*reached = true
+	}))
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CORSAllowedOrigins = []string{"https://app.example.com"}
+	opts.CORSAllowedMethods = []string{"get", "POST"}
+	opts.CORSAllowedHeaders = []string{"content-type", "X-Requested-With"}
+	opts.CORSAllowCredentials = true
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	return NewOAuthProxy(opts, func(string) bool { return true }), upstream, reached
+}
+
+func preflightRequest(origin string, method string, headers string) *http.Request {
+	req, _ := http.NewRequest("OPTIONS", "/api/items", nil)
+	req.RequestURI = "/api/items"
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	return req
+}
+
+func TestCORSPreflight(t *testing.T) {
+	proxy, upstream, reached := newCORSTestProxy(t)
+	defer upstream.Close()
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, preflightRequest("https://app.example.com", "POST", "Content-Type, x-requested-with"))
+
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, false, *reached)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST", rw.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type, X-Requested-With", rw.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, rw.Header()["Vary"], "Origin")
+	assert.Equal(t, "", rw.Body.String())
+}
+
+func TestCORSPreflightDenied(t *testing.T) {
+	for _, req := range []*http.Request{
+		preflightRequest("https://evil.example.com", "POST", ""),
+		preflightRequest("https://app.example.com", "DELETE", ""),
+		preflightRequest("https://app.example.com", "POST", "Content-Type, X-Secret"),
+	} {
+		proxy, upstream, reached := newCORSTestProxy(t)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		upstream.Close()
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Equal(t, false, *reached)
+		assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSNonPreflightOptions(t *testing.T) {
+	proxy, upstream, reached := newCORSTestProxy(t)
+	defer upstream.Close()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/api/items", nil)
+	req.RequestURI = "/api/items"
+	req.Header.Set("Origin", "https://app.example.com")
+	proxy.ServeHTTP(rw, req)
+
+	// without Access-Control-Request-Method it has to be authenticated
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, false, *reached)
+	assert.Contains(t, rw.Body.String(), "Sign in")
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSPreflightWithoutPolicy(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, preflightRequest("https://app.example.com", "POST", ""))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	c, err := newCORSPolicy([]string{"*"}, defaultCORSMethods, nil, false)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, c.allowsOrigin("https://anything.example.org"))
+	assert.Equal(t, true, c.allowsMethod("DELETE"))
+	assert.Equal(t, true, c.allowsHeaders(""))
+	assert.Equal(t, false, c.allowsHeaders("Authorization"))
+}
+
+func TestCORSOptions(t *testing.T) {
+	o := testOptions()
+	o.CORSAllowedOrigins = []string{"https://App.example.com", "http://localhost:3000"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"https://app.example.com", "http://localhost:3000"}, o.cors.origins)
+	assert.Equal(t, defaultCORSMethods, o.cors.methods)
+
+	for _, origin := range []string{"app.example.com", "https://app.example.com/", "ftp://app.example.com"} {
+		o = testOptions()
+		o.CORSAllowedOrigins = []string{origin}
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, origin)
+		assert.Contains(t, err.Error(), "invalid setting: cors-allowed-origin=", origin)
+	}
+
+	o = testOptions()
+	o.CORSAllowedOrigins = []string{"*"}
+	o.CORSAllowCredentials = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: cors-allowed-origin=* can't be used with cors-allow-credentials")
+
+	o = testOptions()
+	o.CORSAllowedHeaders = []string{"Content-Type"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "cors-allowed-header and cors-allow-credentials require cors-allowed-origin")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// forwardJWTIssuer is the iss claim of the JWTs minted for upstreams.
+const forwardJWTIssuer = "oauth2_proxy"
+
+// forwardJWTLifetime is how long a JWT minted for an upstream is valid. A new
+// one is minted for every request, so this only has to cover the request.
+const forwardJWTLifetime = 5 * time.Minute
+
+// forwardJWTSigner mints the JWTs asserting the authenticated user to the
+// upstream (-forward-jwt-key), so that upstreams can verify who the user is
+// with the public key instead of trusting plain headers.
+type forwardJWTSigner struct {
+	signer jose.Signer
+	// header is the request header the JWT is passed in.
+	header string
+}
+
+// newForwardJWTSigner signs with key using RS256. The key ID is the RFC 7638
+// thumbprint of the public key, so that upstreams can tell keys apart when
+// the key is rotated.
+func newForwardJWTSigner(key *rsa.PrivateKey, header string) (*forwardJWTSigner, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: &key.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key: jose.JSONWebKey{
+			Key:   key,
+			KeyID: base64.RawURLEncoding.EncodeToString(thumbprint),
+		},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+	return &forwardJWTSigner{signer: signer, header: header}, nil
+}
+
+// mint returns a JWT carrying the user, email and groups of session as its
+// sub, email and groups claims, valid for forwardJWTLifetime from now.
+func (s *forwardJWTSigner) mint(session *providers.SessionState, now time.Time) (string, error) {
+	groups := session.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	claims := map[string]interface{}{
+		"iss":    forwardJWTIssuer,
+		"sub":    session.User,
+		"groups": groups,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    now.Add(forwardJWTLifetime).Unix(),
+	}
+	if session.Email != "" {
+		claims["email"] = session.Email
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	jws, err := s.signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+var testForwardJWTKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+// verifyForwardJWT checks the signature of a forwarded JWT and returns its
+// claims.
+func verifyForwardJWT(t *testing.T, token string) (map[string]interface{}, jose.Header) {
+	jws, err := jose.ParseSigned(token)
+	assert.Equal(t, nil, err)
+	payload, err := jws.Verify(&testForwardJWTKey.PublicKey)
+	assert.Equal(t, nil, err)
+	var claims map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(payload, &claims))
+	return claims, jws.Signatures[0].Header
+}
+
+func TestForwardJWTMint(t *testing.T) {
+	signer, err := newForwardJWTSigner(testForwardJWTKey, "X-Forwarded-Access-Token")
+	assert.Equal(t, nil, err)
+
+	now := time.Unix(1500000000, 0)
+	token, err := signer.mint(&providers.SessionState{
+		User:   "jdoe",
+		Email:  "jdoe@example.com",
+		Groups: []string{"admins", "devs"},
+	}, now)
+	assert.Equal(t, nil, err)
+
+	claims, header := verifyForwardJWT(t, token)
+	assert.Equal(t, "oauth2_proxy", claims["iss"])
+	assert.Equal(t, "jdoe", claims["sub"])
+	assert.Equal(t, "jdoe@example.com", claims["email"])
+	assert.Equal(t, []interface{}{"admins", "devs"}, claims["groups"])
+	assert.Equal(t, float64(1500000000), claims["iat"])
+	assert.Equal(t, float64(1500000300), claims["exp"])
+	assert.Equal(t, "RS256", header.Algorithm)
+	assert.Equal(t, "JWT", header.ExtraHeaders["typ"])
+	assert.NotEqual(t, "", header.KeyID)
+
+	// another key does not verify it
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jws, _ := jose.ParseSigned(token)
+	_, err = jws.Verify(&other.PublicKey)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestForwardJWTMintWithoutEmailOrGroups(t *testing.T) {
+	signer, _ := newForwardJWTSigner(testForwardJWTKey, "X-Forwarded-Access-Token")
+	token, err := signer.mint(&providers.SessionState{User: "jdoe"}, time.Now())
+	assert.Equal(t, nil, err)
+
+	claims, _ := verifyForwardJWT(t, token)
+	_, ok := claims["email"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, []interface{}{}, claims["groups"])
+}
+
+func TestForwardJWTPassedUpstream(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer upstream.Close()
+
+	keyFile := writeTestPEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(testForwardJWTKey))
+	defer os.Remove(keyFile)
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	// the groups are only kept in encrypted sessions
+	opts.CookieSecret = "16 bytes AES-128"
+	opts.CookieEncrypt = true
+	opts.EmailDomains = []string{"*"}
+	opts.ForwardJWTKey = keyFile
+	opts.ForwardJWTHeader = "X-Identity"
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &providers.SessionState{
+		User: "jdoe", Email: "jdoe@example.com", Groups: []string{"devs"},
+		AccessToken: "my_access_token", ExpiresOn: time.Now().Add(time.Hour)}))
+	req = requestWithCookies(rw)
+	req.RequestURI = "/"
+	// a token sent by the client is replaced
+	req.Header.Set("X-Identity", "forged")
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	claims, _ := verifyForwardJWT(t, received.Get("X-Identity"))
+	assert.Equal(t, "jdoe", claims["sub"])
+	assert.Equal(t, "jdoe@example.com", claims["email"])
+	assert.Equal(t, []interface{}{"devs"}, claims["groups"])
+}
+
+func TestForwardJWTKeyOptions(t *testing.T) {
+	keyFile := writeTestPEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(testForwardJWTKey))
+	defer os.Remove(keyFile)
+
+	o := testOptions()
+	o.ForwardJWTKey = keyFile
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "X-Forwarded-Access-Token", o.forwardJWT.header)
+
+	o = testOptions()
+	o.ForwardJWTKey = keyFile
+	o.PassAccessToken = true
+	o.CookieSecret = "16 bytes AES-128"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: forward-jwt-header=X-Forwarded-Access-Token is used by pass-access-token")
+
+	o.ForwardJWTHeader = "X-Identity"
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.ForwardJWTKey = "/nonexistent/key.pem"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid forward-jwt-key: ")
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/csv"
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -50,17 +52,17 @@ func (h *HtpasswdFile) Validate(user string, password string) bool {
 		return false
 	}
 
-	shaPrefix := realPassword[:5]
-	if shaPrefix == "{SHA}" {
+	if strings.HasPrefix(realPassword, "{SHA}") {
 		shaValue := realPassword[5:]
 		d := sha1.New()
 		d.Write([]byte(password))
-		return shaValue == base64.StdEncoding.EncodeToString(d.Sum(nil))
+		return subtle.ConstantTimeCompare([]byte(shaValue), []byte(base64.StdEncoding.EncodeToString(d.Sum(nil)))) == 1
 	}
 
-	bcryptPrefix := realPassword[:4]
-	if bcryptPrefix == "$2a$" || bcryptPrefix == "$2b$" || bcryptPrefix == "$2x$" || bcryptPrefix == "$2y$" {
-		return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+	for _, bcryptPrefix := range []string{"$2a$", "$2b$", "$2x$", "$2y$"} {
+		if strings.HasPrefix(realPassword, bcryptPrefix) {
+			return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+		}
 	}
 
 	log.Printf("Invalid htpasswd entry for %s. Must be a SHA or bcrypt entry.", user)
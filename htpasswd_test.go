@@ -35,3 +35,29 @@ func TestBcrypt(t *testing.T) {
 	valid = h.Validate("testuser2", "top-secret")
 	assert.Equal(t, valid, true)
 }
+
+func TestWrongPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), 1)
+	assert.Equal(t, err, nil)
+	file := bytes.NewBuffer([]byte(fmt.Sprintf("testuser1:%s\ntestuser2:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n", hash)))
+	h, err := NewHtpasswd(file)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, false, h.Validate("testuser1", "wrong"))
+	assert.Equal(t, false, h.Validate("testuser2", "wrong"))
+	assert.Equal(t, false, h.Validate("nobody", "password"))
+}
+
+func TestInvalidEntry(t *testing.T) {
+	file := bytes.NewBuffer([]byte("testuser1:abc\ntestuser2:plaintext\n"))
+	h, err := NewHtpasswd(file)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, false, h.Validate("testuser1", "abc"))
+	assert.Equal(t, false, h.Validate("testuser2", "plaintext"))
+}
+
+func TestMissingFile(t *testing.T) {
+	_, err := NewHtpasswdFromFile("/nonexistent/htpasswd")
+	assert.NotEqual(t, nil, err)
+}
@@ -1,17 +1,71 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Server struct {
 	Handler http.Handler
 	Opts    *Options
+	// OnShutdown, if set, is run by Shutdown once the in-flight requests
+	// finished, before ListenAndServe returns.
+	OnShutdown func(ctx context.Context)
+
+	mu  sync.Mutex
+	srv *http.Server
+	// drained is closed once Shutdown has finished.
+	drained chan struct{}
+}
+
+// httpServer returns the server that serves the requests, creating it on
+// first use so that Shutdown can be called before it listens.
+func (s *Server) httpServer() *http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv == nil {
+		s.srv = &http.Server{Handler: s.Handler}
+		s.drained = make(chan struct{})
+	}
+	return s.srv
+}
+
+// Shutdown stops accepting connections and waits for the in-flight requests
+// to finish, or for ctx to be done. ListenAndServe returns once it finished.
+// Hijacked connections, such as WebSockets, are not waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	srv := s.httpServer()
+	defer close(s.drained)
+	err := srv.Shutdown(ctx)
+	if s.OnShutdown != nil {
+		s.OnShutdown(ctx)
+	}
+	return err
+}
+
+// serve serves requests on listener until it fails or Shutdown is called, in
+// which case it waits for Shutdown to finish.
+func (s *Server) serve(listener net.Listener, name string) {
+	srv := s.httpServer()
+	err := srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		<-s.drained
+	} else if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		log.Printf("ERROR: %s.Serve() - %s", strings.ToLower(name), err)
+	}
+
+	log.Printf("%s: closing %s", name, listener.Addr())
 }
 
 func (s *Server) ListenAndServe() {
@@ -23,7 +77,30 @@ func (s *Server) ListenAndServe() {
 }
 
 func (s *Server) ServeHTTP() {
-	httpAddress := s.Opts.HttpAddress
+	listener, err := listenHTTP(s.Opts.HttpAddress, s.Opts.unixSocketMode)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+	log.Printf("HTTP: listening on %s", listener.Addr())
+
+	s.serveHTTP(listener)
+}
+
+// serveHTTP serves HTTP/1.1 on listener and, with -enable-h2c, cleartext
+// HTTP/2 for load balancers that terminate TLS. HTTP/1.1 requests, including
+// WebSocket upgrades, are served the same either way.
+func (s *Server) serveHTTP(listener net.Listener) {
+	if s.Opts.EnableH2C {
+		srv := s.httpServer()
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+	s.serve(listener, "HTTP")
+}
+
+// listenHTTP listens on an -http-address, [http://]<addr>:<port> or
+// unix://<path>. A Unix socket gets socketMode, unless it is 0, and a stale
+// socket file left at its path is removed first.
+func listenHTTP(httpAddress string, socketMode os.FileMode) (net.Listener, error) {
 	scheme := ""
 
 	i := strings.Index(httpAddress, "://")
@@ -42,19 +119,40 @@ func (s *Server) ServeHTTP() {
 	slice := strings.SplitN(httpAddress, "//", 2)
 	listenAddr := slice[len(slice)-1]
 
+	if networkType == "unix" {
+		if err := removeStaleSocket(listenAddr); err != nil {
+			return nil, err
+		}
+	}
 	listener, err := net.Listen(networkType, listenAddr)
 	if err != nil {
-		log.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
+		return nil, fmt.Errorf("listen (%s, %s) failed - %s", networkType, listenAddr, err)
 	}
-	log.Printf("HTTP: listening on %s", listenAddr)
-
-	server := &http.Server{Handler: s.Handler}
-	err = server.Serve(listener)
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: http.Serve() - %s", err)
+	if networkType == "unix" && socketMode != 0 {
+		if err := os.Chmod(listenAddr, socketMode); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("setting the mode of %s failed - %s", listenAddr, err)
+		}
 	}
+	return listener, nil
+}
 
-	log.Printf("HTTP: closing %s", listener.Addr())
+// removeStaleSocket removes the socket file a previous process left behind at
+// path, which would make listening on it fail with "address already in use".
+// A socket another process still accepts connections on is left alone, and so
+// is any other kind of file.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen (unix, %s) failed - another process is listening on it", path)
+	}
+	log.Printf("removing stale socket %s", path)
+	return os.Remove(path)
 }
 
 func (s *Server) ServeHTTPS() {
@@ -63,9 +161,6 @@ func (s *Server) ServeHTTPS() {
 		MinVersion: tls.VersionTLS12,
 		MaxVersion: tls.VersionTLS12,
 	}
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
-	}
 
 	var err error
 	config.Certificates = make([]tls.Certificate, 1)
@@ -80,15 +175,18 @@ func (s *Server) ServeHTTPS() {
 	}
 	log.Printf("HTTPS: listening on %s", ln.Addr())
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	srv := &http.Server{Handler: s.Handler}
-	err = srv.Serve(tlsListener)
+	s.serveTLS(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
+}
 
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: https.Serve() - %s", err)
+// serveTLS serves HTTPS on listener, negotiating HTTP/2 with the clients that
+// support it (ALPN) and HTTP/1.1 with the others.
+func (s *Server) serveTLS(listener net.Listener, config *tls.Config) {
+	srv := s.httpServer()
+	if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+		log.Fatalf("FATAL: configuring HTTP/2 failed - %s", err)
 	}
-
-	log.Printf("HTTPS: closing %s", tlsListener.Addr())
+	config.NextProtos = []string{"h2", "http/1.1"}
+	s.serve(tls.NewListener(listener, config), "HTTPS")
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
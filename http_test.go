@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// slowHandler writes the start of its response, then waits for release
+// before finishing it.
+func slowHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first half, "))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		w.Write([]byte("second half"))
+	})
+}
+
+func TestServerShutdownDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	shutdownRan := make(chan struct{})
+	s := &Server{
+		Handler:    slowHandler(started, release),
+		OnShutdown: func(ctx context.Context) { close(shutdownRan) },
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	served := make(chan struct{})
+	go func() {
+		s.serve(ln, "HTTP")
+		close(served)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/stream")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		responses <- result{string(body), err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// no new connections are accepted once the shutdown started
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepts connections after shutdown")
+		}
+	}
+
+	// the server waits for the in-flight request
+	select {
+	case <-served:
+		t.Fatal("server exited before the in-flight request finished")
+	case <-shutdown:
+		t.Fatal("shutdown finished before the in-flight request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	r := <-responses
+	assert.Equal(t, nil, r.err)
+	assert.Equal(t, "first half, second half", r.body)
+	assert.Equal(t, nil, <-shutdown)
+	<-shutdownRan
+	<-served
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := &Server{Handler: slowHandler(started, release)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	served := make(chan struct{})
+	go func() {
+		s.serve(ln, "HTTP")
+		close(served)
+	}()
+
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/stream")
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	<-served
+}
+
+// unixSocketClient sends all requests to the socket at path.
+func unixSocketClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestUnixSocketServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oauth2.sock")
+
+	// a socket file left behind by a previous process
+	stale, err := net.Listen("unix", path)
+	assert.Equal(t, nil, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(path)
+	assert.Equal(t, nil, err)
+
+	ln, err := listenHTTP("unix://"+path, 0660)
+	assert.Equal(t, nil, err)
+	fi, err := os.Stat(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.URL.Path))
+	})}
+	served := make(chan struct{})
+	go func() {
+		s.serve(ln, "HTTP")
+		close(served)
+	}()
+
+	res, err := unixSocketClient(path).Get("http://oauth2-proxy/ping")
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello from /ping", string(body))
+
+	// a socket in use is not taken over
+	_, err = listenHTTP("unix://"+path, 0)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "another process is listening on it")
+
+	assert.Equal(t, nil, s.Shutdown(context.Background()))
+	<-served
+	_, err = os.Stat(path)
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestUnixSocketLeavesOtherFilesAlone(t *testing.T) {
+	f, err := ioutil.TempFile("", "oauth2.sock")
+	assert.Equal(t, nil, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	_, err = listenHTTP("unix://"+f.Name(), 0)
+	assert.NotEqual(t, nil, err)
+	_, err = os.Stat(f.Name())
+	assert.Equal(t, nil, err)
+}
+
+func TestUnixSocketModeOption(t *testing.T) {
+	o := testOptions()
+	o.HttpAddress = "unix:///var/run/oauth2.sock"
+	o.UnixSocketMode = "0660"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, os.FileMode(0660), o.unixSocketMode)
+
+	o.UnixSocketMode = "rw-rw----"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: unix-socket-mode=\"rw-rw----\" must be octal permissions (ie: 0660)")
+
+	o = testOptions()
+	o.UnixSocketMode = "0660"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: unix-socket-mode requires a unix://<path> http-address")
+}
+
+// newHTTP2TestServer returns a server proxying everything, without
+// authentication, to an upstream answering with the protocol the request
+// reached the proxy with.
+func newHTTP2TestServer(t *testing.T, opts *Options) (*Server, *httptest.Server) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocketUpgradeRequest(r) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+			conn.Close()
+			return
+		}
+		w.Header().Set("X-Proto", r.Proto)
+		proxy.ServeHTTP(w, r)
+	})
+	return &Server{Handler: handler, Opts: opts}, upstream
+}
+
+func TestServeTLSNegotiatesHTTP2(t *testing.T) {
+	caFile, cert := newTestCA(t)
+	defer os.Remove(caFile)
+	s, upstream := newHTTP2TestServer(t, testOptions())
+	defer upstream.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go s.serveTLS(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12})
+	defer s.Shutdown(context.Background())
+
+	caPEM, _ := ioutil.ReadFile(caFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	// a client that supports HTTP/2 gets it
+	h2 := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	assert.Equal(t, nil, http2.ConfigureTransport(h2))
+	res, err := (&http.Client{Transport: h2}).Get("https://" + ln.Addr().String() + "/app")
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, "HTTP/2.0", res.Header.Get("X-Proto"))
+	assert.Equal(t, "upstream /app", string(body))
+
+	// HTTP/1.1 clients are still served
+	h1 := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	res, err = (&http.Client{Transport: h1}).Get("https://" + ln.Addr().String() + "/app")
+	assert.Equal(t, nil, err)
+	res.Body.Close()
+	assert.Equal(t, 1, res.ProtoMajor)
+	assert.Equal(t, "HTTP/1.1", res.Header.Get("X-Proto"))
+}
+
+func TestServeHTTPWithH2C(t *testing.T) {
+	opts := testOptions()
+	opts.EnableH2C = true
+	s, upstream := newHTTP2TestServer(t, opts)
+	defer upstream.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go s.serveHTTP(ln)
+	defer s.Shutdown(context.Background())
+
+	// HTTP/2 with prior knowledge, as load balancers speak it
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	res, err := (&http.Client{Transport: h2c}).Get("http://" + ln.Addr().String() + "/app")
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, "HTTP/2.0", res.Header.Get("X-Proto"))
+	assert.Equal(t, "upstream /app", string(body))
+
+	// HTTP/1.1
+	res, err = http.Get("http://" + ln.Addr().String() + "/app")
+	assert.Equal(t, nil, err)
+	res.Body.Close()
+	assert.Equal(t, 1, res.ProtoMajor)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// WebSocket upgrades still reach the handler
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+}
+
+func TestEnableH2COption(t *testing.T) {
+	o := testOptions()
+	o.EnableH2C = true
+	assert.Equal(t, nil, o.Validate())
+
+	o.TLSCertFile = "cert.pem"
+	o.TLSKeyFile = "key.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: enable-h2c is for the plain HTTP listener")
+}
+
+func TestShutdownTimeoutOption(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, 30*time.Second, o.ShutdownTimeout)
+	o.ShutdownTimeout = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: shutdown-timeout=-1s must not be negative")
+}
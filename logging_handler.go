@@ -4,19 +4,61 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"text/template"
 	"time"
 )
 
 const (
-	defaultRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}}"
+	defaultRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}} {{.RequestID}}"
 )
 
+// redacted replaces the values of sensitive headers and query parameters in
+// request logs.
+const redacted = "REDACTED"
+
+// defaultRedactedHeaders carry credentials and are never logged; more can be
+// added with -redact-header.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactedQueryParams carry codes, tokens or secrets and are never logged.
+var redactedQueryParams = map[string]bool{
+	"code":          true,
+	"access_token":  true,
+	"id_token":      true,
+	"refresh_token": true,
+	"token":         true,
+	"client_secret": true,
+	"password":      true,
+}
+
+// upstreamTimingKey is the request context key of the *upstreamTiming that
+// UpstreamProxy fills in for the JSON request log.
+type upstreamTimingKey struct{}
+
+type upstreamTiming struct {
+	latency time.Duration
+	done    bool
+}
+
+// observeUpstreamLatency records the time since start as the upstream latency
+// of req when req is being logged by JSONLoggingHandler.
+func observeUpstreamLatency(req *http.Request, start time.Time) {
+	if t, ok := req.Context().Value(upstreamTimingKey{}).(*upstreamTiming); ok {
+		t.latency = time.Since(start)
+		t.done = true
+	}
+}
+
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
 // code and body size
 type responseLogger struct {
@@ -61,6 +103,21 @@ func (l *responseLogger) WriteHeader(s int) {
 	l.status = s
 }
 
+// Hijack lets the websocket proxy take over the connection. The upgrade is
+// logged with status 101 as nothing is written through the logger after it.
+func (l *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := l.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.Hijacker is not available on writer")
+	}
+	l.ExtractGAPMetadata()
+	conn, rw, err := hj.Hijack()
+	if err == nil && l.status == 0 {
+		l.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
 func (l *responseLogger) Status() int {
 	return l.status
 }
@@ -76,6 +133,7 @@ type logMessageData struct {
 	Host,
 	Protocol,
 	RequestDuration,
+	RequestID,
 	RequestMethod,
 	RequestURI,
 	ResponseSize,
@@ -84,22 +142,102 @@ type logMessageData struct {
 	Upstream,
 	UserAgent,
 	Username string
+
+	header http.Header
+	redact map[string]bool
+}
+
+// RequestHeader returns the value of the named request header, for logging
+// formats such as {{.RequestHeader "X-Request-Id"}}. Sensitive headers are
+// redacted.
+func (d logMessageData) RequestHeader(name string) string {
+	value := d.header.Get(name)
+	if value != "" && d.redact[http.CanonicalHeaderKey(name)] {
+		return redacted
+	}
+	return value
+}
+
+// jsonLogMessage is a request log line written by JSONLoggingHandler.
+type jsonLogMessage struct {
+	Timestamp string  `json:"timestamp"`
+	Client    string  `json:"client"`
+	Host      string  `json:"host"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Size      int     `json:"size"`
+	Duration  float64 `json:"duration"`
+	Upstream  string  `json:"upstream,omitempty"`
+	// UpstreamLatency is how long the upstream took to serve the request,
+	// left out when the request wasn't proxied.
+	UpstreamLatency *float64 `json:"upstream_latency,omitempty"`
+	UserAgent       string   `json:"user_agent"`
+	User            string   `json:"user,omitempty"`
+	RequestID       string   `json:"request_id,omitempty"`
 }
 
 // loggingHandler is the http.Handler implementation for LoggingHandlerTo and its friends
 type loggingHandler struct {
-	writer      io.Writer
-	handler     http.Handler
-	enabled     bool
-	logTemplate *template.Template
+	writer        io.Writer
+	handler       http.Handler
+	enabled       bool
+	logTemplate   *template.Template
+	json          bool
+	redactHeaders map[string]bool
 }
 
-func LoggingHandler(out io.Writer, h http.Handler, v bool, requestLoggingTpl string) http.Handler {
+// LoggingHandler logs each request with the requestLoggingTpl template. The
+// values of the Authorization, Proxy-Authorization and Cookie headers and of
+// redactHeaders are replaced with REDACTED, as are those of query parameters
+// carrying codes or tokens.
+func LoggingHandler(out io.Writer, h http.Handler, v bool, requestLoggingTpl string, redactHeaders ...string) http.Handler {
 	return loggingHandler{
-		writer:      out,
-		handler:     h,
-		enabled:     v,
-		logTemplate: template.Must(template.New("request-log").Parse(requestLoggingTpl)),
+		writer:        out,
+		handler:       h,
+		enabled:       v,
+		logTemplate:   template.Must(template.New("request-log").Parse(requestLoggingTpl)),
+		redactHeaders: newRedactedHeaders(redactHeaders),
+	}
+}
+
+func newRedactedHeaders(extra []string) map[string]bool {
+	headers := make(map[string]bool)
+	for _, name := range append(defaultRedactedHeaders, extra...) {
+		headers[http.CanonicalHeaderKey(name)] = true
+	}
+	return headers
+}
+
+// redactURI returns the request URI of u with the values of sensitive query
+// parameters replaced. The other parameters are kept as sent, in order.
+func redactURI(u url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key := param
+		if eq := strings.IndexByte(param, '='); eq >= 0 {
+			key = param[:eq]
+		}
+		if name, err := url.QueryUnescape(key); err == nil && redactedQueryParams[strings.ToLower(name)] {
+			params[i] = key + "=" + redacted
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	return u.RequestURI()
+}
+
+// JSONLoggingHandler logs each request as a single JSON object, for
+// -log-format=json.
+func JSONLoggingHandler(out io.Writer, h http.Handler, v bool) http.Handler {
+	return loggingHandler{
+		writer:  out,
+		handler: h,
+		enabled: v,
+		json:    true,
 	}
 }
 
@@ -107,17 +245,21 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t := time.Now()
 	url := *req.URL
 	logger := &responseLogger{w: w}
+	timing := &upstreamTiming{}
+	if h.json {
+		req = req.WithContext(context.WithValue(req.Context(), upstreamTimingKey{}, timing))
+	}
 	h.handler.ServeHTTP(logger, req)
 	if !h.enabled {
 		return
 	}
-	h.writeLogLine(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size())
+	h.writeLogLine(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size(), timing)
 }
 
 // Log entry for req similar to Apache Common Log Format.
 // ts is the timestamp with which the entry should be logged.
 // status, size are used to provide the response HTTP status and size.
-func (h loggingHandler) writeLogLine(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
+func (h loggingHandler) writeLogLine(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int, timing *upstreamTiming) {
 	if username == "" {
 		username = "-"
 	}
@@ -130,31 +272,70 @@ func (h loggingHandler) writeLogLine(username, upstream string, req *http.Reques
 		}
 	}
 
-	client := req.Header.Get("X-Real-IP")
-	if client == "" {
-		client = req.RemoteAddr
-	}
+	client := clientIP(req)
+	id := req.Header.Get(RequestIDHeader)
+	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
 
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
+	if h.json {
+		if username == "-" {
+			username = ""
+		}
+		if upstream == "-" {
+			upstream = ""
+		}
+		var latency *float64
+		if timing.done {
+			seconds := roundMillis(timing.latency.Seconds())
+			latency = &seconds
+		}
+		b, err := json.Marshal(jsonLogMessage{
+			Timestamp:       ts.Format(time.RFC3339),
+			Client:          client,
+			Host:            req.Host,
+			Method:          req.Method,
+			Path:            redactURI(url),
+			Protocol:        req.Proto,
+			Status:          status,
+			Size:            size,
+			Duration:        roundMillis(duration),
+			Upstream:        upstream,
+			UpstreamLatency: latency,
+			UserAgent:       req.UserAgent(),
+			User:            username,
+			RequestID:       id,
+		})
+		if err != nil {
+			return
+		}
+		h.writer.Write(append(b, '\n'))
+		return
 	}
 
-	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
-
+	if id == "" {
+		id = "-"
+	}
 	h.logTemplate.Execute(h.writer, logMessageData{
 		Client:          client,
 		Host:            req.Host,
 		Protocol:        req.Proto,
 		RequestDuration: fmt.Sprintf("%0.3f", duration),
+		RequestID:       id,
 		RequestMethod:   req.Method,
-		RequestURI:      fmt.Sprintf("%q", url.RequestURI()),
+		RequestURI:      fmt.Sprintf("%q", redactURI(url)),
 		ResponseSize:    fmt.Sprintf("%d", size),
 		StatusCode:      fmt.Sprintf("%d", status),
 		Timestamp:       ts.Format("02/Jan/2006:15:04:05 -0700"),
 		Upstream:        upstream,
 		UserAgent:       fmt.Sprintf("%q", req.UserAgent()),
 		Username:        username,
+		header:          req.Header,
+		redact:          h.redactHeaders,
 	})
 
 	h.writer.Write([]byte("\n"))
 }
+
+// roundMillis rounds seconds to the millisecond.
+func roundMillis(seconds float64) float64 {
+	return float64(int64(seconds*1000+0.5)) / 1000
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,7 +18,7 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		Format,
 		ExpectedLogMessage string
 	}{
-		{defaultRequestLoggingFormat, fmt.Sprintf("127.0.0.1 - - [%s] test-server GET - \"/foo/bar\" HTTP/1.1 \"\" 200 4 0.000\n", ts.Format("02/Jan/2006:15:04:05 -0700"))},
+		{defaultRequestLoggingFormat, fmt.Sprintf("127.0.0.1 - - [%s] test-server GET - \"/foo/bar\" HTTP/1.1 \"\" 200 4 0.000 -\n", ts.Format("02/Jan/2006:15:04:05 -0700"))},
 		{"{{.RequestMethod}}", "GET\n"},
 	}
 
@@ -40,3 +42,159 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestJSONLoggingHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		upstream string
+	}{
+		{"authenticated", "jdoe@example.com", "127.0.0.1:8080"},
+		{"anonymous", "", ""},
+	}
+
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		handler := func(w http.ResponseWriter, req *http.Request) {
+			if test.user != "" {
+				w.Header().Set("GAP-Auth", test.user)
+				w.Header().Set("GAP-Upstream-Address", test.upstream)
+				observeUpstreamLatency(req, time.Now().Add(-20*time.Millisecond))
+			}
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("test"))
+		}
+
+		h := JSONLoggingHandler(buf, http.HandlerFunc(handler), true)
+
+		r, _ := http.NewRequest("GET", "/foo/bar?baz=1", nil)
+		r.RemoteAddr = "127.0.0.1:52000"
+		r.Host = "test-server"
+		r.Header.Set("User-Agent", "probe/1.0")
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Header().Get("GAP-Auth") != "" {
+			t.Errorf("%s: GAP-Auth header was not removed", test.name)
+		}
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("%s: log line %q is not valid JSON: %v", test.name, buf.String(), err)
+		}
+		expected := map[string]interface{}{
+			"client":     "127.0.0.1",
+			"host":       "test-server",
+			"method":     "GET",
+			"path":       "/foo/bar?baz=1",
+			"protocol":   "HTTP/1.1",
+			"status":     float64(http.StatusTeapot),
+			"size":       float64(4),
+			"user_agent": "probe/1.0",
+		}
+		if test.user != "" {
+			expected["user"] = test.user
+			expected["upstream"] = test.upstream
+			if latency, _ := line["upstream_latency"].(float64); latency < 0.02 {
+				t.Errorf("%s: upstream_latency %#v is below the upstream's 20ms", test.name, line["upstream_latency"])
+			}
+		} else if _, ok := line["upstream_latency"]; ok {
+			t.Errorf("%s: unexpected field \"upstream_latency\" in %q", test.name, buf.String())
+		}
+		for _, field := range []string{"user", "upstream"} {
+			if _, ok := expected[field]; !ok {
+				if _, ok := line[field]; ok {
+					t.Errorf("%s: unexpected field %q in %q", test.name, field, buf.String())
+				}
+			}
+		}
+		for field, value := range expected {
+			if line[field] != value {
+				t.Errorf("%s: field %q was %#v instead of %#v", test.name, field, line[field], value)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, fmt.Sprint(line["timestamp"])); err != nil {
+			t.Errorf("%s: invalid timestamp: %v", test.name, err)
+		}
+		if _, ok := line["duration"].(float64); !ok {
+			t.Errorf("%s: duration %#v is not a number", test.name, line["duration"])
+		}
+	}
+}
+
+func TestLoggingHandlerRedactsSecrets(t *testing.T) {
+	const format = `{{.RequestURI}} {{.RequestHeader "Authorization"}} {{.RequestHeader "cookie"}} {{.RequestHeader "X-Api-Key"}} {{.RequestHeader "X-Request-Id"}}`
+	secrets := []string{"the-code", "the-access-token", "the-bearer-token", "the-session", "the-api-key"}
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		expected string
+	}{
+		{
+			name:     "text",
+			handler:  LoggingHandler(nil, nil, true, format, "X-Api-Key"),
+			expected: `"/oauth2/callback?code=REDACTED&state=nonce%3A%2Fapp&ACCESS_TOKEN=REDACTED&access%5Ftoken=REDACTED" REDACTED REDACTED REDACTED req-1` + "\n",
+		},
+		{
+			name:     "json",
+			handler:  JSONLoggingHandler(nil, nil, true),
+			expected: `/oauth2/callback?code=REDACTED&state=nonce%3A%2Fapp&ACCESS_TOKEN=REDACTED&access%5Ftoken=REDACTED`,
+		},
+	}
+
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		h := test.handler.(loggingHandler)
+		h.writer = buf
+		h.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusFound)
+		})
+
+		r, _ := http.NewRequest("GET", "/oauth2/callback?code=the-code&state=nonce%3A%2Fapp&ACCESS_TOKEN=the-access-token&access%5Ftoken=the-access-token", nil)
+		r.RemoteAddr = "127.0.0.1"
+		r.Header.Set("Authorization", "Bearer the-bearer-token")
+		r.Header.Set("Cookie", "_oauth2_proxy=the-session")
+		r.Header.Set("X-Api-Key", "the-api-key")
+		r.Header.Set("X-Request-Id", "req-1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		actual := buf.String()
+		for _, secret := range secrets {
+			if strings.Contains(actual, secret) {
+				t.Errorf("%s: %q was logged in %q", test.name, secret, actual)
+			}
+		}
+		if test.name == "json" {
+			var line map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatalf("%s: log line %q is not valid JSON: %v", test.name, actual, err)
+			}
+			actual = fmt.Sprint(line["path"])
+		}
+		if !strings.Contains(actual, test.expected) {
+			t.Errorf("%s: log line\n%s\ndoes not contain\n%s", test.name, actual, test.expected)
+		}
+	}
+}
+
+func TestLoggingHandlerDisabled(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test"))
+	})
+	for _, h := range []http.Handler{
+		LoggingHandler(buf, handler, false, defaultRequestLoggingFormat),
+		JSONLoggingHandler(buf, handler, false),
+	} {
+		r, _ := http.NewRequest("GET", "/oauth2/callback?code=the-code", nil)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Body.String() != "test" {
+			t.Errorf("response was %q instead of %q", rw.Body.String(), "test")
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("nothing should be logged, got %q", buf.String())
+	}
+}
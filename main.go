@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -15,68 +19,256 @@ import (
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	flagSet := NewFlagSet()
+	flagSet.Parse(os.Args[1:])
+
+	if flagSet.Lookup("version").Value.(flag.Getter).Get().(bool) {
+		fmt.Printf("oauth2_proxy v%s (built with %s)\n", VERSION, runtime.Version())
+		return
+	}
+
+	opts, err := loadOptions(flagSet)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	err = opts.Validate()
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+	if opts.SSLInsecureSkipVerify {
+		log.Printf("WARNING: -ssl-insecure-skip-verify is set, the certificates of the identity provider are NOT verified, never use this in production")
+	}
+	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	oauthproxy := NewOAuthProxy(opts, validator)
+
+	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
+		if len(opts.EmailDomains) > 1 {
+			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
+		} else if opts.EmailDomains[0] != "*" {
+			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
+		}
+	}
+
+	if opts.HtpasswdFile != "" {
+		log.Printf("using htpasswd file %s", opts.HtpasswdFile)
+		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
+		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
+		if err != nil {
+			log.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
+		}
+	}
+
+	if opts.MetricsAddr != "" {
+		go func() {
+			log.Printf("metrics: listening on %s", opts.MetricsAddr)
+			log.Fatal(http.ListenAndServe(opts.MetricsAddr, oauthproxy.Metrics.Handler()))
+		}()
+	}
+
+	var proxyHandler http.Handler = oauthproxy
+	if opts.EnableCompression {
+		proxyHandler = CompressionHandler(oauthproxy, opts.CompressionMinSize, opts.CompressionTypes)
+	}
+	handler := LoggingHandler(os.Stdout, proxyHandler, opts.RequestLogging, opts.RequestLoggingFormat, opts.RedactHeaders...)
+	if opts.LogFormat == "json" {
+		handler = JSONLoggingHandler(os.Stdout, proxyHandler, opts.RequestLogging)
+	}
+	handler = RequestIDHandler(opts.realIP, handler)
+	handler = RealIPHandler(opts.realIP, handler)
+	s := &Server{
+		Handler: handler,
+		Opts:    opts,
+		OnShutdown: func(ctx context.Context) {
+			if err := oauthproxy.StopBackgroundRefresh(ctx); err != nil {
+				log.Printf("ERROR: shutdown - background refreshes did not finish: %s", err)
+			}
+		},
+	}
+	go shutdownOnSignal(s, opts.ShutdownTimeout)
+	s.ListenAndServe()
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT and then lets the in-flight
+// requests and background refreshes finish for up to timeout. A second signal
+// exits at once.
+func shutdownOnSignal(s *Server, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	signal.Stop(signals)
+	log.Printf("received %s, shutting down (waiting up to %s for in-flight requests)", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("ERROR: shutdown - in-flight requests did not finish: %s", err)
+	}
+}
+
+// NewFlagSet declares the command line flags. Each flag sets the Options field
+// tagged with its name, which can also be given in the -config file.
+func NewFlagSet() *flag.FlagSet {
 	flagSet := flag.NewFlagSet("oauth2_proxy", flag.ExitOnError)
 
 	emailDomains := StringArray{}
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
+	stripResponseHeaders := StringArray{}
+	corsAllowedOrigins := StringArray{}
+	corsAllowedMethods := StringArray{}
+	corsAllowedHeaders := StringArray{}
+	allowedMethods := StringArray{}
 	googleGroups := StringArray{}
+	keycloakGroups := StringArray{}
+	gitlabGroups := StringArray{}
+	azureGroups := StringArray{}
 	oidcGroups := StringArray{}
+	oidcAudiences := StringArray{}
+	oidcPrompt := StringArray{}
+	userInfoFields := StringArray{}
+	claimHeaders := StringArray{}
+	trustedProxies := StringArray{}
+	whitelistDomains := StringArray{}
+	extraJwtIssuers := StringArray{}
+	redactHeaders := StringArray{}
+	providerCAFiles := StringArray{}
+	upstreamCAFiles := StringArray{}
+	compressionTypes := StringArray{}
+	cookieDomains := StringArray{}
 
-	config := flagSet.String("config", "", "path to config file")
-	showVersion := flagSet.Bool("version", false, "print version string")
+	flagSet.String("config", "", "path to config file")
+	flagSet.Bool("version", false, "print version string")
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
+	flagSet.String("unix-socket-mode", "", "permissions of the socket, ie: 0660, when the http-address is unix://<path>; by default they follow the umask")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("metrics-address", "", "<addr>:<port> to serve Prometheus metrics on at /metrics; disabled when empty")
 	flagSet.String("tls-cert", "", "path to certificate file")
 	flagSet.String("tls-key", "", "path to private key file")
+	flagSet.Bool("enable-h2c", false, "accept cleartext HTTP/2 (h2c) on the http-address, e.g. behind a load balancer that terminates TLS")
+	flagSet.Duration("shutdown-timeout", 30*time.Second, "on SIGTERM or SIGINT, how long to wait for in-flight requests to finish before exiting")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
-	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
-	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
+	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User, X-Auth-Request-Email and X-Auth-Request-Groups response headers (useful in Nginx auth_request mode)")
+	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files, optionally prefixed with PATH= to mount them at another path. Routing is based on the path")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Bool("set-groups-header", false, "pass the user's groups to upstream as a comma separated X-Forwarded-Groups header")
+	flagSet.Bool("expose-token-endpoint", false, "return the session's access token as JSON at /oauth2/token, refreshing it first when it is about to expire; keeps the access token in the session")
+	flagSet.Var(&userInfoFields, "userinfo-field", "session field returned by the userinfo endpoint: user, email or groups (may be given multiple times; default: all of them)")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.Var(&claimHeaders, "set-claim-header", "pass an ID token claim to upstream as a header, given as claim:Header-Name (may be given multiple times)")
+	flagSet.Bool("pass-id-token", false, "pass the OIDC id_token to upstream via the header set with -id-token-header")
+	flagSet.String("id-token-header", "X-Forwarded-Id-Token", "the header the id_token is passed to upstream in when -pass-id-token is set")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
-	flagSet.Bool("pass-authorization-header", false, "pass the Authorization Header to upstream")
+	flagSet.String("upstream-host", "", "send this Host header to upstream instead, e.g. for S3 websites or name based virtual hosts (overrides -pass-host-header)")
+	flagSet.String("upstream-tls-cert", "", "path to a client certificate presented to HTTPS upstreams that require mutual TLS")
+	flagSet.String("upstream-tls-key", "", "path to the private key of the -upstream-tls-cert")
+	flagSet.String("upstream-tls-ca", "", "path to PEM encoded CA certificates that HTTPS upstreams are verified against instead of the system roots (same as a single -upstream-ca-file)")
+	flagSet.Var(&upstreamCAFiles, "upstream-ca-file", "path to PEM encoded CA certificates that HTTPS upstreams are verified against instead of the system roots (may be given multiple times)")
+	flagSet.Bool("use-system-trust-store", false, "trust the system roots in addition to the -provider-ca-file and -upstream-ca-file CAs")
+	flagSet.Duration("upstream-timeout", 0, "how long to wait for the response headers of HTTP(S) upstreams (0 for no limit)")
+	flagSet.Duration("upstream-dial-timeout", 30*time.Second, "how long to wait for a connection to HTTP(S) upstreams to be established")
+	flagSet.Int("upstream-max-idle-conns", 100, "idle connections to HTTP(S) upstreams kept for reuse (0 for no limit)")
+	flagSet.Int("upstream-max-conns-per-host", 0, "connections to each HTTP(S) upstream host, including those in use; further requests wait for one to become free (0 for no limit)")
+	flagSet.Var(&stripResponseHeaders, "strip-response-header", "remove this header from the responses of the upstreams, ie: Server (may be given multiple times)")
+	flagSet.String("strip-path-prefix", "", "remove this path prefix (ie: /app) from requests before proxying them to the upstreams, and add it to the redirects they send")
+	flagSet.Bool("pass-authorization-header", false, "pass the access token to upstream as an Authorization: Bearer header, replacing the one sent by the client")
 	flagSet.Bool("set-authorization-header", false, "set Authorization response headers (useful in Nginx auth_request mode)")
+	flagSet.Var(&allowedMethods, "allowed-methods", "only allow these HTTP methods for request paths matching a regex, given as path-regex=METHOD[,METHOD...]; other methods get 405 (may be given multiple times)")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
-	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
+	flagSet.Var(&corsAllowedOrigins, "cors-allowed-origin", "answer CORS preflight requests from this origin, ie: https://app.example.com or * (may be given multiple times)")
+	flagSet.Var(&corsAllowedMethods, "cors-allowed-method", "method allowed in answers to CORS preflight requests (may be given multiple times; default: GET, HEAD, POST, PUT, PATCH and DELETE)")
+	flagSet.Var(&corsAllowedHeaders, "cors-allowed-header", "request header allowed in answers to CORS preflight requests (may be given multiple times)")
+	flagSet.Bool("cors-allow-credentials", false, "allow cookies to be sent with cross-origin requests in answers to CORS preflight requests")
+	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented by the identity provider when using HTTPS (development only, logs a warning)")
 	flagSet.Bool("allow-bearer", false, "allow validating of Bearer authz header or access_token URL param")
+	flagSet.Bool("skip-jwt-bearer-tokens", false, "accept requests carrying an Authorization: Bearer JWT issued by the OpenID Connect issuer or an -extra-jwt-issuers entry, without a login or session cookie")
+	flagSet.Var(&extraJwtIssuers, "extra-jwt-issuers", "also accept bearer JWTs from this issuer, given as issuer=audience (may be given multiple times)")
 
 
-	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email and .example.com for the subdomains of example.com")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.Var(&azureGroups, "azure-group", "restrict logins to members of this azure group, given by object ID or, with -azure-resolve-group-names, display name (may be given multiple times)")
+	flagSet.Bool("azure-resolve-group-names", false, "look the display names of the user's azure groups up at Microsoft Graph")
 	flagSet.String("github-org", "", "restrict logins to members of this organisation")
 	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.Var(&gitlabGroups, "gitlab-group", "restrict logins to members of this gitlab group, given by its full path (ie: mygroup/subgroup) (may be given multiple times)")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.Duration("google-group-cache-ttl", 5*time.Minute, "how long a user's google group membership is cached before the Admin SDK is asked again (0 to disable)")
+	flagSet.String("google-hosted-domain", "", "restrict logins to accounts of this Google Workspace domain (ie: yourcompany.com)")
+	flagSet.Var(&keycloakGroups, "keycloak-group", "restrict logins to users holding this keycloak role, as realm:<role> or <client>:<role> (may be given multiple times)")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
-	flagSet.String("custom-templates-dir", "", "path to custom html templates")
+	flagSet.String("custom-templates-dir", "", "path to custom html templates (sign_in.html and error.html; missing files fall back to the defaults)")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.Var(&whitelistDomains, "whitelist-domain", "allow redirects after login to this domain, .example.com for it and its subdomains; add :port or :* for other ports (may be given multiple times)")
+	flagSet.String("banner", "", "message shown above the sign-in button, e.g. a compliance notice")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
+	flagSet.String("ping-path", "/ping", "the path of the health check endpoint, answered with 200 OK without authentication")
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
-	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
+	flagSet.Var(&cookieDomains, "cookie-domain", "an optional cookie domain to force cookies to (ie: .yourcompany.com); the first one matching the request host is used (may be given multiple times)")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
+	flagSet.String("session-store", "cookie", "where to keep sessions: cookie, or redis to keep them server side with only a key in the cookie")
+	flagSet.String("redis-connection-url", "", "URL of the redis server used by -session-store=redis (ie: redis://127.0.0.1:6379/0)")
+	flagSet.Duration("session-background-refresh", 0, "with -session-store=redis, refresh sessions whose tokens expire within this duration in the background instead of on the request (0 to disable)")
+	flagSet.Duration("session-idle-timeout", 0, "sign out sessions that haven't been used for this duration, e.g. 30m (0 to disable)")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.Bool("cookie-encrypt", false, "encrypt the whole session cookie (AES-GCM with the cookie-secret) instead of only the tokens in it")
+	flagSet.Bool("cookie-csrf-per-request", false, "give every login its own CSRF cookie, so that logins started at the same time in several tabs don't fail with a CSRF error")
+	flagSet.Bool("cookie-secret-kdf", false, "derive the cookie encryption key from the cookie-secret with HKDF-SHA256, allowing secrets of any length from 16 bytes instead of exactly 16, 24 or 32 bytes")
+	flagSet.String("cookie-samesite", "lax", "set SameSite cookie attribute: lax, strict or none (none requires -cookie-secure)")
 
 	flagSet.Bool("request-logging", true, "Log requests to stdout")
 	flagSet.String("request-logging-format", defaultRequestLoggingFormat, "Template for log lines")
+	flagSet.String("log-level", "info", "provider log level: info or debug")
+	flagSet.String("log-format", "text", "format of request and provider log lines: text or json")
+	flagSet.Var(&redactHeaders, "redact-header", "request header whose value is replaced with REDACTED in request logs, in addition to Authorization, Proxy-Authorization and Cookie (may be given multiple times)")
+	flagSet.String("real-ip-header", "X-Real-IP", "header holding the client address set by a trusted proxy, such as X-Forwarded-For (empty to always use the peer address)")
+	flagSet.Var(&trustedProxies, "trusted-proxies", "CIDR ranges or addresses of proxies whose real-ip-header is honored (comma separated, may be given multiple times; default: all)")
+	flagSet.Int("callback-rate-limit", 0, "sign-in and callback requests allowed per minute from each client address (0 for no limit)")
+	flagSet.Bool("enable-compression", false, "compress responses with gzip or deflate for clients that accept it, unless they are encoded already")
+	flagSet.Int("compression-min-size", 1024, "smallest response in bytes that is compressed")
+	flagSet.Var(&compressionTypes, "compression-type", "content type to compress, ie: application/json or text/* (may be given multiple times; default: common text types)")
 
 	flagSet.String("provider", "google", "OAuth provider")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com)")
+	flagSet.Var(&oidcAudiences, "oidc-allowed-audiences", "accept OpenID Connect ID tokens issued for this audience (may be given multiple times; default: the client-id)")
+	flagSet.String("oidc-client-jwt-key", "", "path to a PEM encoded RSA private key; authenticates to the OpenID Connect token endpoint with a signed JWT (private_key_jwt) instead of the client secret")
+	flagSet.String("oidc-email-claim", "email", "OpenID Connect ID token claim holding the user's email address")
+	flagSet.String("oidc-username-claim", "preferred_username", "OpenID Connect ID token claim holding the user name; the local part of the email is used when it is missing")
+	flagSet.Bool("oidc-userinfo-fallback", true, "look the email up at the -validate-url userinfo endpoint when the ID token does not contain it")
+	flagSet.Duration("oidc-userinfo-cache-ttl", 30*time.Second, "reuse the email looked up at the userinfo endpoint for the same access token this long (0 to disable)")
+	flagSet.Int("oidc-userinfo-retries", 1, "retry userinfo endpoint calls failing with a network error or 5xx response this many times")
+	flagSet.Bool("oidc-require-email-verified", false, "reject OpenID Connect ID tokens without email_verified=true (by default only email_verified=false is rejected)")
+	flagSet.Bool("oidc-use-pkce", false, "use PKCE (S256 code challenge) for the OpenID Connect authorization code flow")
+	flagSet.String("oidc-introspection-url", "", "OpenID Connect token introspection endpoint (RFC 7662) used to validate opaque access tokens once the ID token has expired")
+	flagSet.Bool("oidc-verify-nonce", false, "send a nonce with the OpenID Connect authorization request and require the ID token to echo it")
+	flagSet.Duration("oidc-max-age", time.Duration(0), "require users to have authenticated at the OpenID Connect provider within this long (max_age, checked against the auth_time claim); 0 to disable")
+	flagSet.Var(&oidcPrompt, "oidc-prompt", "OpenID Connect prompt value sent with the authorization request: consent, login, select_account or none (may be given multiple times); replaces approval_prompt")
 	flagSet.Var(&oidcGroups, "oidc-groups", "Restrict access to specific groups")
+	flagSet.String("oidc-groups-claim", "groups", "OpenID Connect claim holding the user's groups; nested claims use a dotted path (ie: realm_access.roles)")
+	flagSet.String("oidc-groups-from", "id_token", "token to read the OpenID Connect groups claim from: id_token or access_token")
+	flagSet.String("oidc-jwks-url", "", "OpenID Connect signing key (JWKS) endpoint; overrides the jwks_uri of the discovery document")
+	flagSet.Duration("oidc-jwks-refresh-interval", time.Hour, "refetch the OpenID Connect signing keys this often (0 to disable); they are also refetched when a token uses an unknown key ID")
+	flagSet.Int("oidc-id-token-cache-size", 1000, "how many verified ID tokens are remembered until they expire, so that sessions are not verified again on every request (0 to disable)")
+	flagSet.String("oidc-post-logout-redirect-url", "", "where the OpenID Connect provider sends the user after /oauth2/logout (must be registered with the provider)")
+	flagSet.Duration("oidc-refresh-before", time.Duration(0), "refresh OpenID Connect sessions this long before their tokens expire")
+	flagSet.Bool("oidc-require-all-groups", false, "require membership in every -oidc-groups entry instead of any one of them")
+	flagSet.Bool("oidc-group-case-insensitive", false, "match groups ignoring case and surrounding whitespace")
+	flagSet.Bool("okta-fetch-groups", false, "look the user's groups up at the Okta users API when the token does not contain the groups claim")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
@@ -84,56 +276,29 @@ func main() {
 	flagSet.String("validate-url", "", "Access token validation endpoint")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+	flagSet.Duration("provider-request-timeout", 10*time.Second, "timeout for requests to the identity provider; 0 to disable")
+	flagSet.Var(&providerCAFiles, "provider-ca-file", "path to PEM encoded CA certificates that the identity provider is verified against instead of the system roots (may be given multiple times)")
+	flagSet.Int("provider-token-retries", 0, "retry token endpoint calls failing with a network error or 5xx response this many times")
+	flagSet.Duration("provider-token-retry-base-delay", 100*time.Millisecond, "delay before the first token endpoint retry; doubles with every further retry")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
+	flagSet.String("forward-jwt-key", "", "path to a PEM encoded RSA private key; passes the user, email and groups to upstream as a short-lived JWT signed with it")
+	flagSet.String("forward-jwt-header", "X-Forwarded-Access-Token", "request header the JWT minted with -forward-jwt-key is passed to upstream in")
+	return flagSet
+}
 
-	flagSet.Parse(os.Args[1:])
-
-	if *showVersion {
-		fmt.Printf("oauth2_proxy v%s (built with %s)\n", VERSION, runtime.Version())
-		return
-	}
-
+// loadOptions resolves the options from the parsed flags, the environment and
+// the -config file, in that order of precedence, falling back to the flag
+// defaults.
+func loadOptions(flagSet *flag.FlagSet) (*Options, error) {
 	opts := NewOptions()
-
 	cfg := make(EnvOptions)
-	if *config != "" {
-		_, err := toml.DecodeFile(*config, &cfg)
-		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
+	if config := flagSet.Lookup("config").Value.String(); config != "" {
+		if _, err := toml.DecodeFile(config, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to load config file %s - %s", config, err)
 		}
 	}
 	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
-
-	err := opts.Validate()
-	if err != nil {
-		log.Printf("%s", err)
-		os.Exit(1)
-	}
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
-	oauthproxy := NewOAuthProxy(opts, validator)
-
-	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
-		if len(opts.EmailDomains) > 1 {
-			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
-		} else if opts.EmailDomains[0] != "*" {
-			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
-		}
-	}
-
-	if opts.HtpasswdFile != "" {
-		log.Printf("using htpasswd file %s", opts.HtpasswdFile)
-		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
-		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
-		if err != nil {
-			log.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
-		}
-	}
-
-	s := &Server{
-		Handler: LoggingHandler(os.Stdout, oauthproxy, opts.RequestLogging, opts.RequestLoggingFormat),
-		Opts:    opts,
-	}
-	s.ListenAndServe()
+	return opts, nil
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfigFile = `
+http_address = "0.0.0.0:4180"
+upstreams = [
+    "http://127.0.0.1:8080/",
+    "/api/=http://127.0.0.1:9090/"
+]
+email_domains = ["example.com"]
+client_id = "file-client-id"
+client_secret = "file-client-secret"
+cookie_secret = "file-cookie-secret"
+cookie_expire = "12h"
+cookie_secure = false
+skip_provider_button = true
+provider_token_retries = 3
+callback_rate_limit = 30
+`
+
+func loadTestOptions(t *testing.T, config string, args ...string) *Options {
+	f, err := ioutil.TempFile("", "oauth2_proxy_cfg_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	flagSet := NewFlagSet()
+	if err := flagSet.Parse(append([]string{"-config=" + f.Name()}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := loadOptions(flagSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestLoadOptionsFromConfigFile(t *testing.T) {
+	opts := loadTestOptions(t, testConfigFile)
+	assert.Equal(t, "0.0.0.0:4180", opts.HttpAddress)
+	assert.Equal(t, []string{"http://127.0.0.1:8080/", "/api/=http://127.0.0.1:9090/"}, opts.Upstreams)
+	assert.Equal(t, []string{"example.com"}, opts.EmailDomains)
+	assert.Equal(t, "file-client-id", opts.ClientID)
+	assert.Equal(t, "file-client-secret", opts.ClientSecret)
+	assert.Equal(t, "file-cookie-secret", opts.CookieSecret)
+	assert.Equal(t, 12*time.Hour, opts.CookieExpire)
+	assert.Equal(t, false, opts.CookieSecure)
+	assert.Equal(t, true, opts.SkipProviderButton)
+	assert.Equal(t, 3, opts.TokenRetries)
+	assert.Equal(t, 30, opts.CallbackRateLimit)
+
+	// options missing from the file keep the flag defaults
+	assert.Equal(t, ":443", opts.HttpsAddress)
+	assert.Equal(t, "google", opts.Provider)
+	assert.Equal(t, true, opts.CookieHttpOnly)
+	assert.Equal(t, 10*time.Second, opts.RequestTimeout)
+}
+
+func TestLoadOptionsFlagsOverrideConfigFile(t *testing.T) {
+	opts := loadTestOptions(t, testConfigFile,
+		"-client-id=flag-client-id",
+		"-cookie-expire=1h",
+		"-cookie-secure=true",
+		"-upstream=http://127.0.0.1:7070/",
+		"-callback-rate-limit=0")
+	assert.Equal(t, "flag-client-id", opts.ClientID)
+	assert.Equal(t, time.Hour, opts.CookieExpire)
+	assert.Equal(t, true, opts.CookieSecure)
+	assert.Equal(t, []string{"http://127.0.0.1:7070/"}, opts.Upstreams)
+	assert.Equal(t, 0, opts.CallbackRateLimit)
+
+	// options not given as flags are still read from the file
+	assert.Equal(t, "file-client-secret", opts.ClientSecret)
+	assert.Equal(t, []string{"example.com"}, opts.EmailDomains)
+}
+
+func TestLoadOptionsEnvironmentOverridesConfigFile(t *testing.T) {
+	os.Setenv("OAUTH2_PROXY_CLIENT_SECRET", "env-client-secret")
+	defer os.Unsetenv("OAUTH2_PROXY_CLIENT_SECRET")
+	os.Setenv("OAUTH2_PROXY_CLIENT_ID", "env-client-id")
+	defer os.Unsetenv("OAUTH2_PROXY_CLIENT_ID")
+
+	opts := loadTestOptions(t, testConfigFile, "-client-id=flag-client-id")
+	assert.Equal(t, "env-client-secret", opts.ClientSecret)
+	assert.Equal(t, "flag-client-id", opts.ClientID)
+}
+
+func TestLoadOptionsCookieDomains(t *testing.T) {
+	// a single domain, as before -cookie-domain could be repeated
+	opts := loadTestOptions(t, `cookie_domain = ".example.com"`)
+	assert.Equal(t, []string{".example.com"}, opts.CookieDomains)
+
+	opts = loadTestOptions(t, `cookie_domain = [".example.com", ".example.org"]`)
+	assert.Equal(t, []string{".example.com", ".example.org"}, opts.CookieDomains)
+
+	opts = loadTestOptions(t, "", "-cookie-domain=.example.com", "-cookie-domain=.example.org")
+	assert.Equal(t, []string{".example.com", ".example.org"}, opts.CookieDomains)
+}
+
+func TestLoadOptionsInvalidConfigFile(t *testing.T) {
+	flagSet := NewFlagSet()
+	flagSet.Parse([]string{"-config=/nonexistent/oauth2_proxy.cfg"})
+	_, err := loadOptions(flagSet)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "failed to load config file /nonexistent/oauth2_proxy.cfg")
+}
+
+// Every option must have a flag and a config file name, and every flag other
+// than -config and -version must set an option.
+func TestEveryOptionHasFlagAndConfigName(t *testing.T) {
+	flagSet := NewFlagSet()
+	fields := map[string]bool{}
+	typ := reflect.TypeOf(Options{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || field.Name == "CompiledRegex" {
+			// internal values set by Validate
+			continue
+		}
+		flagName := field.Tag.Get("flag")
+		cfgName := field.Tag.Get("cfg")
+		assert.NotEqual(t, "", flagName, "%s has no flag", field.Name)
+		assert.NotEqual(t, (*flag.Flag)(nil), flagSet.Lookup(flagName), "-%s is not declared", flagName)
+		assert.NotEqual(t, "", cfgName, "%s has no config file name", field.Name)
+		fields[flagName] = true
+	}
+
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "version" {
+			assert.Equal(t, true, fields[f.Name], "-%s sets no option", f.Name)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus metrics of the proxy, served on
+// -metrics-address.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	// authentications counts completed OAuth callbacks by result: success,
+	// denied or error.
+	authentications *prometheus.CounterVec
+	// groupDenials counts logins of allowed emails that failed the
+	// provider's group check.
+	groupDenials prometheus.Counter
+	// tokenRefreshes counts session refreshes by result: success or
+	// failure.
+	tokenRefreshes *prometheus.CounterVec
+	// upstreamLatency is the time taken by proxied requests, by upstream.
+	upstreamLatency *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		authentications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oauth2proxy_authentications_total",
+			Help: "Completed OAuth logins by result (success, denied or error).",
+		}, []string{"result"}),
+		groupDenials: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "oauth2proxy_group_denials_total",
+			Help: "Logins denied because the user is not in an allowed group.",
+		}),
+		tokenRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oauth2proxy_token_refresh_total",
+			Help: "Session token refreshes by result (success or failure).",
+		}, []string{"result"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "oauth2proxy_upstream_latency_seconds",
+			Help:    "Time taken by requests proxied to the upstream.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"upstream"}),
+	}
+	m.registry.MustRegister(m.authentications, m.groupDenials,
+		m.tokenRefreshes, m.upstreamLatency)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format at /metrics.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+func (m *Metrics) observeUpstream(upstream string, start time.Time) {
+	m.upstreamLatency.WithLabelValues(upstream).Observe(time.Since(start).Seconds())
+}
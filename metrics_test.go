@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrapeMetrics returns the metrics as served on -metrics-address.
+func scrapeMetrics(t *testing.T, m *Metrics) string {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	m.Handler().ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body, _ := ioutil.ReadAll(rw.Body)
+	return string(body)
+}
+
+func TestMetricsAuthenticationSuccess(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+
+	code, _ := pat_test.getCallbackEndpoint()
+	assert.Equal(t, 302, code)
+
+	metrics := scrapeMetrics(t, pat_test.proxy.Metrics)
+	assert.Contains(t, metrics, `oauth2proxy_authentications_total{result="success"} 1`)
+	assert.NotContains(t, metrics, `oauth2proxy_authentications_total{result="denied"}`)
+	assert.Contains(t, metrics, "oauth2proxy_group_denials_total 0")
+}
+
+func TestMetricsAuthenticationDenied(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	pat_test.proxy.Validator = func(string) bool { return false }
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+		url.QueryEscape(pat_test.proxy.signState("nonce", "")), nil)
+	req.AddCookie(pat_test.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+
+	metrics := scrapeMetrics(t, pat_test.proxy.Metrics)
+	assert.Contains(t, metrics, `oauth2proxy_authentications_total{result="denied"} 1`)
+	// the email was not allowed, so the groups were never checked
+	assert.Contains(t, metrics, "oauth2proxy_group_denials_total 0")
+}
+
+// GroupDenyingTestProvider fails every group check.
+type GroupDenyingTestProvider struct {
+	*TestProvider
+}
+
+func (tp *GroupDenyingTestProvider) ValidateGroup(*providers.SessionState) bool {
+	return false
+}
+
+func TestMetricsGroupDenial(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	pat_test.proxy.provider = &GroupDenyingTestProvider{pat_test.proxy.provider.(*TestProvider)}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+		url.QueryEscape(pat_test.proxy.signState("nonce", "")), nil)
+	req.AddCookie(pat_test.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+
+	metrics := scrapeMetrics(t, pat_test.proxy.Metrics)
+	assert.Contains(t, metrics, `oauth2proxy_authentications_total{result="denied"} 1`)
+	assert.Contains(t, metrics, "oauth2proxy_group_denials_total 1")
+}
+
+func TestMetricsTokenRefresh(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	provider := &RefreshingTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.provider = provider
+	pc_test.proxy.CookieRefresh = time.Hour
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		RefreshToken: "my_refresh_token", ExpiresOn: time.Now().Add(time.Hour)}
+	pc_test.SaveSession(startSession, time.Now().Add(-2*time.Hour))
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	metrics := scrapeMetrics(t, pc_test.proxy.Metrics)
+	assert.Contains(t, metrics, `oauth2proxy_token_refresh_total{result="success"} 1`)
+	assert.NotContains(t, metrics, `oauth2proxy_token_refresh_total{result="failure"}`)
+}
+
+func TestMetricsUpstreamLatency(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthRegex = []string{"/public"}
+	opts.Validate()
+
+	upstream_url, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstream_url, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/public", nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+	}
+
+	metrics := scrapeMetrics(t, proxy.Metrics)
+	assert.Contains(t, metrics, `oauth2proxy_upstream_latency_seconds_count{upstream="`+upstream_url.Host+`"} 2`)
+}
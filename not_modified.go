@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+)
+
+// authResponseHeaders are the response headers set from the session by
+// -set-xauthrequest and -set-authorization-header.
+var authResponseHeaders = []string{
+	"X-Auth-Request-User",
+	"X-Auth-Request-Email",
+	"X-Auth-Request-Groups",
+	"Authorization",
+}
+
+// conditionalRequest reports whether the upstream may answer req with 304 Not
+// Modified.
+func conditionalRequest(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// notModifiedWriter holds back the auth response headers until the upstream
+// answers and leaves them out of a 304 Not Modified, so that the 304 carries
+// the upstream's headers only. A cache updates the response it stored with
+// the headers of a 304, which would otherwise put the user's identity into
+// the response it serves to the next client.
+type notModifiedWriter struct {
+	http.ResponseWriter
+	authHeaders http.Header
+	wroteHeader bool
+}
+
+func newNotModifiedWriter(w http.ResponseWriter) *notModifiedWriter {
+	held := http.Header{}
+	header := w.Header()
+	for _, name := range authResponseHeaders {
+		if values, ok := header[name]; ok {
+			held[name] = values
+			delete(header, name)
+		}
+	}
+	return &notModifiedWriter{ResponseWriter: w, authHeaders: held}
+}
+
+func (w *notModifiedWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status != http.StatusNotModified {
+			header := w.Header()
+			for name, values := range w.authHeaders {
+				header[name] = append(values, header[name]...)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *notModifiedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses from the upstream flowing.
+func (w *notModifiedWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+const testETag = `"33a64df551425fcc55e4d42a148795d9f25f89d4"`
+
+// conditionalUpstream answers with 304 when If-None-Match matches testETag and
+// keeps the headers of the last request it received.
+func conditionalUpstream(received *http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header
+		w.Header().Set("ETag", testETag)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if r.Header.Get("If-None-Match") == testETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+}
+
+// requestConditionalUpstream sends a request with an authenticated session
+// and the given request headers through a proxy setting the auth response
+// headers.
+func requestConditionalUpstream(t *testing.T, upstream *httptest.Server, header http.Header) *httptest.ResponseRecorder {
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "16 bytes AES-128"
+	opts.SetXAuthRequest = true
+	opts.SetAuthorization = true
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &providers.SessionState{
+		User: "jdoe", Email: "jdoe@example.com", IdToken: "id_token",
+		AccessToken: "my_access_token", ExpiresOn: time.Now().Add(time.Hour)}))
+	req = requestWithCookies(rw)
+	req.RequestURI = "/"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestNotModifiedRelayedVerbatim(t *testing.T) {
+	var received http.Header
+	upstream := conditionalUpstream(&received)
+	defer upstream.Close()
+
+	rw := requestConditionalUpstream(t, upstream, http.Header{
+		"If-None-Match":     {testETag},
+		"If-Modified-Since": {"Wed, 21 Oct 2015 07:28:00 GMT"},
+	})
+	assert.Equal(t, testETag, received.Get("If-None-Match"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", received.Get("If-Modified-Since"))
+
+	assert.Equal(t, http.StatusNotModified, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+	assert.Equal(t, testETag, rw.Header().Get("ETag"))
+	assert.Equal(t, "public, max-age=60", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"Accept-Encoding"}, rw.Header()["Vary"])
+	for _, h := range authResponseHeaders {
+		assert.Equal(t, "", rw.Header().Get(h), h)
+	}
+}
+
+func TestNotModifiedStaleETagGetsAuthHeaders(t *testing.T) {
+	var received http.Header
+	upstream := conditionalUpstream(&received)
+	defer upstream.Close()
+
+	rw := requestConditionalUpstream(t, upstream, http.Header{
+		"If-None-Match": {`"stale"`},
+	})
+	assert.Equal(t, `"stale"`, received.Get("If-None-Match"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, testETag, rw.Header().Get("ETag"))
+	assert.Equal(t, "jdoe", rw.Header().Get("X-Auth-Request-User"))
+	assert.Equal(t, "Bearer id_token", rw.Header().Get("Authorization"))
+}
+
+func TestNotModifiedUnconditionalRequest(t *testing.T) {
+	var received http.Header
+	upstream := conditionalUpstream(&received)
+	defer upstream.Close()
+
+	rw := requestConditionalUpstream(t, upstream, nil)
+	assert.Equal(t, "", received.Get("If-None-Match"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "jdoe@example.com", rw.Header().Get("X-Auth-Request-Email"))
+}
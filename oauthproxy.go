@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -10,8 +14,10 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
@@ -20,6 +26,10 @@ import (
 
 const SignatureHeader = "GAP-Signature"
 
+// perRequestLoginCookieExpire is how long the cookies kept for a login live
+// with -cookie-csrf-per-request.
+const perRequestLoginCookieExpire = 15 * time.Minute
+
 var SignatureHeaders []string = []string{
 	"Content-Length",
 	"Content-Md5",
@@ -34,26 +44,37 @@ var SignatureHeaders []string = []string{
 }
 
 type OAuthProxy struct {
-	CookieSeed     string
-	CookieName     string
-	CSRFCookieName string
-	CookieDomain   string
-	CookieSecure   bool
-	CookieHttpOnly bool
-	CookieExpire   time.Duration
-	CookieRefresh  time.Duration
-	Validator      func(string) bool
+	CookieSeed            string
+	CookieName            string
+	CSRFCookieName        string
+	AuthRequestCookieName string
+	CSRFPerRequest        bool
+	CookieDomains         []string
+	CookieSecure          bool
+	CookieHttpOnly        bool
+	CookieSameSite        http.SameSite
+	CookieEncrypt         bool
+	CookieExpire          time.Duration
+	CookieRefresh         time.Duration
+	SessionIdleTimeout    time.Duration
+	Validator             func(string) bool
 
 	RobotsPath        string
 	PingPath          string
 	SignInPath        string
 	SignOutPath       string
+	LogoutPath        string
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	UserInfoPath      string
+	TokenPath         string
 
 	redirectURL         *url.URL // the url to receive requests at
 	provider            providers.Provider
+	sessionStore        SessionStore
+	backgroundRefresh   *backgroundRefresher
+	refreshes           refreshGroup
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
@@ -63,23 +84,54 @@ type OAuthProxy struct {
 	PassBasicAuth       bool
 	SkipProviderButton  bool
 	PassUserHeaders     bool
+	SetGroupsHeader     bool
+	UserInfoFields      []string
 	BasicAuthPassword   string
 	PassAccessToken     bool
+	PassIdToken         bool
+	IdTokenHeader       string
+	claimHeaders        []claimHeader
 	SetAuthorization    bool
 	PassAuthorization   bool
 	CookieCipher        *cookie.Cipher
 	skipAuthRegex       []string
 	skipAuthPreflight   bool
+	cors                *corsPolicy
 	compiledRegex       []*regexp.Regexp
+	methodRules         []methodRule
 	templates           *template.Template
 	Footer              string
+	Banner              string
+	WhitelistDomains    []string
 	AllowBearer         bool
+	// SkipJwtBearerTokens accepts requests carrying a bearer JWT the
+	// provider can verify, without a session cookie.
+	SkipJwtBearerTokens bool
+
+	// ExposeTokenEndpoint serves the session's access token at TokenPath.
+	ExposeTokenEndpoint bool
+
+	// forwardJWT, when set, mints a JWT asserting the user for the upstream.
+	forwardJWT *forwardJWTSigner
+
+	// PostLogoutRedirectURL is where the user ends up after Logout.
+	PostLogoutRedirectURL string
+
+	// callbackLimiter throttles the sign-in and callback endpoints per
+	// client address.
+	callbackLimiter *rateLimiter
+	// callbackLimitByClientIP keys callbackLimiter on the address resolved
+	// from the real IP header instead of the peer address.
+	callbackLimitByClientIP bool
+
+	Metrics *Metrics
 }
 
 type UpstreamProxy struct {
 	upstream string
 	handler  http.Handler
 	auth     hmacauth.HmacAuth
+	metrics  *Metrics
 }
 
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -88,15 +140,24 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
 		u.auth.SignRequest(r)
 	}
+	if u.metrics != nil {
+		defer u.metrics.observeUpstream(u.upstream, time.Now())
+	}
+	defer observeUpstreamLatency(r, time.Now())
+	if conditionalRequest(r) && !websocketUpgradeRequest(r) {
+		w = newNotModifiedWriter(w)
+	}
 	u.handler.ServeHTTP(w, r)
 }
 
-func setProxyUpstreamHostHeader(proxy *WebsocketReverseProxy, target *url.URL) {
+// setProxyUpstreamHostHeader sends requests to the upstream with the given
+// Host header instead of the one the client sent.
+func setProxyUpstreamHostHeader(proxy *WebsocketReverseProxy, host string) {
 	director := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		director(req)
 		// use RequestURI so that we aren't unescaping encoded slashes in the request path
-		req.Host = target.Host
+		req.Host = host
 		req.URL.Opaque = req.RequestURI
 		req.URL.RawQuery = ""
 	}
@@ -110,38 +171,125 @@ func setProxyDirector(proxy *WebsocketReverseProxy) {
 		req.URL.RawQuery = ""
 	}
 }
+
+// setProxyPathRewrite replaces the prefix the upstream is mapped at with the
+// path of the upstream URL, so that a request for /api/users to an upstream
+// mapped as /api/=http://api:8080/v1/ is sent as /v1/users.
+func setProxyPathRewrite(proxy *WebsocketReverseProxy, prefix string, targetPath string) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if strings.HasPrefix(req.URL.Opaque, prefix) {
+			req.URL.Opaque = targetPath + req.URL.Opaque[len(prefix):]
+		}
+	}
+}
+
+// setProxyStripPrefix removes prefix from the path of requests to the
+// upstream and adds it back to the redirects it sends, so an upstream rooted
+// at / can be served under the prefix.
+func setProxyStripPrefix(proxy *WebsocketReverseProxy, prefix string) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.URL.Opaque = stripPathPrefix(req.URL.Opaque, prefix)
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		location := res.Header.Get("Location")
+		if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+			res.Header.Set("Location", prefix+location)
+		}
+		return nil
+	}
+}
+
+// setProxyStripResponseHeaders removes the named headers from the upstream's
+// responses, after any other ModifyResponse hook of the proxy ran.
+func setProxyStripResponseHeaders(proxy *WebsocketReverseProxy, headers []string) {
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if modifyResponse != nil {
+			if err := modifyResponse(res); err != nil {
+				return err
+			}
+		}
+		for _, h := range headers {
+			res.Header.Del(h)
+		}
+		return nil
+	}
+}
+
+// stripPathPrefix removes prefix from a request URI if it matches whole path
+// segments; a path that becomes empty is replaced by /.
+func stripPathPrefix(uri string, prefix string) string {
+	if prefix == "" || !strings.HasPrefix(uri, prefix) {
+		return uri
+	}
+	rest := uri[len(prefix):]
+	switch {
+	case rest == "" || rest[0] == '?':
+		return "/" + rest
+	case rest[0] == '/':
+		return rest
+	}
+	return uri
+}
+
 func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
 }
 
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
+	metrics := NewMetrics()
 	serveMux := http.NewServeMux()
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
 		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
 			SignatureHeader, SignatureHeaders)
 	}
-	for _, u := range opts.proxyURLs {
-		path := u.Path
+	transport := newUpstreamTransport(opts)
+	var upstreams []*WebsocketReverseProxy
+	for i, u := range opts.proxyURLs {
+		path := opts.proxyPaths[i]
 		switch u.Scheme {
 		case "http", "https":
+			targetPath := u.Path
 			u.Path = ""
-			log.Printf("mapping path %q => upstream %q", path, u)
+			log.Printf("mapping path %q => upstream %q", path, u.String()+targetPath)
 			proxy := NewWebsocketReverseProxy(u)
-			if !opts.PassHostHeader {
-				setProxyUpstreamHostHeader(proxy, u)
-			} else {
+			proxy.Transport = transport
+			proxy.TLSClientConfig = opts.upstreamTLS
+			if proxy.TLSClientConfig == nil && opts.SSLInsecureSkipVerify {
+				// -ssl-insecure-skip-verify applies to WebSocket upstreams
+				// as well, but the -provider-ca-file CAs do not
+				proxy.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+			switch {
+			case opts.UpstreamHost != "":
+				setProxyUpstreamHostHeader(proxy, opts.UpstreamHost)
+			case !opts.PassHostHeader:
+				setProxyUpstreamHostHeader(proxy, u.Host)
+			default:
 				setProxyDirector(proxy)
 			}
+			if opts.StripPathPrefix != "" {
+				setProxyStripPrefix(proxy, opts.StripPathPrefix)
+			}
+			if len(opts.StripResponseHeaders) > 0 {
+				setProxyStripResponseHeaders(proxy, opts.StripResponseHeaders)
+			}
+			// the path mapping applies to the path left after stripping
+			if prefix := stripPathPrefix(path, opts.StripPathPrefix); prefix != targetPath {
+				setProxyPathRewrite(proxy, prefix, targetPath)
+			}
+			upstreams = append(upstreams, proxy)
 			serveMux.Handle(path,
-				&UpstreamProxy{u.Host, proxy, auth})
+				&UpstreamProxy{u.Host, proxy, auth, metrics})
 		case "file":
-			if u.Fragment != "" {
-				path = u.Fragment
-			}
 			log.Printf("mapping path %q => file system %q", path, u.Path)
 			proxy := NewFileServer(path, u.Path)
-			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil})
+			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil, metrics})
 		default:
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
@@ -159,56 +307,88 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
 	}
 
-	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, opts.CookieDomain, refresh)
+	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v samesite:%s expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieSameSite, opts.CookieExpire, strings.Join(opts.CookieDomains, ","), refresh)
 
 	var cipher *cookie.Cipher
-	if opts.PassAccessToken || opts.SetAuthorization || opts.PassAuthorization || (opts.CookieRefresh != time.Duration(0)) {
+	if opts.needsCookieCipher() {
 		var err error
-		cipher, err = cookie.NewCipher(secretBytes(opts.CookieSecret))
+		cipher, err = cookie.NewCipher(cookieCipherKey(opts))
 		if err != nil {
 			log.Fatal("cookie-secret error: ", err)
 		}
 	}
 
-	return &OAuthProxy{
-		CookieName:     opts.CookieName,
-		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
-		CookieSeed:     opts.CookieSecret,
-		CookieDomain:   opts.CookieDomain,
-		CookieSecure:   opts.CookieSecure,
-		CookieHttpOnly: opts.CookieHttpOnly,
-		CookieExpire:   opts.CookieExpire,
-		CookieRefresh:  opts.CookieRefresh,
-		Validator:      validator,
+	p := &OAuthProxy{
+		CookieName:            opts.CookieName,
+		CSRFCookieName:        fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
+		AuthRequestCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "authreq"),
+		CSRFPerRequest:        opts.CookieCSRFPerRequest,
+		CookieSeed:            opts.CookieSecret,
+		CookieDomains:         opts.CookieDomains,
+		CookieSecure:          opts.CookieSecure,
+		CookieHttpOnly:        opts.CookieHttpOnly,
+		CookieSameSite:        sameSite(opts.CookieSameSite),
+		CookieEncrypt:         opts.CookieEncrypt,
+		CookieExpire:          opts.CookieExpire,
+		CookieRefresh:         opts.CookieRefresh,
+		SessionIdleTimeout:    opts.SessionIdleTimeout,
+		Validator:             validator,
 
 		RobotsPath:        "/robots.txt",
-		PingPath:          "/ping",
+		PingPath:          opts.PingPath,
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
+		LogoutPath:        fmt.Sprintf("%s/logout", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		UserInfoPath:      fmt.Sprintf("%s/userinfo", opts.ProxyPrefix),
+		TokenPath:         fmt.Sprintf("%s/token", opts.ProxyPrefix),
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
+		sessionStore:       opts.sessionStore,
+		backgroundRefresh:  newBackgroundRefresher(opts.SessionBackgroundRefresh),
 		serveMux:           serveMux,
+		Metrics:            metrics,
 		redirectURL:        redirectURL,
 		skipAuthRegex:      opts.SkipAuthRegex,
 		skipAuthPreflight:  opts.SkipAuthPreflight,
+		cors:               opts.cors,
 		compiledRegex:      opts.CompiledRegex,
+		methodRules:        opts.methodRules,
 		SetXAuthRequest:    opts.SetXAuthRequest,
 		PassBasicAuth:      opts.PassBasicAuth,
 		PassUserHeaders:    opts.PassUserHeaders,
+		SetGroupsHeader:    opts.SetGroupsHeader,
+		UserInfoFields:     opts.UserInfoFields,
 		BasicAuthPassword:  opts.BasicAuthPassword,
 		PassAccessToken:    opts.PassAccessToken,
+		PassIdToken:        opts.PassIdToken,
+		IdTokenHeader:      opts.IdTokenHeader,
+		claimHeaders:       opts.claimHeaders,
 		SetAuthorization:   opts.SetAuthorization,
 		PassAuthorization:  opts.PassAuthorization,
 		SkipProviderButton: opts.SkipProviderButton,
 		CookieCipher:       cipher,
 		templates:          loadTemplates(opts.CustomTemplatesDir),
 		Footer:             opts.Footer,
+		Banner:             opts.Banner,
+		WhitelistDomains:   opts.WhitelistDomains,
 		AllowBearer:        opts.AllowBearerHeader,
+
+		SkipJwtBearerTokens:   opts.SkipJwtBearerTokens,
+		ExposeTokenEndpoint:   opts.ExposeTokenEndpoint,
+		forwardJWT:            opts.forwardJWT,
+		PostLogoutRedirectURL: opts.OIDCPostLogoutURL,
+		callbackLimiter:       newRateLimiter(opts.CallbackRateLimit),
+
+		callbackLimitByClientIP: len(opts.TrustedProxies) > 0,
+	}
+	for _, proxy := range upstreams {
+		proxy.ErrorHandler = p.UpstreamErrorPage
 	}
+	return p
 }
 
 func (p *OAuthProxy) GetRedirectURI(host string) string {
@@ -233,12 +413,16 @@ func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(host, code string, authReq *providers.AuthRequest) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
 	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	if ap, ok := p.provider.(providers.AuthRequestProvider); ok {
+		s, err = ap.RedeemAuthRequest(redirectURI, code, authReq)
+	} else {
+		s, err = p.provider.Redeem(redirectURI, code)
+	}
 	if err != nil {
 		return
 	}
@@ -318,7 +502,7 @@ func joinCookies(cookies []*http.Cookie) (*http.Cookie, error) {
 	for i := 1; i < len(cookies); i++ {
 		c.Value += cookies[i].Value
 	}
-	c.Name = strings.TrimRight(c.Name, "-0")
+	c.Name = strings.TrimSuffix(c.Name, "-0")
 	return c, nil
 }
 
@@ -345,48 +529,124 @@ func loadCookie(req *http.Request, cookieName string) (*http.Cookie, error) {
 }
 
 func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
-	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
+	return laxLoginCookie(p.makeCookie(req, p.loginCookieName(p.CSRFCookieName, value), value, expiration, now))
 }
 
-func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, expiration time.Duration, now time.Time) *http.Cookie {
-	if p.CookieDomain != "" {
-		domain := req.Host
-		if h, _, err := net.SplitHostPort(domain); err == nil {
-			domain = h
-		}
-		if !strings.HasSuffix(domain, p.CookieDomain) {
-			log.Printf("Warning: request host is %q but using configured cookie domain of %q", domain, p.CookieDomain)
-		}
+// loginCookieName returns the name of the cookie kept for the login with the
+// given CSRF nonce. With -cookie-csrf-per-request every login gets cookies of
+// its own, named after a hash of its nonce, so that logins running at the
+// same time in several tabs don't overwrite each other's.
+func (p *OAuthProxy) loginCookieName(name, nonce string) string {
+	if !p.CSRFPerRequest {
+		return name
+	}
+	h := sha256.Sum256([]byte(nonce))
+	return fmt.Sprintf("%s_%x", name, h[:8])
+}
+
+// loginCookieExpire returns how long the cookies kept for a login live.
+// Per-request cookies of abandoned logins pile up, so they expire sooner.
+func (p *OAuthProxy) loginCookieExpire() time.Duration {
+	if p.CSRFPerRequest && p.CookieExpire > perRequestLoginCookieExpire {
+		return perRequestLoginCookieExpire
 	}
+	return p.CookieExpire
+}
 
+// laxLoginCookie relaxes SameSite=Strict to Lax on the cookies that are read
+// by the OAuth callback, which browsers reach through a cross-site redirect
+// from the identity provider and would not send Strict cookies to.
+func laxLoginCookie(c *http.Cookie) *http.Cookie {
+	if c.SameSite == http.SameSiteStrictMode {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
+
+func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	return &http.Cookie{
 		Name:     name,
 		Value:    value,
 		Path:     "/",
-		Domain:   p.CookieDomain,
+		Domain:   p.cookieDomain(req),
 		HttpOnly: p.CookieHttpOnly,
 		Secure:   p.CookieSecure,
+		SameSite: p.CookieSameSite,
 		Expires:  now.Add(expiration),
 	}
 }
 
-func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request) {
+// cookieDomain returns the first of CookieDomains that matches the host of
+// req, or "" to set a host-only cookie if none does.
+func (p *OAuthProxy) cookieDomain(req *http.Request) string {
+	if len(p.CookieDomains) == 0 {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, domain := range p.CookieDomains {
+		if cookieDomainMatches(host, domain) {
+			return domain
+		}
+	}
+	return ""
+}
 
-	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour * -1, time.Now()))
+// cookieDomainMatches reports whether browsers accept a cookie for domain
+// from host: the domain, with or without a leading dot, must be the host
+// itself or one of its parent domains.
+func cookieDomainMatches(host string, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// ClearCSRFCookie expires the CSRF cookie of the login with the given nonce.
+func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request, nonce string) {
+	name := p.loginCookieName(p.CSRFCookieName, nonce)
+	http.SetCookie(rw, laxLoginCookie(p.makeCookie(req, name, "", time.Hour*-1, time.Now())))
 }
 
 func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.loginCookieExpire(), time.Now()))
+}
+
+// MakeAuthRequestCookie makes the cookie keeping the AuthRequest of the login
+// with the given CSRF nonce.
+func (p *OAuthProxy) MakeAuthRequestCookie(req *http.Request, nonce string, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	return laxLoginCookie(p.makeCookie(req, p.loginCookieName(p.AuthRequestCookieName, nonce), value, expiration, now))
+}
+
+func (p *OAuthProxy) ClearAuthRequestCookie(rw http.ResponseWriter, req *http.Request, nonce string) {
+	http.SetCookie(rw, p.MakeAuthRequestCookie(req, nonce, "", time.Hour*-1, time.Now()))
+}
+
+func (p *OAuthProxy) SetAuthRequestCookie(rw http.ResponseWriter, req *http.Request, nonce string, val string) {
+	http.SetCookie(rw, p.MakeAuthRequestCookie(req, nonce, val, p.loginCookieExpire(), time.Now()))
+}
+
+// loadAuthRequest returns the AuthRequest stored by OAuthStart for the login
+// with the given CSRF nonce, or nil when there is none.
+func (p *OAuthProxy) loadAuthRequest(req *http.Request, nonce string) (*providers.AuthRequest, error) {
+	c, err := req.Cookie(p.loginCookieName(p.AuthRequestCookieName, nonce))
+	if err != nil {
+		return nil, nil
+	}
+	return providers.DecodeAuthRequest(c.Value)
 }
 
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
+	p.clearStoredSession(req)
 	cookies := p.MakeSessionCookie(req, "", time.Hour * -1, time.Now())
 	for _, clr := range cookies {
 		http.SetCookie(rw, clr)
 	}
+	p.clearStaleSessionCookies(rw, req, cookies)
 
 	// ugly hack because default domain changed
-	if p.CookieDomain == "" && len(cookies) > 0 {
+	if len(cookies) > 0 && cookies[0].Domain == "" {
 		clr2 := *cookies[0]
 		clr2.Domain = req.Host
 		http.SetCookie(rw, &clr2)
@@ -394,9 +654,41 @@ func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Reques
 }
 
 func (p *OAuthProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	for _, c := range p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()) {
+	cookies := p.MakeSessionCookie(req, val, p.CookieExpire, time.Now())
+	for _, c := range cookies {
 		http.SetCookie(rw, c)
 	}
+	p.clearStaleSessionCookies(rw, req, cookies)
+}
+
+// clearStaleSessionCookies expires the session cookies the request carries
+// that are not being written, e.g. the chunks left over when a session that
+// was split across several cookies shrinks.
+func (p *OAuthProxy) clearStaleSessionCookies(rw http.ResponseWriter, req *http.Request, written []*http.Cookie) {
+	writing := make(map[string]bool, len(written))
+	for _, c := range written {
+		writing[c.Name] = true
+	}
+	for _, c := range req.Cookies() {
+		if writing[c.Name] || !p.isSessionCookieName(c.Name) {
+			continue
+		}
+		writing[c.Name] = true
+		http.SetCookie(rw, p.makeCookie(req, c.Name, "", time.Hour*-1, time.Now()))
+	}
+}
+
+// isSessionCookieName reports whether name is the session cookie or one of
+// the numbered chunks it is split into.
+func (p *OAuthProxy) isSessionCookieName(name string) bool {
+	if name == p.CookieName {
+		return true
+	}
+	if !strings.HasPrefix(name, p.CookieName+"-") {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(name, p.CookieName+"-"))
+	return err == nil
 }
 
 func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
@@ -411,7 +703,12 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 		return nil, age, errors.New("Cookie Signature not valid")
 	}
 
-	session, err := p.provider.SessionFromCookie(val, p.CookieCipher)
+	if p.sessionStore != nil {
+		if val, err = p.sessionStore.Load(val); err != nil {
+			return nil, age, err
+		}
+	}
+	session, err := p.decodeSession(val)
 	if err != nil {
 		return nil, age, err
 	}
@@ -420,36 +717,236 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 	return session, age, nil
 }
 
-func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
+// decodeSession decodes a session encoded by encodeSession.
+func (p *OAuthProxy) decodeSession(val string) (*providers.SessionState, error) {
+	if p.CookieEncrypt {
+		// also rejects sessions written before encryption was turned on
+		var err error
+		if val, err = p.CookieCipher.Open(val); err != nil {
+			return nil, err
+		}
+	}
+	return p.provider.SessionFromCookie(val, p.CookieCipher)
+}
+
+// encodeSession encodes s for the session cookie or the session store.
+func (p *OAuthProxy) encodeSession(s *providers.SessionState) (string, error) {
 	value, err := p.provider.CookieForSession(s, p.CookieCipher)
+	if err != nil {
+		return "", err
+	}
+	if p.CookieEncrypt {
+		return p.CookieCipher.Seal(value)
+	}
+	return value, nil
+}
+
+func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
+	p.markSeen(s)
+	value, err := p.encodeSession(s)
 	if err != nil {
 		return err
 	}
+	if p.sessionStore != nil {
+		if value, err = p.storeSession(req, s, value); err != nil {
+			return err
+		}
+	}
 	p.SetSessionCookie(rw, req, value)
 	return nil
 }
 
+// storeSession saves the encoded session in the session store and returns the
+// key to put in the cookie. The request's key is reused while the store still
+// has its session, so that concurrent requests keep working; logins clear the
+// old session first and so always get a new key.
+func (p *OAuthProxy) storeSession(req *http.Request, s *providers.SessionState, value string) (string, error) {
+	key := p.storedSessionKey(req)
+	if key != "" {
+		if _, err := p.sessionStore.Load(key); err != nil {
+			key = ""
+		}
+	}
+	if key == "" {
+		var err error
+		if key, err = cookie.Nonce(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := p.sessionStore.Save(key, value, p.storedSessionExpiration(s)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// storedSessionExpiration returns how long the session store keeps s.
+func (p *OAuthProxy) storedSessionExpiration(s *providers.SessionState) time.Duration {
+	// sessions that can be refreshed must outlive their tokens
+	expiration := p.CookieExpire
+	if s.RefreshToken == "" && !s.ExpiresOn.IsZero() {
+		if untilExpiry := s.ExpiresOn.Sub(time.Now()); untilExpiry > 0 && untilExpiry < expiration {
+			expiration = untilExpiry
+		}
+	}
+	// sessions in use are stored again, so idle sessions run out
+	if p.SessionIdleTimeout != 0 && p.SessionIdleTimeout < expiration {
+		expiration = p.SessionIdleTimeout
+	}
+	return expiration
+}
+
+// markSeen sets the LastSeen time of s to now when -session-idle-timeout is
+// set.
+func (p *OAuthProxy) markSeen(s *providers.SessionState) {
+	if p.SessionIdleTimeout != 0 {
+		s.LastSeen = time.Now()
+	}
+}
+
+// sessionIdle reports whether s has not been used for longer than
+// -session-idle-timeout. Sessions without a LastSeen time were created before
+// the timeout was turned on, and count as idle.
+func (p *OAuthProxy) sessionIdle(s *providers.SessionState) bool {
+	return p.SessionIdleTimeout != 0 && time.Now().Sub(s.LastSeen) > p.SessionIdleTimeout
+}
+
+// lastSeenUpdates is how often per -session-idle-timeout the LastSeen time of
+// a session in use is stored again. Updating it on every request would write
+// the session for each one; in exchange sessions may be signed out up to a
+// tenth of the timeout early.
+const lastSeenUpdates = 10
+
+// touchDue reports whether the LastSeen time of s is old enough to be stored
+// again.
+func (p *OAuthProxy) touchDue(s *providers.SessionState) bool {
+	return time.Now().Sub(s.LastSeen) > p.SessionIdleTimeout/lastSeenUpdates
+}
+
+// touchSession stores s again with its LastSeen time set to now. Unlike
+// SaveSession it keeps the time the session cookie was issued, which
+// -cookie-refresh and -cookie-expire count from.
+func (p *OAuthProxy) touchSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState, age time.Duration) error {
+	if !p.touchDue(s) {
+		return nil
+	}
+	if p.sessionStore != nil {
+		// the cookie only carries the key, which stays the same
+		return p.touchStoredSession(p.storedSessionKey(req))
+	}
+	p.markSeen(s)
+	value, err := p.encodeSession(s)
+	if err != nil {
+		return err
+	}
+	issued := time.Now().Truncate(time.Second).Add(-age)
+	cookies := p.MakeSessionCookie(req, value, p.CookieExpire, issued)
+	for _, c := range cookies {
+		http.SetCookie(rw, c)
+	}
+	p.clearStaleSessionCookies(rw, req, cookies)
+	return nil
+}
+
+// touchStoredSession sets the LastSeen time of the session stored under key
+// to now. The session is loaded again first: a background refresh or another
+// request may have stored new tokens since this request loaded it, and a
+// rotated refresh token can't be used again.
+func (p *OAuthProxy) touchStoredSession(key string) error {
+	val, err := p.sessionStore.Load(key)
+	if err == ErrSessionNotFound {
+		// signed out meanwhile
+		return nil
+	} else if err != nil {
+		return err
+	}
+	session, err := p.decodeSession(val)
+	if err != nil {
+		return err
+	}
+	if !p.touchDue(session) {
+		return nil
+	}
+	p.markSeen(session)
+	value, err := p.encodeSession(session)
+	if err != nil {
+		return err
+	}
+	return p.sessionStore.Save(key, value, p.storedSessionExpiration(session))
+}
+
+// storedSessionKey returns the session store key carried by the request's
+// session cookie, or "" if there is none.
+func (p *OAuthProxy) storedSessionKey(req *http.Request) string {
+	c, err := loadCookie(req, p.CookieName)
+	if err != nil {
+		return ""
+	}
+	key, _, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
+	if !ok {
+		return ""
+	}
+	return key
+}
+
+// clearStoredSession removes the request's session from the session store.
+func (p *OAuthProxy) clearStoredSession(req *http.Request) {
+	if p.sessionStore == nil {
+		return
+	}
+	key := p.storedSessionKey(req)
+	if key == "" {
+		return
+	}
+	if err := p.sessionStore.Clear(key); err != nil {
+		log.Printf("%s error clearing session %s", getRemoteAddr(req), err)
+	}
+}
+
 func (p *OAuthProxy) RobotsTxt(rw http.ResponseWriter) {
 	rw.WriteHeader(http.StatusOK)
 	fmt.Fprintf(rw, "User-agent: *\nDisallow: /")
 }
 
-func (p *OAuthProxy) PingPage(rw http.ResponseWriter) {
-	rw.WriteHeader(http.StatusOK)
-	fmt.Fprintf(rw, "OK")
+// PingPage answers health checks without looking at the session, so load
+// balancer probes neither need to authenticate nor reach the provider.
+func (p *OAuthProxy) PingPage(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, "OK")
+	case "HEAD":
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
 }
 
-func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
+func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, req *http.Request, code int, title string, message string) {
 	log.Printf("ErrorPage %d %s %s", code, title, message)
+	p.renderErrorPage(rw, req, code, title, message, "")
+}
+
+// renderErrorPage renders error.html; requestID is shown on the page when set.
+func (p *OAuthProxy) renderErrorPage(rw http.ResponseWriter, req *http.Request, code int, title string, message string, requestID string) {
 	rw.WriteHeader(code)
 	t := struct {
-		Title       string
-		Message     string
-		ProxyPrefix string
+		Title        string
+		Message      string
+		ProviderName string
+		Path         string
+		ProxyPrefix  string
+		Footer       string
+		RequestID    string
 	}{
-		Title:       fmt.Sprintf("%d %s", code, title),
-		Message:     message,
-		ProxyPrefix: p.ProxyPrefix,
+		Title:        fmt.Sprintf("%d %s", code, title),
+		Message:      message,
+		ProviderName: p.provider.Data().ProviderName,
+		Path:         req.URL.Path,
+		ProxyPrefix:  p.ProxyPrefix,
+		Footer:       p.Footer,
+		RequestID:    requestID,
 	}
 	p.templates.ExecuteTemplate(rw, "error.html", t)
 }
@@ -469,19 +966,21 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 	t := struct {
 		ProviderName  string
 		SignInMessage string
+		Banner        string
 		CustomLogin   bool
 		Redirect      string
 		Version       string
 		ProxyPrefix   string
-		Footer        template.HTML
+		Footer        string
 	}{
 		ProviderName:  p.provider.Data().ProviderName,
 		SignInMessage: p.SignInMessage,
+		Banner:        p.Banner,
 		CustomLogin:   p.displayCustomLoginForm(),
 		Redirect:      redirect_url,
 		Version:       VERSION,
 		ProxyPrefix:   p.ProxyPrefix,
-		Footer:        template.HTML(p.Footer),
+		Footer:        p.Footer,
 	}
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
@@ -510,13 +1009,83 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 	}
 
 	redirect = req.Form.Get("rd")
-	if redirect == "" || !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+	if redirect == "" && req.URL.Path != p.OAuthStartPath && req.URL.Path != p.SignInPath {
+		// a protected page sending the user straight to the provider
+		// (-skip-provider-button) is where the user wants to end up
+		redirect = req.URL.RequestURI()
+	}
+	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
 
 	return
 }
 
+// IsValidRedirect reports whether the user may be sent to redirect after
+// login: a path on this host, or an http(s) URL on one of WhitelistDomains.
+func (p *OAuthProxy) IsValidRedirect(redirect string) bool {
+	if isSafeRedirect(redirect) {
+		return true
+	}
+	if len(p.WhitelistDomains) == 0 || hasSpaceOrControl(redirect) || strings.HasPrefix(redirect, "/\\") {
+		return false
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, domain := range p.WhitelistDomains {
+		if whitelistedHost(domain, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// whitelistedHost matches host against a -whitelist-domain entry. A leading
+// dot matches the domain and all its subdomains. An entry without a port only
+// matches hosts without one, "host:port" that port and "host:*" any port.
+func whitelistedHost(domain, host string) bool {
+	hostname, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	}
+	domainName, domainPort := domain, ""
+	if i := strings.LastIndex(domain, ":"); i >= 0 {
+		domainName, domainPort = domain[:i], domain[i+1:]
+	}
+	if domainPort != "*" && domainPort != port {
+		return false
+	}
+	hostname, domainName = strings.ToLower(hostname), strings.ToLower(domainName)
+	if strings.HasPrefix(domainName, ".") {
+		return hostname == domainName[1:] || strings.HasSuffix(hostname, domainName)
+	}
+	return hostname == domainName
+}
+
+// isSafeRedirect reports whether redirect is a path on this host. Anything
+// else, including protocol relative URLs such as //evil.com and /\evil.com,
+// which browsers treat alike, could send the user to another site.
+func isSafeRedirect(redirect string) bool {
+	return !hasSpaceOrControl(redirect) &&
+		strings.HasPrefix(redirect, "/") &&
+		!strings.HasPrefix(redirect, "//") &&
+		!strings.HasPrefix(redirect, "/\\")
+}
+
+// hasSpaceOrControl reports whether s contains whitespace or control
+// characters. Browsers drop tabs and newlines from URLs, so that
+// "/\t/evil.com" is followed like //evil.com.
+func hasSpaceOrControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0
+}
+
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
 	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
@@ -534,45 +1103,82 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
 
 func getRemoteAddr(req *http.Request) (s string) {
 	s = req.RemoteAddr
-	if req.Header.Get("X-Real-IP") != "" {
-		s += fmt.Sprintf(" (%q)", req.Header.Get("X-Real-IP"))
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+	}
+	if client := clientIP(req); client != "" && client != host {
+		s += fmt.Sprintf(" (%q)", client)
 	}
 	return
 }
 
+// callbackLimitKey returns the address the sign-in and callback rate limit is
+// kept for. The real IP header is only relied on with -trusted-proxies, as
+// without it every peer is trusted and a client could send another address
+// with each request.
+func (p *OAuthProxy) callbackLimitKey(req *http.Request) string {
+	if p.callbackLimitByClientIP {
+		return clientIP(req)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	switch path := req.URL.Path; {
+	case path == p.PingPath:
+		p.PingPage(rw, req)
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
-	case path == p.PingPath:
-		p.PingPage(rw)
+	case p.cors != nil && corsPreflightRequest(req):
+		p.CORSPreflight(rw, req)
 	case p.IsWhitelistedRequest(req):
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveUpstream(rw, req)
+	case (path == p.SignInPath || path == p.OAuthCallbackPath) && !p.callbackLimiter.Allow(p.callbackLimitKey(req)):
+		p.TooManyRequests(rw, req)
 	case path == p.SignInPath:
 		p.SignIn(rw, req)
 	case path == p.SignOutPath:
 		p.SignOut(rw, req)
+	case path == p.LogoutPath:
+		p.Logout(rw, req)
 	case path == p.OAuthStartPath:
 		p.OAuthStart(rw, req)
 	case path == p.OAuthCallbackPath:
 		p.OAuthCallback(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.UserInfoPath:
+		p.UserInfo(rw, req)
+	case path == p.TokenPath && p.ExposeTokenEndpoint:
+		p.Token(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
 }
 
+// TooManyRequests rejects a client that went over -callback-rate-limit before
+// anything is sent to the provider.
+func (p *OAuthProxy) TooManyRequests(rw http.ResponseWriter, req *http.Request) {
+	log.Printf("%s rate limit exceeded for %s", getRemoteAddr(req), req.URL.Path)
+	p.ErrorPage(rw, req, http.StatusTooManyRequests, "Too Many Requests", "Too many sign-in attempts, try again later.")
+}
+
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 
 	user, ok := p.ManualSignIn(rw, req)
 	if ok {
 		session := &providers.SessionState{User: user}
+		p.clearStoredSession(req)
 		p.SaveSession(rw, req, session)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
@@ -589,20 +1195,84 @@ func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
 	http.Redirect(rw, req, "/", 302)
 }
 
+// Logout clears the session cookie and, when the provider supports it, sends
+// the user on to end their session at the identity provider.
+func (p *OAuthProxy) Logout(rw http.ResponseWriter, req *http.Request) {
+	session, _, err := p.LoadCookiedSession(req)
+	if err != nil {
+		session = nil
+	}
+	p.ClearSessionCookie(rw, req)
+
+	if lp, ok := p.provider.(providers.LogoutProvider); ok {
+		if logoutURL := lp.GetLogoutURL(session, p.PostLogoutRedirectURL); logoutURL != "" {
+			http.Redirect(rw, req, logoutURL, 302)
+			return
+		}
+	}
+	redirect := p.PostLogoutRedirectURL
+	if redirect == "" {
+		redirect = "/"
+	}
+	http.Redirect(rw, req, redirect, 302)
+}
+
+// stateSignature returns the HMAC of the nonce and the redirect carried in
+// the state parameter, keyed with the cookie secret.
+func (p *OAuthProxy) stateSignature(nonce, redirect string) []byte {
+	h := hmac.New(sha256.New, []byte(p.CookieSeed))
+	h.Write([]byte(nonce + ":" + redirect))
+	return h.Sum(nil)
+}
+
+// signState returns the state parameter for a login, "nonce:signature:redirect",
+// so that the callback can tell states it issued from forged ones.
+func (p *OAuthProxy) signState(nonce, redirect string) string {
+	sig := b64.RawURLEncoding.EncodeToString(p.stateSignature(nonce, redirect))
+	return fmt.Sprintf("%v:%v:%v", nonce, sig, redirect)
+}
+
+// verifyState checks the signature of a state parameter made by signState
+// and returns the nonce and redirect it carries.
+func (p *OAuthProxy) verifyState(state string) (nonce, redirect string, ok bool) {
+	s := strings.SplitN(state, ":", 3)
+	if len(s) != 3 {
+		return "", "", false
+	}
+	sig, err := b64.RawURLEncoding.DecodeString(s[1])
+	if err != nil || !hmac.Equal(sig, p.stateSignature(s[0], s[2])) {
+		return "", "", false
+	}
+	return s[0], s[2], true
+}
+
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 	nonce, err := cookie.Nonce()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	p.SetCSRFCookie(rw, req, nonce)
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	state := p.signState(nonce, redirect)
+	loginURL := p.provider.GetLoginURL(redirectURI, state)
+	if ap, ok := p.provider.(providers.AuthRequestProvider); ok {
+		authReq, err := ap.NewAuthRequest()
+		if err != nil {
+			p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
+			return
+		}
+		if authReq != nil {
+			p.SetAuthRequestCookie(rw, req, nonce, authReq.Encode())
+			loginURL = ap.GetAuthRequestLoginURL(redirectURI, state, authReq)
+		}
+	}
+	http.Redirect(rw, req, loginURL, 302)
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
@@ -611,58 +1281,88 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	// finish the oauth cycle
 	err := req.ParseForm()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	errorString := req.Form.Get("error")
 	if errorString != "" {
-		p.ErrorPage(rw, 403, "Permission Denied", errorString)
+		p.ErrorPage(rw, req, 403, "Permission Denied", errorString)
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
-	if err != nil {
-		log.Printf("%s error redeeming code %s", remoteAddr, err)
-		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
-		return
-	}
-
-	s := strings.SplitN(req.Form.Get("state"), ":", 2)
-	if len(s) != 2 {
-		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
+	nonce, redirect, ok := p.verifyState(req.Form.Get("state"))
+	if !ok {
+		log.Printf("%s invalid state signature, potential attack", remoteAddr)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid State")
 		return
 	}
-	nonce := s[0]
-	redirect := s[1]
-	c, err := req.Cookie(p.CSRFCookieName)
+	c, err := req.Cookie(p.loginCookieName(p.CSRFCookieName, nonce))
 	if err != nil {
-		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+		p.ErrorPage(rw, req, 403, "Permission Denied", err.Error())
 		return
 	}
-	p.ClearCSRFCookie(rw, req)
+	p.ClearCSRFCookie(rw, req, nonce)
 	if c.Value != nonce {
 		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
-		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		p.ErrorPage(rw, req, 403, "Permission Denied", "csrf failed")
+		return
+	}
+
+	authReq, err := p.loadAuthRequest(req, nonce)
+	if err != nil {
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
+	if authReq != nil {
+		p.ClearAuthRequestCookie(rw, req, nonce)
+	}
 
-	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
 
+	session, err := p.redeemCode(req.Host, req.Form.Get("code"), authReq)
+	if tokenErr, ok := err.(*providers.TokenError); ok && tokenErr.LoginRequired() {
+		// the code expired or was already used, e.g. by a reloaded callback
+		log.Printf("%s code rejected, restarting login %s", remoteAddr, err)
+		p.Metrics.authentications.WithLabelValues("error").Inc()
+		http.Redirect(rw, req, p.SignInPath+"?rd="+url.QueryEscape(redirect), 302)
+		return
+	}
+	if _, ok := err.(*providers.AccountError); ok {
+		p.Metrics.authentications.WithLabelValues("denied").Inc()
+		log.Printf("%s Permission Denied: %s", remoteAddr, err)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+		return
+	}
+	if err != nil {
+		log.Printf("%s error redeeming code %s", remoteAddr, err)
+		p.Metrics.authentications.WithLabelValues("error").Inc()
+		p.ErrorPage(rw, req, 502, "Bad Gateway", "The identity provider could not complete the login.")
+		return
+	}
+
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session) {
+	validEmail := p.Validator(session.Email)
+	if validEmail && p.provider.ValidateGroup(session) {
 		log.Printf("%s authentication complete %s", remoteAddr, session)
+		p.clearStoredSession(req)
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+			p.Metrics.authentications.WithLabelValues("error").Inc()
+			p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
 			return
 		}
+		p.Metrics.authentications.WithLabelValues("success").Inc()
 		http.Redirect(rw, req, redirect, 302)
 	} else {
+		if validEmail {
+			p.Metrics.groupDenials.Inc()
+		}
+		p.Metrics.authentications.WithLabelValues("denied").Inc()
 		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
-		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
 	}
 }
 
@@ -675,10 +1375,76 @@ func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request)
 	}
 }
 
+// UserInfo returns the configured fields of the user's session as JSON, so
+// that frontends can tell who is logged in.
+func (p *OAuthProxy) UserInfo(rw http.ResponseWriter, req *http.Request) {
+	session, status := p.authenticate(rw, req)
+	switch status {
+	case http.StatusAccepted:
+	case http.StatusInternalServerError:
+		http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		return
+	default:
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+
+	info := make(map[string]interface{}, len(p.UserInfoFields))
+	for _, field := range p.UserInfoFields {
+		switch field {
+		case "user":
+			info["user"] = session.User
+		case "email":
+			info["email"] = session.Email
+		case "groups":
+			groups := session.Groups
+			if groups == nil {
+				groups = []string{}
+			}
+			info["groups"] = groups
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(info)
+}
+
+// Token returns the access token of the current session as JSON, for
+// frontends calling APIs directly. Sessions whose tokens are about to expire
+// are refreshed first, as for any other authenticated request.
+func (p *OAuthProxy) Token(rw http.ResponseWriter, req *http.Request) {
+	session, status := p.authenticate(rw, req)
+	switch status {
+	case http.StatusAccepted:
+	case http.StatusInternalServerError:
+		http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		return
+	default:
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if session.AccessToken == "" {
+		http.Error(rw, "no access token in session", http.StatusNotFound)
+		return
+	}
+
+	token := map[string]interface{}{
+		"access_token": session.AccessToken,
+		"token_type":   "Bearer",
+	}
+	if !session.ExpiresOn.IsZero() {
+		token["expires_in"] = int64(session.ExpiresOn.Sub(time.Now()).Seconds())
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(rw).Encode(token)
+}
+
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 	status := p.Authenticate(rw, req)
 	if status == http.StatusInternalServerError {
-		p.ErrorPage(rw, http.StatusInternalServerError,
+		p.ErrorPage(rw, req, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
 	} else if status == http.StatusForbidden {
 		if p.SkipProviderButton {
@@ -687,24 +1453,52 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
 	} else {
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveUpstream(rw, req)
 	}
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	_, status := p.authenticate(rw, req)
+	return status
+}
+
+// authenticate is Authenticate, also returning the session of an
+// authenticated request.
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (*providers.SessionState, int) {
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := getRemoteAddr(req)
 
-	session, sessionAge, err := p.LoadCookiedSession(req)
+	// a bearer JWT is checked like a cookie session but never saved
+	session, err := p.GetJwtSession(req)
 	if err != nil {
 		log.Printf("%s %s", remoteAddr, err)
 	}
-	if session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
+	var sessionAge time.Duration
+	cookied, refreshingInBackground := false, false
+	if session == nil {
+		session, sessionAge, err = p.LoadCookiedSession(req)
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+		cookied = session != nil
+	}
+	if cookied && p.sessionIdle(session) {
+		log.Printf("%s removing session. idle since %s %s", remoteAddr, session.LastSeen, session)
+		session = nil
+		cookied = false
+		clearSession = true
+	}
+	refreshCookie := session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0)
+	if refreshCookie {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
+	} else if cookied && p.backgroundRefresh != nil {
+		refreshingInBackground = p.refreshInBackground(p.storedSessionKey(req), session)
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
+	if refreshingInBackground {
+		// the request goes on with the current tokens, which are still valid
+	} else if ok, err := p.refreshSession(session, refreshCookie); err != nil {
 		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
 		clearSession = true
 		session = nil
@@ -749,7 +1543,12 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			return nil, http.StatusInternalServerError
+		}
+	} else if cookied && session != nil && p.SessionIdleTimeout != 0 {
+		if err := p.touchSession(rw, req, session, sessionAge); err != nil {
+			// the session may time out early, but it is still valid
+			log.Printf("%s error updating last seen time %s", remoteAddr, err)
 		}
 	}
 
@@ -765,7 +1564,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		return nil, http.StatusForbidden
 	}
 
 	// At this point, the user is authenticated. proxy normally
@@ -782,17 +1581,53 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
 	}
+	if p.SetGroupsHeader {
+		// never pass on a groups header sent by the client
+		req.Header.Del("X-Forwarded-Groups")
+		if len(session.Groups) > 0 {
+			req.Header["X-Forwarded-Groups"] = []string{strings.Join(session.Groups, ",")}
+		}
+	}
+	if len(p.claimHeaders) > 0 {
+		p.setClaimHeaders(req, session)
+	}
 	if p.SetXAuthRequest {
 		rw.Header().Set("X-Auth-Request-User", session.User)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
+		if len(session.Groups) > 0 {
+			rw.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		}
 	}
 	if p.PassAccessToken && session.AccessToken != "" {
 		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
 	}
-	if p.PassAuthorization && session.IdToken != "" {
-		req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", session.IdToken)}
+	if p.forwardJWT != nil {
+		// never pass on a token sent by the client
+		req.Header.Del(p.forwardJWT.header)
+		token, err := p.forwardJWT.mint(session, time.Now())
+		if err != nil {
+			log.Printf("%s could not sign the forwarded JWT: %s", remoteAddr, err)
+			return nil, http.StatusInternalServerError
+		}
+		req.Header.Set(p.forwardJWT.header, token)
+	}
+	if p.PassIdToken {
+		// never pass on an id_token header sent by the client
+		req.Header.Del(p.IdTokenHeader)
+		if session.IdToken != "" {
+			req.Header.Set(p.IdTokenHeader, session.IdToken)
+		}
+	}
+	if p.PassAuthorization {
+		if session.AccessToken != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", session.AccessToken))
+		} else if !p.PassBasicAuth {
+			// never pass on the credentials the client authenticated to
+			// the proxy with
+			req.Header.Del("Authorization")
+		}
 	}
 	if p.SetAuthorization && session.IdToken != "" {
 		rw.Header().Set("Authorization", fmt.Sprintf("Bearer %s", session.IdToken))
@@ -802,7 +1637,61 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	return session, http.StatusAccepted
+}
+
+// refreshSession refreshes the session's tokens when the provider considers
+// them due, and also when the session cookie is due for a refresh if the
+// provider can refresh sessions early, so the session lives as long as the
+// cookie rather than the tokens. Concurrent refreshes of the same session
+// share one token exchange.
+func (p *OAuthProxy) refreshSession(session *providers.SessionState, refreshCookie bool) (bool, error) {
+	if session == nil || session.RefreshToken == "" {
+		return p.redeemRefreshToken(session, refreshCookie)
+	}
+	return p.refreshes.do(session, func(s *providers.SessionState) (bool, error) {
+		return p.redeemRefreshToken(s, refreshCookie)
+	})
+}
+
+// redeemRefreshToken is refreshSession without the sharing of token
+// exchanges.
+func (p *OAuthProxy) redeemRefreshToken(session *providers.SessionState, refreshCookie bool) (refreshed bool, err error) {
+	defer func() {
+		if err != nil {
+			p.Metrics.tokenRefreshes.WithLabelValues("failure").Inc()
+		} else if refreshed {
+			p.Metrics.tokenRefreshes.WithLabelValues("success").Inc()
+		}
+	}()
+	if r, ok := p.provider.(providers.SessionRefresher); ok && refreshCookie {
+		if refreshed, err = r.RefreshSession(session); refreshed || err != nil {
+			return
+		}
+	}
+	return p.provider.RefreshSessionIfNeeded(session)
+}
+
+// setClaimHeaders passes the claims configured with -set-claim-header from the
+// session's ID token to the upstream. Claim headers sent by the client are
+// always removed.
+func (p *OAuthProxy) setClaimHeaders(req *http.Request, session *providers.SessionState) {
+	for _, ch := range p.claimHeaders {
+		req.Header.Del(ch.header)
+	}
+	if session.IdToken == "" {
+		return
+	}
+	claims, err := providers.IdTokenClaims(session.IdToken)
+	if err != nil {
+		log.Printf("%s %s", getRemoteAddr(req), err)
+		return
+	}
+	for _, ch := range p.claimHeaders {
+		if value, ok := providers.ClaimHeaderValue(claims, ch.claim); ok {
+			req.Header.Set(ch.header, value)
+		}
+	}
 }
 
 func (p *OAuthProxy) CheckAuthHeader(req *http.Request) (*providers.SessionState, error) {
@@ -812,7 +1701,9 @@ func (p *OAuthProxy) CheckAuthHeader(req *http.Request) (*providers.SessionState
 	}
 	s := strings.SplitN(auth, " ", 2)
 	if len(s) != 2 {
-		return nil, fmt.Errorf("invalid Authorization header %s", req.Header.Get("Authorization"))
+		// the header is left out of errors, which are logged, as it may
+		// hold a credential
+		return nil, errors.New("invalid Authorization header")
 	}
 
 	switch s[0] {
@@ -824,24 +1715,26 @@ func (p *OAuthProxy) CheckAuthHeader(req *http.Request) (*providers.SessionState
 	case "Bearer":
 		return p.CheckBearerAuth(s[1])
 	default:
-		return nil, fmt.Errorf("invalid Authorization header, unsupport type %s", s[1])
+		return nil, errors.New("invalid Authorization header, unsupported type")
 	}
 }
 
 func (p *OAuthProxy) CheckBasicAuth(value string) (*providers.SessionState, error) {
 	b, err := b64.StdEncoding.DecodeString(value)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("invalid basic auth encoding")
 	}
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return nil, fmt.Errorf("invalid format %s", b)
+		return nil, errors.New("invalid basic auth format")
 	}
 	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
 		log.Printf("authenticated %q via basic auth", pair[0])
-		return &providers.SessionState{User: pair[0]}, nil
+		// htpasswd users are service accounts without an email address,
+		// so the user name stands in for it upstream
+		return &providers.SessionState{User: pair[0], Email: pair[0]}, nil
 	}
-	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
+	return nil, fmt.Errorf("%q not in HtpasswdFile", pair[0])
 }
 
 func (p *OAuthProxy) CheckBearerAuth(value string) (*providers.SessionState, error) {
@@ -860,6 +1753,33 @@ func (p *OAuthProxy) CheckBearerAuth(value string) (*providers.SessionState, err
 	}, nil
 }
 
+// GetJwtSession builds a session from a JWT sent in an Authorization: Bearer
+// header when SkipJwtBearerTokens is set. It returns nil without an error when
+// there is no bearer token to check.
+func (p *OAuthProxy) GetJwtSession(req *http.Request) (*providers.SessionState, error) {
+	if !p.SkipJwtBearerTokens {
+		return nil, nil
+	}
+	bp, ok := p.provider.(providers.BearerTokenProvider)
+	if !ok {
+		return nil, nil
+	}
+	s := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 || s[0] != "Bearer" || strings.Count(s[1], ".") != 2 {
+		// opaque tokens are left to -allow-bearer
+		return nil, nil
+	}
+
+	session, err := bp.SessionFromBearerToken(s[1])
+	if err != nil {
+		return nil, err
+	}
+	if !p.provider.ValidateGroup(session) {
+		return nil, fmt.Errorf("bearer token of %s is not in an allowed group", session)
+	}
+	return session, nil
+}
+
 func (p *OAuthProxy) CheckURLParam(req *http.Request) (*providers.SessionState, error) {
 	if req.Method != http.MethodGet {
 		return nil, nil
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,14 +19,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/mbland/hmacauth"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func init() {
@@ -39,7 +53,7 @@ func TestNewReverseProxy(t *testing.T) {
 	proxyURL, _ := url.Parse(backendURL.Scheme + "://" + backendHost + "/")
 
 	proxyHandler := NewWebsocketReverseProxy(proxyURL)
-	setProxyUpstreamHostHeader(proxyHandler, proxyURL)
+	setProxyUpstreamHostHeader(proxyHandler, proxyURL.Host)
 	frontend := httptest.NewServer(proxyHandler)
 	defer frontend.Close()
 
@@ -51,6 +65,121 @@ func TestNewReverseProxy(t *testing.T) {
 	}
 }
 
+func TestUpstreamHostHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		name           string
+		passHostHeader bool
+		upstreamHost   string
+		expected       string
+	}{
+		{"pass host header", true, "", "app.example.com"},
+		{"upstream's host", false, "", backendURL.Host},
+		{"configured host", true, "bucket.s3-website.example.com", "bucket.s3-website.example.com"},
+		{"configured host without pass host header", false, "vhost.internal:8080", "vhost.internal:8080"},
+	}
+	for _, test := range tests {
+		opts := NewOptions()
+		opts.Upstreams = []string{backend.URL}
+		opts.ClientID = "bazquux"
+		opts.ClientSecret = "foobar"
+		opts.CookieSecret = "xyzzyplugh"
+		opts.EmailDomains = []string{"*"}
+		opts.PassHostHeader = test.passHostHeader
+		opts.UpstreamHost = test.upstreamHost
+		assert.Equal(t, nil, opts.Validate(), test.name)
+		proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://app.example.com/foo", nil)
+		req.RequestURI = "/foo"
+		proxy.serveMux.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code, test.name)
+		assert.Equal(t, test.expected, rw.Body.String(), test.name)
+	}
+}
+
+func newFileUpstreamTest(t *testing.T) (proxy *OAuthProxy, root string) {
+	root, err := ioutil.TempDir("", "file-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	www := filepath.Join(root, "www")
+	for name, content := range map[string]string{
+		filepath.Join(www, "index.html"):  "<h1>index</h1>",
+		filepath.Join(www, "style.css"):   "h1 {}",
+		filepath.Join(root, "secret.txt"): "top secret",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := NewOptions()
+	opts.Upstreams = []string{"file://" + www + "/#/static/"}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewOAuthProxy(opts, func(string) bool { return true }), root
+}
+
+func TestFileUpstream(t *testing.T) {
+	proxy, root := newFileUpstreamTest(t)
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		path        string
+		code        int
+		contentType string
+		body        string
+	}{
+		{"/static/", 200, "text/html; charset=utf-8", "<h1>index</h1>"},
+		{"/static/style.css", 200, "text/css; charset=utf-8", "h1 {}"},
+		{"/static/missing.txt", 404, "", ""},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", test.path, nil)
+		proxy.serveMux.ServeHTTP(rw, req)
+		assert.Equal(t, test.code, rw.Code, test.path)
+		if test.code == 200 {
+			assert.Equal(t, test.contentType, rw.Header().Get("Content-Type"), test.path)
+			assert.Equal(t, test.body, rw.Body.String(), test.path)
+		}
+	}
+}
+
+func TestFileUpstreamPathTraversal(t *testing.T) {
+	proxy, root := newFileUpstreamTest(t)
+	defer os.RemoveAll(root)
+
+	for _, path := range []string{"/static/../secret.txt", "/static/%2e%2e/secret.txt"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		proxy.serveMux.ServeHTTP(rw, req)
+		assert.NotEqual(t, 200, rw.Code, path)
+		assert.NotContains(t, rw.Body.String(), "top secret", path)
+
+		// also when the path reaches the file server uncleaned
+		rw = httptest.NewRecorder()
+		NewFileServer("/static/", filepath.Join(root, "www")).ServeHTTP(rw, req)
+		assert.NotEqual(t, 200, rw.Code, path)
+		assert.NotContains(t, rw.Body.String(), "top secret", path)
+	}
+}
+
 func TestEncodedSlashes(t *testing.T) {
 	var seen string
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -92,6 +221,40 @@ func TestRobotsTxt(t *testing.T) {
 	assert.Equal(t, "User-agent: *\nDisallow: /", rw.Body.String())
 }
 
+func TestPing(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.PingPath = "/healthz"
+	opts.Validate()
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	// any use of the provider panics
+	proxy.provider = nil
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	req.AddCookie(&http.Cookie{Name: opts.CookieName, Value: "garbage"})
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+	assert.Equal(t, "", rw.Header().Get("Location"))
+	assert.Equal(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/healthz", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/healthz", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	assert.Equal(t, "GET, HEAD", rw.Header().Get("Allow"))
+}
+
 type TestProvider struct {
 	*providers.ProviderData
 	EmailAddress string
@@ -171,8 +334,8 @@ func TestBasicAuthPassword(t *testing.T) {
 	})
 
 	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
-		strings.NewReader(""))
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+		url.QueryEscape(proxy.signState("nonce", "")), strings.NewReader(""))
 	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
 	proxy.ServeHTTP(rw, req)
 	if rw.Code >= 400 {
@@ -270,8 +433,8 @@ func (pat_test *PassAccessTokenTest) Close() {
 func (pat_test *PassAccessTokenTest) getCallbackEndpoint() (http_code int,
 	cookie string) {
 	rw := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
-		strings.NewReader(""))
+	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+		url.QueryEscape(pat_test.proxy.signState("nonce", "")), strings.NewReader(""))
 	if err != nil {
 		return 0, ""
 	}
@@ -428,6 +591,27 @@ func TestSignInPageDirectAccessRedirectsToRoot(t *testing.T) {
 	}
 }
 
+func TestSignInPageBanner(t *testing.T) {
+	sip_test := NewSignInPageTest(false)
+	sip_test.proxy.Banner = "Staff only"
+	_, body := sip_test.GetEndpoint("/oauth2/sign_in")
+	assert.Contains(t, body, `<div class="banner center">Staff only</div>`)
+
+	sip_test.proxy.Banner = ""
+	_, body = sip_test.GetEndpoint("/oauth2/sign_in")
+	assert.NotContains(t, body, `class="banner`)
+}
+
+func TestSignInPageEscapesBannerAndFooter(t *testing.T) {
+	sip_test := NewSignInPageTest(false)
+	sip_test.proxy.Banner = `<script>alert("banner")</script>`
+	sip_test.proxy.Footer = `<script>alert("footer")</script>`
+	_, body := sip_test.GetEndpoint("/oauth2/sign_in")
+	assert.NotContains(t, body, `<script>alert(`)
+	assert.Contains(t, body, `&lt;script&gt;alert(&#34;banner&#34;)&lt;/script&gt;`)
+	assert.Contains(t, body, `&lt;script&gt;alert(&#34;footer&#34;)&lt;/script&gt;`)
+}
+
 func TestSignInPageSkipProvider(t *testing.T) {
 	sip_test := NewSignInPageTest(true)
 	const endpoint = "/some/random/endpoint"
@@ -456,6 +640,435 @@ func TestSignInPageSkipProviderDirect(t *testing.T) {
 	}
 }
 
+// With -skip-provider-button both protected pages and the sign-in page send
+// the user straight to the provider, keeping the page to return to in the
+// state.
+func TestSignInPageSkipProviderRedirectsToProvider(t *testing.T) {
+	sip_test := NewSignInPageTest(true)
+	loginURL := sip_test.opts.provider.Data().LoginURL
+
+	for endpoint, expected := range map[string]string{
+		"/reports/42?tab=summary":          "/reports/42?tab=summary",
+		"/oauth2/sign_in?rd=%2Freports%2F": "/reports/",
+		"/oauth2/sign_in":                  "/",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", endpoint, nil)
+		sip_test.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code, endpoint)
+
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		assert.Equal(t, loginURL.Host, location.Host, endpoint)
+		assert.Equal(t, loginURL.Path, location.Path, endpoint)
+		_, redirect, ok := sip_test.proxy.verifyState(location.Query().Get("state"))
+		assert.Equal(t, true, ok, endpoint)
+		assert.Equal(t, expected, redirect, endpoint)
+	}
+}
+
+func TestSignInPageWithoutSkipProviderRendersButton(t *testing.T) {
+	sip_test := NewSignInPageTest(false)
+	for endpoint, code := range map[string]int{"/reports/42": 403, "/oauth2/sign_in": 200} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", endpoint, nil)
+		sip_test.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code, endpoint)
+		assert.Equal(t, "", rw.HeaderMap.Get("Location"), endpoint)
+		assert.Contains(t, rw.Body.String(), `<form method="GET" action="/oauth2/start">`, endpoint)
+	}
+}
+
+type AuthRequestTestProvider struct {
+	*TestProvider
+	RedeemedWith *providers.AuthRequest
+}
+
+func (tp *AuthRequestTestProvider) NewAuthRequest() (*providers.AuthRequest, error) {
+	return &providers.AuthRequest{CodeVerifier: "verifier"}, nil
+}
+
+func (tp *AuthRequestTestProvider) GetAuthRequestLoginURL(redirectURI, state string, r *providers.AuthRequest) string {
+	return tp.GetLoginURL(redirectURI, state) + "&code_challenge=" + providers.CodeChallengeS256(r.CodeVerifier)
+}
+
+func (tp *AuthRequestTestProvider) RedeemAuthRequest(redirectURL, code string, r *providers.AuthRequest) (*providers.SessionState, error) {
+	tp.RedeemedWith = r
+	return &providers.SessionState{Email: tp.EmailAddress, AccessToken: "my_access_token"}, nil
+}
+
+func TestOAuthStartAndCallbackCarryAuthRequest(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	provider := &AuthRequestTestProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "john.doe@example.com"),
+	}
+	proxy.provider = provider
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2Ffoo", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Contains(t, rw.HeaderMap.Get("Location"),
+		"code_challenge="+providers.CodeChallengeS256("verifier"))
+
+	resp := http.Response{Header: rw.HeaderMap}
+	var csrf, authReq *http.Cookie
+	for _, c := range resp.Cookies() {
+		switch c.Name {
+		case proxy.CSRFCookieName:
+			csrf = c
+		case proxy.AuthRequestCookieName:
+			authReq = c
+		}
+	}
+	assert.NotEqual(t, (*http.Cookie)(nil), csrf)
+	assert.NotEqual(t, (*http.Cookie)(nil), authReq)
+
+	location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=code1234&state="+
+		url.QueryEscape(location.Query().Get("state")), nil)
+	req.AddCookie(csrf)
+	req.AddCookie(authReq)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/foo", rw.HeaderMap.Get("Location"))
+	assert.Equal(t, &providers.AuthRequest{CodeVerifier: "verifier"}, provider.RedeemedWith)
+	assert.Contains(t, strings.Join(rw.HeaderMap["Set-Cookie"], "\n"), proxy.AuthRequestCookieName+"=;")
+}
+
+// SequentialAuthRequestTestProvider gives every login a code verifier of its
+// own and remembers the ones it redeemed codes with.
+type SequentialAuthRequestTestProvider struct {
+	*AuthRequestTestProvider
+	started  int
+	redeemed []string
+}
+
+func (tp *SequentialAuthRequestTestProvider) NewAuthRequest() (*providers.AuthRequest, error) {
+	tp.started++
+	return &providers.AuthRequest{CodeVerifier: fmt.Sprintf("verifier-%d", tp.started)}, nil
+}
+
+func (tp *SequentialAuthRequestTestProvider) RedeemAuthRequest(redirectURL, code string, r *providers.AuthRequest) (*providers.SessionState, error) {
+	tp.redeemed = append(tp.redeemed, r.CodeVerifier)
+	return tp.AuthRequestTestProvider.RedeemAuthRequest(redirectURL, code, r)
+}
+
+// cookieJar keeps the cookies a browser would, by name.
+type cookieJar map[string]*http.Cookie
+
+func (j cookieJar) update(rw *httptest.ResponseRecorder) {
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if c.Value == "" {
+			delete(j, c.Name)
+		} else {
+			j[c.Name] = c
+		}
+	}
+}
+
+func (j cookieJar) get(path string) *http.Request {
+	req, _ := http.NewRequest("GET", path, nil)
+	for _, c := range j {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+// overlappingLogins starts a login to /a and one to /b in the same browser
+// before finishing them in turn, and returns the responses of the callbacks.
+func overlappingLogins(t *testing.T, perRequest bool) (*SequentialAuthRequestTestProvider, cookieJar, []*httptest.ResponseRecorder) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.CookieCSRFPerRequest = perRequest
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	provider := &SequentialAuthRequestTestProvider{AuthRequestTestProvider: &AuthRequestTestProvider{
+		TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "john.doe@example.com"),
+	}}
+	proxy.provider = provider
+
+	jar := cookieJar{}
+	var states []string
+	for _, rd := range []string{"%2Fa", "%2Fb"} {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, jar.get("/oauth2/start?rd="+rd))
+		assert.Equal(t, 302, rw.Code)
+		jar.update(rw)
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		states = append(states, location.Query().Get("state"))
+	}
+
+	var callbacks []*httptest.ResponseRecorder
+	for _, state := range states {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, jar.get("/oauth2/callback?code=code1234&state="+url.QueryEscape(state)))
+		jar.update(rw)
+		callbacks = append(callbacks, rw)
+	}
+	return provider, jar, callbacks
+}
+
+func TestOverlappingLoginsWithPerRequestCSRFCookies(t *testing.T) {
+	provider, jar, callbacks := overlappingLogins(t, true)
+
+	assert.Equal(t, 302, callbacks[0].Code)
+	assert.Equal(t, "/a", callbacks[0].HeaderMap.Get("Location"))
+	assert.Equal(t, 302, callbacks[1].Code)
+	assert.Equal(t, "/b", callbacks[1].HeaderMap.Get("Location"))
+	assert.Equal(t, []string{"verifier-1", "verifier-2"}, provider.redeemed)
+
+	// the login cookies are gone once the logins completed
+	for name := range jar {
+		assert.Equal(t, "_oauth2_proxy", name)
+	}
+}
+
+func TestOverlappingLoginsWithSharedCSRFCookie(t *testing.T) {
+	_, _, callbacks := overlappingLogins(t, false)
+
+	// the second login overwrote the CSRF cookie of the first one
+	assert.Equal(t, 403, callbacks[0].Code)
+	assert.Contains(t, callbacks[0].Body.String(), "csrf failed")
+}
+
+func TestPerRequestCSRFCookieNames(t *testing.T) {
+	opts := testOptions()
+	opts.CookieCSRFPerRequest = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	c := proxy.MakeCSRFCookie(req, "nonce1", time.Hour, time.Now())
+	assert.Equal(t, true, strings.HasPrefix(c.Name, "_oauth2_proxy_csrf_"))
+	assert.NotEqual(t, c.Name, proxy.MakeCSRFCookie(req, "nonce2", time.Hour, time.Now()).Name)
+	assert.Equal(t, c.Name, proxy.MakeCSRFCookie(req, "nonce1", time.Hour, time.Now()).Name)
+	assert.Equal(t, false, strings.Contains(c.Name, "nonce1"))
+	assert.Equal(t, true, strings.HasPrefix(proxy.MakeAuthRequestCookie(req, "nonce1", "authreq", time.Hour, time.Now()).Name, "_oauth2_proxy_authreq_"))
+
+	// cookies of abandoned logins don't stay around for -cookie-expire
+	rw := httptest.NewRecorder()
+	now := time.Now()
+	proxy.SetCSRFCookie(rw, req, "nonce1")
+	cookies := (&http.Response{Header: rw.HeaderMap}).Cookies()
+	assert.Equal(t, true, cookies[0].Expires.Before(now.Add(16*time.Minute)))
+}
+
+func TestOAuthStartSignsState(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2Ffoo", nil)
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	nonce, redirect, ok := pat_test.proxy.verifyState(location.Query().Get("state"))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "/foo", redirect)
+	resp := http.Response{Header: rw.HeaderMap}
+	for _, c := range resp.Cookies() {
+		if c.Name == pat_test.proxy.CSRFCookieName {
+			assert.Equal(t, nonce, c.Value)
+		}
+	}
+}
+
+func TestOAuthCallbackState(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	proxy := pat_test.proxy
+
+	valid := proxy.signState("nonce", "/foo")
+	parts := strings.SplitN(valid, ":", 3)
+	otherSig := strings.SplitN(proxy.signState("other", "/foo"), ":", 3)[1]
+
+	for _, tc := range []struct {
+		name  string
+		state string
+		code  int
+	}{
+		{"valid state", valid, 302},
+		{"tampered nonce", "other:" + parts[1] + ":/foo", 403},
+		{"tampered redirect", "nonce:" + parts[1] + ":https://evil.example.com/", 403},
+		{"wrong signature", "nonce:" + otherSig + ":/foo", 403},
+		{"malformed signature", "nonce:%%%:/foo", 403},
+		{"unsigned state", "nonce:/foo", 403},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+			url.QueryEscape(tc.state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.name)
+		if tc.code == 302 {
+			assert.Equal(t, "/foo", rw.HeaderMap.Get("Location"), tc.name)
+		} else {
+			assert.Contains(t, rw.Body.String(), "Invalid State", tc.name)
+		}
+	}
+}
+
+func TestDeepLinkRedirectRoundTrip(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	proxy := pat_test.proxy
+	proxy.SkipProviderButton = true
+
+	const deepLink = "/app/reports/42?tab=summary&sort=desc"
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", deepLink, nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	state := location.Query().Get("state")
+	nonce, redirect, ok := proxy.verifyState(state)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, deepLink, redirect)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+		url.QueryEscape(state), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, nonce, time.Hour, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, deepLink, rw.HeaderMap.Get("Location"))
+}
+
+func TestExternalRedirectRejected(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	proxy := pat_test.proxy
+
+	for _, rd := range []string{
+		"https://evil.example.com/",
+		"//evil.example.com/",
+		"/\\evil.example.com/",
+		"/\t/evil.example.com/",
+		"/\n/evil.example.com/",
+		"/\r\n/evil.example.com/",
+		"/ /evil.example.com/",
+		"evil.example.com",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/start?rd="+url.QueryEscape(rd), nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code, rd)
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		_, redirect, ok := proxy.verifyState(location.Query().Get("state"))
+		assert.Equal(t, true, ok, rd)
+		assert.Equal(t, "/", redirect, rd)
+
+		// a signed state is checked again before redirecting
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+			url.QueryEscape(proxy.signState("nonce", rd)), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code, rd)
+		assert.Equal(t, "/", rw.HeaderMap.Get("Location"), rd)
+	}
+}
+
+func TestEncodedControlCharacterRedirectRejected(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	proxy := pat_test.proxy
+
+	for _, rd := range []string{"/%09/evil.example.com/", "/%0a/evil.example.com/", "/%0d%0a/evil.example.com/"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/start?rd="+rd, nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code, rd)
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		_, redirect, ok := proxy.verifyState(location.Query().Get("state"))
+		assert.Equal(t, true, ok, rd)
+		assert.Equal(t, "/", redirect, rd)
+	}
+}
+
+func TestIsValidRedirectWhitelistDomains(t *testing.T) {
+	proxy := &OAuthProxy{WhitelistDomains: []string{".example.com", "other.io", "ports.example.org:8443", ".any.example.net:*"}}
+
+	tests := []struct {
+		redirect string
+		valid    bool
+	}{
+		{"/app", true},
+		{"https://example.com/app", true},
+		{"https://app.example.com/app", true},
+		{"http://deep.app.example.com/", true},
+		{"//app.example.com/app", true},
+		{"https://APP.Example.com/", true},
+		{"https://other.io/", true},
+		{"https://sub.other.io/", false},
+		{"https://evil.com/", false},
+		{"https://example.com.evil.com/", false},
+		{"https://evilexample.com/", false},
+		{"https://app.example.com:8443/", false},
+		{"https://ports.example.org:8443/", true},
+		{"https://ports.example.org/", false},
+		{"https://ports.example.org:9443/", false},
+		{"https://app.any.example.net:1234/", true},
+		{"https://app.any.example.net/", true},
+		{"javascript://app.example.com/%0aalert(1)", false},
+		{"https://user@app.example.com/", false},
+		{"/\\app.example.com/", false},
+		{"/\t/app.example.com/", false},
+		{"/\n/app.example.com/", false},
+		{"https://app.example.com/\t", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.valid, proxy.IsValidRedirect(test.redirect), test.redirect)
+	}
+
+	proxy.WhitelistDomains = nil
+	assert.Equal(t, false, proxy.IsValidRedirect("https://app.example.com/"))
+}
+
+func TestWhitelistDomainRedirect(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	proxy := pat_test.proxy
+	proxy.WhitelistDomains = []string{".example.com"}
+
+	for _, test := range []struct {
+		rd       string
+		expected string
+	}{
+		{"https://app.example.com/reports", "https://app.example.com/reports"},
+		{"https://evil.com/", "/"},
+		{"https://app.example.com:8443/", "/"},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/start?rd="+url.QueryEscape(test.rd), nil)
+		proxy.ServeHTTP(rw, req)
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		state := location.Query().Get("state")
+		nonce, redirect, ok := proxy.verifyState(state)
+		assert.Equal(t, true, ok, test.rd)
+		assert.Equal(t, test.expected, redirect, test.rd)
+
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+			url.QueryEscape(state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, nonce, time.Hour, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code, test.rd)
+		assert.Equal(t, test.expected, rw.HeaderMap.Get("Location"), test.rd)
+	}
+}
+
 type ProcessCookieTest struct {
 	opts          *Options
 	proxy         *OAuthProxy
@@ -536,150 +1149,1452 @@ func TestLoadCookiedSession(t *testing.T) {
 	assert.Equal(t, startSession.AccessToken, session.AccessToken)
 }
 
-func TestProcessCookieNoCookieError(t *testing.T) {
+func TestSplitSessionCookieRoundTrip(t *testing.T) {
 	pc_test := NewProcessCookieTestWithDefaults()
 
-	session, _, err := pc_test.LoadCookiedSession()
-	assert.Equal(t, "Cookie \"_oauth2_proxy\" not present", err.Error())
-	if session != nil {
-		t.Errorf("expected nil session. got %#v", session)
+	startSession := &providers.SessionState{
+		Email:       "michael.bland@gsa.gov",
+		AccessToken: "my_access_token",
+		IdToken:     strings.Repeat("i", 12*1024),
+	}
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, startSession))
+
+	cookies := rw.Result().Cookies()
+	assert.True(t, len(cookies) > 3)
+	req, _ := http.NewRequest("GET", "/", nil)
+	for i, c := range cookies {
+		assert.Equal(t, fmt.Sprintf("%s-%d", pc_test.opts.CookieName, i), c.Name)
+		assert.True(t, len(c.Value) <= 3840)
+		req.AddCookie(c)
 	}
+
+	session, _, err := pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+	assert.Equal(t, startSession.IdToken, session.IdToken)
 }
 
-func TestProcessCookieRefreshNotSet(t *testing.T) {
+func TestSaveSessionExpiresStaleChunks(t *testing.T) {
 	pc_test := NewProcessCookieTestWithDefaults()
-	pc_test.proxy.CookieExpire = time.Duration(23) * time.Hour
-	reference := time.Now().Add(time.Duration(-2) * time.Hour)
+	for i := 0; i < 4; i++ {
+		pc_test.req.AddCookie(&http.Cookie{
+			Name: fmt.Sprintf("%s-%d", pc_test.opts.CookieName, i), Value: "chunk"})
+	}
+	pc_test.req.AddCookie(&http.Cookie{Name: pc_test.opts.CookieName + "-other", Value: "unrelated"})
 
 	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
-	pc_test.SaveSession(startSession, reference)
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, startSession))
+
+	expired := map[string]bool{}
+	for _, c := range pc_test.rw.Result().Cookies() {
+		if c.Name == pc_test.opts.CookieName {
+			assert.NotEqual(t, "", c.Value)
+			assert.True(t, c.Expires.After(time.Now()))
+			continue
+		}
+		assert.Equal(t, "", c.Value)
+		assert.True(t, c.Expires.Before(time.Now()))
+		expired[c.Name] = true
+	}
+	assert.Equal(t, map[string]bool{
+		pc_test.opts.CookieName + "-0": true,
+		pc_test.opts.CookieName + "-1": true,
+		pc_test.opts.CookieName + "-2": true,
+		pc_test.opts.CookieName + "-3": true,
+	}, expired)
+}
 
-	session, age, err := pc_test.LoadCookiedSession()
-	assert.Equal(t, nil, err)
-	if age < time.Duration(-2)*time.Hour {
-		t.Errorf("cookie too young %v", age)
+func TestClearSessionCookieExpiresChunks(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	for i := 0; i < 2; i++ {
+		pc_test.req.AddCookie(&http.Cookie{
+			Name: fmt.Sprintf("%s-%d", pc_test.opts.CookieName, i), Value: "chunk"})
 	}
-	assert.Equal(t, startSession.Email, session.Email)
+
+	pc_test.proxy.ClearSessionCookie(pc_test.rw, pc_test.req)
+
+	cleared := map[string]bool{}
+	for _, c := range pc_test.rw.Result().Cookies() {
+		assert.Equal(t, "", c.Value)
+		assert.True(t, c.Expires.Before(time.Now()))
+		cleared[c.Name] = true
+	}
+	assert.True(t, cleared[pc_test.opts.CookieName])
+	assert.True(t, cleared[pc_test.opts.CookieName+"-0"])
+	assert.True(t, cleared[pc_test.opts.CookieName+"-1"])
 }
 
-func TestProcessCookieFailIfCookieExpired(t *testing.T) {
+func TestCookieSameSite(t *testing.T) {
+	tests := []struct {
+		mode      string
+		attribute string
+		csrf      string
+	}{
+		{"lax", "SameSite=Lax", "SameSite=Lax"},
+		{"strict", "SameSite=Strict", "SameSite=Lax"},
+		{"none", "SameSite=None", "SameSite=None"},
+	}
+
+	for _, tt := range tests {
+		opts := NewOptions()
+		opts.ClientID = "bazquux"
+		opts.ClientSecret = "xyzzyplugh"
+		opts.CookieSecret = "0123456789abcdefabcd"
+		opts.EmailDomains = []string{"*"}
+		opts.CookieSameSite = tt.mode
+		assert.Equal(t, nil, opts.Validate(), tt.mode)
+		proxy := NewOAuthProxy(opts, func(string) bool { return true })
+		req, _ := http.NewRequest("GET", "/", nil)
+
+		c := proxy.MakeSessionCookie(req, "value", time.Hour, time.Now())[0]
+		assert.Contains(t, c.String(), tt.attribute, tt.mode)
+		assert.Contains(t, c.String(), "; Secure", tt.mode)
+
+		// the callback is reached by a cross-site redirect, which Strict
+		// cookies are not sent on
+		assert.Contains(t, proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()).String(), tt.csrf, tt.mode)
+		assert.Contains(t, proxy.MakeAuthRequestCookie(req, "nonce", "authreq", time.Hour, time.Now()).String(), tt.csrf, tt.mode)
+	}
+}
+
+func TestCookieEncrypt(t *testing.T) {
 	pc_test := NewProcessCookieTestWithDefaults()
-	pc_test.proxy.CookieExpire = time.Duration(24) * time.Hour
-	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	pc_test.proxy.CookieEncrypt = true
+
 	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
-	pc_test.SaveSession(startSession, reference)
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, startSession))
+	cookies := pc_test.rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.NotContains(t, cookies[0].Value, "michael.bland")
+
+	session, _, err := pc_test.proxy.LoadCookiedSession(requestWithCookies(pc_test.rw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+}
+
+func TestCookieEncryptRejectsTamperedSession(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieEncrypt = true
+
+	value, err := pc_test.proxy.provider.CookieForSession(
+		&providers.SessionState{Email: "michael.bland@gsa.gov"}, pc_test.proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	sealed, err := pc_test.proxy.CookieCipher.Seal(value)
+	assert.Equal(t, nil, err)
+	raw, err := base64.URLEncoding.DecodeString(sealed)
+	assert.Equal(t, nil, err)
+	raw[len(raw)-1] ^= 1
 
+	// a correctly signed cookie still has to decrypt
+	for _, c := range pc_test.MakeCookie(base64.URLEncoding.EncodeToString(raw), time.Now()) {
+		pc_test.req.AddCookie(c)
+	}
 	session, _, err := pc_test.LoadCookiedSession()
 	assert.NotEqual(t, nil, err)
-	if session != nil {
-		t.Errorf("expected nil session %#v", session)
-	}
+	assert.Equal(t, (*providers.SessionState)(nil), session)
 }
 
-func TestProcessCookieFailIfRefreshSetAndCookieExpired(t *testing.T) {
+func TestCookieEncryptRejectsPlainSession(t *testing.T) {
 	pc_test := NewProcessCookieTestWithDefaults()
-	pc_test.proxy.CookieExpire = time.Duration(24) * time.Hour
-	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
-	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
-	pc_test.SaveSession(startSession, reference)
+	pc_test.SaveSession(&providers.SessionState{Email: "michael.bland@gsa.gov"}, time.Now())
+	pc_test.proxy.CookieEncrypt = true
 
-	pc_test.proxy.CookieRefresh = time.Hour
 	session, _, err := pc_test.LoadCookiedSession()
 	assert.NotEqual(t, nil, err)
-	if session != nil {
-		t.Errorf("expected nil session %#v", session)
-	}
+	assert.Equal(t, (*providers.SessionState)(nil), session)
 }
 
-func NewAuthOnlyEndpointTest() *ProcessCookieTest {
-	pc_test := NewProcessCookieTestWithDefaults()
-	pc_test.req, _ = http.NewRequest("GET",
-		pc_test.opts.ProxyPrefix+"/auth", nil)
-	return pc_test
+func newTestLogoutProxy(endSessionURL string) *OAuthProxy {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.OIDCPostLogoutURL = "https://example.com/logged-out"
+	// the cipher is needed to keep the ID token in the session
+	opts.CookieRefresh = time.Hour
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	provider := providers.NewOIDCProvider(&providers.ProviderData{})
+	provider.EndSessionURL, _ = url.Parse(endSessionURL)
+	proxy.provider = provider
+	return proxy
 }
 
-func TestAuthOnlyEndpointAccepted(t *testing.T) {
-	test := NewAuthOnlyEndpointTest()
-	startSession := &providers.SessionState{
-		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
-	test.SaveSession(startSession, time.Now())
+func TestLogoutRedirectsToEndSessionEndpoint(t *testing.T) {
+	proxy := newTestLogoutProxy("https://idp.example.com/logout")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/logout", nil)
+	session := &providers.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", IdToken: "my_id_token"}
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+	req = requestWithCookies(rw)
+	req.URL.Path = "/oauth2/logout"
 
-	test.proxy.ServeHTTP(test.rw, test.req)
-	assert.Equal(t, http.StatusAccepted, test.rw.Code)
-	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
-	assert.Equal(t, "", string(bodyBytes))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	location, err := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "idp.example.com", location.Host)
+	assert.Equal(t, "/logout", location.Path)
+	assert.Equal(t, "my_id_token", location.Query().Get("id_token_hint"))
+	assert.Equal(t, "https://example.com/logged-out", location.Query().Get("post_logout_redirect_uri"))
+	assert.Contains(t, rw.HeaderMap.Get("Set-Cookie"), proxy.CookieName+"=;")
 }
 
-func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
-	test := NewAuthOnlyEndpointTest()
+func TestLogoutWithoutEndSessionEndpoint(t *testing.T) {
+	proxy := newTestLogoutProxy("")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/logout", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "https://example.com/logged-out", rw.HeaderMap.Get("Location"))
+}
 
-	test.proxy.ServeHTTP(test.rw, test.req)
+func newTestUserInfoRequest(t *testing.T, proxy *OAuthProxy, session *providers.SessionState) *http.Request {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/userinfo", nil)
+	if session != nil {
+		assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+		req = requestWithCookies(rw)
+		req.URL.Path = "/oauth2/userinfo"
+	}
+	return req
+}
+
+func TestUserInfo(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	req := newTestUserInfoRequest(t, pc_test.proxy, &providers.SessionState{
+		Email:       "john.doe@example.com",
+		User:        "john.doe",
+		AccessToken: "my_access_token",
+		Groups:      []string{"admins", "devs"},
+	})
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+	assert.JSONEq(t, `{"user": "john.doe", "email": "john.doe@example.com", "groups": ["admins", "devs"]}`,
+		rw.Body.String())
+}
+
+func TestUserInfoFields(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.UserInfoFields = []string{"email", "groups"}
+	req := newTestUserInfoRequest(t, pc_test.proxy, &providers.SessionState{
+		Email:       "john.doe@example.com",
+		User:        "john.doe",
+		AccessToken: "my_access_token",
+	})
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"email": "john.doe@example.com", "groups": []}`, rw.Body.String())
+}
+
+func TestUserInfoUnauthenticated(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	req := newTestUserInfoRequest(t, pc_test.proxy, nil)
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.NotEqual(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+}
+
+// ExpiringTestProvider refreshes sessions whose tokens have expired.
+type ExpiringTestProvider struct {
+	*TestProvider
+	refreshes int
+}
+
+func (tp *ExpiringTestProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	if s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	tp.refreshes++
+	s.AccessToken = "refreshed_access_token"
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func newTestTokenRequest(t *testing.T, proxy *OAuthProxy, session *providers.SessionState) *http.Request {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/token", nil)
+	if session != nil {
+		assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+		req = requestWithCookies(rw)
+		req.URL.Path = "/oauth2/token"
+	}
+	return req
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.ExposeTokenEndpoint = true
+	req := newTestTokenRequest(t, pc_test.proxy, &providers.SessionState{
+		Email:       "john.doe@example.com",
+		AccessToken: "my_access_token",
+		ExpiresOn:   time.Now().Add(time.Hour),
+	})
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, "no-store", rw.HeaderMap.Get("Cache-Control"))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &token))
+	assert.Equal(t, "my_access_token", token.AccessToken)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, true, token.ExpiresIn > 3500 && token.ExpiresIn <= 3600)
+}
+
+func TestTokenEndpointRefreshesExpiredSession(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.ExposeTokenEndpoint = true
+	provider := &ExpiringTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.provider = provider
+	req := newTestTokenRequest(t, pc_test.proxy, &providers.SessionState{
+		Email:        "john.doe@example.com",
+		AccessToken:  "my_access_token",
+		RefreshToken: "my_refresh_token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	})
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 1, provider.refreshes)
+	assert.Contains(t, rw.Body.String(), `"access_token":"refreshed_access_token"`)
+	// the refreshed session is saved as well
+	assert.Contains(t, rw.HeaderMap.Get("Set-Cookie"), pc_test.proxy.CookieName+"=")
+}
+
+func TestTokenEndpointUnauthenticated(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.ExposeTokenEndpoint = true
+	req := newTestTokenRequest(t, pc_test.proxy, nil)
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "access_token")
+}
+
+func TestTokenEndpointDisabled(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	req := newTestTokenRequest(t, pc_test.proxy, &providers.SessionState{
+		Email:       "john.doe@example.com",
+		AccessToken: "my_access_token",
+	})
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ServeHTTP(rw, req)
+	assert.NotContains(t, rw.Body.String(), "my_access_token")
+}
+
+func TestProcessCookieNoCookieError(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.Equal(t, "Cookie \"_oauth2_proxy\" not present", err.Error())
+	if session != nil {
+		t.Errorf("expected nil session. got %#v", session)
+	}
+}
+
+func TestProcessCookieRefreshNotSet(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieExpire = time.Duration(23) * time.Hour
+	reference := time.Now().Add(time.Duration(-2) * time.Hour)
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, reference)
+
+	session, age, err := pc_test.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	if age < time.Duration(-2)*time.Hour {
+		t.Errorf("cookie too young %v", age)
+	}
+	assert.Equal(t, startSession.Email, session.Email)
+}
+
+func TestProcessCookieFailIfCookieExpired(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieExpire = time.Duration(24) * time.Hour
+	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, reference)
+
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.NotEqual(t, nil, err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+func TestProcessCookieFailIfRefreshSetAndCookieExpired(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieExpire = time.Duration(24) * time.Hour
+	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, reference)
+
+	pc_test.proxy.CookieRefresh = time.Hour
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.NotEqual(t, nil, err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+// RefreshingTestProvider refreshes sessions with a refresh token whenever it
+// is asked to.
+type RefreshingTestProvider struct {
+	*TestProvider
+	refreshes int
+}
+
+func (tp *RefreshingTestProvider) RefreshSession(s *providers.SessionState) (bool, error) {
+	if s.RefreshToken == "" {
+		return false, nil
+	}
+	tp.refreshes++
+	s.AccessToken = "refreshed_access_token"
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func TestProcessCookieRefreshesSessionWhenCookieIsDue(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	provider := &RefreshingTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.provider = provider
+	pc_test.proxy.CookieExpire = 168 * time.Hour
+	pc_test.proxy.CookieRefresh = time.Hour
+
+	// the tokens are still valid for another hour, only the cookie is due
+	reference := time.Now().Add(-time.Hour - time.Minute)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		RefreshToken: "my_refresh_token", ExpiresOn: time.Now().Add(time.Hour)}
+	pc_test.SaveSession(startSession, reference)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, 1, provider.refreshes)
+
+	cookies := (&http.Response{Header: pc_test.rw.HeaderMap}).Cookies()
+	assert.Equal(t, 1, len(cookies))
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	session, age, err := pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refreshed_access_token", session.AccessToken)
+	assert.Equal(t, true, age < time.Minute)
+}
+
+func TestProcessCookieNotRefreshedBeforeCookieIsDue(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	provider := &RefreshingTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.provider = provider
+	pc_test.proxy.CookieExpire = 168 * time.Hour
+	pc_test.proxy.CookieRefresh = time.Hour
+
+	reference := time.Now().Add(-time.Hour + time.Minute)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		RefreshToken: "my_refresh_token", ExpiresOn: time.Now().Add(time.Hour)}
+	pc_test.SaveSession(startSession, reference)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, 0, provider.refreshes)
+	assert.Equal(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestSessionIdleTimeoutSignsOutIdleSession(t *testing.T) {
+	for _, lastSeen := range []time.Time{time.Now().Add(-31 * time.Minute), time.Time{}} {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.SessionIdleTimeout = 30 * time.Minute
+
+		startSession := &providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			ExpiresOn: time.Now().Add(time.Hour), LastSeen: lastSeen}
+		pc_test.SaveSession(startSession, time.Now().Add(-time.Hour))
+
+		assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+		cookies := (&http.Response{Header: pc_test.rw.HeaderMap}).Cookies()
+		assert.NotEqual(t, 0, len(cookies))
+		for _, c := range cookies {
+			assert.Equal(t, "", c.Value)
+		}
+	}
+}
+
+func TestSessionIdleTimeoutKeepsActiveSessionAlive(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.SessionIdleTimeout = 30 * time.Minute
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		ExpiresOn: time.Now().Add(time.Hour), LastSeen: time.Now().Add(-29 * time.Minute)}
+	pc_test.SaveSession(startSession, time.Now().Add(-2*time.Hour))
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	cookies := (&http.Response{Header: pc_test.rw.HeaderMap}).Cookies()
+	assert.Equal(t, 1, len(cookies))
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	session, age, err := pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+	assert.Equal(t, true, time.Now().Sub(session.LastSeen) < time.Minute)
+	// the cookie keeps its age, -cookie-refresh and -cookie-expire still apply
+	assert.Equal(t, true, age >= 2*time.Hour)
+}
+
+func TestSessionIdleTimeoutSkipsRecentlySeenSession(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.SessionIdleTimeout = 30 * time.Minute
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		ExpiresOn: time.Now().Add(time.Hour), LastSeen: time.Now().Add(-time.Minute)}
+	pc_test.SaveSession(startSession, time.Now().Add(-2*time.Hour))
+
+	// the last seen time is only stored again once it is 3 minutes old
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
+// RotatingTestProvider refreshes sessions with a new refresh token every
+// time, and rejects refresh tokens that were used before.
+type RotatingTestProvider struct {
+	*TestProvider
+	mu     sync.Mutex
+	issued int
+	used   map[string]bool
+}
+
+func (tp *RotatingTestProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	if s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	return tp.RefreshSession(s)
+}
+
+func (tp *RotatingTestProvider) RefreshSession(s *providers.SessionState) (bool, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.used == nil {
+		tp.used = make(map[string]bool)
+	}
+	if tp.used[s.RefreshToken] {
+		return false, errors.New("invalid_grant")
+	}
+	tp.used[s.RefreshToken] = true
+	tp.issued++
+	s.AccessToken = fmt.Sprintf("access-token-%d", tp.issued)
+	s.RefreshToken = fmt.Sprintf("refresh-token-%d", tp.issued)
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func TestProcessCookieKeepsRotatedRefreshToken(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.provider = &RotatingTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+
+	rw := httptest.NewRecorder()
+	session := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "access-token-0",
+		RefreshToken: "refresh-token-0", ExpiresOn: time.Now().Add(-time.Minute)}
+	for i := 1; i <= 2; i++ {
+		assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, session))
+		next := httptest.NewRecorder()
+		assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(next, requestWithCookies(rw)))
+
+		// the re-issued cookie carries the new refresh token
+		var err error
+		session, _, err = pc_test.proxy.LoadCookiedSession(requestWithCookies(next))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("refresh-token-%d", i), session.RefreshToken)
+		session.ExpiresOn = time.Now().Add(-time.Minute)
+		rw = httptest.NewRecorder()
+	}
+}
+
+func NewAuthOnlyEndpointTest() *ProcessCookieTest {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+	return pc_test
+}
+
+func TestAuthOnlyEndpointAccepted(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now())
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointUnauthorizedOnExpiration(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.CookieExpire = time.Duration(24) * time.Hour
+	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, reference)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
+}
+
+func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now())
+	test.validate_user = false
+
+	test.proxy.ServeHTTP(test.rw, test.req)
 	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
 	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
 	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
 }
 
-func TestAuthOnlyEndpointUnauthorizedOnExpiration(t *testing.T) {
-	test := NewAuthOnlyEndpointTest()
-	test.proxy.CookieExpire = time.Duration(24) * time.Hour
-	reference := time.Now().Add(time.Duration(25) * time.Hour * -1)
-	startSession := &providers.SessionState{
-		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
-	test.SaveSession(startSession, reference)
+func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
+	var pc_test ProcessCookieTest
+
+	pc_test.opts = NewOptions()
+	pc_test.opts.SetXAuthRequest = true
+	pc_test.opts.Validate()
+
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+		return pc_test.validate_user
+	})
+	pc_test.proxy.provider = &TestProvider{
+		ValidToken: true,
+	}
+
+	pc_test.validate_user = true
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+
+	startSession := &providers.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
+	assert.Equal(t, "oauth_user", pc_test.rw.HeaderMap["X-Auth-Request-User"][0])
+	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
+	assert.Equal(t, "", pc_test.rw.Header().Get("X-Auth-Request-Groups"))
+}
+
+func TestAuthOnlyEndpointSetXAuthRequestGroups(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.SetXAuthRequest = true
+	startSession := &providers.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token",
+		Groups: []string{"admins", "devs"}}
+	test.SaveSession(startSession, time.Now())
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, "oauth_user", test.rw.Header().Get("X-Auth-Request-User"))
+	assert.Equal(t, "oauth_user@example.com", test.rw.Header().Get("X-Auth-Request-Email"))
+	assert.Equal(t, "admins,devs", test.rw.Header().Get("X-Auth-Request-Groups"))
+}
+
+func TestAuthOnlyEndpointSetXAuthRequestAnonymous(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.SetXAuthRequest = true
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	for _, h := range []string{"X-Auth-Request-User", "X-Auth-Request-Email", "X-Auth-Request-Groups"} {
+		assert.Equal(t, "", test.rw.Header().Get(h), h)
+	}
+}
+
+func TestSetGroupsHeader(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.SetGroupsHeader = true
+	pc_test.req.Header.Set("X-Forwarded-Groups", "spoofed-admins")
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"admins", "devs"}}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, []string{"admins,devs"}, pc_test.req.Header["X-Forwarded-Groups"])
+}
+
+func TestSetGroupsHeaderStripsSpoofedHeaderWithoutGroups(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.SetGroupsHeader = true
+	pc_test.req.Header.Set("X-Forwarded-Groups", "spoofed-admins")
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Groups"))
+}
+
+func TestSetGroupsHeaderOption(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Groups")))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SetGroupsHeader = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.provider = &TestProvider{ValidToken: true}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &providers.SessionState{
+		Email: "john.doe@example.com", AccessToken: "my_access_token",
+		Groups: []string{"admins", "devs"}}))
+	req = requestWithCookies(rw)
+	req.Header.Set("X-Forwarded-Groups", "spoofed-admins")
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "admins,devs", rw.Body.String())
+}
+
+func TestGroupsWithoutCookieCipher(t *testing.T) {
+	opts := testOptions()
+	opts.SetGroupsHeader = true
+	opts.SetXAuthRequest = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.provider = &TestProvider{ValidToken: true}
+	// the session cookie is only signed, so the groups have to be kept in
+	// its plain form
+	assert.Equal(t, (*cookie.Cipher)(nil), proxy.CookieCipher)
+
+	req := newTestUserInfoRequest(t, proxy, &providers.SessionState{
+		Email: "john.doe@example.com", User: "john.doe", AccessToken: "my_access_token",
+		Groups: []string{"admins", "devs"}})
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"user": "john.doe", "email": "john.doe@example.com", "groups": ["admins", "devs"]}`,
+		rw.Body.String())
+
+	req.URL.Path = opts.ProxyPrefix + "/auth"
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "admins,devs", rw.Header().Get("X-Auth-Request-Groups"))
+
+	req.URL.Path = "/"
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(httptest.NewRecorder(), req))
+	assert.Equal(t, "admins,devs", req.Header.Get("X-Forwarded-Groups"))
+}
+
+func TestPassAuthorizationHeader(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.PassAuthorization = true
+	pc_test.proxy.PassBasicAuth = false
+	pc_test.req.SetBasicAuth("michael.bland", "proxy-password")
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		IdToken: "my_id_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, []string{"Bearer my_access_token"}, pc_test.req.Header["Authorization"])
+}
+
+func TestPassAuthorizationHeaderReplacesBasicAuth(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.PassAuthorization = true
+	pc_test.proxy.PassBasicAuth = true
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, []string{"Bearer my_access_token"}, pc_test.req.Header["Authorization"])
+	assert.Equal(t, "michael.bland@gsa.gov", pc_test.req.Header.Get("X-Forwarded-Email"))
+}
+
+func TestPassAuthorizationHeaderWithoutAccessToken(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.PassAuthorization = true
+	pc_test.proxy.PassBasicAuth = false
+	pc_test.req.Header.Set("Authorization", "Bearer forged")
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "", pc_test.req.Header.Get("Authorization"))
+}
+
+func TestPassAuthorizationHeaderAfterRefresh(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.provider = &RotatingTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.PassAuthorization = true
+	pc_test.proxy.PassBasicAuth = false
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "access-token-0",
+		RefreshToken: "refresh-token-0", ExpiresOn: time.Now().Add(-time.Minute)}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, []string{"Bearer access-token-1"}, pc_test.req.Header["Authorization"])
+}
+
+// bearerTestProvider accepts the bearer tokens it has sessions for.
+type bearerTestProvider struct {
+	*TestProvider
+	sessions map[string]*providers.SessionState
+}
+
+func (bp *bearerTestProvider) SessionFromBearerToken(rawToken string) (*providers.SessionState, error) {
+	if s, ok := bp.sessions[rawToken]; ok {
+		return s, nil
+	}
+	return nil, errors.New("could not verify bearer token")
+}
+
+func NewJwtBearerTest() (*ProcessCookieTest, *bearerTestProvider) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.SkipJwtBearerTokens = true
+	provider := &bearerTestProvider{
+		TestProvider: pc_test.proxy.provider.(*TestProvider),
+		sessions: map[string]*providers.SessionState{
+			"header.valid.sig": {
+				Email: "michael.bland@gsa.gov", User: "michael.bland",
+				AccessToken: "header.valid.sig", ExpiresOn: time.Now().Add(time.Hour)},
+		},
+	}
+	pc_test.proxy.provider = provider
+	return pc_test, provider
+}
+
+func TestJwtBearerTokenAccepted(t *testing.T) {
+	pc_test, _ := NewJwtBearerTest()
+	pc_test.req.Header.Set("Authorization", "Bearer header.valid.sig")
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "michael.bland@gsa.gov", pc_test.req.Header.Get("X-Forwarded-Email"))
+	assert.Equal(t, "michael.bland", pc_test.req.Header.Get("X-Forwarded-User"))
+	// no session cookie is issued for bearer tokens
+	assert.Equal(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestJwtBearerTokenRejected(t *testing.T) {
+	pc_test, _ := NewJwtBearerTest()
+	pc_test.req.Header.Set("Authorization", "Bearer header.expired.sig")
+
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Email"))
+}
+
+func TestJwtBearerTokenExpiredSession(t *testing.T) {
+	pc_test, provider := NewJwtBearerTest()
+	provider.sessions["header.stale.sig"] = &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "header.stale.sig",
+		ExpiresOn: time.Now().Add(-time.Minute)}
+	pc_test.req.Header.Set("Authorization", "Bearer header.stale.sig")
+
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestJwtBearerTokenEmailValidationFailure(t *testing.T) {
+	pc_test, _ := NewJwtBearerTest()
+	pc_test.validate_user = false
+	pc_test.req.Header.Set("Authorization", "Bearer header.valid.sig")
+
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestJwtBearerTokenDisabled(t *testing.T) {
+	pc_test, _ := NewJwtBearerTest()
+	pc_test.proxy.SkipJwtBearerTokens = false
+	pc_test.req.Header.Set("Authorization", "Bearer header.valid.sig")
+
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestPassIdToken(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.PassIdToken = true
+	pc_test.proxy.IdTokenHeader = "X-Forwarded-Id-Token"
+	pc_test.req.Header.Set("X-Forwarded-Id-Token", "spoofed_id_token")
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		IdToken: "my_id_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, []string{"my_id_token"}, pc_test.req.Header["X-Forwarded-Id-Token"])
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Access-Token"))
+}
+
+func TestPassIdTokenCustomHeader(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.PassIdToken = true
+	pc_test.proxy.IdTokenHeader = "X-Id-Token"
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		IdToken: "my_id_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "my_id_token", pc_test.req.Header.Get("X-Id-Token"))
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Id-Token"))
+}
+
+func TestPassIdTokenStripsSpoofedHeaderWithoutIdToken(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.PassIdToken = true
+	pc_test.proxy.IdTokenHeader = "X-Forwarded-Id-Token"
+	pc_test.req.Header.Set("X-Forwarded-Id-Token", "spoofed_id_token")
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Id-Token"))
+}
+
+func TestSetClaimHeaders(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.claimHeaders = []claimHeader{
+		{"sub", "X-User-Id"},
+		{"department", "X-Dept"},
+		{"level", "X-Level"},
+		{"roles", "X-Roles"},
+		{"missing", "X-Missing"},
+	}
+	pc_test.req.Header.Set("X-Dept", "spoofed")
+	pc_test.req.Header.Set("X-Missing", "spoofed")
+
+	payload := `{"sub": "248289761001", "department": "engineering", "level": 3, "roles": ["admin", "dev"]}`
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		IdToken: "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, []string{"248289761001"}, pc_test.req.Header["X-User-Id"])
+	assert.Equal(t, []string{"engineering"}, pc_test.req.Header["X-Dept"])
+	assert.Equal(t, []string{"3"}, pc_test.req.Header["X-Level"])
+	assert.Equal(t, []string{"admin,dev"}, pc_test.req.Header["X-Roles"])
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Missing"))
+}
+
+func TestSetClaimHeadersStripsSpoofedHeadersWithoutIdToken(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.claimHeaders = []claimHeader{{"sub", "X-User-Id"}}
+	pc_test.req.Header.Set("X-User-Id", "spoofed")
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "", pc_test.req.Header.Get("X-User-Id"))
+}
+
+func TestGroupsHeaderNotSetByDefault(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"admins"}}
+	pc_test.SaveSession(startSession, time.Now())
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "", pc_test.req.Header.Get("X-Forwarded-Groups"))
+}
+
+func TestHtpasswdBasicAuth(t *testing.T) {
+	var forwardedEmail string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedEmail = r.Header.Get("X-Forwarded-Email")
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"example.com"}
+	opts.Validate()
+
+	upstream_url, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstream_url, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("ci-secret"), bcrypt.MinCost)
+	proxy.HtpasswdFile, _ = NewHtpasswd(strings.NewReader("ci-bot:" + string(hash) + "\n"))
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/builds", nil)
+	req.SetBasicAuth("ci-bot", "ci-secret")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "response", rw.Body.String())
+	assert.Equal(t, "ci-bot", forwardedEmail)
+
+	forwardedEmail = ""
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/builds", nil)
+	req.SetBasicAuth("ci-bot", "wrong")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "", forwardedEmail)
+}
+
+func TestMalformedAuthorizationHeaderNotLogged(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	hash, _ := bcrypt.GenerateFromPassword([]byte("ci-secret"), bcrypt.MinCost)
+	proxy.HtpasswdFile, _ = NewHtpasswd(strings.NewReader("ci-bot:" + string(hash) + "\n"))
+
+	for _, auth := range []string{
+		"s3cr3t-token",
+		"Token s3cr3t-token",
+		"Basic s3cr3t-token",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("s3cr3t-token")),
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("ci-bot:s3cr3t-token")),
+	} {
+		logs.Reset()
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", auth)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code, auth)
+		assert.NotContains(t, logs.String(), "s3cr3t", auth)
+		assert.NotContains(t, logs.String(), strings.TrimPrefix(auth, "Basic "), auth)
+	}
+}
+
+func TestAuthSkippedForPreflightRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthPreflight = true
+	opts.Validate()
+
+	upstream_url, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstream_url, "")
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/preflight-request", nil)
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "response", rw.Body.String())
+}
+
+func TestSkipAuthRegex(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipProviderButton = true
+	opts.SkipAuthRegex = []string{"^/assets/", `^/healthz$`}
+	assert.Equal(t, nil, opts.Validate())
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for _, path := range []string{"/assets/app.js", "/healthz"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		// an unreadable session cookie is not looked at
+		req.AddCookie(&http.Cookie{Name: opts.CookieName, Value: "garbage"})
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code, path)
+		assert.Equal(t, "upstream "+path, rw.Body.String(), path)
+		assert.Equal(t, "", rw.HeaderMap.Get("Set-Cookie"), path)
+	}
+
+	for _, path := range []string{"/app/assets/app.js", "/healthz/details", "/"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code, path)
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		assert.Equal(t, upstreamURL.Host, location.Host, path)
+		assert.Equal(t, "/oauth/authorize", location.Path, path)
+	}
+}
+
+func TestCustomProxyPrefix(t *testing.T) {
+	// the upstream doubles as the provider's token endpoint
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			w.Write([]byte(`{"access_token": "my_auth_token"}`))
+			return
+		}
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.ProxyPrefix = "/_auth/"
+	// the app's own /oauth2/ paths are public
+	opts.SkipAuthRegex = []string{"^/oauth2/"}
+	assert.Equal(t, nil, opts.Validate())
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// the app's paths reach the upstream
+	for _, path := range []string{"/oauth2/sign_in", "/oauth2/callback"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code, path)
+		assert.Equal(t, "upstream "+path, rw.Body.String(), path)
+	}
+
+	// the sign in page links to the prefixed start endpoint
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_auth/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), `action="/_auth/start"`)
+
+	// the provider sends the user back to the prefixed callback
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/_auth/start?rd=%2Ffoo", nil)
+	req.Host = "proxy.example.com"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "https://proxy.example.com/_auth/callback", location.Query().Get("redirect_uri"))
+	cookies := (&http.Response{Header: rw.HeaderMap}).Cookies()
 
-	test.proxy.ServeHTTP(test.rw, test.req)
-	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
-	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
-	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/_auth/callback?code=callback_code&state="+
+		url.QueryEscape(location.Query().Get("state")), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/foo", rw.HeaderMap.Get("Location"))
 }
 
-func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
-	test := NewAuthOnlyEndpointTest()
-	startSession := &providers.SessionState{
-		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
-	test.SaveSession(startSession, time.Now())
-	test.validate_user = false
+func TestUpstreamPathRouting(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.RequestURI))
+		}))
+	}
+	api := newUpstream("api")
+	defer api.Close()
+	users := newUpstream("users")
+	defer users.Close()
+	web := newUpstream("web")
+	defer web.Close()
 
-	test.proxy.ServeHTTP(test.rw, test.req)
-	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
-	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
-	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
+	opts := NewOptions()
+	opts.Upstreams = []string{
+		"/api/=" + api.URL + "/v1/",
+		"/api/users=" + users.URL,
+		"/=" + web.URL + "/",
+	}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
+
+	web_url, _ := url.Parse(web.URL)
+	opts.provider = NewTestProvider(web_url, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/api/items?id=1", "api /v1/items?id=1"},
+		{"/api/users/jdoe", "users /jdoe"},
+		{"/api/users/", "users /"},
+		{"/api/", "api /v1/"},
+		{"/apiary", "web /apiary"},
+		{"/index.html", "web /index.html"},
+		{"/", "web /"},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.RequestURI = tc.path
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code, tc.path)
+		assert.Equal(t, tc.expected, rw.Body.String(), tc.path)
+	}
+
+	// a prefix without its trailing slash is redirected to the prefix
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/users", nil)
+	req.RequestURI = "/api/users"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusMovedPermanently, rw.Code)
+	assert.Equal(t, "/api/users/", rw.HeaderMap.Get("Location"))
 }
 
-func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
-	var pc_test ProcessCookieTest
+func TestStripPathPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		uri      string
+		expected string
+	}{
+		{"/app/users?id=1", "/users?id=1"},
+		{"/app/", "/"},
+		{"/app", "/"},
+		{"/app?id=1", "/?id=1"},
+		{"/apple", "/apple"},
+		{"/other/app/users", "/other/app/users"},
+		{"/", "/"},
+	} {
+		assert.Equal(t, tc.expected, stripPathPrefix(tc.uri, "/app"), tc.uri)
+	}
+	assert.Equal(t, "/app/users", stripPathPrefix("/app/users", ""))
+}
 
-	pc_test.opts = NewOptions()
-	pc_test.opts.SetXAuthRequest = true
-	pc_test.opts.Validate()
+func TestUpstreamStripPathPrefix(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logout" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer upstream.Close()
 
-	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
-		return pc_test.validate_user
-	})
-	pc_test.proxy.provider = &TestProvider{
-		ValidToken: true,
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL + "/"}
+	opts.StripPathPrefix = "/app"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/app/users?id=1", "/users?id=1"},
+		{"/app/", "/"},
+		{"/app", "/"},
+		{"/apple", "/apple"},
+		{"/static/app.js", "/static/app.js"},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.RequestURI = tc.path
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code, tc.path)
+		assert.Equal(t, tc.expected, rw.Body.String(), tc.path)
 	}
 
-	pc_test.validate_user = true
+	// redirects of the upstream keep the prefix
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/app/logout", nil)
+	req.RequestURI = "/app/logout"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/app/login", rw.HeaderMap.Get("Location"))
+}
 
-	pc_test.rw = httptest.NewRecorder()
-	pc_test.req, _ = http.NewRequest("GET",
-		pc_test.opts.ProxyPrefix+"/auth", nil)
+func TestUpstreamStripResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal-app/1.2")
+		w.Header().Set("X-Internal-Trace", "span-1234")
+		w.Header().Set("X-Request-Region", "eu-west")
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/logout" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
 
-	startSession := &providers.SessionState{
-		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token"}
-	pc_test.SaveSession(startSession, time.Now())
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL + "/"}
+	opts.StripPathPrefix = "/app"
+	opts.StripResponseHeaders = []string{"x-internal-TRACE", "Server"}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
 
-	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
-	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
-	assert.Equal(t, "oauth_user", pc_test.rw.HeaderMap["X-Auth-Request-User"][0])
-	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/app/", nil)
+	req.RequestURI = "/app/"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, "", rw.HeaderMap.Get("Server"))
+	assert.Equal(t, "", rw.HeaderMap.Get("X-Internal-Trace"))
+	assert.Equal(t, "eu-west", rw.HeaderMap.Get("X-Request-Region"))
+	assert.Equal(t, "text/plain", rw.HeaderMap.Get("Content-Type"))
+
+	// the redirects of the upstream still get the prefix
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/app/logout", nil)
+	req.RequestURI = "/app/logout"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/app/login", rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "", rw.HeaderMap.Get("X-Internal-Trace"))
 }
 
-func TestAuthSkippedForPreflightRequests(t *testing.T) {
+// readWebsocketFrame reads a single unfragmented frame with a payload of less
+// than 126 bytes and returns its unmasked payload.
+func readWebsocketFrame(r *bufio.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, header[1]&0x7f)
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return payload, nil
+}
+
+func TestWebsocketUpgradeRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ws", nil)
+	assert.Equal(t, false, websocketUpgradeRequest(req))
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "keep-alive")
+	assert.Equal(t, false, websocketUpgradeRequest(req))
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	assert.Equal(t, true, websocketUpgradeRequest(req))
+	req.Header.Set("Upgrade", "h2c")
+	assert.Equal(t, false, websocketUpgradeRequest(req))
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	var upstreamEmail string
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("response"))
+		upstreamEmail = r.Header.Get("X-Forwarded-Email")
+		h := sha1.New()
+		io.WriteString(h, r.Header.Get("Sec-WebSocket-Key")+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n\r\n")
+		bufrw.Flush()
+		payload, err := readWebsocketFrame(bufrw.Reader)
+		if err != nil {
+			t.Errorf("reading frame failed: %v", err)
+			return
+		}
+		// echo the payload in an unmasked text frame
+		bufrw.Write([]byte{0x81, byte(len(payload))})
+		bufrw.Write(payload)
+		bufrw.Flush()
 	}))
 	defer upstream.Close()
 
@@ -687,20 +2602,91 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	opts.Upstreams = append(opts.Upstreams, upstream.URL)
 	opts.ClientID = "bazquux"
 	opts.ClientSecret = "foobar"
-	opts.CookieSecret = "xyzzyplugh"
-	opts.SkipAuthPreflight = true
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
 	opts.Validate()
 
 	upstream_url, _ := url.Parse(upstream.URL)
-	opts.provider = NewTestProvider(upstream_url, "")
+	provider := NewTestProvider(upstream_url, "")
+	provider.ValidToken = true
+	opts.provider = provider
 
-	proxy := NewOAuthProxy(opts, func(string) bool { return false })
-	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("OPTIONS", "/preflight-request", nil)
-	proxy.ServeHTTP(rw, req)
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
 
-	assert.Equal(t, 200, rw.Code)
-	assert.Equal(t, "response", rw.Body.String())
+	handshake := func(authenticated bool) (*http.Response, net.Conn, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", frontend.URL+"/ws", nil)
+		req.Header.Set("Connection", "keep-alive, Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if authenticated {
+			session := &providers.SessionState{Email: "michael.bland@gsa.gov"}
+			value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+			assert.Equal(t, nil, err)
+			for _, c := range proxy.MakeSessionCookie(req, value, opts.CookieExpire, time.Now()) {
+				req.AddCookie(c)
+			}
+		}
+		conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		assert.Equal(t, nil, req.Write(conn))
+		r := bufio.NewReader(conn)
+		res, err := http.ReadResponse(r, req)
+		if err != nil {
+			t.Fatalf("reading handshake response failed: %v", err)
+		}
+		return res, conn, r
+	}
+
+	// the handshake is authenticated like any other request
+	res, conn, _ := handshake(false)
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, "", upstreamEmail)
+
+	res, conn, r := handshake(true)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "michael.bland@gsa.gov", upstreamEmail)
+
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	payload := []byte("hello")
+	frame := append([]byte{0x81, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	assert.Equal(t, nil, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed, err := readWebsocketFrame(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(echoed))
+}
+
+func TestWebsocketProxySSLInsecureSkipVerify(t *testing.T) {
+	upstreamConfig := func(skipVerify bool) *tls.Config {
+		opts := NewOptions()
+		opts.Upstreams = append(opts.Upstreams, "https://upstream.example.com/")
+		opts.ClientID = "bazquux"
+		opts.ClientSecret = "foobar"
+		opts.CookieSecret = "0123456789abcdefabcd"
+		opts.EmailDomains = []string{"*"}
+		opts.SSLInsecureSkipVerify = skipVerify
+		opts.Validate()
+
+		proxy := NewOAuthProxy(opts, func(string) bool { return true })
+		req, _ := http.NewRequest("GET", "/ws", nil)
+		handler, _ := proxy.serveMux.(*http.ServeMux).Handler(req)
+		return handler.(*UpstreamProxy).handler.(*WebsocketReverseProxy).TLSClientConfig
+	}
+
+	assert.Equal(t, (*tls.Config)(nil), upstreamConfig(false))
+	assert.Equal(t, true, upstreamConfig(true).InsecureSkipVerify)
 }
 
 type SignatureAuthenticator struct {
@@ -808,8 +2794,12 @@ func (st *SignatureTest) MakeRequestWithExpectedKey(method, body, key string) {
 		req.AddCookie(c)
 	}
 	// This is used by the upstream to validate the signature.
+	hash := crypto.SHA1
+	if st.opts.signatureData != nil {
+		hash = st.opts.signatureData.hash
+	}
 	st.authenticator.auth = hmacauth.NewHmacAuth(
-		crypto.SHA1, []byte(key), SignatureHeader, SignatureHeaders)
+		hash, []byte(key), SignatureHeader, SignatureHeaders)
 	proxy.ServeHTTP(st.rw, req)
 }
 
@@ -839,3 +2829,391 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func TestCookieDomainMatches(t *testing.T) {
+	for _, tc := range []struct {
+		host   string
+		domain string
+		match  bool
+	}{
+		{"app.example.com", ".example.com", true},
+		{"app.example.com", "example.com", true},
+		{"example.com", ".example.com", true},
+		{"a.b.example.com", ".example.com", true},
+		{"App.Example.com", ".example.COM", true},
+		{"badexample.com", ".example.com", false},
+		{"badexample.com", "example.com", false},
+		{"example.com", ".app.example.com", false},
+	} {
+		assert.Equal(t, tc.match, cookieDomainMatches(tc.host, tc.domain), tc.host+" "+tc.domain)
+	}
+}
+
+func TestSessionCookieDomain(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.CookieDomains = []string{".example.com"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for _, host := range []string{"app.example.com", "other.example.com:8443"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+		proxy.SetSessionCookie(rw, req, "value")
+		proxy.SetCSRFCookie(rw, req, "nonce")
+		cookies := (&http.Response{Header: rw.HeaderMap}).Cookies()
+		assert.Equal(t, 2, len(cookies), host)
+		for _, c := range cookies {
+			assert.Equal(t, "example.com", c.Domain, c.Name)
+		}
+		assert.Contains(t, rw.HeaderMap["Set-Cookie"][0], "; Domain=example.com;")
+	}
+
+	// without a cookie domain the cookies are host-only
+	proxy.CookieDomains = nil
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://app.example.com/", nil)
+	proxy.SetSessionCookie(rw, req, "value")
+	assert.NotContains(t, rw.HeaderMap["Set-Cookie"][0], "Domain=")
+}
+
+func TestSessionCookieMultipleDomains(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.CookieDomains = []string{".example.com", ".example.org"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for host, expected := range map[string]string{
+		"app.example.com":      "; Domain=example.com;",
+		"app.example.org:8443": "; Domain=example.org;",
+		"example.org":          "; Domain=example.org;",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+		proxy.SetSessionCookie(rw, req, "value")
+		assert.Contains(t, rw.HeaderMap["Set-Cookie"][0], expected, host)
+	}
+
+	// hosts outside all the domains get a host-only cookie
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "https://app.example.net/", nil)
+	proxy.SetSessionCookie(rw, req, "value")
+	assert.NotContains(t, rw.HeaderMap["Set-Cookie"][0], "Domain=")
+}
+
+// Two proxies on the same parent domain with different -cookie-name values
+// don't touch each other's cookies.
+func TestCookieNameOverride(t *testing.T) {
+	newProxy := func(cookieName string) *OAuthProxy {
+		opts := NewOptions()
+		opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+		opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+		opts.ClientID = "bazquux"
+		opts.ClientSecret = "foobar"
+		opts.EmailDomains = []string{"*"}
+		opts.CookieName = cookieName
+		assert.Equal(t, nil, opts.Validate())
+		return NewOAuthProxy(opts, func(string) bool { return true })
+	}
+	proxy := newProxy("_app2")
+	assert.Equal(t, "_app2", proxy.CookieName)
+	assert.Equal(t, "_app2_csrf", proxy.CSRFCookieName)
+	assert.Equal(t, "_app2_authreq", proxy.AuthRequestCookieName)
+
+	// the CSRF cookie set when starting a login
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	var names []string
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{"_app2_csrf"}, names)
+
+	// sessions too large for one cookie are split into numbered chunks
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	proxy.SetSessionCookie(rw, req, strings.Repeat("v", 5000))
+	names = nil
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{"_app2-0", "_app2-1"}, names)
+
+	// a session of the proxy with the default name is not accepted
+	other := newProxy("_oauth2_proxy")
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, c := range other.MakeSessionCookie(req, "email:jdoe@example.com user:jdoe", time.Hour, time.Now()) {
+		req.AddCookie(c)
+	}
+	_, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, `Cookie "_app2" not present`, err.Error())
+	session, _, err := other.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+}
+
+func TestRequestSignatureSHA256(t *testing.T) {
+	st := NewSignatureTest()
+	defer st.Close()
+	st.opts.SignatureKey = "sha256:foobar"
+	payload := `{ "hello": "world!" }`
+	st.MakeRequestWithExpectedKey("POST", payload, "foobar")
+	assert.Equal(t, 200, st.rw.Code)
+	assert.Equal(t, st.rw.Body.String(), "signatures match")
+}
+
+func TestRequestSignatureWrongKey(t *testing.T) {
+	st := NewSignatureTest()
+	defer st.Close()
+	st.opts.SignatureKey = "sha256:foobar"
+	st.MakeRequestWithExpectedKey("GET", "", "other key")
+	assert.Equal(t, 200, st.rw.Code)
+	assert.Contains(t, st.rw.Body.String(), "signatures do not match")
+}
+
+// newSignedTestRequest is a request as the proxy sends it upstream, signed
+// with key.
+func newSignedTestRequest(key string) *http.Request {
+	req := httptest.NewRequest("POST", "/foo/bar?id=1", strings.NewReader(`{"hello": "world!"}`))
+	req.Header.Set("Content-Length", "19")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+	req.Header.Set("X-Forwarded-User", "mbland")
+	req.Header.Set("X-Forwarded-Email", "mbland@acm.org")
+	req.Header.Add("Cookie", "a=1")
+	req.Header.Add("Cookie", "b=2")
+	hmacauth.NewHmacAuth(crypto.SHA256, []byte(key), SignatureHeader, SignatureHeaders).SignRequest(req)
+	return req
+}
+
+// verifyRequestSignature checks the signature of req the way an upstream
+// does, reading the body as the request is handled.
+func verifyRequestSignature(req *http.Request, key string) hmacauth.AuthenticationResult {
+	auth := hmacauth.NewHmacAuth(crypto.SHA256, []byte(key), SignatureHeader, SignatureHeaders)
+	result, _, _ := auth.AuthenticateRequest(req)
+	return result
+}
+
+// The signature is an HMAC over the method, the values of SignatureHeaders
+// in order, one per line with repeated headers joined by commas, the path and
+// the body.
+func TestRequestSignatureCanonicalization(t *testing.T) {
+	req := newSignedTestRequest("foobar")
+	auth := hmacauth.NewHmacAuth(crypto.SHA256, []byte("foobar"), SignatureHeader, SignatureHeaders)
+	stringToSign := auth.StringToSign(req)
+	assert.Equal(t, true, strings.HasPrefix(stringToSign, "POST\n"+
+		"19\n"+
+		"\n"+
+		"application/json\n"+
+		"Mon, 02 Jan 2006 15:04:05 GMT\n"+
+		"\n"+
+		"mbland\n"+
+		"mbland@acm.org\n"+
+		"\n"+
+		"a=1,b=2\n"+
+		"\n"), stringToSign)
+	assert.Contains(t, stringToSign, "/foo/bar")
+
+	mac := hmac.New(sha256.New, []byte("foobar"))
+	mac.Write([]byte(stringToSign))
+	mac.Write([]byte(`{"hello": "world!"}`))
+	expected := "sha256 " + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	assert.Equal(t, expected, req.Header.Get(SignatureHeader))
+
+	// signing is deterministic
+	assert.Equal(t, expected, newSignedTestRequest("foobar").Header.Get(SignatureHeader))
+}
+
+func TestRequestSignatureRoundTrip(t *testing.T) {
+	assert.Equal(t, hmacauth.ResultMatch, verifyRequestSignature(newSignedTestRequest("foobar"), "foobar"))
+	assert.Equal(t, hmacauth.ResultMismatch, verifyRequestSignature(newSignedTestRequest("foobar"), "other key"))
+
+	// a spoofed identity header invalidates the signature
+	req := newSignedTestRequest("foobar")
+	req.Header.Set("X-Forwarded-Email", "admin@acm.org")
+	assert.Equal(t, hmacauth.ResultMismatch, verifyRequestSignature(req, "foobar"))
+
+	req = newSignedTestRequest("foobar")
+	req.Header.Del(SignatureHeader)
+	assert.Equal(t, hmacauth.ResultNoSignature, verifyRequestSignature(req, "foobar"))
+}
+
+func TestCallbackRateLimit(t *testing.T) {
+	redeems := 0
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			redeems++
+		}
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, provider.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.CallbackRateLimit = 2
+	opts.TrustedProxies = []string{"10.0.0.1"}
+	opts.Validate()
+	providerURL, _ := url.Parse(provider.URL)
+	opts.provider = NewTestProvider(providerURL, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	handler := RealIPHandler(opts.realIP, proxy)
+
+	callback := func(client string) int {
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code=guess&state="+
+			url.QueryEscape(proxy.signState("nonce", "")), nil)
+		req.RemoteAddr = "10.0.0.1:52000"
+		req.Header.Set("X-Real-IP", client)
+		req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, 302, callback("203.0.113.7"))
+	assert.Equal(t, 302, callback("203.0.113.7"))
+	assert.Equal(t, 2, redeems)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, callback("203.0.113.7"))
+	}
+	assert.Equal(t, 2, redeems)
+
+	// the sign-in page shares the limit of the callback
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	req.RemoteAddr = "10.0.0.1:52000"
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	// other clients are unaffected
+	assert.Equal(t, 302, callback("198.51.100.1"))
+	assert.Equal(t, 3, redeems)
+}
+
+func TestCallbackRateLimitIgnoresRealIPWithoutTrustedProxies(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CallbackRateLimit = 2
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	handler := RealIPHandler(opts.realIP, proxy)
+
+	signIn := func(peer, client string) int {
+		req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+		req.RemoteAddr = peer + ":52000"
+		req.Header.Set("X-Real-IP", client)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// a client can't get around the limit by sending another address with
+	// each request
+	assert.Equal(t, 200, signIn("203.0.113.7", "192.0.2.1"))
+	assert.Equal(t, 200, signIn("203.0.113.7", "192.0.2.2"))
+	assert.Equal(t, http.StatusTooManyRequests, signIn("203.0.113.7", "192.0.2.3"))
+	assert.Equal(t, 200, signIn("198.51.100.1", "192.0.2.3"))
+}
+
+func TestCallbackRateLimitDisabled(t *testing.T) {
+	test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer test.Close()
+	for i := 0; i < 20; i++ {
+		code, _ := test.getCallbackEndpoint()
+		assert.Equal(t, 302, code)
+	}
+}
+
+func newRedeemErrorTest(status int, body string) (*OAuthProxy, func()) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, provider.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.Validate()
+	providerURL, _ := url.Parse(provider.URL)
+	opts.provider = NewTestProvider(providerURL, "michael.bland@gsa.gov")
+	return NewOAuthProxy(opts, func(string) bool { return true }), provider.Close
+}
+
+func TestOAuthCallbackRedeemError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		code     int
+		location string
+	}{
+		{"expired code", 400, `{"error": "invalid_grant", "error_description": "Code expired"}`,
+			302, "/oauth2/sign_in?rd=%2Fdeep%2Flink%3Fa%3Db"},
+		{"denied", 400, `{"error": "access_denied"}`,
+			302, "/oauth2/sign_in?rd=%2Fdeep%2Flink%3Fa%3Db"},
+		{"bad client", 401, `{"error": "invalid_client"}`, 502, ""},
+		{"provider down", 503, `Service Unavailable`, 502, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, closeProvider := newRedeemErrorTest(tt.status, tt.body)
+			defer closeProvider()
+
+			req, _ := http.NewRequest("GET", "/oauth2/callback?code=expired&state="+
+				url.QueryEscape(proxy.signState("nonce", "/deep/link?a=b")), nil)
+			req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, req)
+			assert.Equal(t, tt.code, rw.Code)
+			assert.Equal(t, tt.location, rw.Header().Get("Location"))
+			for _, c := range rw.Header()["Set-Cookie"] {
+				assert.NotContains(t, c, proxy.CookieName+"=")
+			}
+		})
+	}
+}
+
+type accountErrorProvider struct {
+	*TestProvider
+}
+
+func (p accountErrorProvider) Redeem(redirectURL, code string) (*providers.SessionState, error) {
+	return nil, &providers.AccountError{Reason: "jdoe@gmail.com is not an account of the hosted domain example.com"}
+}
+
+func TestOAuthCallbackAccountError(t *testing.T) {
+	proxy, closeProvider := newRedeemErrorTest(200, `{}`)
+	defer closeProvider()
+	proxy.provider = accountErrorProvider{proxy.provider.(*TestProvider)}
+
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=code&state="+
+		url.QueryEscape(proxy.signState("nonce", "/")), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Invalid Account")
+}
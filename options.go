@@ -10,9 +10,11 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
@@ -20,76 +22,187 @@ import (
 
 // Configuration Options that can be set by Command Line Flag, or Config File
 type Options struct {
-	ProxyPrefix  string `flag:"proxy-prefix" cfg:"proxy-prefix"`
+	ProxyPrefix  string `flag:"proxy-prefix" cfg:"proxy_prefix"`
+	PingPath     string `flag:"ping-path" cfg:"ping_path"`
 	HttpAddress  string `flag:"http-address" cfg:"http_address"`
 	HttpsAddress string `flag:"https-address" cfg:"https_address"`
+	MetricsAddr  string `flag:"metrics-address" cfg:"metrics_address"`
 	RedirectURL  string `flag:"redirect-url" cfg:"redirect_url"`
 	ClientID     string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
 	ClientSecret string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
 	TLSCertFile  string `flag:"tls-cert" cfg:"tls_cert_file"`
 	TLSKeyFile   string `flag:"tls-key" cfg:"tls_key_file"`
 
+	UnixSocketMode  string        `flag:"unix-socket-mode" cfg:"unix_socket_mode"`
+	EnableH2C       bool          `flag:"enable-h2c" cfg:"enable_h2c"`
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout" cfg:"shutdown_timeout"`
+
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
+	AzureGroups              []string `flag:"azure-group" cfg:"azure_groups"`
+	AzureResolveGroupNames   bool     `flag:"azure-resolve-group-names" cfg:"azure_resolve_group_names"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
 	GitHubTeam               string   `flag:"github-team" cfg:"github_team"`
+	GitLabGroups             []string `flag:"gitlab-group" cfg:"gitlab_groups"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
+	GoogleHostedDomain       string   `flag:"google-hosted-domain" cfg:"google_hosted_domain"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
+	KeycloakGroups           []string `flag:"keycloak-group" cfg:"keycloak_groups"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
 	Footer                   string   `flag:"footer" cfg:"footer"`
+	Banner                   string   `flag:"banner" cfg:"banner"`
+	WhitelistDomains         []string `flag:"whitelist-domain" cfg:"whitelist_domains"`
+
+	GoogleGroupCacheTTL time.Duration `flag:"google-group-cache-ttl" cfg:"google_group_cache_ttl"`
 
-	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
-	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
-	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
-	CookieExpire   time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
-	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
-	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
-	CookieHttpOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	CookieName           string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
+	CookieSecret         string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
+	CookieDomains        []string      `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
+	CookieExpire         time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
+	CookieRefresh        time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
+	CookieSecure         bool          `flag:"cookie-secure" cfg:"cookie_secure"`
+	CookieHttpOnly       bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	CookieSameSite       string        `flag:"cookie-samesite" cfg:"cookie_samesite"`
+	CookieEncrypt        bool          `flag:"cookie-encrypt" cfg:"cookie_encrypt"`
+	CookieKDF            bool          `flag:"cookie-secret-kdf" cfg:"cookie_secret_kdf"`
+	CookieCSRFPerRequest bool          `flag:"cookie-csrf-per-request" cfg:"cookie_csrf_per_request"`
+
+	SessionStore             string        `flag:"session-store" cfg:"session_store"`
+	RedisConnectionURL       string        `flag:"redis-connection-url" cfg:"redis_connection_url" env:"OAUTH2_PROXY_REDIS_CONNECTION_URL"`
+	SessionBackgroundRefresh time.Duration `flag:"session-background-refresh" cfg:"session_background_refresh"`
+	SessionIdleTimeout       time.Duration `flag:"session-idle-timeout" cfg:"session_idle_timeout"`
 
 	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
 	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
+	AllowedMethods        []string `flag:"allowed-methods" cfg:"allowed_methods"`
 	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
 	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
 	PassAccessToken       bool     `flag:"pass-access-token" cfg:"pass_access_token"`
+	PassIdToken           bool     `flag:"pass-id-token" cfg:"pass_id_token"`
+	IdTokenHeader         string   `flag:"id-token-header" cfg:"id_token_header"`
 	PassHostHeader        bool     `flag:"pass-host-header" cfg:"pass_host_header"`
+	UpstreamHost          string   `flag:"upstream-host" cfg:"upstream_host"`
+	StripPathPrefix       string   `flag:"strip-path-prefix" cfg:"strip_path_prefix"`
+	StripResponseHeaders  []string `flag:"strip-response-header" cfg:"strip_response_headers"`
+	UpstreamTLSCert       string   `flag:"upstream-tls-cert" cfg:"upstream_tls_cert_file"`
+	UpstreamTLSKey        string   `flag:"upstream-tls-key" cfg:"upstream_tls_key_file"`
+	UpstreamTLSCA         string   `flag:"upstream-tls-ca" cfg:"upstream_tls_ca_file"`
+	UpstreamCAFiles       []string `flag:"upstream-ca-file" cfg:"upstream_ca_files"`
+	UseSystemTrustStore   bool     `flag:"use-system-trust-store" cfg:"use_system_trust_store"`
 	SkipProviderButton    bool     `flag:"skip-provider-button" cfg:"skip_provider_button"`
 	PassUserHeaders       bool     `flag:"pass-user-headers" cfg:"pass_user_headers"`
+	SetGroupsHeader       bool     `flag:"set-groups-header" cfg:"set_groups_header"`
+	UserInfoFields        []string `flag:"userinfo-field" cfg:"userinfo_fields"`
+	ExposeTokenEndpoint   bool     `flag:"expose-token-endpoint" cfg:"expose_token_endpoint"`
+	SetClaimHeaders       []string `flag:"set-claim-header" cfg:"set_claim_headers"`
 	SSLInsecureSkipVerify bool     `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify"`
 	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
 	SetAuthorization      bool     `flag:"set-authorization-header" cfg:"set_authorization_header"`
 	PassAuthorization     bool     `flag:"pass-authorization-header" cfg:"pass_authorization_header"`
 	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	CORSAllowedOrigins    []string `flag:"cors-allowed-origin" cfg:"cors_allowed_origins"`
+	CORSAllowedMethods    []string `flag:"cors-allowed-method" cfg:"cors_allowed_methods"`
+	CORSAllowedHeaders    []string `flag:"cors-allowed-header" cfg:"cors_allowed_headers"`
+	CORSAllowCredentials  bool     `flag:"cors-allow-credentials" cfg:"cors_allow_credentials"`
 	AllowBearerHeader     bool     `flag:"allow-bearer" cfg:"allow_bearer"`
+	SkipJwtBearerTokens   bool     `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens"`
+	ExtraJwtIssuers       []string `flag:"extra-jwt-issuers" cfg:"extra_jwt_issuers"`
+
+	UpstreamTimeout         time.Duration `flag:"upstream-timeout" cfg:"upstream_timeout"`
+	UpstreamDialTimeout     time.Duration `flag:"upstream-dial-timeout" cfg:"upstream_dial_timeout"`
+	UpstreamMaxIdleConns    int           `flag:"upstream-max-idle-conns" cfg:"upstream_max_idle_conns"`
+	UpstreamMaxConnsPerHost int           `flag:"upstream-max-conns-per-host" cfg:"upstream_max_conns_per_host"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
-	Provider          string   `flag:"provider" cfg:"provider"`
-	OIDCIssuerURL     string   `flag:"oidc-issuer-url" cfg:"oidc_issuer_url"`
-	LoginURL          string   `flag:"login-url" cfg:"login_url"`
-	RedeemURL         string   `flag:"redeem-url" cfg:"redeem_url"`
-	ProfileURL        string   `flag:"profile-url" cfg:"profile_url"`
-	ProtectedResource string   `flag:"resource" cfg:"resource"`
-	ValidateURL       string   `flag:"validate-url" cfg:"validate_url"`
-	Scope             string   `flag:"scope" cfg:"scope"`
-	ApprovalPrompt    string   `flag:"approval-prompt" cfg:"approval_prompt"`
-	OIDCGroups        []string `flag:"oidc-groups" cfg:"oidc_groups"`
+	Provider          string        `flag:"provider" cfg:"provider"`
+	OIDCIssuerURL     string        `flag:"oidc-issuer-url" cfg:"oidc_issuer_url"`
+	LoginURL          string        `flag:"login-url" cfg:"login_url"`
+	RedeemURL         string        `flag:"redeem-url" cfg:"redeem_url"`
+	ProfileURL        string        `flag:"profile-url" cfg:"profile_url"`
+	ProtectedResource string        `flag:"resource" cfg:"resource"`
+	ValidateURL       string        `flag:"validate-url" cfg:"validate_url"`
+	Scope             string        `flag:"scope" cfg:"scope"`
+	ApprovalPrompt    string        `flag:"approval-prompt" cfg:"approval_prompt"`
+	TokenRetries      int           `flag:"provider-token-retries" cfg:"provider_token_retries"`
+	TokenRetryDelay   time.Duration `flag:"provider-token-retry-base-delay" cfg:"provider_token_retry_base_delay"`
+	RequestTimeout    time.Duration `flag:"provider-request-timeout" cfg:"provider_request_timeout"`
+	ProviderCAFiles   []string      `flag:"provider-ca-file" cfg:"provider_ca_files"`
+	OIDCGroups        []string      `flag:"oidc-groups" cfg:"oidc_groups"`
+	OIDCAudiences     []string      `flag:"oidc-allowed-audiences" cfg:"oidc_allowed_audiences"`
+	OIDCGroupsClaim   string        `flag:"oidc-groups-claim" cfg:"oidc_groups_claim"`
+	OIDCGroupsFrom    string        `flag:"oidc-groups-from" cfg:"oidc_groups_from"`
+	OIDCRequireAll    bool          `flag:"oidc-require-all-groups" cfg:"oidc_require_all_groups"`
+	OIDCGroupsNoCase  bool          `flag:"oidc-group-case-insensitive" cfg:"oidc_group_case_insensitive"`
+	OIDCEmailClaim    string        `flag:"oidc-email-claim" cfg:"oidc_email_claim"`
+	OIDCUsernameClaim string        `flag:"oidc-username-claim" cfg:"oidc_username_claim"`
+	OIDCUserInfo      bool          `flag:"oidc-userinfo-fallback" cfg:"oidc_userinfo_fallback"`
+	OIDCUserInfoTTL   time.Duration `flag:"oidc-userinfo-cache-ttl" cfg:"oidc_userinfo_cache_ttl"`
+	OIDCUserInfoRetry int           `flag:"oidc-userinfo-retries" cfg:"oidc_userinfo_retries"`
+	OIDCEmailVerified bool          `flag:"oidc-require-email-verified" cfg:"oidc_require_email_verified"`
+	OIDCUsePKCE       bool          `flag:"oidc-use-pkce" cfg:"oidc_use_pkce"`
+	OIDCVerifyNonce   bool          `flag:"oidc-verify-nonce" cfg:"oidc_verify_nonce"`
+	OIDCPrompt        []string      `flag:"oidc-prompt" cfg:"oidc_prompt"`
+	OIDCMaxAge        time.Duration `flag:"oidc-max-age" cfg:"oidc_max_age"`
+	OIDCIntrospection string        `flag:"oidc-introspection-url" cfg:"oidc_introspection_url"`
+	OIDCRefreshBefore time.Duration `flag:"oidc-refresh-before" cfg:"oidc_refresh_before"`
+	OIDCJWKSURL       string        `flag:"oidc-jwks-url" cfg:"oidc_jwks_url"`
+	OIDCJWKSRefresh   time.Duration `flag:"oidc-jwks-refresh-interval" cfg:"oidc_jwks_refresh_interval"`
+	OIDCIDTokenCache  int           `flag:"oidc-id-token-cache-size" cfg:"oidc_id_token_cache_size"`
+	OIDCClientJWTKey  string        `flag:"oidc-client-jwt-key" cfg:"oidc_client_jwt_key"`
+	OIDCPostLogoutURL string        `flag:"oidc-post-logout-redirect-url" cfg:"oidc_post_logout_redirect_url"`
+	OktaFetchGroups   bool          `flag:"okta-fetch-groups" cfg:"okta_fetch_groups"`
 
 	RequestLogging       bool   `flag:"request-logging" cfg:"request_logging"`
 	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
+	LogLevel             string `flag:"log-level" cfg:"log_level"`
+	LogFormat            string `flag:"log-format" cfg:"log_format"`
+
+	RedactHeaders []string `flag:"redact-header" cfg:"redact_headers"`
+
+	RealIPHeader   string   `flag:"real-ip-header" cfg:"real_ip_header"`
+	TrustedProxies []string `flag:"trusted-proxies" cfg:"trusted_proxies"`
+
+	CallbackRateLimit int `flag:"callback-rate-limit" cfg:"callback_rate_limit"`
+
+	EnableCompression  bool     `flag:"enable-compression" cfg:"enable_compression"`
+	CompressionMinSize int      `flag:"compression-min-size" cfg:"compression_min_size"`
+	CompressionTypes   []string `flag:"compression-type" cfg:"compression_types"`
 
 	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
 
+	ForwardJWTKey    string `flag:"forward-jwt-key" cfg:"forward_jwt_key"`
+	ForwardJWTHeader string `flag:"forward-jwt-header" cfg:"forward_jwt_header"`
+
 	// internal values that are set after config validation
-	redirectURL   *url.URL
-	proxyURLs     []*url.URL
-	CompiledRegex []*regexp.Regexp
-	provider      providers.Provider
-	signatureData *SignatureData
-	oidcVerifier  *oidc.IDTokenVerifier
+	redirectURL    *url.URL
+	proxyURLs      []*url.URL
+	proxyPaths     []string
+	CompiledRegex  []*regexp.Regexp
+	provider       providers.Provider
+	signatureData  *SignatureData
+	oidcVerifier   *oidc.IDTokenVerifier
+	jwtIssuers     map[string]*providers.BearerIssuer
+	oidcEndSession string
+	sessionStore   SessionStore
+	claimHeaders   []claimHeader
+	methodRules    []methodRule
+	cors           *corsPolicy
+	realIP         *realIPResolver
+	upstreamTLS    *tls.Config
+	forwardJWT     *forwardJWTSigner
+	httpClient     *http.Client
+	unixSocketMode os.FileMode
+}
+
+// claimHeader maps an ID token claim to the header it is passed upstream in.
+type claimHeader struct {
+	claim  string
+	header string
 }
 
 type SignatureData struct {
@@ -100,26 +213,54 @@ type SignatureData struct {
 func NewOptions() *Options {
 	return &Options{
 		ProxyPrefix:          "/oauth2",
+		PingPath:             "/ping",
 		HttpAddress:          "127.0.0.1:4180",
 		HttpsAddress:         ":443",
+		ShutdownTimeout:      30 * time.Second,
 		DisplayHtpasswdForm:  true,
 		CookieName:           "_oauth2_proxy",
 		CookieSecure:         true,
 		CookieHttpOnly:       true,
+		CookieSameSite:       "lax",
 		CookieExpire:         time.Duration(168) * time.Hour,
 		CookieRefresh:        time.Duration(0),
+		SessionStore:         "cookie",
 		SetXAuthRequest:      false,
 		SkipAuthPreflight:    false,
+		CORSAllowedMethods:   defaultCORSMethods,
 		PassBasicAuth:        true,
 		PassUserHeaders:      true,
+		UserInfoFields:       []string{"user", "email", "groups"},
 		PassAccessToken:      false,
+		PassIdToken:          false,
+		IdTokenHeader:        "X-Forwarded-Id-Token",
 		PassHostHeader:       true,
 		SetAuthorization:     false,
 		PassAuthorization:    false,
 		ApprovalPrompt:       "force",
+		TokenRetryDelay:      100 * time.Millisecond,
+		RequestTimeout:       10 * time.Second,
+		OIDCJWKSRefresh:      time.Hour,
+		OIDCGroupsClaim:      "groups",
+		OIDCGroupsFrom:       "id_token",
+		OIDCEmailClaim:       "email",
+		OIDCUsernameClaim:    "preferred_username",
+		OIDCUserInfo:         true,
+		OIDCUserInfoTTL:      30 * time.Second,
+		OIDCUserInfoRetry:    1,
+		OIDCIDTokenCache:     1000,
+		GoogleGroupCacheTTL:  5 * time.Minute,
 		RequestLogging:       true,
 		AllowBearerHeader:    false,
 		RequestLoggingFormat: defaultRequestLoggingFormat,
+		LogLevel:             "info",
+		LogFormat:            "text",
+		RealIPHeader:         "X-Real-IP",
+		CompressionMinSize:   1024,
+		UpstreamDialTimeout:  30 * time.Second,
+		UpstreamMaxIdleConns: 100,
+		CompressionTypes:     defaultCompressionTypes,
+		ForwardJWTHeader:     "X-Forwarded-Access-Token",
 	}
 }
 
@@ -132,23 +273,48 @@ func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []strin
 	return parsed, msgs
 }
 
-func (o *Options) Validate() error {
-	if o.SSLInsecureSkipVerify {
-		// TODO: Accept a certificate bundle.
-		insecureTransport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		http.DefaultClient = &http.Client{Transport: insecureTransport}
+// parseEndpointURL parses the URL of a provider endpoint, which has to be an
+// absolute http(s) URL as the proxy requests it itself. An empty URL keeps the
+// provider's default.
+func parseEndpointURL(to_parse string, urltype string, msgs []string) (*url.URL, []string) {
+	parsed, msgs := parseURL(to_parse, urltype, msgs)
+	if parsed != nil && to_parse != "" && ((parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "") {
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: %s-url=%q must be an absolute http or https URL", urltype, to_parse))
+	}
+	return parsed, msgs
+}
+
+// splitUpstream splits an upstream of the form PATH=URL, such as
+// "/api/=http://127.0.0.1:8080/", into its path prefix and URL. The path is
+// always returned with a trailing slash so that it matches everything below
+// it. Upstreams without a path prefix are returned unchanged with an empty
+// path.
+func splitUpstream(upstream string) (string, string) {
+	if !strings.HasPrefix(upstream, "/") {
+		return "", upstream
+	}
+	i := strings.Index(upstream, "=")
+	if i < 0 {
+		return "", upstream
 	}
+	path := upstream[:i]
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path, upstream[i+1:]
+}
 
+func (o *Options) Validate() error {
 	msgs := make([]string, 0)
+	msgs = parseProviderHTTPClient(o, msgs)
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
 	if o.ClientID == "" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	if o.ClientSecret == "" {
+	if o.ClientSecret == "" && o.OIDCClientJWTKey == "" {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
 	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
@@ -156,33 +322,163 @@ func (o *Options) Validate() error {
 			"\n      use email-domain=* to authorize all email addresses")
 	}
 
+	switch o.Provider {
+	case "", "google", "azure", "facebook", "github", "gitlab", "keycloak", "linkedin", "okta", "oidc":
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: provider=%q must be one of google, azure, facebook, github, gitlab, keycloak, linkedin, okta or oidc", o.Provider))
+	}
+	if o.OIDCIssuerURL == "" {
+		o.OIDCIssuerURL = defaultOIDCIssuerURL(o.Provider)
+	}
 	if o.OIDCIssuerURL != "" {
-		// Configure discoverable provider data.
-		provider, err := oidc.NewProvider(context.Background(), o.OIDCIssuerURL)
-		if err != nil {
-			return err
+		msgs = discoverOIDCProvider(o, msgs)
+	}
+
+	o.jwtIssuers = make(map[string]*providers.BearerIssuer)
+	for _, jwtIssuer := range o.ExtraJwtIssuers {
+		i := strings.LastIndex(jwtIssuer, "=")
+		if i <= 0 || i == len(jwtIssuer)-1 {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: extra-jwt-issuers=%q must be given as issuer=audience", jwtIssuer))
+			continue
 		}
-		o.oidcVerifier = provider.Verifier(&oidc.Config{
-			ClientID: o.ClientID,
-		})
-		o.LoginURL = provider.Endpoint().AuthURL
-		o.RedeemURL = provider.Endpoint().TokenURL
-		if o.Scope == "" {
-			o.Scope = "openid email profile"
+		issuer, audience := jwtIssuer[:i], jwtIssuer[i+1:]
+		if b, ok := o.jwtIssuers[issuer]; ok {
+			// one verifier per issuer, accepting each audience given for it
+			b.Audiences = append(b.Audiences, audience)
+			continue
+		}
+		verifier, err := newJWTVerifier(o.httpClient, issuer, o.OIDCJWKSRefresh)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: extra-jwt-issuers=%q %s", jwtIssuer, err))
+			continue
 		}
+		o.jwtIssuers[issuer] = &providers.BearerIssuer{Verifier: verifier, Audiences: []string{audience}}
 	}
 
 	o.redirectURL, msgs = parseURL(o.RedirectURL, "redirect", msgs)
+	if len(o.CookieDomains) > 0 && o.redirectURL != nil && o.redirectURL.Host != "" {
+		// the proxy is reached at the host of the redirect URL, so browsers
+		// would reject a cookie for any other domain
+		host := o.redirectURL.Hostname()
+		matched := false
+		for _, domain := range o.CookieDomains {
+			matched = matched || cookieDomainMatches(host, domain)
+		}
+		if !matched {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: cookie-domain=%q does not match the redirect-url host %q", strings.Join(o.CookieDomains, ","), host))
+		}
+	}
 
+	o.proxyURLs, o.proxyPaths = nil, nil
+	seenPaths := make(map[string]bool)
 	for _, u := range o.Upstreams {
-		upstreamURL, err := url.Parse(u)
+		path, target := splitUpstream(u)
+		upstreamURL, err := url.Parse(target)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("error parsing upstream: %s", err))
-		} else {
-			if upstreamURL.Path == "" {
-				upstreamURL.Path = "/"
+			continue
+		}
+		switch upstreamURL.Scheme {
+		case "http", "https":
+			if upstreamURL.Host == "" {
+				msgs = append(msgs, fmt.Sprintf("invalid setting: upstream=%q is missing a host", u))
+				continue
 			}
-			o.proxyURLs = append(o.proxyURLs, upstreamURL)
+		case "file":
+		default:
+			msgs = append(msgs, fmt.Sprintf("invalid setting: upstream=%q must be an http, https or file URL", u))
+			continue
+		}
+		if upstreamURL.Path == "" {
+			upstreamURL.Path = "/"
+		}
+		if path == "" {
+			path = upstreamURL.Path
+			if upstreamURL.Scheme == "file" && upstreamURL.Fragment != "" {
+				path = upstreamURL.Fragment
+			}
+		} else if upstreamURL.Scheme != "file" && !strings.HasSuffix(upstreamURL.Path, "/") {
+			// the remainder of the request path is appended to the
+			// upstream path, so it has to end in a slash as well
+			upstreamURL.Path += "/"
+		}
+		if seenPaths[path] {
+			msgs = append(msgs, fmt.Sprintf("duplicate upstream path %q", path))
+			continue
+		}
+		seenPaths[path] = true
+		o.proxyURLs = append(o.proxyURLs, upstreamURL)
+		o.proxyPaths = append(o.proxyPaths, path)
+	}
+
+	if o.UpstreamHost != "" {
+		if u, err := url.Parse("http://" + o.UpstreamHost); err != nil || u.Host != o.UpstreamHost {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: upstream-host=%q must be a host name, optionally with a port", o.UpstreamHost))
+		}
+	}
+
+	upstreamCAFiles := o.UpstreamCAFiles
+	if o.UpstreamTLSCA != "" {
+		upstreamCAFiles = append([]string{o.UpstreamTLSCA}, upstreamCAFiles...)
+	}
+	if o.UpstreamTLSCert != "" || o.UpstreamTLSKey != "" || len(upstreamCAFiles) > 0 {
+		config, err := loadUpstreamTLSConfig(o.UpstreamTLSCert, o.UpstreamTLSKey,
+			upstreamCAFiles, o.UseSystemTrustStore)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: %s", err))
+		} else {
+			o.upstreamTLS = config
+		}
+	}
+
+	o.unixSocketMode = 0
+	if o.UnixSocketMode != "" {
+		mode, err := strconv.ParseUint(o.UnixSocketMode, 8, 32)
+		switch {
+		case err != nil || mode > 0777:
+			msgs = append(msgs, fmt.Sprintf("invalid setting: unix-socket-mode=%q must be octal permissions (ie: 0660)", o.UnixSocketMode))
+		case !strings.HasPrefix(o.HttpAddress, "unix://"):
+			msgs = append(msgs, fmt.Sprintf("invalid setting: unix-socket-mode requires a unix://<path> http-address, not %q", o.HttpAddress))
+		default:
+			o.unixSocketMode = os.FileMode(mode)
+		}
+	}
+	if o.EnableH2C && (o.TLSCertFile != "" || o.TLSKeyFile != "") {
+		msgs = append(msgs, "invalid setting: enable-h2c is for the plain HTTP listener and can't be used with tls-cert and tls-key, which negotiate HTTP/2 anyway")
+	}
+	if o.ShutdownTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: shutdown-timeout=%s must not be negative", o.ShutdownTimeout))
+	}
+	if o.UpstreamTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: upstream-timeout=%s must not be negative", o.UpstreamTimeout))
+	}
+	if o.UpstreamDialTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: upstream-dial-timeout=%s must not be negative", o.UpstreamDialTimeout))
+	}
+	if o.UpstreamMaxIdleConns < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: upstream-max-idle-conns=%d must not be negative", o.UpstreamMaxIdleConns))
+	}
+	if o.UpstreamMaxConnsPerHost < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: upstream-max-conns-per-host=%d must not be negative", o.UpstreamMaxConnsPerHost))
+	}
+
+	if o.OIDCIDTokenCache < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: oidc-id-token-cache-size=%d must not be negative", o.OIDCIDTokenCache))
+	}
+	if o.CompressionMinSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: compression-min-size=%d must not be negative", o.CompressionMinSize))
+	}
+
+	if o.StripPathPrefix != "" {
+		if !strings.HasPrefix(o.StripPathPrefix, "/") || strings.HasSuffix(o.StripPathPrefix, "/") {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: strip-path-prefix=%q must start with and must not end with a slash (ie: /app)", o.StripPathPrefix))
+		}
+	}
+
+	for _, h := range o.StripResponseHeaders {
+		if h == "" || strings.ContainsAny(h, ": \t") {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: strip-response-header=%q must be a header name (ie: X-Internal-Trace)", h))
 		}
 	}
 
@@ -194,9 +490,74 @@ func (o *Options) Validate() error {
 		}
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
+	o.cors = nil
+	if len(o.CORSAllowedOrigins) > 0 {
+		cors, err := newCORSPolicy(o.CORSAllowedOrigins, o.CORSAllowedMethods, o.CORSAllowedHeaders, o.CORSAllowCredentials)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: %s", err))
+		} else {
+			o.cors = cors
+		}
+	} else if len(o.CORSAllowedHeaders) > 0 || o.CORSAllowCredentials {
+		msgs = append(msgs, "cors-allowed-header and cors-allow-credentials require cors-allowed-origin")
+	}
+
+	o.methodRules = nil
+	for _, rule := range o.AllowedMethods {
+		r, err := parseMethodRule(rule)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid setting: allowed-methods=%q %s", rule, err))
+			continue
+		}
+		o.methodRules = append(o.methodRules, r)
+	}
 	msgs = parseProviderInfo(o, msgs)
+	if _, ok := o.provider.(*providers.GoogleProvider); o.GoogleHostedDomain != "" && !ok {
+		msgs = append(msgs, "google-hosted-domain requires the google provider")
+	}
+	if _, ok := o.provider.(providers.BearerTokenProvider); o.SkipJwtBearerTokens && !ok {
+		msgs = append(msgs, "skip-jwt-bearer-tokens requires an OpenID Connect based provider")
+	}
 
-	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
+	var trustedProxies []string
+	for _, p := range o.TrustedProxies {
+		for _, cidr := range strings.Split(p, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr != "" {
+				trustedProxies = append(trustedProxies, cidr)
+			}
+		}
+	}
+	realIP, err := newRealIPResolver(o.RealIPHeader, trustedProxies)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: trusted-proxies %s", err))
+	} else {
+		o.realIP = realIP
+	}
+
+	if o.CallbackRateLimit < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: callback-rate-limit=%d must not be negative", o.CallbackRateLimit))
+	}
+
+	o.claimHeaders = nil
+	for _, mapping := range o.SetClaimHeaders {
+		// claim names may be URLs, header names never contain a colon
+		i := strings.LastIndex(mapping, ":")
+		if i <= 0 || i == len(mapping)-1 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid setting: set-claim-header=%q must be claim:Header-Name", mapping))
+			continue
+		}
+		o.claimHeaders = append(o.claimHeaders, claimHeader{
+			claim:  mapping[:i],
+			header: http.CanonicalHeaderKey(strings.TrimSpace(mapping[i+1:])),
+		})
+	}
+
+	if o.PassIdToken && o.IdTokenHeader == "" {
+		msgs = append(msgs, "id_token_header must be set when pass_id_token == true")
+	}
+
+	if o.needsCookieCipher() {
 		valid_cookie_secret_size := false
 		for _, i := range []int{16, 24, 32} {
 			if len(secretBytes(o.CookieSecret)) == i {
@@ -207,17 +568,23 @@ func (o *Options) Validate() error {
 		if string(secretBytes(o.CookieSecret)) != o.CookieSecret {
 			decoded = true
 		}
-		if valid_cookie_secret_size == false {
-			var suffix string
+		if o.CookieKDF {
+			// the key is derived from the secret as given, whatever its
+			// length, but a short secret is still easily guessed
+			if len(o.CookieSecret) < minCookieSecretKDFLength {
+				msgs = append(msgs, fmt.Sprintf(
+					"cookie_secret must be at least %d bytes when cookie_secret_kdf == true, but is %d bytes.",
+					minCookieSecretKDFLength, len(o.CookieSecret)))
+			}
+		} else if valid_cookie_secret_size == false {
+			suffix := " Set cookie_secret_kdf = true to derive the key from a secret of another length."
 			if decoded {
-				suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", o.CookieSecret)
+				suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q.", o.CookieSecret) + suffix
 			}
 			msgs = append(msgs, fmt.Sprintf(
 				"cookie_secret must be 16, 24, or 32 bytes "+
-					"to create an AES cipher when "+
-					"pass_access_token == true or "+
-					"cookie_refresh != 0, but is %d bytes.%s",
-				len(secretBytes(o.CookieSecret)), suffix))
+					"to create an AES cipher when %s, but is %d bytes.%s",
+				cookieCipherSettingsList(), len(secretBytes(o.CookieSecret)), suffix))
 		}
 	}
 
@@ -240,8 +607,118 @@ func (o *Options) Validate() error {
 			msgs = append(msgs, "missing setting: google-service-account-json")
 		}
 	}
+	if o.GoogleGroupCacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: google-group-cache-ttl=%s must not be negative", o.GoogleGroupCacheTTL))
+	}
+
+	switch o.LogLevel {
+	case "", "info", "debug":
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: log-level=%q must be info or debug", o.LogLevel))
+	}
+
+	switch o.LogFormat {
+	case "", "text", "json":
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: log-format=%q must be text or json", o.LogFormat))
+	}
+
+	switch o.CookieSameSite {
+	case "", "lax", "strict":
+	case "none":
+		if !o.CookieSecure {
+			msgs = append(msgs, "cookie_samesite=none requires cookie_secure == true")
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: cookie-samesite=%q must be lax, strict or none", o.CookieSameSite))
+	}
+
+	switch o.SessionStore {
+	case "", "cookie":
+	case "redis":
+		if o.RedisConnectionURL == "" {
+			msgs = append(msgs, "missing setting: redis-connection-url")
+		} else if store, err := NewRedisSessionStore(o.RedisConnectionURL); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing redis-connection-url=%q %s", o.RedisConnectionURL, err))
+		} else {
+			o.sessionStore = store
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: session-store=%q must be cookie or redis", o.SessionStore))
+	}
+	if o.SessionBackgroundRefresh < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: session-background-refresh=%s must not be negative", o.SessionBackgroundRefresh))
+	} else if o.SessionBackgroundRefresh > 0 {
+		if o.SessionStore != "redis" {
+			msgs = append(msgs, "invalid setting: session-background-refresh requires session-store=redis")
+		}
+		if _, ok := o.provider.(providers.SessionRefresher); !ok {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid setting: session-background-refresh is not supported by provider=%q", o.Provider))
+		}
+	}
+
+	if o.SessionIdleTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: session-idle-timeout=%s must not be negative", o.SessionIdleTimeout))
+	}
+
+	switch o.OIDCGroupsFrom {
+	case "", "id_token", "access_token":
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: oidc-groups-from=%q must be id_token or access_token",
+			o.OIDCGroupsFrom))
+	}
+
+	if o.OIDCMaxAge < 0 {
+		msgs = append(msgs, fmt.Sprintf("invalid setting: oidc-max-age=%s must not be negative", o.OIDCMaxAge))
+	}
+
+	for _, prompt := range o.OIDCPrompt {
+		switch prompt {
+		case "consent", "login", "select_account":
+		case "none":
+			if len(o.OIDCPrompt) > 1 {
+				msgs = append(msgs, "invalid setting: oidc-prompt=none must not be combined with other values")
+			}
+		default:
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid setting: oidc-prompt=%q must be consent, login, select_account or none",
+				prompt))
+		}
+	}
+
+	for _, field := range o.UserInfoFields {
+		switch field {
+		case "user", "email", "groups":
+		default:
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid setting: userinfo-field=%q must be user, email or groups",
+				field))
+		}
+	}
+
+	// the endpoint paths are appended to the prefix, which must not end
+	// in a slash
+	o.ProxyPrefix = strings.TrimRight(o.ProxyPrefix, "/")
+	if !strings.HasPrefix(o.ProxyPrefix, "/") {
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: proxy-prefix=%q must start with / and not be /", o.ProxyPrefix))
+	}
+
+	if !strings.HasPrefix(o.PingPath, "/") {
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid setting: ping-path=%q must start with /", o.PingPath))
+	}
 
 	msgs = parseSignatureKey(o, msgs)
+	msgs = parseForwardJWTKey(o, msgs)
 	msgs = validateCookieName(o, msgs)
 
 	if len(msgs) != 0 {
@@ -251,26 +728,77 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// discoverOIDCProvider configures the ID token verifier and the endpoints not
+// given explicitly from the discovery document of the oidc-issuer-url.
+func discoverOIDCProvider(o *Options, msgs []string) []string {
+	ctx := oidc.ClientContext(context.Background(), o.httpClient)
+	provider, err := oidc.NewProvider(ctx, o.OIDCIssuerURL)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("unable to discover oidc-issuer-url=%q: %v", o.OIDCIssuerURL, err))
+	}
+	var discovery struct {
+		UserInfoURL   string `json:"userinfo_endpoint"`
+		JWKSURL       string `json:"jwks_uri"`
+		EndSessionURL string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return append(msgs, fmt.Sprintf("unable to read the discovery document of oidc-issuer-url=%q: %v", o.OIDCIssuerURL, err))
+	}
+	// endpoints given explicitly take precedence over discovered ones
+	jwksURL := o.OIDCJWKSURL
+	if jwksURL == "" {
+		jwksURL = discovery.JWKSURL
+	}
+	keySet := providers.NewJWKSKeySet(jwksURL, o.OIDCJWKSRefresh)
+	keySet.Client = o.httpClient
+	o.oidcVerifier = oidc.NewVerifier(o.OIDCIssuerURL, keySet,
+		&oidc.Config{
+			ClientID: o.ClientID,
+			// the audience is checked against the allowed list instead
+			SkipClientIDCheck: len(o.OIDCAudiences) > 0,
+		})
+	if o.LoginURL == "" {
+		o.LoginURL = provider.Endpoint().AuthURL
+	}
+	if o.RedeemURL == "" {
+		o.RedeemURL = provider.Endpoint().TokenURL
+	}
+	if o.ValidateURL == "" {
+		o.ValidateURL = discovery.UserInfoURL
+	}
+	o.oidcEndSession = discovery.EndSessionURL
+	return msgs
+}
+
 func parseProviderInfo(o *Options, msgs []string) []string {
 	p := &providers.ProviderData{
-		Scope:          o.Scope,
-		ClientID:       o.ClientID,
-		ClientSecret:   o.ClientSecret,
-		ApprovalPrompt: o.ApprovalPrompt,
-	}
-	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
-	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
-	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
-	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
+		Scope:               o.Scope,
+		ClientID:            o.ClientID,
+		ClientSecret:        o.ClientSecret,
+		ApprovalPrompt:      o.ApprovalPrompt,
+		TokenRetries:        o.TokenRetries,
+		TokenRetryBaseDelay: o.TokenRetryDelay,
+		RequestTimeout:      o.RequestTimeout,
+		HTTPClient:          o.httpClient,
+	}
+	p.LoginURL, msgs = parseEndpointURL(o.LoginURL, "login", msgs)
+	p.RedeemURL, msgs = parseEndpointURL(o.RedeemURL, "redeem", msgs)
+	p.ProfileURL, msgs = parseEndpointURL(o.ProfileURL, "profile", msgs)
+	p.ValidateURL, msgs = parseEndpointURL(o.ValidateURL, "validate", msgs)
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
 
 	o.provider = providers.New(o.Provider, p)
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
+		p.SetGroupRestriction(o.AzureGroups, o.AzureResolveGroupNames)
 	case *providers.GitHubProvider:
 		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+	case *providers.KeycloakProvider:
+		p.SetGroups(o.KeycloakGroups)
 	case *providers.GoogleProvider:
+		p.HostedDomain = o.GoogleHostedDomain
+		p.GroupCacheTTL = o.GoogleGroupCacheTTL
 		if o.GoogleServiceAccountJSON != "" {
 			file, err := os.Open(o.GoogleServiceAccountJSON)
 			if err != nil {
@@ -280,19 +808,138 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 			}
 		}
 	case *providers.OIDCProvider:
-		if o.oidcVerifier == nil {
-			msgs = append(msgs, "oidc provider requires an oidc issuer URL")
-		} else {
-			p.Verifier = o.oidcVerifier
+		msgs = parseOIDCProviderInfo(o, p, msgs)
+		if len(o.OIDCGroups) > 0 {
+			p.SetGroupRestriction(o.OIDCGroups)
 		}
-
+	case *providers.GitLabProvider:
+		msgs = parseOIDCProviderInfo(o, p.OIDCProvider, msgs)
+		groups := append(append([]string{}, o.GitLabGroups...), o.OIDCGroups...)
+		if len(groups) > 0 {
+			p.SetGroupRestriction(groups)
+		}
+	case *providers.OktaProvider:
+		msgs = parseOIDCProviderInfo(o, p.OIDCProvider, msgs)
 		if len(o.OIDCGroups) > 0 {
 			p.SetGroupRestriction(o.OIDCGroups)
 		}
+		p.FetchGroups = o.OktaFetchGroups
+		if issuer, err := url.Parse(o.OIDCIssuerURL); err == nil {
+			p.APIURL = &url.URL{Scheme: issuer.Scheme, Host: issuer.Host}
+		}
 	}
 	return msgs
 }
 
+// newJWTVerifier discovers the signing keys of issuer with client and returns
+// a verifier for the tokens it issued. The audience is left to the caller to
+// check.
+func newJWTVerifier(client *http.Client, issuer string, refresh time.Duration) (*oidc.IDTokenVerifier, error) {
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), client), issuer)
+	if err != nil {
+		return nil, err
+	}
+	var discovery struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, err
+	}
+	keySet := providers.NewJWKSKeySet(discovery.JWKSURL, refresh)
+	keySet.Client = client
+	return oidc.NewVerifier(issuer, keySet, &oidc.Config{SkipClientIDCheck: true}), nil
+}
+
+// parseProviderHTTPClient sets up the HTTP client for the calls to the
+// identity provider: one that accepts any certificate with
+// -ssl-insecure-skip-verify, for identity providers with self-signed
+// certificates in development, or one that trusts the -provider-ca-file CAs.
+func parseProviderHTTPClient(o *Options, msgs []string) []string {
+	o.httpClient = http.DefaultClient
+	var config *tls.Config
+	switch {
+	case o.SSLInsecureSkipVerify && len(o.ProviderCAFiles) > 0:
+		return append(msgs, "invalid setting: provider-ca-file and ssl-insecure-skip-verify are mutually exclusive")
+	case o.SSLInsecureSkipVerify:
+		config = &tls.Config{InsecureSkipVerify: true}
+	case len(o.ProviderCAFiles) > 0:
+		pool, err := loadCAPool("provider", o.ProviderCAFiles, o.UseSystemTrustStore)
+		if err != nil {
+			return append(msgs, fmt.Sprintf("invalid setting: %s", err))
+		}
+		config = &tls.Config{RootCAs: pool}
+	default:
+		return msgs
+	}
+	o.httpClient = &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+	return msgs
+}
+
+// defaultOIDCIssuerURL is the issuer of the providers with a well known one,
+// which oidc-issuer-url overrides for self-hosted instances.
+func defaultOIDCIssuerURL(provider string) string {
+	if provider == "gitlab" {
+		return "https://gitlab.com"
+	}
+	return ""
+}
+
+// parseOIDCProviderInfo applies the oidc-* options to an OpenID Connect
+// provider or to one built on it.
+func parseOIDCProviderInfo(o *Options, p *providers.OIDCProvider, msgs []string) []string {
+	if o.oidcVerifier == nil {
+		if o.OIDCIssuerURL == "" {
+			msgs = append(msgs, fmt.Sprintf("missing setting: oidc-issuer-url (required by the %s provider)", o.Provider))
+		}
+	} else {
+		p.Verifier = o.oidcVerifier
+	}
+
+	if o.OIDCGroupsClaim != "" {
+		p.GroupsClaim = o.OIDCGroupsClaim
+	}
+	if o.OIDCGroupsFrom != "" {
+		p.GroupsFrom = o.OIDCGroupsFrom
+	}
+	p.GroupsRequireAll = o.OIDCRequireAll
+	p.GroupsCaseInsensitive = o.OIDCGroupsNoCase
+	if o.OIDCEmailClaim != "" {
+		p.EmailClaim = o.OIDCEmailClaim
+	}
+	if o.OIDCUsernameClaim != "" {
+		p.UsernameClaim = o.OIDCUsernameClaim
+	}
+	p.UserInfoFallback = o.OIDCUserInfo
+	p.UserInfoCacheTTL = o.OIDCUserInfoTTL
+	p.UserInfoRetries = o.OIDCUserInfoRetry
+	p.RequireEmailVerified = o.OIDCEmailVerified
+	p.UsePKCE = o.OIDCUsePKCE
+	p.VerifyNonce = o.OIDCVerifyNonce
+	p.Prompt = o.OIDCPrompt
+	p.MaxAge = o.OIDCMaxAge
+	p.IntrospectionURL, msgs = parseURL(o.OIDCIntrospection, "oidc-introspection", msgs)
+	p.EndSessionURL, msgs = parseURL(o.oidcEndSession, "oidc-end-session", msgs)
+	p.RefreshBefore = o.OIDCRefreshBefore
+	p.AllowedAudiences = o.OIDCAudiences
+	p.ExtraBearerIssuers = o.jwtIssuers
+	p.IDTokenCacheSize = o.OIDCIDTokenCache
+	if o.OIDCClientJWTKey != "" {
+		key, err := providers.LoadClientJWTKey(o.OIDCClientJWTKey)
+		if err != nil {
+			msgs = append(msgs, "invalid oidc-client-jwt-key: "+err.Error())
+		} else {
+			p.ClientJWTKey = key
+		}
+	}
+	p.Logger.Debug = o.LogLevel == "debug"
+	p.Logger.JSON = o.LogFormat == "json"
+	return msgs
+}
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
@@ -314,6 +961,30 @@ func parseSignatureKey(o *Options, msgs []string) []string {
 	return msgs
 }
 
+func parseForwardJWTKey(o *Options, msgs []string) []string {
+	if o.ForwardJWTKey == "" {
+		return msgs
+	}
+	header := http.CanonicalHeaderKey(o.ForwardJWTHeader)
+	if header == "" {
+		return append(msgs, "missing setting: forward-jwt-header (required by forward-jwt-key)")
+	}
+	if o.PassAccessToken && header == "X-Forwarded-Access-Token" {
+		return append(msgs, fmt.Sprintf(
+			"invalid setting: forward-jwt-header=%s is used by pass-access-token", o.ForwardJWTHeader))
+	}
+	key, err := providers.LoadClientJWTKey(o.ForwardJWTKey)
+	if err != nil {
+		return append(msgs, "invalid forward-jwt-key: "+err.Error())
+	}
+	signer, err := newForwardJWTSigner(key, header)
+	if err != nil {
+		return append(msgs, "invalid forward-jwt-key: "+err.Error())
+	}
+	o.forwardJWT = signer
+	return msgs
+}
+
 func validateCookieName(o *Options, msgs []string) []string {
 	cookie := &http.Cookie{Name: o.CookieName}
 	if cookie.String() == "" {
@@ -336,7 +1007,70 @@ func addPadding(secret string) string {
 	}
 }
 
+// minCookieSecretKDFLength is the shortest cookie secret a key is derived
+// from with cookie-secret-kdf.
+const minCookieSecretKDFLength = 16
+
+// cookieCipherSettings are the settings that put tokens or other data to keep
+// private in the session, which then has to be encrypted.
+var cookieCipherSettings = []struct {
+	name string
+	set  func(o *Options) bool
+}{
+	{"pass_access_token == true", func(o *Options) bool { return o.PassAccessToken }},
+	{"pass_id_token == true", func(o *Options) bool { return o.PassIdToken }},
+	{"set_claim_headers is set", func(o *Options) bool { return len(o.SetClaimHeaders) > 0 }},
+	{"set_authorization_header == true", func(o *Options) bool { return o.SetAuthorization }},
+	{"pass_authorization_header == true", func(o *Options) bool { return o.PassAuthorization }},
+	{"cookie_refresh != 0", func(o *Options) bool { return o.CookieRefresh != time.Duration(0) }},
+	{"cookie_encrypt == true", func(o *Options) bool { return o.CookieEncrypt }},
+	{"expose_token_endpoint == true", func(o *Options) bool { return o.ExposeTokenEndpoint }},
+	{"session_store == redis", func(o *Options) bool { return o.SessionStore == "redis" }},
+	{"session_idle_timeout != 0", func(o *Options) bool { return o.SessionIdleTimeout != 0 }},
+}
+
+// needsCookieCipher reports whether any of cookieCipherSettings is set, so
+// that sessions need a cipher made from the cookie secret.
+func (o *Options) needsCookieCipher() bool {
+	for _, setting := range cookieCipherSettings {
+		if setting.set(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// cookieCipherSettingsList lists cookieCipherSettings for error messages.
+func cookieCipherSettingsList() string {
+	names := make([]string, len(cookieCipherSettings))
+	for i, setting := range cookieCipherSettings {
+		names[i] = setting.name
+	}
+	last := len(names) - 1
+	return strings.Join(names[:last], ", ") + " or " + names[last]
+}
+
+// cookieCipherKey returns the AES key for encrypting cookie values: the secret
+// itself, or a key derived from it with cookie-secret-kdf.
+func cookieCipherKey(o *Options) []byte {
+	if o.CookieKDF {
+		return cookie.DeriveKey([]byte(o.CookieSecret))
+	}
+	return secretBytes(o.CookieSecret)
+}
+
 // secretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
+// sameSite maps the cookie-samesite setting to its http.SameSite mode.
+func sameSite(mode string) http.SameSite {
+	switch mode {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
 func secretBytes(secret string) []byte {
 	b, err := base64.URLEncoding.DecodeString(addPadding(secret))
 	if err == nil {
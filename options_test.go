@@ -3,11 +3,15 @@ package main
 import (
 	"crypto"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -85,26 +89,60 @@ func TestRedirectURL(t *testing.T) {
 
 func TestProxyURLs(t *testing.T) {
 	o := testOptions()
-	o.Upstreams = append(o.Upstreams, "http://127.0.0.1:8081")
+	// two upstreams can't share a path, see TestProxyPathsDuplicate
+	o.Upstreams = []string{"http://127.0.0.1:8081"}
 	assert.Equal(t, nil, o.Validate())
 	expected := []*url.URL{
-		&url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/"},
 		// note the '/' was added
 		&url.URL{Scheme: "http", Host: "127.0.0.1:8081", Path: "/"},
 	}
 	assert.Equal(t, expected, o.proxyURLs)
 }
 
+func TestProxyPaths(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://127.0.0.1:8080/static/",
+		"/api=http://127.0.0.1:8081",
+		"/v2/=http://127.0.0.1:8082/v2",
+		"file:///var/www/static/#/files/",
+		"/docs/=file:///var/www/docs/",
+	}
+	assert.Equal(t, nil, o.Validate())
+	expected := []*url.URL{
+		&url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/static/"},
+		&url.URL{Scheme: "http", Host: "127.0.0.1:8081", Path: "/"},
+		// the upstream path gets a trailing slash like its prefix
+		&url.URL{Scheme: "http", Host: "127.0.0.1:8082", Path: "/v2/"},
+		&url.URL{Scheme: "file", Path: "/var/www/static/", Fragment: "/files/"},
+		&url.URL{Scheme: "file", Path: "/var/www/docs/"},
+	}
+	assert.Equal(t, expected, o.proxyURLs)
+	assert.Equal(t, []string{"/static/", "/api/", "/v2/", "/files/", "/docs/"}, o.proxyPaths)
+}
+
+func TestProxyPathsDuplicate(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://127.0.0.1:8080/",
+		"/=http://127.0.0.1:8081/",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{`duplicate upstream path "/"`}), err.Error())
+}
+
 func TestProxyURLsError(t *testing.T) {
 	o := testOptions()
 	o.Upstreams = append(o.Upstreams, "127.0.0.1:8081")
 	err := o.Validate()
 	assert.NotEqual(t, nil, err)
 
-	expected := errorMsg([]string{
-		"error parsing upstream: parse 127.0.0.1:8081: " +
-			"first path segment in URL cannot contain colon"})
-	assert.Equal(t, expected, err.Error())
+	// newer Go releases quote the URL in the parse error
+	assert.Contains(t, err.Error(), "error parsing upstream: parse ")
+	assert.Contains(t, err.Error(), "127.0.0.1:8081")
+	assert.Contains(t, err.Error(),
+		"first path segment in URL cannot contain colon")
 }
 
 func TestCompiledRegex(t *testing.T) {
@@ -177,6 +215,67 @@ func TestPassAccessTokenRequiresSpecificCookieSecretLengths(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+func TestCookieSecretInvalidLengthSuggestsKDF(t *testing.T) {
+	o := testOptions()
+	o.PassAccessToken = true
+	o.CookieSecret = "a passphrase of any length"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "but is 26 bytes. Set cookie_secret_kdf = true")
+}
+
+func TestExposeTokenEndpointRequiresCipher(t *testing.T) {
+	o := testOptions()
+	o.ExposeTokenEndpoint = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "expose_token_endpoint == true")
+
+	o.CookieSecret = "16 bytes AES-128"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestCookieSecretKDF(t *testing.T) {
+	o := testOptions()
+	o.PassAccessToken = true
+	o.CookieKDF = true
+	o.CookieSecret = "a passphrase of any length"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, cookie.DeriveKey([]byte("a passphrase of any length")), cookieCipherKey(o))
+	assert.Equal(t, 32, len(cookieCipherKey(o)))
+
+	// secrets of a valid AES key length are derived from as well
+	o.CookieSecret = "16 bytes AES-128"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, cookie.DeriveKey([]byte("16 bytes AES-128")), cookieCipherKey(o))
+
+	o.CookieSecret = "too short"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "cookie_secret must be at least 16 bytes when cookie_secret_kdf == true, but is 9 bytes.")
+
+	o.CookieKDF = false
+	o.CookieSecret = "16 bytes AES-128"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []byte("16 bytes AES-128"), cookieCipherKey(o))
+}
+
+func TestCookieSecretKDFEncryptsSession(t *testing.T) {
+	o := testOptions()
+	o.PassAccessToken = true
+	o.CookieKDF = true
+	o.CookieSecret = "a passphrase of any length"
+	assert.Equal(t, nil, o.Validate())
+
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+	encrypted, err := proxy.CookieCipher.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+	c, _ := cookie.NewCipher(cookie.DeriveKey([]byte("a passphrase of any length")))
+	decrypted, err := c.Decrypt(encrypted)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my access token", decrypted)
+}
+
 func TestCookieRefreshMustBeLessThanCookieExpire(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -251,3 +350,625 @@ func TestValidateCookieBadName(t *testing.T) {
 	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
+
+func TestValidateCookieNameNotAToken(t *testing.T) {
+	for _, name := range []string{"", "bad name", "bad;name", "bad=name", "bad,name", "bäd"} {
+		o := testOptions()
+		o.CookieName = name
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, name)
+		assert.Contains(t, err.Error(), fmt.Sprintf("invalid cookie name: %q", name))
+	}
+}
+
+func TestOIDCGroupsFrom(t *testing.T) {
+	o := testOptions()
+	o.OIDCGroupsFrom = "refresh_token"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid setting: oidc-groups-from=\"refresh_token\" must be id_token or access_token")
+}
+
+func TestOIDCPrompt(t *testing.T) {
+	o := testOptions()
+	o.OIDCPrompt = []string{"login", "consent"}
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.OIDCPrompt = []string{"always"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid setting: oidc-prompt=\"always\" must be consent, login, select_account or none")
+
+	o = testOptions()
+	o.OIDCPrompt = []string{"none", "consent"}
+	err = o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid setting: oidc-prompt=none must not be combined with other values")
+}
+
+func TestOIDCPromptPassedToProvider(t *testing.T) {
+	server := newDiscoveryServer()
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.OIDCPrompt = []string{"consent"}
+	assert.Equal(t, nil, o.Validate())
+
+	p := o.provider.(*providers.OIDCProvider)
+	assert.Equal(t, []string{"consent"}, p.Prompt)
+	loginURL, _ := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+	assert.Equal(t, "consent", loginURL.Query().Get("prompt"))
+}
+
+func TestOIDCMaxAgeNegative(t *testing.T) {
+	o := testOptions()
+	o.OIDCMaxAge = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: oidc-max-age=-1m0s must not be negative")
+}
+
+func TestLogLevel(t *testing.T) {
+	o := testOptions()
+	o.LogLevel = "trace"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid setting: log-level=\"trace\" must be info or debug")
+}
+
+func TestLogFormat(t *testing.T) {
+	o := testOptions()
+	o.LogFormat = "logfmt"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid setting: log-format=\"logfmt\" must be text or json")
+}
+
+func TestValidateCookieSameSite(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, "lax", o.CookieSameSite)
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSameSite = "none"
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSameSite = "none"
+	o.CookieSecure = false
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "cookie_samesite=none requires cookie_secure == true")
+
+	o = testOptions()
+	o.CookieSameSite = "relaxed"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid setting: cookie-samesite="relaxed" must be lax, strict or none`)
+}
+
+func TestCookieEncryptRequiresSpecificCookieSecretLengths(t *testing.T) {
+	o := testOptions()
+	o.CookieEncrypt = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "cookie_encrypt == true")
+
+	o.CookieSecret = "16 bytes AES-128"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestSetClaimHeadersOptions(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "16 bytes AES-128"
+	o.SetClaimHeaders = []string{"sub:X-User-Id", "https://example.com/dept:x-dept"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []claimHeader{
+		{"sub", "X-User-Id"},
+		{"https://example.com/dept", "X-Dept"},
+	}, o.claimHeaders)
+
+	o.SetClaimHeaders = []string{"sub", "sub:", ":X-User-Id"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid setting: set-claim-header="sub" must be claim:Header-Name`)
+	assert.Contains(t, err.Error(), `invalid setting: set-claim-header="sub:" must be claim:Header-Name`)
+	assert.Contains(t, err.Error(), `invalid setting: set-claim-header=":X-User-Id" must be claim:Header-Name`)
+}
+
+func TestPingPath(t *testing.T) {
+	o := testOptions()
+	o.PingPath = "healthz"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid setting: ping-path="healthz" must start with /`)
+}
+
+func TestProxyPrefix(t *testing.T) {
+	o := testOptions()
+	o.ProxyPrefix = "/_auth/"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "/_auth", o.ProxyPrefix)
+
+	for _, prefix := range []string{"_auth", "/", ""} {
+		o.ProxyPrefix = prefix
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, prefix)
+		assert.Contains(t, err.Error(), "invalid setting: proxy-prefix=", prefix)
+	}
+}
+
+func TestPassIdTokenRequiresHeader(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "16 bytes AES-128"
+	o.PassIdToken = true
+	assert.Equal(t, nil, o.Validate())
+
+	o.IdTokenHeader = ""
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "id_token_header must be set when pass_id_token == true")
+}
+
+func TestOIDCEndSessionDiscovery(t *testing.T) {
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"issuer": %q,
+			"authorization_endpoint": "%[1]s/auth",
+			"token_endpoint": "%[1]s/token",
+			"jwks_uri": "%[1]s/keys",
+			"end_session_endpoint": "%[1]s/logout"
+		}`, issuer)
+	}))
+	defer server.Close()
+	issuer = server.URL
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = issuer
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.OIDCProvider)
+	assert.Equal(t, issuer+"/logout", p.EndSessionURL.String())
+}
+
+func newDiscoveryServer() *httptest.Server {
+	return startDiscoveryServer(httptest.NewServer)
+}
+
+// startDiscoveryServer serves a discovery document with start, such as
+// httptest.NewTLSServer.
+func startDiscoveryServer(start func(http.Handler) *httptest.Server) *httptest.Server {
+	var server *httptest.Server
+	server = start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"issuer": %q,
+			"authorization_endpoint": "%[1]s/auth",
+			"token_endpoint": "%[1]s/token",
+			"userinfo_endpoint": "%[1]s/userinfo",
+			"jwks_uri": "%[1]s/keys",
+			"end_session_endpoint": "%[1]s/logout"
+		}`, server.URL)
+	}))
+	return server
+}
+
+func TestOIDCDiscoveredEndpoints(t *testing.T) {
+	server := newDiscoveryServer()
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.OIDCProvider)
+	assert.Equal(t, server.URL+"/auth", p.Data().LoginURL.String())
+	assert.Equal(t, server.URL+"/token", p.Data().RedeemURL.String())
+	assert.Equal(t, server.URL+"/userinfo", p.Data().ValidateURL.String())
+	assert.Equal(t, server.URL+"/logout", p.EndSessionURL.String())
+}
+
+func TestOIDCExplicitEndpointsOverrideDiscovery(t *testing.T) {
+	server := newDiscoveryServer()
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.LoginURL = "https://idp.example.com/authorize"
+	o.RedeemURL = "https://idp.example.com/oauth/token"
+	o.ValidateURL = "https://idp.example.com/me"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.OIDCProvider)
+	assert.Equal(t, "https://idp.example.com/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, "https://idp.example.com/oauth/token", p.Data().RedeemURL.String())
+	assert.Equal(t, "https://idp.example.com/me", p.Data().ValidateURL.String())
+	assert.Equal(t, server.URL+"/logout", p.EndSessionURL.String())
+}
+
+func TestGitLabSelfHosted(t *testing.T) {
+	server := newDiscoveryServer()
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "gitlab"
+	o.OIDCIssuerURL = server.URL
+	o.GitLabGroups = []string{"mygroup/subgroup"}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.GitLabProvider)
+	assert.Equal(t, server.URL+"/auth", p.Data().LoginURL.String())
+	assert.Equal(t, server.URL+"/userinfo", p.Data().ValidateURL.String())
+	assert.Equal(t, true, p.ValidateGroup(&providers.SessionState{Groups: []string{"mygroup/subgroup"}}))
+	assert.Equal(t, false, p.ValidateGroup(&providers.SessionState{Groups: []string{"mygroup"}}))
+}
+
+func TestGitLabProviderOverrides(t *testing.T) {
+	assert.Equal(t, "https://gitlab.com", defaultOIDCIssuerURL("gitlab"))
+	assert.Equal(t, "", defaultOIDCIssuerURL("oidc"))
+
+	// a self-hosted instance replaces gitlab.com
+	server := newDiscoveryServer()
+	defer server.Close()
+	o := testOptions()
+	o.Provider = "gitlab"
+	o.OIDCIssuerURL = server.URL
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, server.URL, o.OIDCIssuerURL)
+	p := o.provider.(*providers.GitLabProvider)
+	assert.Equal(t, server.URL+"/auth", p.Data().LoginURL.String())
+	assert.Equal(t, server.URL+"/token", p.Data().RedeemURL.String())
+	assert.Equal(t, server.URL+"/userinfo", p.Data().ValidateURL.String())
+}
+
+func TestUserInfoFieldsOption(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, []string{"user", "email", "groups"}, o.UserInfoFields)
+
+	o.UserInfoFields = []string{"email", "access_token"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid setting: userinfo-field=\"access_token\" must be user, email or groups")
+}
+
+func TestTrustedProxies(t *testing.T) {
+	o := testOptions()
+	o.RealIPHeader = "X-Forwarded-For"
+	o.TrustedProxies = []string{"10.0.0.0/8, 192.168.1.1", "::1"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "X-Forwarded-For", o.realIP.header)
+	assert.Equal(t, 3, len(o.realIP.trusted))
+	assert.Equal(t, "192.168.1.1/32", o.realIP.trusted[1].String())
+	assert.Equal(t, "::1/128", o.realIP.trusted[2].String())
+
+	o.TrustedProxies = []string{"10.0.0.0/33"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: trusted-proxies")
+}
+
+func TestSkipJwtBearerTokensRequiresOIDC(t *testing.T) {
+	o := testOptions()
+	o.SkipJwtBearerTokens = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "skip-jwt-bearer-tokens requires an OpenID Connect based provider")
+}
+
+func TestExtraJwtIssuers(t *testing.T) {
+	server := newDiscoveryServer()
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.SkipJwtBearerTokens = true
+	o.ExtraJwtIssuers = []string{
+		server.URL + "=other-audience",
+		server.URL + "=batch-jobs",
+	}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.OIDCProvider)
+	assert.Equal(t, 1, len(p.ExtraBearerIssuers))
+	assert.Equal(t, []string{"other-audience", "batch-jobs"}, p.ExtraBearerIssuers[server.URL].Audiences)
+
+	o.ExtraJwtIssuers = []string{server.URL}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "must be given as issuer=audience")
+}
+
+func TestOIDCProviderRequiresIssuer(t *testing.T) {
+	o := testOptions()
+	o.Provider = "oidc"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "missing setting: oidc-issuer-url (required by the oidc provider)")
+}
+
+func TestUpstreamHost(t *testing.T) {
+	o := testOptions()
+	o.UpstreamHost = "bucket.s3-website.example.com:8080"
+	assert.Equal(t, nil, o.Validate())
+
+	for _, host := range []string{"http://bucket.example.com", "bucket.example.com/path"} {
+		o.UpstreamHost = host
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, host)
+		assert.Contains(t, err.Error(), "invalid setting: upstream-host=", host)
+	}
+}
+
+func TestStripPathPrefixOption(t *testing.T) {
+	o := testOptions()
+	o.StripPathPrefix = "/app"
+	assert.Equal(t, nil, o.Validate())
+
+	for _, prefix := range []string{"app", "/app/", "/"} {
+		o.StripPathPrefix = prefix
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, prefix)
+		assert.Contains(t, err.Error(), "invalid setting: strip-path-prefix=", prefix)
+	}
+}
+
+func TestStripResponseHeaderOption(t *testing.T) {
+	o := testOptions()
+	o.StripResponseHeaders = []string{"Server", "x-internal-trace"}
+	assert.Equal(t, nil, o.Validate())
+
+	for _, header := range []string{"", "X-Internal-Trace: 1", "X Internal"} {
+		o.StripResponseHeaders = []string{header}
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, header)
+		assert.Contains(t, err.Error(), "invalid setting: strip-response-header=", header)
+	}
+}
+
+func TestGoogleGroupCacheTTLNegative(t *testing.T) {
+	o := testOptions()
+	o.GoogleGroupCacheTTL = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: google-group-cache-ttl=-1m0s must not be negative")
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "16 bytes AES-128"
+	o.SessionIdleTimeout = 30 * time.Minute
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.SessionIdleTimeout = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: session-idle-timeout=-1m0s must not be negative")
+
+	// the last seen time is kept encrypted with the session
+	o = testOptions()
+	o.SessionIdleTimeout = 30 * time.Minute
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "cookie_secret must be 16, 24, or 32 bytes")
+	assert.Contains(t, err.Error(), "session_store == redis or session_idle_timeout != 0, but is")
+}
+
+func TestCompressionMinSizeNegative(t *testing.T) {
+	o := testOptions()
+	o.CompressionMinSize = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: compression-min-size=-1 must not be negative")
+}
+
+func TestOIDCIDTokenCacheSizeNegative(t *testing.T) {
+	o := testOptions()
+	o.OIDCIDTokenCache = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: oidc-id-token-cache-size=-1 must not be negative")
+}
+
+func TestCookieDomainMatchesRedirectURL(t *testing.T) {
+	for _, tc := range []struct {
+		domain string
+		valid  bool
+	}{
+		{".example.com", true},
+		{"example.com", true},
+		{"auth.example.com", true},
+		{".EXAMPLE.com", true},
+		{".example.org", false},
+		{"ample.com", false},
+		{"other.example.com", false},
+	} {
+		o := testOptions()
+		o.RedirectURL = "https://auth.example.com:8443/oauth2/callback"
+		o.CookieDomains = []string{tc.domain}
+		err := o.Validate()
+		if tc.valid {
+			assert.Equal(t, nil, err, tc.domain)
+			continue
+		}
+		assert.NotEqual(t, nil, err, tc.domain)
+		assert.Contains(t, err.Error(), fmt.Sprintf("invalid setting: cookie-domain=%q does not match the redirect-url host \"auth.example.com\"", tc.domain))
+	}
+
+	// one of several domains has to match
+	o := testOptions()
+	o.RedirectURL = "https://auth.example.com/oauth2/callback"
+	o.CookieDomains = []string{".example.org", ".example.com"}
+	assert.Equal(t, nil, o.Validate())
+	o.CookieDomains = []string{".example.org", ".example.net"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid setting: cookie-domain=".example.org,.example.net" does not match the redirect-url host "auth.example.com"`)
+
+	// without a redirect-url the host is only known per request
+	o = testOptions()
+	o.CookieDomains = []string{".example.org"}
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestCallbackRateLimitNegative(t *testing.T) {
+	o := testOptions()
+	o.CallbackRateLimit = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: callback-rate-limit=-1 must not be negative")
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*Options)
+		expected []string
+	}{
+		{
+			name: "missing credentials and authorization rule",
+			modify: func(o *Options) {
+				o.ClientID = ""
+				o.ClientSecret = ""
+				o.EmailDomains = nil
+			},
+			expected: []string{
+				"missing setting: client-id",
+				"missing setting: client-secret",
+				"missing setting for email validation: email-domain or authenticated-emails-file required.",
+			},
+		},
+		{
+			name: "short cookie secret for an encrypted cookie",
+			modify: func(o *Options) {
+				o.SetAuthorization = true
+				o.CookieRefresh = 2 * time.Hour
+				o.CookieExpire = time.Hour
+			},
+			expected: []string{
+				"cookie_secret must be 16, 24, or 32 bytes",
+				"set_authorization_header == true",
+				"cookie_refresh (2h0m0s) must be less than cookie_expire (1h0m0s)",
+			},
+		},
+		{
+			name: "endpoints that are not absolute URLs",
+			modify: func(o *Options) {
+				o.LoginURL = "idp.example.com/authorize"
+				o.RedeemURL = "ftp://idp.example.com/token"
+				o.ValidateURL = "https:///userinfo"
+			},
+			expected: []string{
+				`invalid setting: login-url="idp.example.com/authorize" must be an absolute http or https URL`,
+				`invalid setting: redeem-url="ftp://idp.example.com/token" must be an absolute http or https URL`,
+				`invalid setting: validate-url="https:///userinfo" must be an absolute http or https URL`,
+			},
+		},
+		{
+			name: "unsupported upstreams and provider",
+			modify: func(o *Options) {
+				o.Upstreams = []string{"/api/=unix:///var/run/api.sock", "http:///"}
+				o.Provider = "gogle"
+			},
+			expected: []string{
+				`invalid setting: upstream="/api/=unix:///var/run/api.sock" must be an http, https or file URL`,
+				`invalid setting: upstream="http:///" is missing a host`,
+				`invalid setting: provider="gogle" must be one of`,
+			},
+		},
+		{
+			name: "undiscoverable issuer",
+			modify: func(o *Options) {
+				o.Provider = "oidc"
+				o.OIDCIssuerURL = "http://127.0.0.1:1"
+				o.ClientSecret = ""
+			},
+			expected: []string{
+				"missing setting: client-secret",
+				`unable to discover oidc-issuer-url="http://127.0.0.1:1"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			tt.modify(o)
+			err := o.Validate()
+			if !assert.NotEqual(t, nil, err) {
+				return
+			}
+			assert.True(t, strings.HasPrefix(err.Error(), "Invalid configuration:\n  "))
+			for _, msg := range tt.expected {
+				assert.Contains(t, err.Error(), msg)
+			}
+			assert.NotContains(t, err.Error(), "missing setting: oidc-issuer-url")
+		})
+	}
+}
+
+func TestValidateHappyPath(t *testing.T) {
+	server := newDiscoveryServer()
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.CookieSecret = "32 byte secret for AES-256------"
+	o.SetAuthorization = true
+	o.CookieRefresh = time.Hour
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "/static/=file:///var/www/static/"}
+	o.ProfileURL = "https://idp.example.com/profile"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.proxyURLs))
+	assert.Equal(t, "https://idp.example.com/profile", o.provider.Data().ProfileURL.String())
+}
+
+func TestGoogleHostedDomain(t *testing.T) {
+	o := testOptions()
+	o.GoogleHostedDomain = "example.com"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "example.com", o.provider.(*providers.GoogleProvider).HostedDomain)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GoogleHostedDomain = "example.com"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "google-hosted-domain requires the google provider")
+}
+
+func TestSSLInsecureSkipVerify(t *testing.T) {
+	// the test server presents a self-signed certificate
+	server := startDiscoveryServer(httptest.NewTLSServer)
+	defer server.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "unable to discover oidc-issuer-url")
+	assert.Contains(t, err.Error(), "x509")
+	assert.Equal(t, http.DefaultClient, o.provider.Data().HTTPClient)
+
+	o = testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.SSLInsecureSkipVerify = true
+	assert.Equal(t, nil, o.Validate())
+	client := o.provider.Data().HTTPClient
+	assert.Equal(t, true, client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	assert.Equal(t, server.URL+"/token", o.provider.Data().RedeemURL.String())
+	// the providers get the client, http.DefaultClient is left alone
+	assert.NotEqual(t, http.DefaultClient, client)
+	assert.Equal(t, nil, http.DefaultClient.Transport)
+}
@@ -0,0 +1,63 @@
+package providers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+)
+
+// AuthRequest holds the per-login values a provider binds to the authorize
+// redirect and needs again when the code is redeemed.
+type AuthRequest struct {
+	CodeVerifier string
+	Nonce        string
+}
+
+// AuthRequestProvider is implemented by providers that need an AuthRequest
+// carried across the authorize redirect, e.g. for PKCE or an OIDC nonce.
+type AuthRequestProvider interface {
+	// NewAuthRequest returns nil when the provider has nothing to track.
+	NewAuthRequest() (*AuthRequest, error)
+	GetAuthRequestLoginURL(redirectURI, finalRedirect string, r *AuthRequest) string
+	RedeemAuthRequest(redirectURL, code string, r *AuthRequest) (*SessionState, error)
+}
+
+// Encode serializes the request for storage in a cookie
+func (r *AuthRequest) Encode() string {
+	v := url.Values{}
+	if r.CodeVerifier != "" {
+		v.Set("code_verifier", r.CodeVerifier)
+	}
+	if r.Nonce != "" {
+		v.Set("nonce", r.Nonce)
+	}
+	return v.Encode()
+}
+
+// DecodeAuthRequest deserializes a request stored with Encode
+func DecodeAuthRequest(v string) (*AuthRequest, error) {
+	values, err := url.ParseQuery(v)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthRequest{
+		CodeVerifier: values.Get("code_verifier"),
+		Nonce:        values.Get("nonce"),
+	}, nil
+}
+
+// NewCodeVerifier returns a random RFC 7636 code verifier
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallengeS256 derives the S256 code challenge for a code verifier
+func CodeChallengeS256(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
@@ -1,6 +1,8 @@
 package providers
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
@@ -8,11 +10,21 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"path"
 )
 
 type AzureProvider struct {
 	*ProviderData
 	Tenant string
+	// Groups restricts logins to members of these groups, given by display
+	// name or object ID.
+	Groups []string
+	// ResolveGroupNames looks the display names of the user's groups up at
+	// Microsoft Graph, since the groups claim only holds their object IDs.
+	ResolveGroupNames bool
+	// GraphURL is the Microsoft Graph API base URL, used to resolve group
+	// names and to list the groups when they do not fit in the token.
+	GraphURL *url.URL
 }
 
 func NewAzureProvider(p *ProviderData) *AzureProvider {
@@ -36,7 +48,14 @@ func NewAzureProvider(p *ProviderData) *AzureProvider {
 		p.Scope = "openid"
 	}
 
-	return &AzureProvider{ProviderData: p}
+	return &AzureProvider{
+		ProviderData: p,
+		GraphURL: &url.URL{
+			Scheme: "https",
+			Host:   "graph.microsoft.com",
+			Path:   "/v1.0",
+		},
+	}
 }
 
 func (p *AzureProvider) Configure(tenant string) {
@@ -96,7 +115,7 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 	req.Header = getAzureHeader(s.AccessToken)
 
-	json, err := api.Request(req)
+	json, err := api.RequestWithClient(p.httpClient(), req)
 
 	if err != nil {
 		return "", err
@@ -122,3 +141,118 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	return email, err
 }
+
+// SetGroupRestriction restricts logins to members of the given groups, as
+// recorded on the session when it was created.
+func (p *AzureProvider) SetGroupRestriction(groups []string, resolveNames bool) {
+	p.Groups = groups
+	p.ResolveGroupNames = resolveNames
+}
+
+func (p *AzureProvider) Redeem(redirectURL, code string) (*SessionState, error) {
+	token, err := p.redeemToken(redirectURL, code)
+	if err != nil {
+		return nil, err
+	}
+	s := &SessionState{AccessToken: token.AccessToken}
+	if token.IDToken != "" {
+		s.Groups, err = p.sessionGroups(token.IDToken, token.AccessToken)
+		if err != nil {
+			// the session is still usable, it only fails group restrictions
+			log.Printf("could not read azure groups: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// sessionGroups returns the object IDs of the user's groups, followed by
+// their display names if ResolveGroupNames is set. The IDs are read from the
+// groups claim of the ID token or, when the user is in more groups than fit
+// in a token ("groups overage"), listed with Microsoft Graph.
+func (p *AzureProvider) sessionGroups(idToken, accessToken string) ([]string, error) {
+	claims, err := IdTokenClaims(idToken)
+	if err != nil {
+		return nil, err
+	}
+	ids := claimStrings(claims, "groups")
+	if _, ok := claimValue(claims, "_claim_names.groups"); ok {
+		// the token points at _claim_sources instead of listing the groups
+		if ids, err = p.memberGroups(accessToken); err != nil {
+			return nil, err
+		}
+	}
+	if !p.ResolveGroupNames || len(ids) == 0 {
+		return ids, nil
+	}
+	names, err := p.groupNames(accessToken, ids)
+	if err != nil {
+		return ids, err
+	}
+	return append(ids, names...), nil
+}
+
+// graphRequest posts the JSON encoded params to the Microsoft Graph API
+// method at apiPath and decodes the response into v.
+func (p *AzureProvider) graphRequest(accessToken, apiPath string, params interface{}, v interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	endpoint := *p.GraphURL
+	endpoint.Path = path.Join(endpoint.Path, apiPath)
+	req, err := http.NewRequest("POST", endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = getAzureHeader(accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	return api.RequestJsonWithClient(p.httpClient(), req, v)
+}
+
+// memberGroups lists the object IDs of all groups the user is a member of.
+func (p *AzureProvider) memberGroups(accessToken string) ([]string, error) {
+	// https://docs.microsoft.com/en-us/graph/api/directoryobject-getmembergroups
+	var response struct {
+		Value []string `json:"value"`
+	}
+	err := p.graphRequest(accessToken, "/me/getMemberGroups",
+		map[string]bool{"securityEnabledOnly": false}, &response)
+	return response.Value, err
+}
+
+// groupNames looks up the display names of the groups with the given IDs.
+func (p *AzureProvider) groupNames(accessToken string, ids []string) ([]string, error) {
+	// https://docs.microsoft.com/en-us/graph/api/directoryobject-getbyids
+	var response struct {
+		Value []struct {
+			DisplayName string `json:"displayName"`
+		} `json:"value"`
+	}
+	err := p.graphRequest(accessToken, "/directoryObjects/getByIds",
+		map[string][]string{"ids": ids, "types": {"group"}}, &response)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(response.Value))
+	for _, group := range response.Value {
+		if group.DisplayName != "" {
+			names = append(names, group.DisplayName)
+		}
+	}
+	return names, nil
+}
+
+// ValidateGroup checks that the user is a member of one of the configured
+// groups, matching both the groups' object IDs and their display names.
+func (p *AzureProvider) ValidateGroup(s *SessionState) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, group := range s.Groups {
+		if contains(p.Groups, group) {
+			return true
+		}
+	}
+	log.Printf("%s is not a member of any of the azure groups %q", s.Email, p.Groups)
+	return false
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -199,3 +200,136 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+// newTestAzureGraphServer serves the Microsoft Graph calls used to list and
+// name the user's groups, counting the calls made.
+func newTestAzureGraphServer(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(403)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/v1.0/me/getMemberGroups":
+				w.Write([]byte(`{"value": ["id-engineering", "id-admins"]}`))
+			case "/v1.0/directoryObjects/getByIds":
+				var params struct {
+					IDs []string `json:"ids"`
+				}
+				json.NewDecoder(r.Body).Decode(&params)
+				names := map[string]string{"id-engineering": "Engineering", "id-admins": "Admins"}
+				var value []map[string]string
+				for _, id := range params.IDs {
+					value = append(value, map[string]string{"id": id, "displayName": names[id]})
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func testAzureRedeem(t *testing.T, p *AzureProvider, claims map[string]interface{}) *SessionState {
+	tokenRequests := 0
+	tokenServer := newTestTokenServer(&tokenRequests, func() string {
+		return `{"access_token": "imaginary_access_token", "token_type": "Bearer", ` +
+			`"id_token": "` + newSignedTestJWT(t, claims) + `"}`
+	})
+	defer tokenServer.Close()
+
+	p.RedeemURL, _ = url.Parse(tokenServer.URL)
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "imaginary_access_token", session.AccessToken)
+	return session
+}
+
+func TestAzureProviderInlineGroups(t *testing.T) {
+	graphRequests := 0
+	graph := newTestAzureGraphServer(&graphRequests)
+	defer graph.Close()
+
+	p := testAzureProvider("")
+	p.GraphURL, _ = url.Parse(graph.URL + "/v1.0")
+	p.SetGroupRestriction([]string{"id-engineering"}, false)
+
+	session := testAzureRedeem(t, p, map[string]interface{}{
+		"groups": []string{"id-sales", "id-engineering"},
+	})
+	assert.Equal(t, []string{"id-sales", "id-engineering"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+	assert.Equal(t, 0, graphRequests)
+
+	p.SetGroupRestriction([]string{"Engineering"}, false)
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestAzureProviderResolveGroupNames(t *testing.T) {
+	graphRequests := 0
+	graph := newTestAzureGraphServer(&graphRequests)
+	defer graph.Close()
+
+	p := testAzureProvider("")
+	p.GraphURL, _ = url.Parse(graph.URL + "/v1.0")
+	p.SetGroupRestriction([]string{"Engineering"}, true)
+
+	session := testAzureRedeem(t, p, map[string]interface{}{
+		"groups": []string{"id-engineering"},
+	})
+	assert.Equal(t, []string{"id-engineering", "Engineering"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+	assert.Equal(t, 1, graphRequests)
+
+	// raw object IDs still match
+	p.SetGroupRestriction([]string{"id-engineering"}, true)
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	p.SetGroupRestriction([]string{"Admins"}, true)
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestAzureProviderGroupsOverage(t *testing.T) {
+	graphRequests := 0
+	graph := newTestAzureGraphServer(&graphRequests)
+	defer graph.Close()
+
+	p := testAzureProvider("")
+	p.GraphURL, _ = url.Parse(graph.URL + "/v1.0")
+	p.SetGroupRestriction([]string{"id-admins"}, false)
+
+	session := testAzureRedeem(t, p, map[string]interface{}{
+		"_claim_names": map[string]string{"groups": "src1"},
+		"_claim_sources": map[string]interface{}{
+			"src1": map[string]string{
+				"endpoint": "https://graph.windows.net/tenant/users/123456789/getMemberObjects",
+			},
+		},
+	})
+	assert.Equal(t, []string{"id-engineering", "id-admins"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+	assert.Equal(t, 1, graphRequests)
+}
+
+func TestAzureProviderGroupsOverageFailure(t *testing.T) {
+	graphRequests := 0
+	graph := newTestAzureGraphServer(&graphRequests)
+	defer graph.Close()
+
+	p := testAzureProvider("")
+	p.GraphURL, _ = url.Parse(graph.URL + "/unknown")
+	p.SetGroupRestriction([]string{"id-admins"}, false)
+
+	session := testAzureRedeem(t, p, map[string]interface{}{
+		"_claim_names": map[string]string{"groups": "src1"},
+	})
+	assert.Equal(t, 0, len(session.Groups))
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestAzureProviderWithoutGroupRestriction(t *testing.T) {
+	p := testAzureProvider("")
+	assert.Equal(t, true, p.ValidateGroup(&SessionState{}))
+}
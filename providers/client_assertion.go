@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// clientAssertionType is the RFC 7523 client_assertion_type for a JWT
+// signed by the client (private_key_jwt).
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// LoadClientJWTKey reads the PEM encoded RSA private key used to sign
+// private_key_jwt client assertions, in PKCS #1 or PKCS #8 form. The JWTs
+// forwarded to upstreams (-forward-jwt-key) are signed with a key read the
+// same way.
+func LoadClientJWTKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key in %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("only RSA private keys are supported")
+	}
+	return rsaKey, nil
+}
+
+// newClientAssertion signs a client assertion identifying clientID to the
+// token endpoint at audience, valid for five minutes.
+func newClientAssertion(key *rsa.PrivateKey, clientID, audience string, now time.Time) (string, error) {
+	jti, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"jti": jti,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
@@ -0,0 +1,66 @@
+package providers
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func writeTestPEM(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "client-jwt-key")
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	return f.Name()
+}
+
+func TestLoadClientJWTKey(t *testing.T) {
+	pkcs1 := writeTestPEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(testOIDCSigningKey))
+	defer os.Remove(pkcs1)
+	key, err := LoadClientJWTKey(pkcs1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testOIDCSigningKey.N, key.N)
+
+	der, err := x509.MarshalPKCS8PrivateKey(testOIDCSigningKey)
+	assert.Equal(t, nil, err)
+	pkcs8 := writeTestPEM(t, "PRIVATE KEY", der)
+	defer os.Remove(pkcs8)
+	key, err = LoadClientJWTKey(pkcs8)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testOIDCSigningKey.N, key.N)
+
+	invalid := writeTestPEM(t, "PRIVATE KEY", []byte("not a key"))
+	defer os.Remove(invalid)
+	_, err = LoadClientJWTKey(invalid)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNewClientAssertion(t *testing.T) {
+	now := time.Now()
+	assertion, err := newClientAssertion(testOIDCSigningKey, "client", "https://issuer.example.com/token", now)
+	assert.Equal(t, nil, err)
+
+	jws, err := jose.ParseSigned(assertion)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "RS256", jws.Signatures[0].Header.Algorithm)
+	payload, err := jws.Verify(&testOIDCSigningKey.PublicKey)
+	assert.Equal(t, nil, err)
+
+	var claims map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "client", claims["iss"])
+	assert.Equal(t, "client", claims["sub"])
+	assert.Equal(t, "https://issuer.example.com/token", claims["aud"])
+	assert.NotEqual(t, "", claims["jti"])
+	assert.Equal(t, float64(now.Add(5*time.Minute).Unix()), claims["exp"])
+
+	other, _ := newClientAssertion(testOIDCSigningKey, "client", "https://issuer.example.com/token", now)
+	assert.NotEqual(t, assertion, other)
+}
@@ -65,7 +65,7 @@ func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
 		Email string
 	}
 	var r result
-	err = api.RequestJson(req, &r)
+	err = api.RequestJsonWithClient(p.httpClient(), req, &r)
 	if err != nil {
 		return "", err
 	}
@@ -2,13 +2,13 @@ package providers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
-	"strconv"
 	"strings"
 )
 
@@ -55,58 +55,95 @@ func (p *GitHubProvider) SetOrgTeam(org, team string) {
 	}
 }
 
-func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/#list-your-organizations
-
-	var orgs []struct {
-		Login string `json:"login"`
-	}
-
-	type orgsPage []struct {
-		Login string `json:"login"`
+// apiURL returns the URL of the GitHub API endpoint at apiPath, below the
+// ValidateURL so that GitHub Enterprise is supported.
+func (p *GitHubProvider) apiURL(apiPath string, params url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(p.ValidateURL.Path, apiPath),
+		RawQuery: params.Encode(),
 	}
+}
 
-	pn := 1
-	for {
-		params := url.Values{
-			"limit": {"200"},
-			"page":  {strconv.Itoa(pn)},
-		}
-
-		endpoint := &url.URL{
-			Scheme:   p.ValidateURL.Scheme,
-			Host:     p.ValidateURL.Host,
-			Path:     path.Join(p.ValidateURL.Path, "/user/orgs"),
-			RawQuery: params.Encode(),
+// getPages calls a paginated GitHub API endpoint and passes the body of
+// every page to decode, following the rel="next" links of the Link header.
+// https://developer.github.com/v3/#pagination
+func (p *GitHubProvider) getPages(accessToken string, endpoint *url.URL, decode func(body []byte) error) error {
+	for next := endpoint; next != nil; {
+		req, err := http.NewRequest("GET", next.String(), nil)
+		if err != nil {
+			return fmt.Errorf("could not create new GET request: %v", err)
 		}
-		req, _ := http.NewRequest("GET", endpoint.String(), nil)
 		req.Header.Set("Accept", "application/vnd.github.v3+json")
 		req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := p.httpClient().Do(req)
 		if err != nil {
-			return false, err
+			return err
 		}
 
 		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			return false, err
+			return err
 		}
 		if resp.StatusCode != 200 {
-			return false, fmt.Errorf(
-				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+			return fmt.Errorf(
+				"got %d from %q %s", resp.StatusCode, next.String(), body)
+		}
+		if err := decode(body); err != nil {
+			return fmt.Errorf("%s unmarshaling %s", err, body)
 		}
 
-		var op orgsPage
-		if err := json.Unmarshal(body, &op); err != nil {
-			return false, err
+		next = nextPage(next, resp.Header.Get("Link"))
+	}
+	return nil
+}
+
+// nextPage returns the rel="next" URL of a Link header, or nil on the last
+// page. Links to another host are not followed, so that the access token is
+// only ever sent to the API.
+func nextPage(current *url.URL, link string) *url.URL {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		target := strings.TrimSpace(parts[0])
+		if len(target) < 2 || target[0] != '<' || target[len(target)-1] != '>' {
+			continue
 		}
-		if len(op) == 0 {
-			break
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) != `rel="next"` {
+				continue
+			}
+			u, err := current.Parse(target[1 : len(target)-1])
+			if err != nil || u.Host != current.Host {
+				return nil
+			}
+			return u
 		}
+	}
+	return nil
+}
 
-		orgs = append(orgs, op...)
-		pn += 1
+var githubPageParams = url.Values{"per_page": {"100"}}
+
+func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
+	// https://developer.github.com/v3/orgs/#list-your-organizations
+
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	err := p.getPages(accessToken, p.apiURL("/user/orgs", githubPageParams), func(body []byte) error {
+		var page []struct {
+			Login string `json:"login"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+		orgs = append(orgs, page...)
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
 
 	var presentOrgs []string
@@ -122,48 +159,29 @@ func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 	return false, nil
 }
 
+type githubTeam struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	Org  struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
 func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	// https://developer.github.com/v3/orgs/teams/#list-user-teams
 
-	var teams []struct {
-		Name string `json:"name"`
-		Slug string `json:"slug"`
-		Org  struct {
-			Login string `json:"login"`
-		} `json:"organization"`
-	}
-
-	params := url.Values{
-		"limit": {"200"},
-	}
-
-	endpoint := &url.URL{
-		Scheme:   p.ValidateURL.Scheme,
-		Host:     p.ValidateURL.Host,
-		Path:     path.Join(p.ValidateURL.Path, "/user/teams"),
-		RawQuery: params.Encode(),
-	}
-	req, _ := http.NewRequest("GET", endpoint.String(), nil)
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false, err
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	var teams []githubTeam
+	err := p.getPages(accessToken, p.apiURL("/user/teams", githubPageParams), func(body []byte) error {
+		var page []githubTeam
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+		teams = append(teams, page...)
+		return nil
+	})
 	if err != nil {
 		return false, err
 	}
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf(
-			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
-	}
-
-	if err := json.Unmarshal(body, &teams); err != nil {
-		return false, fmt.Errorf("%s unmarshaling %s", err, body)
-	}
 
 	var hasOrg bool
 	presentOrgs := make(map[string]bool)
@@ -194,61 +212,60 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	return false, nil
 }
 
-func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
-
-	var emails []struct {
-		Email   string `json:"email"`
-		Primary bool   `json:"primary"`
-	}
-
-	// if we require an Org or Team, check that first
-	if p.Org != "" {
-		if p.Team != "" {
-			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		} else {
-			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		}
-	}
-
-	endpoint := &url.URL{
-		Scheme: p.ValidateURL.Scheme,
-		Host:   p.ValidateURL.Host,
-		Path:   path.Join(p.ValidateURL.Path, "/user/emails"),
+// ValidateGroup checks that the user is a member of the configured
+// organization and, if set, of one of the configured teams.
+func (p *GitHubProvider) ValidateGroup(s *SessionState) bool {
+	if p.Org == "" {
+		return true
 	}
-	req, _ := http.NewRequest("GET", endpoint.String(), nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", s.AccessToken))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+	var ok bool
+	var err error
+	if p.Team != "" {
+		ok, err = p.hasOrgAndTeam(s.AccessToken)
+	} else {
+		ok, err = p.hasOrg(s.AccessToken)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
 	if err != nil {
-		return "", err
+		log.Printf("failed checking GitHub membership of %s: %s", s.Email, err)
+		return false
 	}
+	return ok
+}
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("got %d from %q %s",
-			resp.StatusCode, endpoint.String(), body)
-	}
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
 
-	log.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+// GetEmailAddress returns the user's primary email address, provided that
+// GitHub has verified it.
+func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
+	// https://developer.github.com/v3/users/emails/#list-email-addresses-for-a-user
 
-	if err := json.Unmarshal(body, &emails); err != nil {
-		return "", fmt.Errorf("%s unmarshaling %s", err, body)
+	var emails []githubEmail
+	err := p.getPages(s.AccessToken, p.apiURL("/user/emails", githubPageParams), func(body []byte) error {
+		var page []githubEmail
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+		emails = append(emails, page...)
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
 	for _, email := range emails {
 		if email.Primary {
+			if !email.Verified {
+				return "", fmt.Errorf("primary email %q is not verified", email.Email)
+			}
 			return email.Email, nil
 		}
 	}
 
-	return "", nil
+	return "", errors.New("no primary email address")
 }
 
 func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
@@ -269,7 +286,7 @@ func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("token %s", s.AccessToken))
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -30,8 +31,7 @@ func testGitHubProvider(hostname string) *GitHubProvider {
 func testGitHubBackend(payload []string) *httptest.Server {
 	pathToQueryMap := map[string][]string{
 		"/user":        []string{""},
-		"/user/emails": []string{""},
-		"/user/orgs":   []string{"limit=200&page=1", "limit=200&page=2", "limit=200&page=3"},
+		"/user/emails": []string{"per_page=100"},
 	}
 
 	return httptest.NewServer(http.HandlerFunc(
@@ -57,6 +57,34 @@ func testGitHubBackend(payload []string) *httptest.Server {
 		}))
 }
 
+// testGitHubPagedBackend serves every path in pages one page at a time,
+// linking to the next page in the Link header like the GitHub API.
+func testGitHubPagedBackend(pages map[string][]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "token imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			payloads, ok := pages[r.URL.Path]
+			if !ok || r.URL.Query().Get("per_page") != "100" {
+				w.WriteHeader(404)
+				return
+			}
+			page := 1
+			fmt.Sscan(r.URL.Query().Get("page"), &page)
+			if page < 1 || page > len(payloads) {
+				w.Write([]byte("[]"))
+				return
+			}
+			if page < len(payloads) {
+				w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?per_page=100&page=%d>; rel="next"`,
+					r.Host, r.URL.Path, page+1))
+			}
+			w.Write([]byte(payloads[page-1]))
+		}))
+}
+
 func TestGitHubProviderDefaults(t *testing.T) {
 	p := testGitHubProvider("")
 	assert.NotEqual(t, nil, p)
@@ -98,7 +126,7 @@ func TestGitHubProviderOverrides(t *testing.T) {
 }
 
 func TestGitHubProviderGetEmailAddress(t *testing.T) {
-	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "primary": true} ]`})
+	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "primary": true, "verified": true} ]`})
 	defer b.Close()
 
 	bURL, _ := url.Parse(b.URL)
@@ -110,17 +138,30 @@ func TestGitHubProviderGetEmailAddress(t *testing.T) {
 	assert.Equal(t, "michael.bland@gsa.gov", email)
 }
 
-func TestGitHubProviderGetEmailAddressWithOrg(t *testing.T) {
-	b := testGitHubBackend([]string{
-		`[ {"email": "michael.bland@gsa.gov", "primary": true, "login":"testorg"} ]`,
-		`[ {"email": "michael.bland1@gsa.gov", "primary": true, "login":"testorg1"} ]`,
-		`[ ]`,
+func TestGitHubProviderGetEmailAddressUnverified(t *testing.T) {
+	b := testGitHubBackend([]string{`[ {"email": "michael.bland@gsa.gov", "primary": true, "verified": false} ]`})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, `primary email "michael.bland@gsa.gov" is not verified`, err.Error())
+	assert.Equal(t, "", email)
+}
+
+func TestGitHubProviderGetEmailAddressPrimaryOnLaterPage(t *testing.T) {
+	b := testGitHubPagedBackend(map[string][]string{
+		"/user/emails": []string{
+			`[ {"email": "mbland@example.com", "primary": false, "verified": true} ]`,
+			`[ {"email": "michael.bland@gsa.gov", "primary": true, "verified": true} ]`,
+		},
 	})
 	defer b.Close()
 
 	bURL, _ := url.Parse(b.URL)
 	p := testGitHubProvider(bURL.Host)
-	p.Org = "testorg1"
 
 	session := &SessionState{AccessToken: "imaginary_access_token"}
 	email, err := p.GetEmailAddress(session)
@@ -128,6 +169,86 @@ func TestGitHubProviderGetEmailAddressWithOrg(t *testing.T) {
 	assert.Equal(t, "michael.bland@gsa.gov", email)
 }
 
+func TestGitHubProviderValidateGroupWithoutOrg(t *testing.T) {
+	b := testGitHubPagedBackend(map[string][]string{})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	assert.Equal(t, true, p.ValidateGroup(session))
+}
+
+func TestGitHubProviderValidateGroupOrg(t *testing.T) {
+	b := testGitHubPagedBackend(map[string][]string{
+		"/user/orgs": []string{
+			`[ {"login": "testorg"} ]`,
+			`[ {"login": "testorg1"}, {"login": "testorg2"} ]`,
+		},
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+
+	p.SetOrgTeam("testorg1", "")
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	p.SetOrgTeam("otherorg", "")
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestGitHubProviderValidateGroupTeam(t *testing.T) {
+	b := testGitHubPagedBackend(map[string][]string{
+		"/user/teams": []string{
+			`[ {"name": "Admins", "slug": "admins", "organization": {"login": "otherorg"}} ]`,
+			`[ {"name": "Devs", "slug": "devs", "organization": {"login": "testorg"}} ]`,
+		},
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+
+	p.SetOrgTeam("testorg", "ops,devs")
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	p.SetOrgTeam("testorg", "admins")
+	assert.Equal(t, false, p.ValidateGroup(session))
+
+	p.SetOrgTeam("thirdorg", "devs")
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestGitHubProviderValidateGroupFailedRequest(t *testing.T) {
+	b := testGitHubPagedBackend(map[string][]string{})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam("testorg", "")
+
+	session := &SessionState{AccessToken: "unexpected_access_token"}
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestGitHubNextPage(t *testing.T) {
+	current, _ := url.Parse("https://api.github.com/user/orgs?per_page=100")
+	link := `<https://api.github.com/user/orgs?per_page=100&page=2>; rel="next", ` +
+		`<https://api.github.com/user/orgs?per_page=100&page=5>; rel="last"`
+	assert.Equal(t, "https://api.github.com/user/orgs?per_page=100&page=2",
+		nextPage(current, link).String())
+
+	assert.Equal(t, (*url.URL)(nil), nextPage(current, ""))
+	assert.Equal(t, (*url.URL)(nil), nextPage(current,
+		`<https://api.github.com/user/orgs?page=1>; rel="first"`))
+	assert.Equal(t, (*url.URL)(nil), nextPage(current,
+		`<https://evil.example.com/user/orgs?page=2>; rel="next"`))
+}
+
 // Note that trying to trigger the "failed building request" case is not
 // practical, since the only way it can fail is if the URL fails to parse.
 func TestGitHubProviderGetEmailAddressFailedRequest(t *testing.T) {
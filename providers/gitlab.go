@@ -1,58 +1,47 @@
 package providers
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/http"
-	"net/url"
+	"os"
 
 	"github.com/bitly/oauth2_proxy/api"
+	"github.com/coreos/go-oidc"
 )
 
+// GitLabProvider is an OpenID Connect provider for GitLab, either gitlab.com
+// or a self-hosted instance. GitLab only lists the user's direct groups in
+// the ID token, so the full paths of all their groups are read from the
+// groups claim of the userinfo endpoint instead.
 type GitLabProvider struct {
-	*ProviderData
+	*OIDCProvider
 }
 
 func NewGitLabProvider(p *ProviderData) *GitLabProvider {
+	g := &GitLabProvider{OIDCProvider: NewOIDCProvider(p)}
 	p.ProviderName = "GitLab"
-	if p.LoginURL == nil || p.LoginURL.String() == "" {
-		p.LoginURL = &url.URL{
-			Scheme: "https",
-			Host:   "gitlab.com",
-			Path:   "/oauth/authorize",
-		}
-	}
-	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
-		p.RedeemURL = &url.URL{
-			Scheme: "https",
-			Host:   "gitlab.com",
-			Path:   "/oauth/token",
-		}
-	}
-	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
-		p.ValidateURL = &url.URL{
-			Scheme: "https",
-			Host:   "gitlab.com",
-			Path:   "/api/v4/user",
-		}
-	}
-	if p.Scope == "" {
-		p.Scope = "read_user"
-	}
-	return &GitLabProvider{ProviderData: p}
+	g.Logger = NewLogger(os.Stderr, "[gitlab] ")
+	g.groupsFallback = g.fetchGroups
+	return g
 }
 
-func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
-
-	req, err := http.NewRequest("GET",
-		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
-	if err != nil {
-		log.Printf("failed building request %s", err)
-		return "", err
+// fetchGroups reads the groups claim from the userinfo endpoint,
+// authenticating with the user's access token.
+func (p *GitLabProvider) fetchGroups(ctx context.Context, idToken *oidc.IDToken, accessToken string) ([]string, error) {
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		return nil, fmt.Errorf("no userinfo endpoint configured (validate-url)")
 	}
-	json, err := api.Request(req)
+	req, err := http.NewRequest("GET", p.ValidateURL.String(), nil)
 	if err != nil {
-		log.Printf("failed making request %s", err)
-		return "", err
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var claims map[string]interface{}
+	if err := api.RequestJsonWithClient(p.httpClient(), req.WithContext(ctx), &claims); err != nil {
+		return nil, err
 	}
-	return json.Get("email").String()
+	p.Logger.Debugf(`msg="groups read from userinfo" subject=%q claim=%q`, idToken.Subject, p.GroupsClaim)
+	return claimStrings(claims, p.GroupsClaim), nil
 }
@@ -1,7 +1,8 @@
 package providers
 
 import (
-	"net/http"
+	"context"
+	"encoding/json"
 	"net/http/httptest"
 	"net/url"
 	"testing"
@@ -9,120 +10,94 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func testGitLabProvider(hostname string) *GitLabProvider {
-	p := NewGitLabProvider(
-		&ProviderData{
-			ProviderName: "",
-			LoginURL:     &url.URL{},
-			RedeemURL:    &url.URL{},
-			ProfileURL:   &url.URL{},
-			ValidateURL:  &url.URL{},
-			Scope:        ""})
-	if hostname != "" {
-		updateURL(p.Data().LoginURL, hostname)
-		updateURL(p.Data().RedeemURL, hostname)
-		updateURL(p.Data().ProfileURL, hostname)
-		updateURL(p.Data().ValidateURL, hostname)
-	}
+func newTestGitLabProvider() *GitLabProvider {
+	p := NewGitLabProvider(newTestOIDCProviderData())
+	p.Verifier = newTestOIDCVerifier()
 	return p
 }
 
-func testGitLabBackend(payload string) *httptest.Server {
-	path := "/api/v4/user"
-	query := "access_token=imaginary_access_token"
-
-	return httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			url := r.URL
-			if url.Path != path || url.RawQuery != query {
-				w.WriteHeader(404)
-			} else {
-				w.WriteHeader(200)
-				w.Write([]byte(payload))
-			}
-		}))
+// newTestGitLabUserInfoServer serves a GitLab userinfo response listing the
+// given group paths.
+func newTestGitLabUserInfoServer(requests *int, groups []string) *httptest.Server {
+	body, _ := json.Marshal(map[string]interface{}{
+		"sub":                "123456789",
+		"email":              "jdoe@example.com",
+		"preferred_username": "jdoe",
+		"groups":             groups,
+	})
+	return newTestBearerAPIServer(requests, "", string(body))
 }
 
-func TestGitLabProviderDefaults(t *testing.T) {
-	p := testGitLabProvider("")
-	assert.NotEqual(t, nil, p)
-	assert.Equal(t, "GitLab", p.Data().ProviderName)
-	assert.Equal(t, "https://gitlab.com/oauth/authorize",
-		p.Data().LoginURL.String())
-	assert.Equal(t, "https://gitlab.com/oauth/token",
-		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://gitlab.com/api/v4/user",
-		p.Data().ValidateURL.String())
-	assert.Equal(t, "read_user", p.Data().Scope)
+// newTestGitLabSession creates a session from an ID token without the
+// groups claim, as GitLab issues them.
+func newTestGitLabSession(t *testing.T, p *GitLabProvider) (*SessionState, error) {
+	return newTestOIDCSession(t, p.OIDCProvider, map[string]interface{}{
+		"groups_direct": []string{"mygroup"},
+	})
 }
 
-func TestGitLabProviderOverrides(t *testing.T) {
-	p := NewGitLabProvider(
-		&ProviderData{
-			LoginURL: &url.URL{
-				Scheme: "https",
-				Host:   "example.com",
-				Path:   "/oauth/auth"},
-			RedeemURL: &url.URL{
-				Scheme: "https",
-				Host:   "example.com",
-				Path:   "/oauth/token"},
-			ValidateURL: &url.URL{
-				Scheme: "https",
-				Host:   "example.com",
-				Path:   "/api/v4/user"},
-			Scope: "profile"})
-	assert.NotEqual(t, nil, p)
+func TestGitLabProviderDefaults(t *testing.T) {
+	p := newTestGitLabProvider()
 	assert.Equal(t, "GitLab", p.Data().ProviderName)
-	assert.Equal(t, "https://example.com/oauth/auth",
-		p.Data().LoginURL.String())
-	assert.Equal(t, "https://example.com/oauth/token",
-		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://example.com/api/v4/user",
-		p.Data().ValidateURL.String())
-	assert.Equal(t, "profile", p.Data().Scope)
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+	assert.Equal(t, "groups", p.GroupsClaim)
 }
 
-func TestGitLabProviderGetEmailAddress(t *testing.T) {
-	b := testGitLabBackend("{\"email\": \"michael.bland@gsa.gov\"}")
-	defer b.Close()
+func TestGitLabProviderGroupsFromUserInfo(t *testing.T) {
+	requests := 0
+	server := newTestGitLabUserInfoServer(&requests, []string{"mygroup", "mygroup/subgroup"})
+	defer server.Close()
 
-	b_url, _ := url.Parse(b.URL)
-	p := testGitLabProvider(b_url.Host)
+	p := newTestGitLabProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
 
-	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
+	session, err := newTestGitLabSession(t, p)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"mygroup", "mygroup/subgroup"}, session.Groups)
+	assert.Equal(t, 1, requests)
 }
 
-// Note that trying to trigger the "failed building request" case is not
-// practical, since the only way it can fail is if the URL fails to parse.
-func TestGitLabProviderGetEmailAddressFailedRequest(t *testing.T) {
-	b := testGitLabBackend("unused payload")
-	defer b.Close()
+func TestGitLabProviderGroupsUserInfoFailure(t *testing.T) {
+	requests := 0
+	server := newTestGitLabUserInfoServer(&requests, []string{"mygroup/subgroup"})
+	defer server.Close()
 
-	b_url, _ := url.Parse(b.URL)
-	p := testGitLabProvider(b_url.Host)
+	p := newTestGitLabProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
+	p.SetGroupRestriction([]string{"mygroup/subgroup"})
 
-	// We'll trigger a request failure by using an unexpected access
-	// token. Alternatively, we could allow the parsing of the payload as
-	// JSON to fail.
-	session := &SessionState{AccessToken: "unexpected_access_token"}
-	email, err := p.GetEmailAddress(session)
-	assert.NotEqual(t, nil, err)
-	assert.Equal(t, "", email)
+	token := newTestOAuth2Token(newSignedTestJWT(t, map[string]interface{}{
+		"email": "jdoe@example.com",
+	}))
+	token.AccessToken = "unknown-token"
+	session, err := p.createSessionState(token, context.Background(), "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 0, len(session.Groups))
+	assert.Equal(t, false, p.ValidateGroup(session))
 }
 
-func TestGitLabProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
-	b := testGitLabBackend("{\"foo\": \"bar\"}")
-	defer b.Close()
-
-	b_url, _ := url.Parse(b.URL)
-	p := testGitLabProvider(b_url.Host)
-
-	session := &SessionState{AccessToken: "imaginary_access_token"}
-	email, err := p.GetEmailAddress(session)
-	assert.NotEqual(t, nil, err)
-	assert.Equal(t, "", email)
+func TestGitLabProviderGroupRestriction(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		groups  []string
+		allowed bool
+	}{
+		{"member of the subgroup", []string{"mygroup", "mygroup/subgroup"}, true},
+		{"member of the parent group only", []string{"mygroup"}, false},
+		{"member of another subgroup", []string{"mygroup/other"}, false},
+		{"member of no group", []string{}, false},
+	} {
+		requests := 0
+		server := newTestGitLabUserInfoServer(&requests, tc.groups)
+
+		p := newTestGitLabProvider()
+		p.ValidateURL, _ = url.Parse(server.URL)
+		p.SetGroupRestriction([]string{"mygroup/subgroup"})
+
+		session, err := newTestGitLabSession(t, p)
+		assert.Equal(t, nil, err, tc.name)
+		assert.Equal(t, tc.allowed, p.ValidateGroup(session), tc.name)
+		server.Close()
+	}
 }
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -26,6 +27,14 @@ type GoogleProvider struct {
 	// GroupValidator is a function that determines if the passed email is in
 	// the configured Google group.
 	GroupValidator func(string) bool
+	// HostedDomain restricts logins to accounts of this Google Workspace
+	// domain. It is passed to Google as hd= to preselect such an account
+	// and checked against the hd claim of the ID token.
+	HostedDomain string
+	// GroupCacheTTL is how long the group membership of a user is reused
+	// before the Admin SDK is asked again; zero disables the cache.
+	GroupCacheTTL time.Duration
+	groupCache    groupMembershipCache
 }
 
 func NewGoogleProvider(p *ProviderData) *GoogleProvider {
@@ -62,32 +71,55 @@ func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 	}
 }
 
-func emailFromIdToken(idToken string) (string, error) {
+// googleIDToken holds the claims of a Google ID token read by the proxy.
+type googleIDToken struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	HostedDomain  string `json:"hd"`
+}
+
+func parseGoogleIDToken(idToken string) (*googleIDToken, error) {
 
 	// id_token is a base64 encode ID token payload
 	// https://developers.google.com/accounts/docs/OAuth2Login#obtainuserinfo
 	jwt := strings.Split(idToken, ".")
+	if len(jwt) < 2 {
+		return nil, errors.New("malformed id_token")
+	}
 	jwtData := strings.TrimSuffix(jwt[1], "=")
 	b, err := base64.RawURLEncoding.DecodeString(jwtData)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var email struct {
-		Email         string `json:"email"`
-		EmailVerified bool   `json:"email_verified"`
-	}
-	err = json.Unmarshal(b, &email)
+	var claims googleIDToken
+	err = json.Unmarshal(b, &claims)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if email.Email == "" {
-		return "", errors.New("missing email")
+	if claims.Email == "" {
+		return nil, errors.New("missing email")
+	}
+	if !claims.EmailVerified {
+		return nil, fmt.Errorf("email %s not listed as verified", claims.Email)
+	}
+	return &claims, nil
+}
+
+// GetLoginURL asks Google to only offer accounts of the HostedDomain.
+func (p *GoogleProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL := p.ProviderData.GetLoginURL(redirectURI, state)
+	if p.HostedDomain == "" {
+		return loginURL
 	}
-	if !email.EmailVerified {
-		return "", fmt.Errorf("email %s not listed as verified", email.Email)
+	a, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
 	}
-	return email.Email, nil
+	params := a.Query()
+	params.Set("hd", p.HostedDomain)
+	a.RawQuery = params.Encode()
+	return a.String()
 }
 
 func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
@@ -109,7 +141,7 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.tokenClient().Do(req)
 	if err != nil {
 		return
 	}
@@ -121,7 +153,7 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = newTokenError(resp.StatusCode, body)
 		return
 	}
 
@@ -135,17 +167,24 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 	if err != nil {
 		return
 	}
-	var email string
-	email, err = emailFromIdToken(jsonResponse.IdToken)
+	var claims *googleIDToken
+	claims, err = parseGoogleIDToken(jsonResponse.IdToken)
 	if err != nil {
 		return
 	}
+	// the hd= login parameter only preselects accounts, any account can
+	// still be used, so the domain of the token has to be checked
+	if p.HostedDomain != "" && !strings.EqualFold(claims.HostedDomain, p.HostedDomain) {
+		err = &AccountError{Reason: fmt.Sprintf(
+			"%s is not an account of the hosted domain %s", claims.Email, p.HostedDomain)}
+		return
+	}
 	s = &SessionState{
 		AccessToken:  jsonResponse.AccessToken,
 		IdToken:      jsonResponse.IdToken,
 		ExpiresOn:    time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
 		RefreshToken: jsonResponse.RefreshToken,
-		Email:        email,
+		Email:        claims.Email,
 	}
 	return
 }
@@ -155,10 +194,64 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 // checked. CredentialsFile is the path to a json file containing a Google service
 // account credentials.
 func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
+	p.setGroupValidator(getAdminService(adminEmail, credentialsReader), groups)
+}
+
+// setGroupValidator checks group memberships with the Admin SDK service,
+// caching them for GroupCacheTTL. Failed lookups are not cached.
+func (p *GoogleProvider) setGroupValidator(service *admin.Service, groups []string) {
 	p.GroupValidator = func(email string) bool {
-		return userInGroup(adminService, groups, email)
+		now := time.Now()
+		if member, ok := p.groupCache.get(email, now); ok {
+			return member
+		}
+		member, err := userInGroup(service, groups, email)
+		if err != nil {
+			log.Printf("%s", err)
+			return false
+		}
+		if p.GroupCacheTTL > 0 {
+			p.groupCache.set(email, member, now, p.GroupCacheTTL)
+		}
+		return member
+	}
+}
+
+// groupMembershipCache remembers whether users are members of the allowed
+// groups, keyed by email, so that the rate limited Admin SDK is not asked on
+// every login and session refresh.
+type groupMembershipCache struct {
+	sync.Mutex
+	entries map[string]groupMembershipEntry
+}
+
+type groupMembershipEntry struct {
+	member  bool
+	expires time.Time
+}
+
+func (c *groupMembershipCache) get(email string, now time.Time) (member bool, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[strings.ToLower(email)]
+	if !ok || now.After(e.expires) {
+		return false, false
+	}
+	return e.member, true
+}
+
+func (c *groupMembershipCache) set(email string, member bool, now time.Time, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]groupMembershipEntry)
+	}
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
 	}
+	c.entries[strings.ToLower(email)] = groupMembershipEntry{member: member, expires: now.Add(ttl)}
 }
 
 func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
@@ -180,11 +273,10 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	return adminService
 }
 
-func userInGroup(service *admin.Service, groups []string, email string) bool {
+func userInGroup(service *admin.Service, groups []string, email string) (bool, error) {
 	user, err := fetchUser(service, email)
 	if err != nil {
-		log.Printf("error fetching user: %v", err)
-		return false
+		return false, fmt.Errorf("error fetching user: %v", err)
 	}
 	id := user.Id
 	custID := user.CustomerId
@@ -195,8 +287,7 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 			if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
 				log.Printf("error fetching members for group %s: group does not exist", group)
 			} else {
-				log.Printf("error fetching group members: %v", err)
-				return false
+				return false, fmt.Errorf("error fetching group members: %v", err)
 			}
 		}
 
@@ -204,16 +295,16 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 			switch member.Type {
 			case "CUSTOMER":
 				if member.Id == custID {
-					return true
+					return true, nil
 				}
 			case "USER":
 				if member.Id == id {
-					return true
+					return true, nil
 				}
 			}
 		}
 	}
-	return false
+	return false, nil
 }
 
 func fetchUser(service *admin.Service, email string) (*admin.User, error) {
@@ -255,7 +346,7 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 		return false, nil
 	}
 
-	newToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
+	newToken, newRefreshToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
 	if err != nil {
 		return false, err
 	}
@@ -267,12 +358,16 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 
 	origExpiration := s.ExpiresOn
 	s.AccessToken = newToken
+	if newRefreshToken != "" {
+		// the old refresh token can't be used again once it was rotated
+		s.RefreshToken = newRefreshToken
+	}
 	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
 	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
 
-func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, expires time.Duration, err error) {
+func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, newRefreshToken string, expires time.Duration, err error) {
 	// https://developers.google.com/identity/protocols/OAuth2WebServer#refresh
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
@@ -286,7 +381,7 @@ func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string,
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.tokenClient().Do(req)
 	if err != nil {
 		return
 	}
@@ -303,14 +398,16 @@ func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string,
 	}
 
 	var data struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int64  `json:"expires_in"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
 		return
 	}
 	token = data.AccessToken
+	newRefreshToken = data.RefreshToken
 	expires = time.Duration(data.ExpiresIn) * time.Second
 	return
 }
@@ -6,9 +6,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	admin "google.golang.org/api/admin/directory/v1"
 )
 
 func newRedeemServer(body []byte) (*url.URL, *httptest.Server) {
@@ -179,3 +182,213 @@ func TestGoogleProviderGetEmailAddressEmailMissing(t *testing.T) {
 	}
 
 }
+
+func TestGoogleProviderHostedDomainLoginURL(t *testing.T) {
+	p := newGoogleProvider()
+	loginURL, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", loginURL.Query().Get("hd"))
+
+	p.HostedDomain = "example.com"
+	loginURL, err = url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+	assert.Equal(t, nil, err)
+	params := loginURL.Query()
+	assert.Equal(t, "example.com", params.Get("hd"))
+	assert.Equal(t, "offline", params.Get("access_type"))
+	assert.Equal(t, "nonce:/", params.Get("state"))
+}
+
+func TestGoogleProviderHostedDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims string
+		valid  bool
+	}{
+		{"matching domain", `{"email": "jdoe@example.com", "email_verified": true, "hd": "example.com"}`, true},
+		{"domain in other case", `{"email": "jdoe@example.com", "email_verified": true, "hd": "Example.COM"}`, true},
+		{"other domain", `{"email": "jdoe@example.org", "email_verified": true, "hd": "example.org"}`, false},
+		{"personal account", `{"email": "jdoe@gmail.com", "email_verified": true}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newGoogleProvider()
+			p.HostedDomain = "example.com"
+			body, err := json.Marshal(redeemResponse{
+				AccessToken: "a1234",
+				IdToken:     "ignored prefix." + base64.RawURLEncoding.EncodeToString([]byte(tt.claims)),
+			})
+			assert.Equal(t, nil, err)
+			var server *httptest.Server
+			p.RedeemURL, server = newRedeemServer(body)
+			defer server.Close()
+
+			session, err := p.Redeem("http://redirect/", "code1234")
+			if tt.valid {
+				assert.Equal(t, nil, err)
+				assert.Equal(t, "jdoe@example.com", session.Email)
+				return
+			}
+			assert.Equal(t, (*SessionState)(nil), session)
+			_, ok := err.(*AccountError)
+			assert.Equal(t, true, ok, "got %v", err)
+			assert.Contains(t, err.Error(), "is not an account of the hosted domain example.com")
+		})
+	}
+}
+
+// newAdminServer fakes the Admin SDK directory API for jdoe@example.com and
+// the group admins@example.com, counting the requests it serves.
+func newAdminServer(t *testing.T, members string, requests *int) (*admin.Service, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*requests++
+		switch r.URL.Path {
+		case "/users/jdoe@example.com":
+			rw.Write([]byte(`{"id": "user123", "customerId": "customer123"}`))
+		case "/groups/admins@example.com/members":
+			rw.Write([]byte(`{"members": ` + members + `}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"error": {"code": 404, "message": "Resource Not Found"}}`))
+		}
+	}))
+	service, err := admin.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = s.URL + "/"
+	return service, s
+}
+
+func TestGoogleProviderGroupMembership(t *testing.T) {
+	tests := []struct {
+		name    string
+		members string
+		member  bool
+	}{
+		{"member", `[{"type": "USER", "id": "user123"}]`, true},
+		{"customer member", `[{"type": "CUSTOMER", "id": "customer123"}]`, true},
+		{"non-member", `[{"type": "USER", "id": "user456"}]`, false},
+		{"empty group", `[]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			service, server := newAdminServer(t, tt.members, &requests)
+			defer server.Close()
+
+			p := newGoogleProvider()
+			p.setGroupValidator(service, []string{"admins@example.com"})
+			assert.Equal(t, tt.member, p.ValidateGroup(&SessionState{Email: "jdoe@example.com"}))
+			assert.Equal(t, 2, requests)
+		})
+	}
+}
+
+func TestGoogleProviderGroupMembershipCache(t *testing.T) {
+	var requests int
+	service, server := newAdminServer(t, `[{"type": "USER", "id": "user123"}]`, &requests)
+	defer server.Close()
+
+	p := newGoogleProvider()
+	p.GroupCacheTTL = time.Minute
+	p.setGroupValidator(service, []string{"admins@example.com"})
+	assert.Equal(t, true, p.ValidateGroup(&SessionState{Email: "jdoe@example.com"}))
+	assert.Equal(t, 2, requests)
+
+	// the cache is keyed case-insensitively by email
+	assert.Equal(t, true, p.ValidateGroup(&SessionState{Email: "JDoe@example.com"}))
+	assert.Equal(t, 2, requests)
+
+	// failed lookups are not cached
+	assert.Equal(t, false, p.ValidateGroup(&SessionState{Email: "nobody@example.com"}))
+	assert.Equal(t, false, p.ValidateGroup(&SessionState{Email: "nobody@example.com"}))
+	assert.Equal(t, 4, requests)
+}
+
+func TestGoogleProviderGroupMembershipCacheDisabled(t *testing.T) {
+	var requests int
+	service, server := newAdminServer(t, `[{"type": "USER", "id": "user123"}]`, &requests)
+	defer server.Close()
+
+	p := newGoogleProvider()
+	p.setGroupValidator(service, []string{"admins@example.com"})
+	assert.Equal(t, true, p.ValidateGroup(&SessionState{Email: "jdoe@example.com"}))
+	assert.Equal(t, true, p.ValidateGroup(&SessionState{Email: "jdoe@example.com"}))
+	assert.Equal(t, 4, requests)
+}
+
+func TestGroupMembershipCacheExpiry(t *testing.T) {
+	var c groupMembershipCache
+	now := time.Unix(1500000000, 0)
+	c.set("jdoe@example.com", true, now, time.Minute)
+
+	member, ok := c.get("jdoe@example.com", now.Add(30*time.Second))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, member)
+
+	_, ok = c.get("jdoe@example.com", now.Add(2*time.Minute))
+	assert.Equal(t, false, ok)
+
+	// expired entries are dropped when another is added
+	c.set("other@example.com", false, now.Add(2*time.Minute), time.Minute)
+	assert.Equal(t, 1, len(c.entries))
+}
+
+// newRotatingTokenServer issues a new refresh token with every refresh and
+// rejects refresh tokens that were already used, like identity providers
+// rotating refresh tokens do.
+func newRotatingTokenServer(refreshTokens *[]string, idToken string) *httptest.Server {
+	used := map[string]bool{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		refreshToken := r.PostForm.Get("refresh_token")
+		*refreshTokens = append(*refreshTokens, refreshToken)
+		if used[refreshToken] {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		used[refreshToken] = true
+		w.Header().Set("Content-Type", "application/json")
+		body := map[string]interface{}{
+			"access_token":  "access-token-" + strconv.Itoa(len(used)),
+			"refresh_token": "refresh-token-" + strconv.Itoa(len(used)),
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		}
+		if idToken != "" {
+			body["id_token"] = idToken
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+func TestGoogleProviderRefreshRotatesRefreshToken(t *testing.T) {
+	var refreshTokens []string
+	server := newRotatingTokenServer(&refreshTokens, "")
+	defer server.Close()
+
+	p := newGoogleProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	session := &SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token-0",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "access-token-1", session.AccessToken)
+	assert.Equal(t, "refresh-token-1", session.RefreshToken)
+
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "refresh-token-2", session.RefreshToken)
+	assert.Equal(t, []string{"refresh-token-0", "refresh-token-1"}, refreshTokens)
+}
@@ -0,0 +1,76 @@
+package providers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+)
+
+// idTokenCache remembers verified ID tokens until they expire, so that the
+// session's ID token is not verified again on every request. It holds at most
+// size tokens, dropping the least recently used one when full. Entries are
+// keyed by a hash of the raw token.
+type idTokenCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type idTokenEntry struct {
+	key     string
+	idToken *oidc.IDToken
+}
+
+func (c *idTokenCache) get(rawIDToken string, now time.Time) (*oidc.IDToken, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[tokenCacheKey(rawIDToken)]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*idTokenEntry)
+	if !now.Before(e.idToken.Expiry) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.idToken, true
+}
+
+func (c *idTokenCache) add(rawIDToken string, idToken *oidc.IDToken, size int, now time.Time) {
+	if size <= 0 || !now.Before(idToken.Expiry) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	key := tokenCacheKey(rawIDToken)
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*idTokenEntry).idToken = idToken
+		c.lru.MoveToFront(el)
+		return
+	}
+	if len(c.entries) >= size {
+		// expired tokens go first, then the least recently used ones
+		for el := c.lru.Back(); el != nil; {
+			prev := el.Prev()
+			if !now.Before(el.Value.(*idTokenEntry).idToken.Expiry) {
+				c.remove(el)
+			}
+			el = prev
+		}
+		for len(c.entries) >= size {
+			c.remove(c.lru.Back())
+		}
+	}
+	c.entries[key] = c.lru.PushFront(&idTokenEntry{key: key, idToken: idToken})
+}
+
+func (c *idTokenCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*idTokenEntry).key)
+	c.lru.Remove(el)
+}
@@ -0,0 +1,133 @@
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingKeySet counts the signature verifications of testKeySet.
+type countingKeySet struct {
+	testKeySet
+	verifications int
+}
+
+func (ks *countingKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	ks.verifications++
+	return ks.testKeySet.VerifySignature(ctx, jwt)
+}
+
+func newCountingOIDCProvider(cacheSize int) (*OIDCProvider, *countingKeySet) {
+	p := newTestOIDCProvider()
+	p.Logger = NewLogger(ioutil.Discard, "[oidc] ")
+	ks := &countingKeySet{testKeySet: testKeySet{key: &testOIDCSigningKey.PublicKey}}
+	p.Verifier = oidc.NewVerifier(testOIDCIssuer, ks, &oidc.Config{ClientID: testOIDCClientID})
+	p.IDTokenCacheSize = cacheSize
+	return p, ks
+}
+
+func TestOIDCProviderValidateSessionStateCacheHit(t *testing.T) {
+	p, ks := newCountingOIDCProvider(10)
+	session := &SessionState{IdToken: newSignedTestJWT(t, map[string]interface{}{})}
+
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, 1, ks.verifications)
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, 1, ks.verifications)
+
+	// another token is verified on its own
+	other := &SessionState{IdToken: newSignedTestJWT(t, map[string]interface{}{"sub": "other"})}
+	assert.Equal(t, true, p.ValidateSessionState(other))
+	assert.Equal(t, 2, ks.verifications)
+}
+
+func TestOIDCProviderValidateSessionStateCacheDisabled(t *testing.T) {
+	p, ks := newCountingOIDCProvider(0)
+	session := &SessionState{IdToken: newSignedTestJWT(t, map[string]interface{}{})}
+
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, 2, ks.verifications)
+}
+
+func TestOIDCProviderIDTokenCacheSkipsRejectedTokens(t *testing.T) {
+	p, ks := newCountingOIDCProvider(10)
+	p.AllowedAudiences = []string{"other-client"}
+	session := &SessionState{IdToken: newSignedTestJWT(t, map[string]interface{}{})}
+
+	assert.Equal(t, false, p.ValidateSessionState(session))
+	assert.Equal(t, false, p.ValidateSessionState(session))
+	assert.Equal(t, 2, ks.verifications)
+	assert.Equal(t, 0, len(p.idTokens.entries))
+}
+
+func TestIDTokenCacheExpiry(t *testing.T) {
+	var c idTokenCache
+	now := time.Unix(1500000000, 0)
+	c.add("token", &oidc.IDToken{Expiry: now.Add(time.Minute)}, 10, now)
+
+	_, ok := c.get("token", now.Add(30*time.Second))
+	assert.Equal(t, true, ok)
+	_, ok = c.get("token", now.Add(time.Minute))
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 0, len(c.entries))
+
+	// tokens that have expired already are not added
+	c.add("expired", &oidc.IDToken{Expiry: now}, 10, now)
+	assert.Equal(t, 0, len(c.entries))
+}
+
+func TestIDTokenCacheEviction(t *testing.T) {
+	var c idTokenCache
+	now := time.Unix(1500000000, 0)
+	c.add("a", &oidc.IDToken{Expiry: now.Add(time.Hour)}, 2, now)
+	c.add("b", &oidc.IDToken{Expiry: now.Add(time.Hour)}, 2, now)
+	// a was used more recently than b
+	_, ok := c.get("a", now)
+	assert.Equal(t, true, ok)
+
+	c.add("c", &oidc.IDToken{Expiry: now.Add(time.Hour)}, 2, now)
+	assert.Equal(t, 2, len(c.entries))
+	_, ok = c.get("b", now)
+	assert.Equal(t, false, ok)
+	_, ok = c.get("a", now)
+	assert.Equal(t, true, ok)
+
+	// expired tokens are evicted before the least recently used ones
+	c.add("d", &oidc.IDToken{Expiry: now.Add(time.Minute)}, 3, now)
+	later := now.Add(2 * time.Minute)
+	c.add("e", &oidc.IDToken{Expiry: later.Add(time.Hour)}, 3, later)
+	c.add("f", &oidc.IDToken{Expiry: later.Add(time.Hour)}, 3, later)
+	assert.Equal(t, 3, len(c.entries))
+	_, ok = c.get("d", later)
+	assert.Equal(t, false, ok)
+	for _, token := range []string{"e", "f"} {
+		_, ok = c.get(token, later)
+		assert.Equal(t, true, ok, token)
+	}
+}
+
+func benchmarkValidateSessionState(b *testing.B, cacheSize int) {
+	p, _ := newCountingOIDCProvider(cacheSize)
+	session := &SessionState{IdToken: newSignedTestJWT(b, map[string]interface{}{})}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !p.ValidateSessionState(session) {
+			b.Fatal("session is not valid")
+		}
+	}
+}
+
+func BenchmarkOIDCProviderValidateSessionState(b *testing.B) {
+	benchmarkValidateSessionState(b, 0)
+}
+
+func BenchmarkOIDCProviderValidateSessionStateCached(b *testing.B) {
+	benchmarkValidateSessionState(b, 1000)
+}
@@ -55,7 +55,7 @@ func validateToken(p Provider, access_token string, header http.Header) bool {
 		params := url.Values{"access_token": {access_token}}
 		endpoint = endpoint + "?" + params.Encode()
 	}
-	resp, err := api.RequestUnparsedResponse(endpoint, header)
+	resp, err := api.RequestUnparsedResponseWithClient(p.Data().httpClient(), endpoint, header)
 	if err != nil {
 		log.Printf("GET %s", stripToken(endpoint))
 		log.Printf("token validation request failed: %s", err)
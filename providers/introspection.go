@@ -0,0 +1,97 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+// introspectionCache remembers recent token introspection results so that
+// validating a session does not hit the identity provider on every request.
+// Entries are keyed by a hash of the access token.
+type introspectionCache struct {
+	sync.Mutex
+	entries   map[string]introspectionEntry
+	lastSweep time.Time
+}
+
+// introspectionSweepInterval is how often expired entries are dropped from the
+// introspection cache.
+const introspectionSweepInterval = time.Minute
+
+type introspectionEntry struct {
+	active  bool
+	expires time.Time
+}
+
+func tokenCacheKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *introspectionCache) get(token string, now time.Time) (active bool, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[tokenCacheKey(token)]
+	if !ok || now.After(e.expires) {
+		return false, false
+	}
+	return e.active, true
+}
+
+func (c *introspectionCache) set(token string, active bool, expires time.Time, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]introspectionEntry)
+	}
+	c.sweep(now)
+	c.entries[tokenCacheKey(token)] = introspectionEntry{active: active, expires: expires}
+}
+
+// sweep drops the expired entries, so that tokens seen once don't
+// accumulate. It runs at most once per introspectionSweepInterval.
+func (c *introspectionCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < introspectionSweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// introspectToken asks the RFC 7662 introspection endpoint whether the token
+// is active, authenticating with the client credentials. It also returns the
+// token's expiry, which is zero if the endpoint does not tell.
+func introspectToken(ctx context.Context, client *http.Client, endpoint *url.URL, clientID, clientSecret, token string) (active bool, expires time.Time, err error) {
+	params := url.Values{}
+	params.Add("token", token)
+	params.Add("token_type_hint", "access_token")
+
+	req, err := http.NewRequest("POST", endpoint.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	json, err := api.RequestWithClient(client, req.WithContext(ctx))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	active, _ = json.Get("active").Bool()
+	if exp, err := json.Get("exp").Int64(); err == nil {
+		expires = time.Unix(exp, 0)
+	}
+	return active, expires, nil
+}
@@ -0,0 +1,203 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// jwksFetchTimeout bounds a fetch of the keys; it is shared by all the
+// requests waiting for it, so it can't use the context of any one of them.
+const jwksFetchTimeout = 30 * time.Second
+
+// jwksMaxBackoff caps the delay before retrying a failed fetch.
+const jwksMaxBackoff = 5 * time.Minute
+
+// JWKSKeySet is an oidc.KeySet that fetches the identity provider's signing
+// keys from its JWKS URI. The keys are refetched once they are older than
+// RefreshInterval, and when a token names a key ID that is not known yet, so
+// that key rotation is picked up without a restart.
+//
+// Concurrent verifications share a single fetch, which runs without holding
+// the lock. After a failed fetch the keys already known keep being used and
+// the next attempt waits minRefetchInterval, doubling with every failure.
+type JWKSKeySet struct {
+	URL             string
+	RefreshInterval time.Duration
+	// Client fetches the keys; nil means http.DefaultClient.
+	Client *http.Client
+
+	// minRefetchInterval limits how often an unknown key ID triggers a
+	// refetch, and is the delay before retrying a failed fetch.
+	minRefetchInterval time.Duration
+
+	mu       sync.Mutex
+	keys     []jose.JSONWebKey
+	fetched  time.Time
+	failures int
+	failed   time.Time
+	err      error
+	// inflight is closed once the fetch in progress is done
+	inflight chan struct{}
+}
+
+func NewJWKSKeySet(url string, refreshInterval time.Duration) *JWKSKeySet {
+	return &JWKSKeySet{
+		URL:                url,
+		RefreshInterval:    refreshInterval,
+		minRefetchInterval: 10 * time.Second,
+	}
+}
+
+func (ks *JWKSKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	keyID := ""
+	if len(jws.Signatures) > 0 {
+		keyID = jws.Signatures[0].Header.KeyID
+	}
+
+	keys, err := ks.keysFor(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if keyID == "" || key.KeyID == keyID {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, nil
+			}
+		}
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// keysFor returns the keys to verify a token signed with keyID, waiting for
+// them to be fetched first if they are due.
+func (ks *JWKSKeySet) keysFor(ctx context.Context, keyID string) ([]jose.JSONWebKey, error) {
+	ks.mu.Lock()
+	if !ks.fetchDue(keyID) {
+		defer ks.mu.Unlock()
+		return ks.current()
+	}
+	if ks.inflight == nil {
+		ks.inflight = make(chan struct{})
+		go ks.refresh(ks.inflight)
+	}
+	inflight := ks.inflight
+	ks.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-inflight:
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.current()
+}
+
+// current returns the keys known, or the error of the last fetch if there are
+// none; keys fetched earlier keep being used if the identity provider is
+// unreachable.
+func (ks *JWKSKeySet) current() ([]jose.JSONWebKey, error) {
+	if len(ks.keys) == 0 && ks.err != nil {
+		return nil, ks.err
+	}
+	return ks.keys, nil
+}
+
+func (ks *JWKSKeySet) fetchDue(keyID string) bool {
+	if ks.inflight != nil {
+		return true
+	}
+	now := time.Now()
+	if ks.failures > 0 && now.Sub(ks.failed) < ks.backoff() {
+		return false
+	}
+	age := now.Sub(ks.fetched)
+	return ks.fetched.IsZero() || (ks.RefreshInterval > 0 && age > ks.RefreshInterval) ||
+		(!ks.knows(keyID) && age > ks.minRefetchInterval)
+}
+
+// backoff is the delay before retrying after the last failed fetch.
+func (ks *JWKSKeySet) backoff() time.Duration {
+	delay := ks.minRefetchInterval
+	for i := 1; i < ks.failures && delay < jwksMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > jwksMaxBackoff {
+		delay = jwksMaxBackoff
+	}
+	return delay
+}
+
+// refresh fetches the keys, records the outcome and closes done.
+func (ks *JWKSKeySet) refresh(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	keys, err := ks.fetch(ctx)
+	cancel()
+
+	ks.mu.Lock()
+	if err == nil {
+		ks.keys = keys
+		ks.fetched = time.Now()
+		ks.failures = 0
+	} else {
+		ks.failures++
+		ks.failed = time.Now()
+	}
+	ks.err = err
+	ks.inflight = nil
+	ks.mu.Unlock()
+	close(done)
+}
+
+func (ks *JWKSKeySet) knows(keyID string) bool {
+	if keyID == "" {
+		return true
+	}
+	for _, key := range ks.keys {
+		if key.KeyID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *JWKSKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest("GET", ks.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := ks.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching keys: got %d from %q %s", resp.StatusCode, ks.URL, body)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+	return keySet.Keys, nil
+}
@@ -0,0 +1,224 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type testJWKSServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     []jose.JSONWebKey
+	requests int
+	// status replaces the keys with an error response when set
+	status int
+	// delay holds every response back
+	delay time.Duration
+}
+
+func newTestJWKSServer() *testJWKSServer {
+	s := &testJWKSServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.mu.Lock()
+			s.requests++
+			status, delay := s.status, s.delay
+			s.mu.Unlock()
+			time.Sleep(delay)
+			if status != 0 {
+				w.WriteHeader(status)
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: s.keys})
+		}))
+	return s
+}
+
+func (s *testJWKSServer) setKey(key *rsa.PrivateKey, keyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: keyID, Algorithm: "RS256", Use: "sig"}}
+}
+
+func (s *testJWKSServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *testJWKSServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newSignedTestJWTWithKey(t *testing.T, key *rsa.PrivateKey, keyID string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: keyID}}, nil)
+	assert.Equal(t, nil, err)
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss": testOIDCIssuer,
+		"aud": testOIDCClientID,
+		"sub": "123456789",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	jws, err := signer.Sign(payload)
+	assert.Equal(t, nil, err)
+	raw, err := jws.CompactSerialize()
+	assert.Equal(t, nil, err)
+	return raw
+}
+
+func newTestJWKSVerifier(ks *JWKSKeySet) *oidc.IDTokenVerifier {
+	return oidc.NewVerifier(testOIDCIssuer, ks, &oidc.Config{ClientID: testOIDCClientID})
+}
+
+func TestJWKSKeySetPicksUpRotatedKey(t *testing.T) {
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	server := newTestJWKSServer()
+	defer server.Close()
+	server.setKey(testOIDCSigningKey, "old")
+
+	ks := NewJWKSKeySet(server.URL, time.Hour)
+	ks.minRefetchInterval = 0
+	verifier := newTestJWKSVerifier(ks)
+	ctx := context.Background()
+
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, testOIDCSigningKey, "old"))
+	assert.Equal(t, nil, err)
+
+	server.setKey(newKey, "new")
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, newKey, "new"))
+	assert.Equal(t, nil, err)
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, testOIDCSigningKey, "old"))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 3, server.requests)
+}
+
+func TestJWKSKeySetRefreshInterval(t *testing.T) {
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	server := newTestJWKSServer()
+	defer server.Close()
+	server.setKey(testOIDCSigningKey, "")
+
+	ks := NewJWKSKeySet(server.URL, 20*time.Millisecond)
+	verifier := newTestJWKSVerifier(ks)
+	ctx := context.Background()
+
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, testOIDCSigningKey, ""))
+	assert.Equal(t, nil, err)
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, testOIDCSigningKey, ""))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, server.requests)
+
+	// a rotation without key IDs is picked up once the keys are stale
+	server.setKey(newKey, "")
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, newKey, ""))
+	assert.NotEqual(t, nil, err)
+	time.Sleep(30 * time.Millisecond)
+	_, err = verifier.Verify(ctx, newSignedTestJWTWithKey(t, newKey, ""))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, server.requests)
+}
+
+func TestJWKSKeySetUnknownKeyIDRateLimited(t *testing.T) {
+	server := newTestJWKSServer()
+	defer server.Close()
+	server.setKey(testOIDCSigningKey, "old")
+
+	ks := NewJWKSKeySet(server.URL, time.Hour)
+	verifier := newTestJWKSVerifier(ks)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := verifier.Verify(ctx, newSignedTestJWTWithKey(t, testOIDCSigningKey, "unknown"))
+		assert.NotEqual(t, nil, err)
+	}
+	assert.Equal(t, 1, server.requests)
+}
+
+func TestJWKSKeySetConcurrentVerificationsShareFetch(t *testing.T) {
+	server := newTestJWKSServer()
+	defer server.Close()
+	server.setKey(testOIDCSigningKey, "key")
+	server.delay = 50 * time.Millisecond
+
+	verifier := newTestJWKSVerifier(NewJWKSKeySet(server.URL, time.Hour))
+	token := newSignedTestJWTWithKey(t, testOIDCSigningKey, "key")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, 1, server.requestCount())
+}
+
+func TestJWKSKeySetBacksOffAfterFailure(t *testing.T) {
+	server := newTestJWKSServer()
+	defer server.Close()
+	server.setKey(testOIDCSigningKey, "key")
+	server.setStatus(http.StatusServiceUnavailable)
+
+	ks := NewJWKSKeySet(server.URL, time.Hour)
+	ks.minRefetchInterval = 20 * time.Millisecond
+	verifier := newTestJWKSVerifier(ks)
+	token := newSignedTestJWTWithKey(t, testOIDCSigningKey, "key")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := verifier.Verify(ctx, token)
+		assert.NotEqual(t, nil, err)
+	}
+	assert.Equal(t, 1, server.requestCount())
+
+	server.setStatus(0)
+	time.Sleep(30 * time.Millisecond)
+	_, err := verifier.Verify(ctx, token)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, server.requestCount())
+}
+
+func TestJWKSKeySetKeepsKeysWhenUnreachable(t *testing.T) {
+	server := newTestJWKSServer()
+	defer server.Close()
+	server.setKey(testOIDCSigningKey, "key")
+
+	ks := NewJWKSKeySet(server.URL, 20*time.Millisecond)
+	verifier := newTestJWKSVerifier(ks)
+	token := newSignedTestJWTWithKey(t, testOIDCSigningKey, "key")
+	ctx := context.Background()
+
+	_, err := verifier.Verify(ctx, token)
+	assert.Equal(t, nil, err)
+
+	server.setStatus(http.StatusInternalServerError)
+	time.Sleep(30 * time.Millisecond)
+	_, err = verifier.Verify(ctx, token)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, server.requestCount())
+}
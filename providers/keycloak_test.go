@@ -0,0 +1,204 @@
+package providers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keycloakAccessTokenPayload is the payload of an access token as issued by
+// Keycloak, trimmed of the claims the provider does not read.
+const keycloakAccessTokenPayload = `{
+  "jti": "5b2e1d2c-a94e-4a1d-9a62-8f2cbd9a2a3e",
+  "exp": 1520000300,
+  "nbf": 0,
+  "iat": 1520000000,
+  "iss": "https://keycloak.example.com/auth/realms/example",
+  "aud": "my-app",
+  "sub": "0d9f6a6e-0e3c-4b43-9d7e-1d1bd3c5b5c1",
+  "typ": "Bearer",
+  "azp": "my-app",
+  "auth_time": 1520000000,
+  "session_state": "d1f0e1c6-2bda-4b1a-b6e6-ad1f1bde6a7b",
+  "acr": "1",
+  "allowed-origins": ["https://internal.example.com"],
+  "realm_access": {
+    "roles": ["offline_access", "uma_authorization", "admin"]
+  },
+  "resource_access": {
+    "my-app": {
+      "roles": ["developer"]
+    },
+    "account": {
+      "roles": ["manage-account", "view-profile"]
+    }
+  },
+  "name": "Michael Bland",
+  "preferred_username": "mbland",
+  "email": "michael.bland@gsa.gov"
+}`
+
+func testKeycloakAccessToken(payload string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+}
+
+func testKeycloakProvider(hostname string) *KeycloakProvider {
+	p := NewKeycloakProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+func testKeycloakBackend(payload string) *httptest.Server {
+	path := "/auth/realms/master/protocol/openid-connect/userinfo"
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path || r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(404)
+			} else {
+				w.WriteHeader(200)
+				w.Write([]byte(payload))
+			}
+		}))
+}
+
+func TestKeycloakProviderDefaults(t *testing.T) {
+	p := testKeycloakProvider("")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Keycloak", p.Data().ProviderName)
+	assert.Equal(t, "https://keycloak.org/auth/realms/master/protocol/openid-connect/auth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://keycloak.org/auth/realms/master/protocol/openid-connect/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://keycloak.org/auth/realms/master/protocol/openid-connect/userinfo",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+}
+
+func TestKeycloakProviderOverrides(t *testing.T) {
+	p := NewKeycloakProvider(
+		&ProviderData{
+			LoginURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/auth/realms/example/protocol/openid-connect/auth"},
+			RedeemURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/auth/realms/example/protocol/openid-connect/token"},
+			ValidateURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/auth/realms/example/protocol/openid-connect/userinfo"},
+			Scope: "profile"})
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Keycloak", p.Data().ProviderName)
+	assert.Equal(t, "https://example.com/auth/realms/example/protocol/openid-connect/auth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://example.com/auth/realms/example/protocol/openid-connect/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://example.com/auth/realms/example/protocol/openid-connect/userinfo",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "profile", p.Data().Scope)
+}
+
+func TestKeycloakProviderGetEmailAddress(t *testing.T) {
+	b := testKeycloakBackend(`{"email": "michael.bland@gsa.gov"}`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testKeycloakProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestKeycloakProviderGetEmailAddressFailedRequest(t *testing.T) {
+	b := testKeycloakBackend("unused payload")
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testKeycloakProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "unexpected_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestKeycloakRoles(t *testing.T) {
+	roles, err := keycloakRoles(testKeycloakAccessToken(keycloakAccessTokenPayload))
+	assert.Equal(t, nil, err)
+	sort.Strings(roles)
+	assert.Equal(t, []string{
+		"account:manage-account",
+		"account:view-profile",
+		"my-app:developer",
+		"realm:admin",
+		"realm:offline_access",
+		"realm:uma_authorization",
+	}, roles)
+}
+
+func TestKeycloakRolesNotAJWT(t *testing.T) {
+	_, err := keycloakRoles("imaginary_access_token")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestKeycloakProviderSetGroups(t *testing.T) {
+	p := testKeycloakProvider("")
+	p.SetGroups([]string{"admin", "realm:auditor", "my-app:developer"})
+	assert.Equal(t, []string{"realm:admin", "realm:auditor", "my-app:developer"}, p.Groups)
+}
+
+func TestKeycloakProviderValidateGroup(t *testing.T) {
+	session := &SessionState{
+		Email:       "michael.bland@gsa.gov",
+		AccessToken: testKeycloakAccessToken(keycloakAccessTokenPayload),
+	}
+	p := testKeycloakProvider("")
+
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	p.SetGroups([]string{"admin"})
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	p.SetGroups([]string{"my-app:developer"})
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	p.SetGroups([]string{"developer", "account:admin"})
+	assert.Equal(t, false, p.ValidateGroup(session))
+
+	p.SetGroups([]string{"realm:missing", "account:view-profile"})
+	assert.Equal(t, true, p.ValidateGroup(session))
+}
+
+func TestKeycloakProviderValidateGroupWithoutRoles(t *testing.T) {
+	session := &SessionState{
+		Email:       "michael.bland@gsa.gov",
+		AccessToken: testKeycloakAccessToken(`{"email": "michael.bland@gsa.gov"}`),
+	}
+	p := testKeycloakProvider("")
+	p.SetGroups([]string{"admin"})
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
@@ -0,0 +1,146 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logger writes leveled, key=value formatted lines under a fixed prefix so
+// that authorization decisions can be picked out of the proxy output.
+type Logger struct {
+	out   *log.Logger
+	w     io.Writer
+	name  string
+	Debug bool
+	// JSON writes every line as a JSON object, with the key=value pairs of
+	// the message as its fields, instead.
+	JSON bool
+}
+
+// NewLogger returns a Logger writing to w. Debug output is disabled until
+// Debug is set.
+func NewLogger(w io.Writer, prefix string) *Logger {
+	name := strings.Trim(strings.TrimSpace(prefix), "[]")
+	return &Logger{out: log.New(w, prefix, log.Ldate|log.Ltime), w: w, name: name}
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.Debug {
+		l.output("debug", format, v...)
+	}
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output("info", format, v...)
+}
+
+func (l *Logger) output(level, format string, v ...interface{}) {
+	if !l.JSON {
+		l.out.Printf("level=%s %s", level, fmt.Sprintf(format, v...))
+		return
+	}
+	fields := parseKeyValues(fmt.Sprintf(format, v...))
+	fields["timestamp"] = time.Now().Format(time.RFC3339)
+	fields["level"] = level
+	fields["logger"] = l.name
+	b, err := json.Marshal(fields)
+	if err != nil {
+		l.out.Printf("level=%s msg=%q error=%q", level, "could not encode log line", err)
+		return
+	}
+	l.w.Write(append(b, '\n'))
+}
+
+// parseKeyValues splits a line of key=value pairs, with values quoted as by
+// %q where needed. Text that is not part of a pair ends up in "msg".
+func parseKeyValues(line string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	var rest []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			end = len(line)
+		}
+		eq := strings.IndexByte(line[:end], '=')
+		if eq <= 0 {
+			rest = append(rest, line[:end])
+			line = line[end:]
+			continue
+		}
+		key, value := line[:eq], line[eq+1:]
+		if strings.HasPrefix(value, `"`) {
+			if n := quotedLength(value); n > 0 {
+				if s, err := strconv.Unquote(value[:n]); err == nil {
+					fields[key] = s
+					line = value[n:]
+					continue
+				}
+			}
+		}
+		if strings.HasPrefix(value, "[") {
+			if items, n := quotedList(value); n > 0 {
+				fields[key] = items
+				line = value[n:]
+				continue
+			}
+		}
+		end = strings.IndexByte(value, ' ')
+		if end < 0 {
+			end = len(value)
+		}
+		fields[key] = value[:end]
+		line = value[end:]
+	}
+	if len(rest) > 0 {
+		fields["msg"] = strings.Join(rest, " ")
+	}
+	return fields
+}
+
+// quotedList parses a list of strings formatted with %q, such as
+// ["admins" "devs"], and returns it with the length of its text, or 0 if s
+// does not start with one.
+func quotedList(s string) ([]string, int) {
+	items := []string{}
+	for i := 1; i < len(s); {
+		switch s[i] {
+		case ' ':
+			i++
+		case ']':
+			return items, i + 1
+		case '"':
+			n := quotedLength(s[i:])
+			if n == 0 {
+				return nil, 0
+			}
+			item, err := strconv.Unquote(s[i : i+n])
+			if err != nil {
+				return nil, 0
+			}
+			items = append(items, item)
+			i += n
+		default:
+			return nil, 0
+		}
+	}
+	return nil, 0
+}
+
+// quotedLength returns the length of the double quoted string s starts with,
+// or 0 if it is not terminated.
+func quotedLength(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return 0
+}
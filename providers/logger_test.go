@@ -0,0 +1,23 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"msg":    "token introspected",
+		"user":   "j \"doe\"",
+		"active": "true",
+		"groups": []string{"admins", "dev ops"},
+		"empty":  []string{},
+	}, parseKeyValues(`msg="token introspected" user="j \"doe\"" active=true groups=["admins" "dev ops"] empty=[]`))
+
+	// text that is not a pair is kept
+	assert.Equal(t, map[string]interface{}{
+		"msg":   "refreshed token",
+		"token": "id_token",
+	}, parseKeyValues(`refreshed token=id_token token`))
+}
@@ -1,111 +1,608 @@
 package providers
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"time"
-
-	"golang.org/x/oauth2"
-
-	"github.com/coreos/go-oidc"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/bitly/oauth2_proxy/api"
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
 )
 
 type OIDCProvider struct {
 	*ProviderData
 
+	// Scopes are the requested scopes, parsed from Scope. "openid" is
+	// always included, and e.g. "offline_access" is needed by some identity
+	// providers to issue a refresh token at all.
+	Scopes []string
+
 	Verifier       *oidc.IDTokenVerifier
 	GroupValidator func(*SessionState) bool
+	// GroupsClaim is the dotted path of the claim holding the user's
+	// groups, e.g. "groups" or "realm_access.roles".
+	GroupsClaim string
+	// GroupsFrom selects the token the groups claim is read from, either
+	// "id_token" or "access_token".
+	GroupsFrom string
+	// GroupsRequireAll requires the user to be in every configured group
+	// rather than any one of them.
+	GroupsRequireAll bool
+	// GroupsCaseInsensitive compares groups ignoring case and surrounding
+	// whitespace, for identity providers that emit them inconsistently.
+	GroupsCaseInsensitive bool
+	// EmailClaim is the ID token claim holding the user's email address.
+	EmailClaim string
+	// UsernameClaim is the ID token claim holding the user name; the
+	// local part of the email is used when it is missing.
+	UsernameClaim string
+	// UserInfoFallback looks the email up at the ValidateURL (userinfo
+	// endpoint) when the ID token does not carry it.
+	UserInfoFallback bool
+	// UserInfoCacheTTL is how long an email looked up at the userinfo
+	// endpoint is reused for the same access token; zero disables caching.
+	UserInfoCacheTTL time.Duration
+	// UserInfoRetries is how often a userinfo call failing with a network
+	// error or a 5xx response is retried.
+	UserInfoRetries int
+	// RequireEmailVerified rejects ID tokens that do not assert
+	// email_verified, rather than only those that deny it.
+	RequireEmailVerified bool
+	// UsePKCE sends an S256 code challenge on the authorize redirect and
+	// the matching code verifier when redeeming the code.
+	UsePKCE bool
+	// VerifyNonce sends a random nonce on the authorize redirect and rejects
+	// ID tokens that do not echo it back.
+	VerifyNonce bool
+	// Prompt lists the prompt values sent on the authorize redirect, e.g.
+	// "consent" to have users grant newly added scopes.
+	Prompt []string
+	// MaxAge, when set, is sent as max_age on the authorize redirect, and ID
+	// tokens whose auth_time claim is older are rejected.
+	MaxAge time.Duration
+	// IntrospectionURL is the RFC 7662 endpoint used to validate the access
+	// token of sessions whose ID token no longer verifies.
+	IntrospectionURL *url.URL
+	// IntrospectionCacheTTL is how long an introspection result is reused.
+	IntrospectionCacheTTL time.Duration
+	// EndSessionURL is the end_session_endpoint the user is sent to on
+	// logout, so that the identity provider session ends too.
+	EndSessionURL *url.URL
+	// RefreshBefore refreshes sessions this long before they expire, so that
+	// in-flight requests do not carry a token that expires mid-request.
+	RefreshBefore time.Duration
+	// AllowedAudiences, when set, lists the audiences accepted on ID tokens;
+	// a token passes if any of its audiences is listed.
+	AllowedAudiences []string
+	// ClientJWTKey, when set, authenticates the client at the token
+	// endpoint with a signed private_key_jwt assertion instead of the
+	// client secret.
+	ClientJWTKey *rsa.PrivateKey
+	// ExtraBearerIssuers are the issuers other than the provider's own whose
+	// bearer tokens are accepted (-extra-jwt-issuers), keyed by issuer URL.
+	ExtraBearerIssuers map[string]*BearerIssuer
+	// IDTokenCacheSize is how many verified ID tokens are remembered until
+	// they expire, so that sessions are not verified again on every request;
+	// zero disables the cache.
+	IDTokenCacheSize int
+	Logger           *Logger
+
+	introspection introspectionCache
+	userInfo      userInfoCache
+	idTokens      idTokenCache
+	// groupsFallback, when set, looks the user's groups up when the token
+	// does not carry the groups claim.
+	groupsFallback func(ctx context.Context, idToken *oidc.IDToken, accessToken string) ([]string, error)
+}
+
+// ErrNoVerifier is returned when an ID token has to be verified by a provider
+// that was set up without a verifier, i.e. without an issuer URL.
+var ErrNoVerifier = errors.New("no ID token verifier configured (oidc-issuer-url)")
+
+// BearerIssuer verifies the bearer tokens of an extra issuer.
+type BearerIssuer struct {
+	// Verifier checks the signature, issuer and expiry; it must skip the
+	// client ID check, the audience is checked against Audiences instead.
+	Verifier  *oidc.IDTokenVerifier
+	Audiences []string
+}
+
+func (b *BearerIssuer) verify(ctx context.Context, rawToken string) (*oidc.IDToken, error) {
+	if b.Verifier == nil {
+		return nil, ErrNoVerifier
+	}
+	idToken, err := b.Verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	for _, aud := range idToken.Audience {
+		if contains(b.Audiences, aud) {
+			return idToken, nil
+		}
+	}
+	return nil, fmt.Errorf("audience %q is not allowed for issuer %q", idToken.Audience, idToken.Issuer)
 }
 
 func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 	p.ProviderName = "OpenID Connect"
+	if p.Scope == "" {
+		p.Scope = "openid email profile"
+	}
+	scopes := strings.Fields(p.Scope)
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	p.Scope = strings.Join(scopes, " ")
 	return &OIDCProvider{ProviderData: p,
+		Scopes:                scopes,
+		GroupsClaim:           "groups",
+		GroupsFrom:            "id_token",
+		EmailClaim:            "email",
+		UsernameClaim:         "preferred_username",
+		IntrospectionCacheTTL: 30 * time.Second,
+		UserInfoCacheTTL:      30 * time.Second,
+		UserInfoRetries:       1,
+		Logger:                NewLogger(os.Stderr, "[oidc] "),
 		GroupValidator: func(s *SessionState) bool {
 			return true
 		}}
 }
 
 func (p *OIDCProvider) GetEmailAddress(state *SessionState) (email string, err error) {
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	return p.getEmailAddress(ctx, state)
+}
+
+func (p *OIDCProvider) getEmailAddress(ctx context.Context, state *SessionState) (email string, err error) {
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		return "", errors.New("no userinfo endpoint configured (validate-url)")
+	}
 	req, err := http.NewRequest("GET",
 		p.ValidateURL.String(), nil)
-
-	req.Header.Add("Authorization", "Bearer "+state.AccessToken)
-
 	if err != nil {
 		log.Printf("failed building request %s", err)
 		return "", err
 	}
+	req.Header.Add("Authorization", "Bearer "+state.AccessToken)
 
-	json, err := api.Request(req)
+	now := time.Now()
+	if email, ok := p.userInfo.get(state.AccessToken, now); ok {
+		return email, nil
+	}
+	json, err := api.RequestWithClient(p.retryClient(p.UserInfoRetries), req.WithContext(ctx))
 	if err != nil {
 		log.Printf("failed making request %s", err)
 		return "", err
 	}
-	return json.Get("email").String()
+	email, err = json.Get("email").String()
+	if err == nil && p.UserInfoCacheTTL > 0 {
+		p.userInfo.set(state.AccessToken, email, now.Add(p.UserInfoCacheTTL))
+	}
+	return email, err
 }
 
 func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
-	ctx := context.Background()
-	c := oauth2.Config{
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			TokenURL: p.RedeemURL.String(),
-		},
-		RedirectURL: redirectURL,
+	return p.RedeemAuthRequest(redirectURL, code, nil)
+}
+
+// NewAuthRequest generates the PKCE code verifier and the nonce for a login,
+// as far as they are enabled.
+func (p *OIDCProvider) NewAuthRequest() (*AuthRequest, error) {
+	if !p.UsePKCE && !p.VerifyNonce {
+		return nil, nil
+	}
+	r := &AuthRequest{}
+	if p.UsePKCE {
+		verifier, err := NewCodeVerifier()
+		if err != nil {
+			return nil, err
+		}
+		r.CodeVerifier = verifier
+	}
+	if p.VerifyNonce {
+		nonce, err := cookie.Nonce()
+		if err != nil {
+			return nil, err
+		}
+		r.Nonce = nonce
+	}
+	return r, nil
+}
+
+// GetLoginURL sends the configured prompt values instead of approval_prompt,
+// as some identity providers reject requests carrying both, and max_age.
+func (p *OIDCProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL := p.ProviderData.GetLoginURL(redirectURI, state)
+	if len(p.Prompt) == 0 && p.MaxAge <= 0 {
+		return loginURL
+	}
+	a, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := a.Query()
+	if len(p.Prompt) > 0 {
+		params.Del("approval_prompt")
+		params.Set("prompt", strings.Join(p.Prompt, " "))
+	}
+	if p.MaxAge > 0 {
+		params.Set("max_age", strconv.FormatInt(int64(p.MaxAge/time.Second), 10))
+	}
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// GetAuthRequestLoginURL adds the code challenge and nonce for r to the login
+// URL.
+func (p *OIDCProvider) GetAuthRequestLoginURL(redirectURI, state string, r *AuthRequest) string {
+	loginURL := p.GetLoginURL(redirectURI, state)
+	if r == nil || (r.CodeVerifier == "" && r.Nonce == "") {
+		return loginURL
+	}
+	a, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := a.Query()
+	if r.CodeVerifier != "" {
+		params.Set("code_challenge", CodeChallengeS256(r.CodeVerifier))
+		params.Set("code_challenge_method", "S256")
+	}
+	if r.Nonce != "" {
+		params.Set("nonce", r.Nonce)
+	}
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// GetLogoutURL returns the RP-initiated logout URL for the session, passing
+// its ID token as id_token_hint.
+func (p *OIDCProvider) GetLogoutURL(s *SessionState, postLogoutRedirectURI string) string {
+	if p.EndSessionURL == nil || p.EndSessionURL.String() == "" {
+		return ""
+	}
+	a := *p.EndSessionURL
+	params := a.Query()
+	if s != nil && s.IdToken != "" {
+		params.Set("id_token_hint", s.IdToken)
+	}
+	if postLogoutRedirectURI != "" {
+		params.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// RedeemAuthRequest redeems the code, sending the code verifier from r when
+// PKCE is enabled and checking the ID token against its nonce when nonce
+// verification is enabled.
+func (p *OIDCProvider) RedeemAuthRequest(redirectURL, code string, r *AuthRequest) (s *SessionState, err error) {
+	if r == nil {
+		r = &AuthRequest{}
+	}
+	if p.UsePKCE && r.CodeVerifier == "" {
+		return nil, errors.New("missing PKCE code verifier")
+	}
+	if p.VerifyNonce && r.Nonce == "" {
+		return nil, errors.New("missing id_token nonce")
+	}
+
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.tokenClient())
+	var token *oauth2.Token
+	if p.UsePKCE || p.ClientJWTKey != nil {
+		params := url.Values{}
+		params.Add("redirect_uri", redirectURL)
+		params.Add("code", code)
+		if r.CodeVerifier != "" {
+			params.Add("code_verifier", r.CodeVerifier)
+		}
+		params.Add("grant_type", "authorization_code")
+		token, err = p.tokenRequest(ctx, params)
+	} else {
+		c := oauth2.Config{
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				TokenURL: p.RedeemURL.String(),
+			},
+			RedirectURL: redirectURL,
+			Scopes:      p.Scopes,
+		}
+		token, err = c.Exchange(ctx, code)
+		if e, ok := err.(*oauth2.RetrieveError); ok {
+			err = newTokenError(e.Response.StatusCode, e.Body)
+		}
 	}
-	token, err := c.Exchange(ctx, code)
 	if err != nil {
+		if err = timeoutError(ctx, err); err == ErrRequestTimeout {
+			return nil, err
+		}
+		if _, ok := err.(*TokenError); ok {
+			return nil, err
+		}
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
-	s, err = p.createSessionState(token, ctx)
+	nonce := ""
+	if p.VerifyNonce {
+		nonce = r.Nonce
+	}
+	s, err = p.createSessionState(token, ctx, nonce)
 	if err != nil {
+		if err = timeoutError(ctx, err); err == ErrRequestTimeout {
+			return nil, err
+		}
 		return nil, fmt.Errorf("unable to update session: %v", err)
 	}
 	return
 }
 
-func (p *OIDCProvider) SetGroupRestriction(groups []string) {
-	p.GroupValidator = func(state *SessionState) bool {
-		accessToken, err := p.Verifier.Verify(context.Background(), state.AccessToken)
+// tokenRequest posts params to the token endpoint, authenticating the client
+// with its secret or a private_key_jwt assertion. The vendored oauth2 package
+// can neither add parameters such as the PKCE code verifier nor sign client
+// assertions, so the request is built here.
+func (p *OIDCProvider) tokenRequest(ctx context.Context, params url.Values) (*oauth2.Token, error) {
+	params.Set("client_id", p.ClientID)
+	if p.ClientJWTKey != nil {
+		assertion, err := newClientAssertion(p.ClientJWTKey, p.ClientID, p.RedeemURL.String(), time.Now())
 		if err != nil {
-			log.Printf("Could not verify access_token: %v for user %s", err, state.User)
-			return false
+			return nil, fmt.Errorf("could not sign client assertion: %v", err)
 		}
+		params.Set("client_assertion_type", clientAssertionType)
+		params.Set("client_assertion", assertion)
+	} else if p.ClientSecret != "" {
+		params.Set("client_secret", p.ClientSecret)
+	}
 
-		var roles struct {
-			RealmAccess struct {
-				Roles []string `json:"roles"`
-			} `json:"realm_access"`
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.tokenClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, newTokenError(resp.StatusCode, body)
+	}
+
+	var jsonResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{
+		AccessToken:  jsonResponse.AccessToken,
+		TokenType:    jsonResponse.TokenType,
+		RefreshToken: jsonResponse.RefreshToken,
+	}
+	if token.RefreshToken == "" {
+		// keep the refresh token if the response did not rotate it
+		token.RefreshToken = params.Get("refresh_token")
+	}
+	if jsonResponse.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second)
+	}
+	extra := map[string]interface{}{}
+	if jsonResponse.IDToken != "" {
+		extra["id_token"] = jsonResponse.IDToken
+	}
+	return token.WithExtra(extra), nil
+}
+
+// SetGroupRestriction restricts logins to members of the given groups, as
+// recorded on the session when it was created.
+func (p *OIDCProvider) SetGroupRestriction(groups []string) {
+	// the groups are fixed, so the lookup sets are built once
+	required := newStringSet(groups)
+	folded := make(stringSet, len(groups))
+	for _, group := range groups {
+		folded[normalizeGroup(group)] = struct{}{}
+	}
+	p.GroupValidator = func(state *SessionState) bool {
+		set, norm := required, func(group string) string { return group }
+		if p.GroupsCaseInsensitive {
+			set, norm = folded, normalizeGroup
 		}
 
-		if err := accessToken.Claims(&roles); err != nil {
-			log.Printf("Failed to parse access_token claims: %v for user %s", err, state.User)
-			return false
+		if p.GroupsRequireAll {
+			have := make(stringSet, len(state.Groups))
+			for _, group := range state.Groups {
+				have[norm(group)] = struct{}{}
+			}
+			for _, group := range groups {
+				if !have.has(norm(group)) {
+					p.Logger.Infof(`msg="group check denied" user=%q missing=%q`, state.User, group)
+					return false
+				}
+			}
+			p.Logger.Infof(`msg="group check allowed" user=%q groups=%q`, state.User, groups)
+			return true
 		}
 
-		print(len(roles.RealmAccess.Roles))
-		for _, existingRole := range roles.RealmAccess.Roles {
-			if contains(groups, existingRole) {
+		for _, existingRole := range state.Groups {
+			if set.has(norm(existingRole)) {
+				p.Logger.Infof(`msg="group check allowed" user=%q group=%q`, state.User, existingRole)
 				return true
 			}
 		}
 
-		log.Printf("User %s does not have required roles", state.User)
+		p.Logger.Infof(`msg="group check denied" user=%q required=%q`, state.User, groups)
 		return false
 	}
 }
 
+// normalizeGroup folds a group name for GroupsCaseInsensitive matching.
+func normalizeGroup(group string) string {
+	return strings.ToLower(strings.TrimSpace(group))
+}
+
+// sessionGroups reads the user's groups from the groups claim of the ID token
+// or, when GroupsFrom is "access_token", of the access token. If the claim is
+// missing, groupsFallback is asked for the groups instead.
+func (p *OIDCProvider) sessionGroups(ctx context.Context, idToken *oidc.IDToken, accessToken string) ([]string, error) {
+	token := idToken
+	if p.GroupsFrom == "access_token" {
+		var err error
+		if token, err = p.verify(ctx, accessToken); err != nil {
+			return nil, fmt.Errorf("could not verify access_token: %v", err)
+		}
+	}
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse %s claims: %v", p.GroupsFrom, err)
+	}
+
+	if _, ok := claimValue(claims, p.GroupsClaim); !ok && p.groupsFallback != nil {
+		return p.groupsFallback(ctx, idToken, accessToken)
+	}
+	return claimStrings(claims, p.GroupsClaim), nil
+}
+
+// claimValue walks the dotted path into the decoded claims and returns the
+// value found there.
+func claimValue(claims map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// claimStrings returns the string values of the claim at the dotted path. A
+// missing claim yields an empty slice.
+func claimStrings(claims map[string]interface{}, path string) []string {
+	value, _ := claimValue(claims, path)
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return []string{}
+}
+
+// IdTokenClaims decodes the claims of a raw ID token without verifying it. It
+// is meant for the ID token of a session, which was verified when the session
+// was created or refreshed. Numbers are kept as json.Number.
+func IdTokenClaims(rawIDToken string) (map[string]interface{}, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id_token: expected 3 parts, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed id_token payload: %v", err)
+	}
+	var claims map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
+	return claims, nil
+}
+
+// ClaimHeaderValue formats the named claim for use as a header value. Strings,
+// numbers and booleans are passed as is and arrays of them are joined by
+// commas. The name is looked up as is first and then as a dotted path, so that
+// namespaced claims such as "https://example.com/department" work.
+func ClaimHeaderValue(claims map[string]interface{}, name string) (string, bool) {
+	value, ok := claims[name]
+	if !ok {
+		if value, ok = claimValue(claims, name); !ok {
+			return "", false
+		}
+	}
+	if items, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			if s, ok := scalarClaimString(item); ok {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ","), true
+	}
+	return scalarClaimString(value)
+}
+
+func scalarClaimString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// contains reports whether item is in slice. It is meant for short or
+// one-off lookups; use a stringSet for a fixed list checked repeatedly.
 func contains(slice []string, item string) bool {
-	set := make(map[string]struct{}, len(slice))
 	for _, s := range slice {
-		set[s] = struct{}{}
+		if s == item {
+			return true
+		}
 	}
+	return false
+}
 
-	_, ok := set[item]
+type stringSet map[string]struct{}
+
+func newStringSet(items []string) stringSet {
+	set := make(stringSet, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+func (s stringSet) has(item string) bool {
+	_, ok := s[item]
 	return ok
 }
 
@@ -114,7 +611,7 @@ func (p *OIDCProvider) ValidateGroup(session *SessionState) bool {
 }
 
 func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
-	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+	if s == nil || s.ExpiresOn.After(time.Now().Add(p.RefreshBefore)) || s.RefreshToken == "" {
 		return false, nil
 	}
 
@@ -125,7 +622,20 @@ func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
 	}
 
-	fmt.Printf("refreshed id token %s (expired on %s)\n", s, origExpiration)
+	p.Logger.Debugf(`msg="refreshed id token" user=%q expires=%q previous_expiry=%q`, s.User, s.ExpiresOn, origExpiration)
+	return true, nil
+}
+
+// RefreshSession redeems the refresh token regardless of when the tokens
+// expire.
+func (p *OIDCProvider) RefreshSession(s *SessionState) (bool, error) {
+	if s == nil || s.RefreshToken == "" {
+		return false, nil
+	}
+	if err := p.redeemRefreshToken(s); err != nil {
+		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+	}
+	p.Logger.Debugf(`msg="refreshed session with cookie" user=%q expires=%q`, s.User, s.ExpiresOn)
 	return true, nil
 }
 
@@ -136,18 +646,42 @@ func (p *OIDCProvider) redeemRefreshToken(s *SessionState) (err error) {
 		Endpoint: oauth2.Endpoint{
 			TokenURL: p.RedeemURL.String(),
 		},
+		Scopes: p.Scopes,
 	}
-	ctx := context.Background()
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.tokenClient())
 	t := &oauth2.Token{
 		RefreshToken: s.RefreshToken,
 		Expiry:       time.Now().Add(-time.Hour),
 	}
-	token, err := c.TokenSource(ctx, t).Token()
+	ts := c.TokenSource(ctx, t)
+	if p.ClientJWTKey != nil {
+		ts = &refreshTokenSource{ctx: ctx, provider: p, refreshToken: s.RefreshToken}
+	}
+	token, err := ts.Token()
 	if err != nil {
+		if err = timeoutError(ctx, err); err == ErrRequestTimeout {
+			return err
+		}
 		return fmt.Errorf("failed to get token: %v", err)
 	}
-	newSession, err := p.createSessionState(token, ctx)
+	if _, ok := token.Extra("id_token").(string); !ok {
+		// Refresh responses are not required to carry a new ID token; keep
+		// the one we have and only update the tokens and expiry.
+		if err = p.checkAuthAge(s.IdToken, time.Now()); err != nil {
+			return err
+		}
+		s.AccessToken = token.AccessToken
+		s.RefreshToken = token.RefreshToken
+		s.ExpiresOn = token.Expiry
+		return
+	}
+	newSession, err := p.createSessionState(token, ctx, "")
 	if err != nil {
+		if err = timeoutError(ctx, err); err == ErrRequestTimeout {
+			return err
+		}
 		return fmt.Errorf("unable to update session: %v", err)
 	}
 	s.AccessToken = newSession.AccessToken
@@ -155,52 +689,257 @@ func (p *OIDCProvider) redeemRefreshToken(s *SessionState) (err error) {
 	s.RefreshToken = newSession.RefreshToken
 	s.ExpiresOn = newSession.ExpiresOn
 	s.Email = newSession.Email
+	s.User = newSession.User
+	s.Groups = newSession.Groups
 	return
 }
 
-func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Context) (*SessionState, error) {
+// verify verifies a JWT with the provider's verifier, failing with
+// ErrNoVerifier rather than panicking when there is none.
+func (p *OIDCProvider) verify(ctx context.Context, rawToken string) (*oidc.IDToken, error) {
+	if p.Verifier == nil {
+		p.Logger.Infof(`msg="cannot verify token" error=%q`, ErrNoVerifier)
+		return nil, ErrNoVerifier
+	}
+	return p.Verifier.Verify(ctx, rawToken)
+}
+
+// verifyIDToken verifies the ID token and checks its audience against
+// AllowedAudiences. Tokens that pass are remembered until they expire.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	now := time.Now()
+	if idToken, ok := p.idTokens.get(rawIDToken, now); ok {
+		return idToken, nil
+	}
+	idToken, err := p.verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.AllowedAudiences) > 0 {
+		allowed := false
+		for _, aud := range idToken.Audience {
+			allowed = allowed || contains(p.AllowedAudiences, aud)
+		}
+		if !allowed {
+			return nil, fmt.Errorf("audience %q is not allowed", idToken.Audience)
+		}
+	}
+	p.idTokens.add(rawIDToken, idToken, p.IDTokenCacheSize, now)
+	return idToken, nil
+}
+
+// refreshTokenSource is an oauth2.TokenSource refreshing through
+// tokenRequest, for client authentication the oauth2 package can't do.
+type refreshTokenSource struct {
+	ctx          context.Context
+	provider     *OIDCProvider
+	refreshToken string
+}
+
+func (ts *refreshTokenSource) Token() (*oauth2.Token, error) {
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("refresh_token", ts.refreshToken)
+	return ts.provider.tokenRequest(ts.ctx, params)
+}
+
+// createSessionState verifies the ID token in the token response. A non-empty
+// nonce must match the nonce claim of the ID token.
+func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Context, nonce string) (*SessionState, error) {
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
 		return nil, fmt.Errorf("token response did not contain an id_token")
 	}
 
 	// Parse and verify ID Token payload.
-	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	idToken, err := p.verifyIDToken(ctx, rawIDToken)
 	if err != nil {
 		return nil, fmt.Errorf("could not verify id_token: %v", err)
 	}
+	if nonce != "" && idToken.Nonce != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	if err := p.checkAuthAge(rawIDToken, time.Now()); err != nil {
+		return nil, err
+	}
 
-	// Extract custom claims.
-	var claims struct {
-		Email    string `json:"email"`
-		Verified *bool  `json:"email_verified"`
+	s, err := p.sessionFromIDToken(ctx, idToken, rawIDToken, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	s.RefreshToken = token.RefreshToken
+	s.ExpiresOn = token.Expiry
+	return s, nil
+}
+
+// SessionFromBearerToken verifies a JWT sent as a bearer token and builds a
+// session from its claims. Tokens naming one of ExtraBearerIssuers as their
+// issuer are verified by it, all others by the provider's own verifier. The
+// token stands in for both the access token and the ID token of the session,
+// which expires with it.
+func (p *OIDCProvider) SessionFromBearerToken(rawToken string) (*SessionState, error) {
+	ctx, cancel := p.requestContext()
+	defer cancel()
+
+	// the unverified issuer only selects the verifier, which checks it
+	claims, err := IdTokenClaims(rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify bearer token: %v", err)
+	}
+	var idToken *oidc.IDToken
+	if extra, ok := p.ExtraBearerIssuers[fmt.Sprint(claims["iss"])]; ok {
+		idToken, err = extra.verify(ctx, rawToken)
+	} else {
+		idToken, err = p.verifyIDToken(ctx, rawToken)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("could not verify bearer token: %v", err)
+	}
+	return p.sessionFromIDToken(ctx, idToken, rawToken, rawToken)
+}
+
+// sessionFromIDToken builds a session from the claims of a verified ID token,
+// shared by the login flow and bearer tokens.
+func (p *OIDCProvider) sessionFromIDToken(ctx context.Context, idToken *oidc.IDToken, rawIDToken, accessToken string) (*SessionState, error) {
+	// Extract custom claims.
+	var claims map[string]interface{}
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
 	}
 
-	if claims.Email == "" {
-		return nil, fmt.Errorf("id_token did not contain an email")
+	var err error
+	email, _ := claims[p.EmailClaim].(string)
+	if email == "" && p.UserInfoFallback {
+		email, err = p.getEmailAddress(ctx, &SessionState{AccessToken: accessToken})
+		if err != nil || email == "" {
+			return nil, fmt.Errorf("id_token did not contain an email (expected claim %q) and the userinfo endpoint did not provide one: %v", p.EmailClaim, err)
+		}
+	}
+	if email == "" {
+		return nil, fmt.Errorf("id_token did not contain an email (expected claim %q)", p.EmailClaim)
 	}
-	if claims.Verified != nil && !*claims.Verified {
-		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
+	verified, present, err := emailVerified(claims)
+	if err != nil {
+		return nil, err
+	}
+	if (present && !verified) || (!present && p.RequireEmailVerified) {
+		return nil, fmt.Errorf("email in id_token (%s) isn't verified", email)
+	}
+
+	user, _ := claims[p.UsernameClaim].(string)
+	if user == "" {
+		user = strings.Split(email, "@")[0]
 	}
 
+	groups, err := p.sessionGroups(ctx, idToken, accessToken)
+	if err != nil {
+		if timeoutError(ctx, err) == ErrRequestTimeout {
+			return nil, ErrRequestTimeout
+		}
+		// the session is still usable, it only fails group restrictions
+		p.Logger.Infof(`msg="could not read groups" user=%q token=%s error=%q`, user, p.GroupsFrom, err)
+	}
+	p.Logger.Debugf(`msg="groups found in token" user=%q claim=%q groups=%q`, user, p.GroupsClaim, groups)
+
 	return &SessionState{
-		AccessToken:  token.AccessToken,
-		IdToken:      rawIDToken,
-		RefreshToken: token.RefreshToken,
-		ExpiresOn:    token.Expiry,
-		Email:        claims.Email,
+		AccessToken: accessToken,
+		IdToken:     rawIDToken,
+		ExpiresOn:   idToken.Expiry,
+		Email:       email,
+		User:        user,
+		Groups:      groups,
 	}, nil
 }
 
+// emailVerified reads the email_verified claim, accepting both the boolean
+// and the "true"/"false" string forms some providers emit.
+func emailVerified(claims map[string]interface{}) (verified bool, present bool, err error) {
+	switch v := claims["email_verified"].(type) {
+	case nil:
+		return false, false, nil
+	case bool:
+		return v, true, nil
+	case string:
+		switch strings.ToLower(v) {
+		case "true":
+			return true, true, nil
+		case "false":
+			return false, true, nil
+		}
+	}
+	return false, true, fmt.Errorf("id_token contains an invalid email_verified claim: %v", claims["email_verified"])
+}
+
+// ValidateSessionState checks that the session's ID token still verifies, or
+// failing that its access token is still active, and that the user
+// authenticated within MaxAge.
 func (p *OIDCProvider) ValidateSessionState(s *SessionState) bool {
-	ctx := context.Background()
-	_, err := p.Verifier.Verify(ctx, s.IdToken)
-	if err != nil {
+	if err := p.checkAuthAge(s.IdToken, time.Now()); err != nil {
+		p.Logger.Infof(`msg="session must authenticate again" user=%q error=%q`, s.User, err)
 		return false
 	}
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	_, err := p.verifyIDToken(ctx, s.IdToken)
+	if err != nil {
+		return p.introspectAccessToken(ctx, s)
+	}
 
 	return true
 }
+
+// checkAuthAge fails when MaxAge is set and the auth_time claim of the ID
+// token is missing or older than MaxAge. Without an ID token there is nothing
+// to check the age against, so the user has to authenticate again as well.
+func (p *OIDCProvider) checkAuthAge(rawIDToken string, now time.Time) error {
+	if p.MaxAge <= 0 {
+		return nil
+	}
+	claims, err := IdTokenClaims(rawIDToken)
+	if err != nil {
+		return err
+	}
+	n, ok := claims["auth_time"].(json.Number)
+	if !ok {
+		return errors.New("id_token has no auth_time claim")
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("id_token contains an invalid auth_time claim: %v", n)
+	}
+	authTime := time.Unix(int64(seconds), 0)
+	if now.Sub(authTime) > p.MaxAge {
+		return fmt.Errorf("authenticated at %s, more than %s ago", authTime.UTC().Format(time.RFC3339), p.MaxAge)
+	}
+	return nil
+}
+
+// introspectAccessToken validates the session's access token at the
+// introspection endpoint, if one is configured, so that sessions with a live
+// opaque access token survive the expiry of their ID token.
+func (p *OIDCProvider) introspectAccessToken(ctx context.Context, s *SessionState) bool {
+	if p.IntrospectionURL == nil || p.IntrospectionURL.String() == "" ||
+		p.ClientID == "" || p.ClientSecret == "" || s.AccessToken == "" {
+		return false
+	}
+
+	now := time.Now()
+	if active, ok := p.introspection.get(s.AccessToken, now); ok {
+		return active
+	}
+	// the endpoint authenticates the client like the token endpoint does
+	active, exp, err := introspectToken(ctx, p.retryClient(p.TokenRetries), p.IntrospectionURL,
+		p.ClientID, p.ClientSecret, s.AccessToken)
+	if err != nil {
+		p.Logger.Infof(`msg="token introspection failed" user=%q error=%q`, s.User, timeoutError(ctx, err))
+		return false
+	}
+	p.Logger.Debugf(`msg="token introspected" user=%q active=%t`, s.User, active)
+	// the result does not outlive the token
+	expires := now.Add(p.IntrospectionCacheTTL)
+	if !exp.IsZero() && exp.Before(expires) {
+		expires = exp
+	}
+	p.introspection.set(s.AccessToken, active, expires, now)
+	return active
+}
@@ -0,0 +1,1757 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const testOIDCIssuer = "https://issuer.example.com"
+const testOIDCClientID = "oauth2_proxy"
+
+var testOIDCSigningKey *rsa.PrivateKey
+
+func init() {
+	var err error
+	testOIDCSigningKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// testKeySet verifies JWTs against a single in-memory RSA key
+type testKeySet struct {
+	key *rsa.PublicKey
+}
+
+func (ks *testKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, err
+	}
+	return jws.Verify(ks.key)
+}
+
+func newTestOIDCVerifier() *oidc.IDTokenVerifier {
+	return oidc.NewVerifier(testOIDCIssuer,
+		&testKeySet{key: &testOIDCSigningKey.PublicKey},
+		&oidc.Config{ClientID: testOIDCClientID})
+}
+
+// newTestOIDCProviderData returns the provider data of the test providers
+// built on OIDCProvider.
+func newTestOIDCProviderData() *ProviderData {
+	return &ProviderData{
+		ClientID:     testOIDCClientID,
+		ClientSecret: "secret",
+		LoginURL:     &url.URL{},
+		RedeemURL:    &url.URL{},
+		ValidateURL:  &url.URL{},
+	}
+}
+
+func newTestOIDCProvider() *OIDCProvider {
+	p := NewOIDCProvider(newTestOIDCProviderData())
+	p.Verifier = newTestOIDCVerifier()
+	return p
+}
+
+// newSignedTestJWT signs the given claims, filling in any standard claims
+// that are required to pass verification.
+func newSignedTestJWT(t testing.TB, claims map[string]interface{}) string {
+	defaults := map[string]interface{}{
+		"iss": testOIDCIssuer,
+		"aud": testOIDCClientID,
+		"sub": "123456789",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range defaults {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	payload, err := json.Marshal(claims)
+	assert.Equal(t, nil, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256, Key: testOIDCSigningKey}, nil)
+	assert.Equal(t, nil, err)
+	jws, err := signer.Sign(payload)
+	assert.Equal(t, nil, err)
+	raw, err := jws.CompactSerialize()
+	assert.Equal(t, nil, err)
+	return raw
+}
+
+func TestOIDCProviderDefaults(t *testing.T) {
+	p := newTestOIDCProvider()
+	assert.Equal(t, "OpenID Connect", p.Data().ProviderName)
+	assert.Equal(t, "groups", p.GroupsClaim)
+	assert.Equal(t, true, p.ValidateGroup(&SessionState{}))
+}
+
+func TestOIDCProviderGetLogoutURL(t *testing.T) {
+	p := newTestOIDCProvider()
+	session := &SessionState{IdToken: "id_token"}
+	assert.Equal(t, "", p.GetLogoutURL(session, "https://example.com/"))
+
+	p.EndSessionURL, _ = url.Parse("https://idp.example.com/logout?client=app")
+	logoutURL, err := url.Parse(p.GetLogoutURL(session, "https://example.com/"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "idp.example.com", logoutURL.Host)
+	assert.Equal(t, "/logout", logoutURL.Path)
+	assert.Equal(t, url.Values{
+		"client":                   {"app"},
+		"id_token_hint":            {"id_token"},
+		"post_logout_redirect_uri": {"https://example.com/"},
+	}, logoutURL.Query())
+
+	// without a session or redirect the user still logs out at the provider
+	assert.Equal(t, "https://idp.example.com/logout?client=app", p.GetLogoutURL(nil, ""))
+}
+
+func TestClaimStrings(t *testing.T) {
+	var claims map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"groups": ["admins", "devs"],
+		"role": "ops",
+		"realm_access": {"roles": ["offline_access", "admins"]},
+		"resource_access": {"account": {"roles": ["view-profile"]}}
+	}`), &claims)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, []string{"admins", "devs"}, claimStrings(claims, "groups"))
+	assert.Equal(t, []string{"ops"}, claimStrings(claims, "role"))
+	assert.Equal(t, []string{"offline_access", "admins"},
+		claimStrings(claims, "realm_access.roles"))
+	assert.Equal(t, []string{"view-profile"},
+		claimStrings(claims, "resource_access.account.roles"))
+	assert.Equal(t, []string{}, claimStrings(claims, "missing"))
+	assert.Equal(t, []string{}, claimStrings(claims, "realm_access.missing"))
+	assert.Equal(t, []string{}, claimStrings(claims, "groups.nested"))
+}
+
+func TestIdTokenClaims(t *testing.T) {
+	raw := newSignedTestJWT(t, map[string]interface{}{
+		"sub":                      "248289761001",
+		"department":               "engineering",
+		"level":                    3,
+		"employee":                 true,
+		"projects":                 []interface{}{"apollo", 11, false},
+		"address":                  map[string]interface{}{"country": "NL"},
+		"https://example.com/team": "platform",
+	})
+	claims, err := IdTokenClaims(raw)
+	assert.Equal(t, nil, err)
+
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"sub", "248289761001"},
+		{"department", "engineering"},
+		{"level", "3"},
+		{"employee", "true"},
+		{"projects", "apollo,11,false"},
+		{"address.country", "NL"},
+		{"https://example.com/team", "platform"},
+	} {
+		value, ok := ClaimHeaderValue(claims, tc.name)
+		assert.Equal(t, true, ok, tc.name)
+		assert.Equal(t, tc.expected, value, tc.name)
+	}
+
+	_, ok := ClaimHeaderValue(claims, "missing")
+	assert.Equal(t, false, ok)
+	// objects have no header representation
+	_, ok = ClaimHeaderValue(claims, "address")
+	assert.Equal(t, false, ok)
+}
+
+func TestIdTokenClaimsLargeNumber(t *testing.T) {
+	claims, err := IdTokenClaims("e30." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"employee_id": 9007199254740993}`)) + ".sig")
+	assert.Equal(t, nil, err)
+	value, _ := ClaimHeaderValue(claims, "employee_id")
+	assert.Equal(t, "9007199254740993", value)
+}
+
+func TestIdTokenClaimsMalformed(t *testing.T) {
+	_, err := IdTokenClaims("not-a-jwt")
+	assert.NotEqual(t, nil, err)
+	_, err = IdTokenClaims("e30.!!!.sig")
+	assert.NotEqual(t, nil, err)
+}
+
+// newTestGroupsSession creates a session from an ID token with the given
+// claims, as returned by the token endpoint.
+func newTestGroupsSession(t *testing.T, p *OIDCProvider, claims map[string]interface{}) *SessionState {
+	claims["email"] = "jdoe@example.com"
+	session, err := p.createSessionState(newTestOAuth2Token(newSignedTestJWT(t, claims)), context.Background(), "")
+	assert.Equal(t, nil, err)
+	return session
+}
+
+func TestOIDCProviderValidateGroupFlatClaim(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.SetGroupRestriction([]string{"admins"})
+
+	session := newTestGroupsSession(t, p, map[string]interface{}{
+		"groups": []string{"devs", "admins"},
+	})
+	assert.Equal(t, []string{"devs", "admins"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+
+	session = newTestGroupsSession(t, p, map[string]interface{}{
+		"groups": []string{"devs"},
+	})
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestOIDCProviderValidateGroupNestedClaim(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsClaim = "realm_access.roles"
+	p.SetGroupRestriction([]string{"admins"})
+
+	session := newTestGroupsSession(t, p, map[string]interface{}{
+		"realm_access": map[string]interface{}{
+			"roles": []string{"offline_access", "admins"},
+		},
+	})
+	assert.Equal(t, []string{"offline_access", "admins"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+}
+
+func TestOIDCProviderValidateGroupMissingClaim(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsClaim = "realm_access.roles"
+	p.SetGroupRestriction([]string{"admins"})
+
+	session := newTestGroupsSession(t, p, map[string]interface{}{
+		"groups": []string{"admins"},
+	})
+	assert.Equal(t, []string{}, session.Groups)
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestOIDCProviderValidateGroupFromIDTokenWithOpaqueAccessToken(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.SetGroupRestriction([]string{"admins"})
+
+	claims := map[string]interface{}{"groups": []string{"admins"}}
+	assert.Equal(t, true, p.ValidateGroup(newTestGroupsSession(t, p, claims)))
+
+	// the session is still created, it only lacks the groups
+	p.GroupsFrom = "access_token"
+	session := newTestGroupsSession(t, p, claims)
+	assert.Equal(t, 0, len(session.Groups))
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestOIDCProviderValidateGroupFromAccessToken(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsFrom = "access_token"
+	p.GroupsClaim = "realm_access.roles"
+	p.SetGroupRestriction([]string{"admins"})
+
+	token := (&oauth2.Token{
+		AccessToken: newSignedTestJWT(t, map[string]interface{}{
+			"realm_access": map[string]interface{}{
+				"roles": []string{"admins"},
+			},
+		}),
+		Expiry: time.Now().Add(time.Hour),
+	}).WithExtra(map[string]interface{}{
+		"id_token": newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"}),
+	})
+	session, err := p.createSessionState(token, context.Background(), "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+}
+
+func TestOIDCProviderValidateGroupWithoutReverifying(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.SetGroupRestriction([]string{"admins"})
+
+	// the ID token is long expired, but the groups on the session are used
+	// as they are
+	session := &SessionState{
+		IdToken: "expired",
+		Groups:  []string{"admins"},
+	}
+	assert.Equal(t, true, p.ValidateGroup(session))
+}
+
+func TestOIDCProviderValidateGroupLogging(t *testing.T) {
+	var buf bytes.Buffer
+	p := newTestOIDCProvider()
+	p.Logger = NewLogger(&buf, "[oidc] ")
+	p.SetGroupRestriction([]string{"admins"})
+
+	session := &SessionState{User: "jdoe", Groups: []string{"devs", "admins"}}
+	assert.Equal(t, true, p.ValidateGroup(session))
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), "[oidc] ")
+	assert.Contains(t, buf.String(),
+		`level=info msg="group check allowed" user="jdoe" group="admins"`)
+
+	buf.Reset()
+	session.Groups = []string{"devs"}
+	assert.Equal(t, false, p.ValidateGroup(session))
+	assert.Contains(t, buf.String(),
+		`level=info msg="group check denied" user="jdoe" required=["admins"]`)
+
+	buf.Reset()
+	p.Logger.Debug = true
+	newTestGroupsSession(t, p, map[string]interface{}{
+		"groups": []string{"devs"},
+	})
+	assert.Contains(t, buf.String(),
+		`level=debug msg="groups found in token" user="jdoe" claim="groups" groups=["devs"]`)
+}
+
+func TestOIDCProviderValidateGroupJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	p := newTestOIDCProvider()
+	p.Logger = NewLogger(&buf, "[oidc] ")
+	p.Logger.JSON = true
+	p.SetGroupRestriction([]string{"admins"})
+
+	session := &SessionState{User: "jdoe", Groups: []string{"devs"}}
+	assert.Equal(t, false, p.ValidateGroup(session))
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	var line map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "oidc", line["logger"])
+	assert.Equal(t, "group check denied", line["msg"])
+	assert.Equal(t, "jdoe", line["user"])
+	assert.Equal(t, []interface{}{"admins"}, line["required"])
+	_, err := time.Parse(time.RFC3339, line["timestamp"].(string))
+	assert.Equal(t, nil, err)
+}
+
+func TestOIDCProviderValidateGroupRequireAll(t *testing.T) {
+	tests := []struct {
+		name       string
+		requireAll bool
+		required   []string
+		groups     []string
+		expected   bool
+	}{
+		{"any: full overlap", false, []string{"platform-admins", "prod-access"}, []string{"platform-admins", "prod-access"}, true},
+		{"any: partial overlap", false, []string{"platform-admins", "prod-access"}, []string{"prod-access"}, true},
+		{"any: no overlap", false, []string{"platform-admins", "prod-access"}, []string{"devs"}, false},
+		{"all: full overlap", true, []string{"platform-admins", "prod-access"}, []string{"devs", "prod-access", "platform-admins"}, true},
+		{"all: partial overlap", true, []string{"platform-admins", "prod-access"}, []string{"prod-access"}, false},
+		{"all: no overlap", true, []string{"platform-admins", "prod-access"}, []string{"devs"}, false},
+	}
+
+	for _, tt := range tests {
+		p := newTestOIDCProvider()
+		p.GroupsRequireAll = tt.requireAll
+		p.SetGroupRestriction(tt.required)
+
+		session := &SessionState{Groups: tt.groups}
+		assert.Equal(t, tt.expected, p.ValidateGroup(session), tt.name)
+	}
+}
+
+func TestOIDCProviderValidateGroupCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		requireAll      bool
+		required        []string
+		groups          []string
+		expected        bool
+	}{
+		{"strict: exact match", false, false, []string{"admins"}, []string{"admins"}, true},
+		{"strict: casing differs", false, false, []string{"admins"}, []string{"Admins"}, false},
+		{"strict: whitespace", false, false, []string{"admins"}, []string{"  admins"}, false},
+		{"insensitive: casing differs", true, false, []string{"admins"}, []string{"ADMINS"}, true},
+		{"insensitive: whitespace", true, false, []string{"admins"}, []string{"  Admins "}, true},
+		{"insensitive: configured group untidy", true, false, []string{" Admins"}, []string{"admins"}, true},
+		{"insensitive: no overlap", true, false, []string{"admins"}, []string{"devs"}, false},
+		{"insensitive all: full overlap", true, true, []string{"Admins", "prod-access"}, []string{"admins ", "PROD-ACCESS"}, true},
+		{"insensitive all: partial overlap", true, true, []string{"Admins", "prod-access"}, []string{"admins"}, false},
+	}
+
+	for _, tt := range tests {
+		p := newTestOIDCProvider()
+		p.GroupsCaseInsensitive = tt.caseInsensitive
+		p.GroupsRequireAll = tt.requireAll
+		p.SetGroupRestriction(tt.required)
+
+		session := &SessionState{Groups: tt.groups}
+		assert.Equal(t, tt.expected, p.ValidateGroup(session), tt.name)
+	}
+}
+
+func newTestOAuth2Token(rawIDToken string) *oauth2.Token {
+	token := &oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	if rawIDToken == "" {
+		return token
+	}
+	return token.WithExtra(map[string]interface{}{"id_token": rawIDToken})
+}
+
+// newTestOIDCSession creates a session with p from an ID token for
+// jdoe@example.com with the given claims, and the access token of
+// newTestOAuth2Token.
+func newTestOIDCSession(t *testing.T, p *OIDCProvider, claims map[string]interface{}) (*SessionState, error) {
+	idTokenClaims := map[string]interface{}{"email": "jdoe@example.com"}
+	for k, v := range claims {
+		idTokenClaims[k] = v
+	}
+	token := newTestOAuth2Token(newSignedTestJWT(t, idTokenClaims))
+	return p.createSessionState(token, context.Background(), "")
+}
+
+// newTestBearerAPIServer serves the JSON body at path, or at any path if path
+// is empty, to requests with the access token of newTestOAuth2Token, counting
+// all requests.
+func newTestBearerAPIServer(requests *int, path string, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			if r.Header.Get("Authorization") != "Bearer access-token" {
+				w.WriteHeader(401)
+				return
+			}
+			if path != "" && r.URL.Path != path {
+				w.WriteHeader(404)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+}
+
+func TestOIDCProviderCreateSessionStateEmailClaim(t *testing.T) {
+	p := newTestOIDCProvider()
+	idToken := newSignedTestJWT(t, map[string]interface{}{
+		"email": "jdoe@example.com",
+	})
+
+	session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, idToken, session.IdToken)
+	assert.Equal(t, "access-token", session.AccessToken)
+	assert.Equal(t, "refresh-token", session.RefreshToken)
+}
+
+func TestOIDCProviderCreateSessionStateCustomEmailClaim(t *testing.T) {
+	for _, claim := range []string{"mail", "upn"} {
+		p := newTestOIDCProvider()
+		p.EmailClaim = claim
+		idToken := newSignedTestJWT(t, map[string]interface{}{
+			claim: "jdoe@example.com",
+		})
+
+		session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "jdoe@example.com", session.Email)
+	}
+}
+
+func TestOIDCProviderCreateSessionStateMissingEmailClaim(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.EmailClaim = "mail"
+	idToken := newSignedTestJWT(t, map[string]interface{}{
+		"email": "jdoe@example.com",
+	})
+
+	session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Equal(t, `id_token did not contain an email (expected claim "mail")`, err.Error())
+}
+
+func newTestUserInfoServer(payload string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer access-token" {
+				w.WriteHeader(401)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(payload))
+		}))
+}
+
+func TestOIDCProviderCreateSessionStateUserInfoFallback(t *testing.T) {
+	server := newTestUserInfoServer(`{"sub": "123456789", "email": "jdoe@example.com"}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.UserInfoFallback = true
+	p.ValidateURL, _ = url.Parse(server.URL)
+	idToken := newSignedTestJWT(t, map[string]interface{}{})
+
+	session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+}
+
+func TestOIDCProviderCreateSessionStateUserInfoFallbackWithoutEmail(t *testing.T) {
+	server := newTestUserInfoServer(`{"sub": "123456789"}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.UserInfoFallback = true
+	p.ValidateURL, _ = url.Parse(server.URL)
+	idToken := newSignedTestJWT(t, map[string]interface{}{})
+
+	session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Contains(t, err.Error(), "the userinfo endpoint did not provide one")
+}
+
+func TestOIDCProviderCreateSessionStateUserInfoFallbackDisabled(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requested = true
+			w.Write([]byte(`{"email": "jdoe@example.com"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.UserInfoFallback = false
+	p.ValidateURL, _ = url.Parse(server.URL)
+	idToken := newSignedTestJWT(t, map[string]interface{}{})
+
+	_, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.Equal(t, `id_token did not contain an email (expected claim "email")`, err.Error())
+	assert.Equal(t, false, requested)
+}
+
+func TestOIDCProviderGetEmailAddressWithoutValidateURL(t *testing.T) {
+	p := newTestOIDCProvider()
+	for _, u := range []*url.URL{nil, &url.URL{}} {
+		p.ValidateURL = u
+		email, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+		assert.Equal(t, "", email)
+		assert.Equal(t, "no userinfo endpoint configured (validate-url)", err.Error())
+	}
+}
+
+func TestOIDCProviderGetEmailAddressBadValidateURL(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.ValidateURL = &url.URL{Scheme: "http", Host: "[::1"}
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+	assert.Equal(t, "", email)
+	assert.Contains(t, err.Error(), "missing ']' in host")
+}
+
+func TestOIDCProviderGetEmailAddress(t *testing.T) {
+	server := newTestUserInfoServer(`{"sub": "123456789", "email": "jdoe@example.com"}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", email)
+}
+
+func TestOIDCProviderGetEmailAddressCached(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(`{"email": "jdoe@example.com"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
+	for i := 0; i < 2; i++ {
+		email, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "jdoe@example.com", email)
+	}
+	assert.Equal(t, 1, requests)
+
+	// another access token is looked up on its own
+	_, err := p.GetEmailAddress(&SessionState{AccessToken: "other-token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, requests)
+}
+
+func TestOIDCProviderGetEmailAddressNotCachedWithoutTTL(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(`{"email": "jdoe@example.com"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
+	p.UserInfoCacheTTL = 0
+	for i := 0; i < 2; i++ {
+		_, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, 2, requests)
+}
+
+func TestOIDCProviderGetEmailAddressRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(500)
+				return
+			}
+			w.Write([]byte(`{"email": "jdoe@example.com"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", email)
+	assert.Equal(t, 2, requests)
+}
+
+func TestOIDCProviderGetEmailAddressRetriesExhausted(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(503)
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.ValidateURL, _ = url.Parse(server.URL)
+	p.UserInfoRetries = 2
+	_, err := p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+	assert.Contains(t, err.Error(), "got 503")
+	assert.Equal(t, 3, requests)
+
+	// failures are not cached
+	_, err = p.GetEmailAddress(&SessionState{AccessToken: "access-token"})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 6, requests)
+}
+
+func TestOIDCProviderCreateSessionStateEmailVerified(t *testing.T) {
+	tests := []struct {
+		name     string
+		verified interface{}
+		strict   bool
+		valid    bool
+	}{
+		{"boolean true", true, false, true},
+		{"boolean false", false, false, false},
+		{"string true", "true", false, true},
+		{"string false", "false", false, false},
+		{"missing", nil, false, true},
+		{"strict boolean true", true, true, true},
+		{"strict string true", "true", true, true},
+		{"strict string false", "false", true, false},
+		{"strict missing", nil, true, false},
+		{"invalid string", "yes", false, false},
+	}
+
+	for _, tt := range tests {
+		p := newTestOIDCProvider()
+		p.RequireEmailVerified = tt.strict
+		claims := map[string]interface{}{"email": "jdoe@example.com"}
+		if tt.verified != nil {
+			claims["email_verified"] = tt.verified
+		}
+		idToken := newSignedTestJWT(t, claims)
+
+		session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+		if tt.valid {
+			assert.Equal(t, nil, err, tt.name)
+			assert.Equal(t, "jdoe@example.com", session.Email, tt.name)
+		} else {
+			assert.NotEqual(t, nil, err, tt.name)
+		}
+	}
+}
+
+func TestCodeChallengeS256(t *testing.T) {
+	// test vector from RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeS256("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+func TestAuthRequestEncodeDecode(t *testing.T) {
+	r := &AuthRequest{CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", Nonce: "nonce"}
+	decoded, err := DecodeAuthRequest(r.Encode())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, r, decoded)
+}
+
+func TestOIDCProviderNewAuthRequest(t *testing.T) {
+	p := newTestOIDCProvider()
+	r, err := p.NewAuthRequest()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*AuthRequest)(nil), r)
+
+	p.UsePKCE = true
+	r, err = p.NewAuthRequest()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 43, len(r.CodeVerifier))
+	other, _ := p.NewAuthRequest()
+	assert.NotEqual(t, r.CodeVerifier, other.CodeVerifier)
+}
+
+func TestOIDCProviderGetAuthRequestLoginURLSendsCodeChallenge(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.UsePKCE = true
+	p.LoginURL, _ = url.Parse("https://issuer.example.com/auth")
+	r := &AuthRequest{CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+
+	loginURL, err := url.Parse(p.GetAuthRequestLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/", r))
+	assert.Equal(t, nil, err)
+	params := loginURL.Query()
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", params.Get("code_challenge"))
+	assert.Equal(t, "S256", params.Get("code_challenge_method"))
+	assert.Equal(t, "nonce:/", params.Get("state"))
+	assert.Equal(t, "", params.Get("code_verifier"))
+}
+
+func TestOIDCProviderGetLoginURLPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		prompt   []string
+		expected string
+	}{
+		{"consent", []string{"consent"}, "consent"},
+		{"login", []string{"login"}, "login"},
+		{"select_account", []string{"select_account"}, "select_account"},
+		{"none", []string{"none"}, "none"},
+		{"several", []string{"login", "consent"}, "login consent"},
+	}
+
+	for _, tt := range tests {
+		p := newTestOIDCProvider()
+		p.ApprovalPrompt = "force"
+		p.LoginURL, _ = url.Parse("https://issuer.example.com/auth")
+		p.Prompt = tt.prompt
+
+		loginURL, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+		assert.Equal(t, nil, err, tt.name)
+		params := loginURL.Query()
+		assert.Equal(t, tt.expected, params.Get("prompt"), tt.name)
+		assert.Equal(t, "", params.Get("approval_prompt"), tt.name)
+		assert.Equal(t, "nonce:/", params.Get("state"), tt.name)
+	}
+}
+
+func TestOIDCProviderGetLoginURLWithoutPrompt(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.ApprovalPrompt = "force"
+	p.LoginURL, _ = url.Parse("https://issuer.example.com/auth")
+
+	loginURL, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+	assert.Equal(t, nil, err)
+	_, ok := loginURL.Query()["prompt"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, "force", loginURL.Query().Get("approval_prompt"))
+}
+
+func TestOIDCProviderGetAuthRequestLoginURLSendsPrompt(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.UsePKCE = true
+	p.Prompt = []string{"consent"}
+	p.LoginURL, _ = url.Parse("https://issuer.example.com/auth")
+	r := &AuthRequest{CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+
+	loginURL, err := url.Parse(p.GetAuthRequestLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/", r))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "consent", loginURL.Query().Get("prompt"))
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+}
+
+func TestOIDCProviderRedeemAuthRequestSendsCodeVerifier(t *testing.T) {
+	idToken := newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access-token", "token_type": "Bearer", ` +
+				`"refresh_token": "refresh-token", "expires_in": 3600, "id_token": "` + idToken + `"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.UsePKCE = true
+	p.RedeemURL, _ = url.Parse(server.URL)
+	r := &AuthRequest{CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+
+	session, err := p.RedeemAuthRequest("https://proxy.example.com/oauth2/callback", "code1234", r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, r.CodeVerifier, form.Get("code_verifier"))
+	assert.Equal(t, "code1234", form.Get("code"))
+	assert.Equal(t, "authorization_code", form.Get("grant_type"))
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, "access-token", session.AccessToken)
+	assert.Equal(t, "refresh-token", session.RefreshToken)
+	assert.Equal(t, idToken, session.IdToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now()))
+}
+
+func TestOIDCProviderRedeemTokenError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "Code already used"}`))
+		}))
+	defer server.Close()
+
+	for _, usePKCE := range []bool{false, true} {
+		p := newTestOIDCProvider()
+		p.UsePKCE = usePKCE
+		p.RedeemURL, _ = url.Parse(server.URL)
+		r := &AuthRequest{CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+
+		session, err := p.RedeemAuthRequest("https://proxy.example.com/oauth2/callback", "code1234", r)
+		assert.Equal(t, (*SessionState)(nil), session)
+		assert.Equal(t, &TokenError{StatusCode: 400, Code: "invalid_grant", Description: "Code already used"}, err)
+	}
+}
+
+func TestOIDCProviderRedeemUsesHTTPClient(t *testing.T) {
+	idToken := newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+	// the test server presents a self-signed certificate
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access-token", "token_type": "Bearer", ` +
+				`"expires_in": 3600, "id_token": "` + idToken + `"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "x509")
+
+	p.HTTPClient = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, "access-token", session.AccessToken)
+}
+
+func TestOIDCProviderRedeemAuthRequestMissingCodeVerifier(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.UsePKCE = true
+
+	session, err := p.RedeemAuthRequest("https://proxy.example.com/oauth2/callback", "code1234", nil)
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Equal(t, "missing PKCE code verifier", err.Error())
+}
+
+func TestOIDCProviderNonce(t *testing.T) {
+	tests := []struct {
+		name  string
+		nonce interface{}
+		valid bool
+	}{
+		{"matching nonce", "expected-nonce", true},
+		{"mismatched nonce", "other-nonce", false},
+		{"absent nonce", nil, false},
+	}
+
+	for _, tt := range tests {
+		claims := map[string]interface{}{"email": "jdoe@example.com"}
+		if tt.nonce != nil {
+			claims["nonce"] = tt.nonce
+		}
+		idToken := newSignedTestJWT(t, claims)
+
+		p := newTestOIDCProvider()
+		session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "expected-nonce")
+		if tt.valid {
+			assert.Equal(t, nil, err, tt.name)
+			assert.Equal(t, "jdoe@example.com", session.Email, tt.name)
+		} else {
+			assert.Equal(t, (*SessionState)(nil), session, tt.name)
+			assert.Equal(t, "id_token nonce does not match", err.Error(), tt.name)
+		}
+	}
+}
+
+func TestOIDCProviderNonceNotCheckedWhenDisabled(t *testing.T) {
+	idToken := newSignedTestJWT(t, map[string]interface{}{
+		"email": "jdoe@example.com",
+		"nonce": "other-nonce",
+	})
+	p := newTestOIDCProvider()
+
+	session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+}
+
+func TestOIDCProviderGetAuthRequestLoginURLSendsNonce(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.VerifyNonce = true
+	p.LoginURL, _ = url.Parse("https://issuer.example.com/auth")
+
+	r, err := p.NewAuthRequest()
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, "", r.Nonce)
+	assert.Equal(t, "", r.CodeVerifier)
+
+	loginURL, err := url.Parse(p.GetAuthRequestLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/", r))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, r.Nonce, loginURL.Query().Get("nonce"))
+	assert.Equal(t, "", loginURL.Query().Get("code_challenge"))
+}
+
+func TestOIDCProviderRedeemAuthRequestChecksNonce(t *testing.T) {
+	idToken := newSignedTestJWT(t, map[string]interface{}{
+		"email": "jdoe@example.com",
+		"nonce": "expected-nonce",
+	})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access-token", "token_type": "Bearer", ` +
+				`"expires_in": 3600, "id_token": "` + idToken + `"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.VerifyNonce = true
+	p.RedeemURL, _ = url.Parse(server.URL)
+
+	session, err := p.RedeemAuthRequest("https://proxy.example.com/oauth2/callback", "code1234",
+		&AuthRequest{Nonce: "expected-nonce"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+
+	session, err = p.RedeemAuthRequest("https://proxy.example.com/oauth2/callback", "code1234",
+		&AuthRequest{Nonce: "other-nonce"})
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Contains(t, err.Error(), "id_token nonce does not match")
+
+	session, err = p.RedeemAuthRequest("https://proxy.example.com/oauth2/callback", "code1234", nil)
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Equal(t, "missing id_token nonce", err.Error())
+}
+
+func TestOIDCProviderGetLoginURLMaxAge(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.LoginURL, _ = url.Parse("https://issuer.example.com/auth")
+
+	loginURL, _ := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+	_, ok := loginURL.Query()["max_age"]
+	assert.Equal(t, false, ok)
+
+	p.MaxAge = 15 * time.Minute
+	loginURL, _ = url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+	assert.Equal(t, "900", loginURL.Query().Get("max_age"))
+}
+
+func TestOIDCProviderRedeemChecksAuthTime(t *testing.T) {
+	var idToken string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access-token", "token_type": "Bearer", ` +
+				`"expires_in": 3600, "id_token": "` + idToken + `"}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.MaxAge = 15 * time.Minute
+	p.RedeemURL, _ = url.Parse(server.URL)
+
+	idToken = newSignedTestJWT(t, map[string]interface{}{
+		"email":     "jdoe@example.com",
+		"auth_time": time.Now().Add(-time.Minute).Unix(),
+	})
+	session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+
+	idToken = newSignedTestJWT(t, map[string]interface{}{
+		"email":     "jdoe@example.com",
+		"auth_time": time.Now().Add(-time.Hour).Unix(),
+	})
+	session, err = p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Contains(t, err.Error(), "more than 15m0s ago")
+
+	idToken = newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+	session, err = p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Equal(t, "unable to update session: id_token has no auth_time claim", err.Error())
+}
+
+func TestOIDCProviderValidateSessionStateMaxAge(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.Logger = NewLogger(ioutil.Discard, "[oidc] ")
+	p.MaxAge = 15 * time.Minute
+	fresh := newSignedTestJWT(t, map[string]interface{}{
+		"auth_time": time.Now().Add(-time.Minute).Unix(),
+	})
+	stale := newSignedTestJWT(t, map[string]interface{}{
+		"auth_time": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	assert.Equal(t, true, p.ValidateSessionState(&SessionState{IdToken: fresh}))
+	assert.Equal(t, false, p.ValidateSessionState(&SessionState{IdToken: stale}))
+
+	// a cached token is checked all the same
+	p.IDTokenCacheSize = 10
+	p.MaxAge = 0
+	assert.Equal(t, true, p.ValidateSessionState(&SessionState{IdToken: stale}))
+	p.MaxAge = 15 * time.Minute
+	assert.Equal(t, false, p.ValidateSessionState(&SessionState{IdToken: stale}))
+}
+
+func TestOIDCProviderRefreshSessionWithoutIDTokenChecksAuthTime(t *testing.T) {
+	requests := 0
+	server := newTestTokenServer(&requests, func() string {
+		return `{"access_token": "new-access-token", "token_type": "Bearer", "expires_in": 3600}`
+	})
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.MaxAge = 15 * time.Minute
+	p.RedeemURL, _ = url.Parse(server.URL)
+	session := &SessionState{
+		AccessToken: "access-token",
+		IdToken: newSignedTestJWT(t, map[string]interface{}{
+			"auth_time": time.Now().Add(-time.Hour).Unix(),
+		}),
+		RefreshToken: "refresh-token",
+	}
+
+	refreshed, err := p.RefreshSession(session)
+	assert.Equal(t, false, refreshed)
+	assert.Contains(t, err.Error(), "more than 15m0s ago")
+	assert.Equal(t, "access-token", session.AccessToken)
+}
+
+func newTestIntrospectionServer(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != testOIDCClientID || pass != "secret" {
+				w.WriteHeader(401)
+				return
+			}
+			r.ParseForm()
+			w.Header().Set("Content-Type", "application/json")
+			switch r.PostForm.Get("token") {
+			case "active-token":
+				w.Write([]byte(`{"active": true, "client_id": "oauth2_proxy"}`))
+			case "expired-token":
+				fmt.Fprintf(w, `{"active": true, "exp": %d}`, time.Now().Add(-time.Second).Unix())
+			default:
+				w.Write([]byte(`{"active": false}`))
+			}
+		}))
+}
+
+func TestOIDCProviderValidateSessionStateIntrospection(t *testing.T) {
+	requests := 0
+	server := newTestIntrospectionServer(&requests)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.IntrospectionURL, _ = url.Parse(server.URL)
+	expiredIDToken := newSignedTestJWT(t, map[string]interface{}{
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+
+	active := &SessionState{IdToken: expiredIDToken, AccessToken: "active-token"}
+	assert.Equal(t, true, p.ValidateSessionState(active))
+	assert.Equal(t, true, p.ValidateSessionState(active))
+	assert.Equal(t, 1, requests)
+
+	inactive := &SessionState{IdToken: expiredIDToken, AccessToken: "revoked-token"}
+	assert.Equal(t, false, p.ValidateSessionState(inactive))
+	assert.Equal(t, false, p.ValidateSessionState(inactive))
+	assert.Equal(t, 2, requests)
+}
+
+func TestOIDCProviderValidateSessionStateIntrospectionCacheExpiry(t *testing.T) {
+	requests := 0
+	server := newTestIntrospectionServer(&requests)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.IntrospectionURL, _ = url.Parse(server.URL)
+	p.IntrospectionCacheTTL = 0
+	session := &SessionState{AccessToken: "active-token"}
+
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, 2, requests)
+}
+
+func TestOIDCProviderValidateSessionStateIntrospectionCacheCappedAtExp(t *testing.T) {
+	requests := 0
+	server := newTestIntrospectionServer(&requests)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.IntrospectionURL, _ = url.Parse(server.URL)
+	p.IntrospectionCacheTTL = time.Hour
+	session := &SessionState{AccessToken: "expired-token"}
+
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, true, p.ValidateSessionState(session))
+	assert.Equal(t, 2, requests)
+}
+
+func TestOIDCProviderValidateSessionStateIntrospectionRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{"active": true}`))
+		}))
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.IntrospectionURL, _ = url.Parse(server.URL)
+	p.TokenRetries = 1
+	assert.Equal(t, true, p.ValidateSessionState(&SessionState{AccessToken: "active-token"}))
+	assert.Equal(t, 2, requests)
+}
+
+func TestIntrospectionCacheSweep(t *testing.T) {
+	var c introspectionCache
+	now := time.Now()
+	c.set("old", true, now.Add(time.Second), now)
+	c.set("new", true, now.Add(time.Hour), now.Add(2*time.Second))
+	// the expired entry is kept until the next sweep is due
+	assert.Equal(t, 2, len(c.entries))
+
+	c.set("newer", true, now.Add(time.Hour), now.Add(introspectionSweepInterval))
+	assert.Equal(t, 2, len(c.entries))
+	_, ok := c.get("old", now)
+	assert.Equal(t, false, ok)
+}
+
+func TestOIDCProviderValidateSessionStateWithoutIntrospection(t *testing.T) {
+	p := newTestOIDCProvider()
+	valid := newSignedTestJWT(t, map[string]interface{}{})
+	expired := newSignedTestJWT(t, map[string]interface{}{
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+
+	assert.Equal(t, true, p.ValidateSessionState(&SessionState{IdToken: valid}))
+	assert.Equal(t, false, p.ValidateSessionState(
+		&SessionState{IdToken: expired, AccessToken: "active-token"}))
+}
+
+func newTestTokenServer(requests *int, response func() string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(response()))
+		}))
+}
+
+func TestOIDCProviderRefreshSessionIfNeededBeforeExpiry(t *testing.T) {
+	requests := 0
+	server := newTestTokenServer(&requests, func() string {
+		idToken := newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+		return `{"access_token": "new-access-token", "token_type": "Bearer", ` +
+			`"refresh_token": "new-refresh-token", "expires_in": 3600, "id_token": "` + idToken + `"}`
+	})
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.RefreshBefore = time.Minute
+	session := &SessionState{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		ExpiresOn:    time.Now().Add(30 * time.Second),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, "new-access-token", session.AccessToken)
+	assert.Equal(t, "new-refresh-token", session.RefreshToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now().Add(time.Minute)))
+}
+
+func TestOIDCProviderRefreshSessionIfNeededNotYetDue(t *testing.T) {
+	requests := 0
+	server := newTestTokenServer(&requests, func() string { return `{}` })
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	session := &SessionState{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		ExpiresOn:    time.Now().Add(30 * time.Second),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+
+	p.RefreshBefore = 10 * time.Second
+	refreshed, err = p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, 0, requests)
+}
+
+func TestOIDCProviderRefreshSession(t *testing.T) {
+	requests := 0
+	server := newTestTokenServer(&requests, func() string {
+		return `{"access_token": "new-access-token", "token_type": "Bearer", "expires_in": 3600}`
+	})
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	session := &SessionState{
+		AccessToken: "access-token",
+		ExpiresOn:   time.Now().Add(30 * time.Minute),
+	}
+
+	// without a refresh token there is nothing to do
+	refreshed, err := p.RefreshSession(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, 0, requests)
+
+	// the tokens are refreshed although they are far from expiring
+	session.RefreshToken = "refresh-token"
+	refreshed, err = p.RefreshSession(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, "new-access-token", session.AccessToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now().Add(45*time.Minute)))
+}
+
+func TestOIDCProviderRefreshSessionIfNeededWithoutIDToken(t *testing.T) {
+	requests := 0
+	server := newTestTokenServer(&requests, func() string {
+		return `{"access_token": "new-access-token", "token_type": "Bearer", "expires_in": 3600}`
+	})
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	session := &SessionState{
+		Email:        "jdoe@example.com",
+		AccessToken:  "access-token",
+		IdToken:      "original-id-token",
+		RefreshToken: "refresh-token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "new-access-token", session.AccessToken)
+	assert.Equal(t, "original-id-token", session.IdToken)
+	assert.Equal(t, "refresh-token", session.RefreshToken)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now()))
+}
+
+func TestOIDCProviderRedeemRetriesTokenEndpoint(t *testing.T) {
+	idToken := newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+	requests := 0
+	server := newFlakyServer(&requests, 2, 502,
+		`{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600, "id_token": "`+idToken+`"}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.TokenRetries = 2
+	p.TokenRetryBaseDelay = time.Millisecond
+
+	session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, 3, requests)
+}
+
+func TestOIDCProviderRefreshRetriesTokenEndpoint(t *testing.T) {
+	requests := 0
+	server := newFlakyServer(&requests, 2, 500,
+		`{"access_token": "new-access-token", "token_type": "Bearer", "expires_in": 3600}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.TokenRetries = 2
+	p.TokenRetryBaseDelay = time.Millisecond
+	session := &SessionState{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "new-access-token", session.AccessToken)
+	assert.Equal(t, 3, requests)
+}
+
+// newHangingServer does not answer until release is closed
+func newHangingServer(release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"active": true}`))
+		}))
+}
+
+func TestOIDCProviderRedeemTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newHangingServer(release)
+	defer server.Close()
+	defer close(release)
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.RequestTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, (*SessionState)(nil), session)
+	assert.Equal(t, ErrRequestTimeout, err)
+	assert.Equal(t, true, time.Since(start) < time.Second)
+}
+
+func TestOIDCProviderRefreshTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newHangingServer(release)
+	defer server.Close()
+	defer close(release)
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.RequestTimeout = 20 * time.Millisecond
+	session := &SessionState{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, false, refreshed)
+	assert.Contains(t, err.Error(), ErrRequestTimeout.Error())
+}
+
+func TestOIDCProviderValidateSessionStateIntrospectionTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newHangingServer(release)
+	defer server.Close()
+	defer close(release)
+
+	p := newTestOIDCProvider()
+	p.IntrospectionURL, _ = url.Parse(server.URL)
+	p.RequestTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	assert.Equal(t, false, p.ValidateSessionState(&SessionState{AccessToken: "active-token"}))
+	assert.Equal(t, true, time.Since(start) < time.Second)
+}
+
+func TestOIDCProviderAllowedAudiences(t *testing.T) {
+	tests := []struct {
+		name     string
+		audience interface{}
+		valid    bool
+	}{
+		{"matching audience", "api", true},
+		{"other audience", "other-client", false},
+		{"multiple audiences", []string{"other-client", "api"}, true},
+		{"multiple other audiences", []string{"other-client", "another-client"}, false},
+	}
+
+	for _, tt := range tests {
+		p := newTestOIDCProvider()
+		// as configured by the options when an allowed list is given
+		p.Verifier = oidc.NewVerifier(testOIDCIssuer,
+			&testKeySet{key: &testOIDCSigningKey.PublicKey},
+			&oidc.Config{ClientID: testOIDCClientID, SkipClientIDCheck: true})
+		p.AllowedAudiences = []string{testOIDCClientID, "api"}
+		idToken := newSignedTestJWT(t, map[string]interface{}{
+			"aud":   tt.audience,
+			"email": "jdoe@example.com",
+		})
+
+		session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+		if tt.valid {
+			assert.Equal(t, nil, err, tt.name)
+			assert.Equal(t, true, p.ValidateSessionState(session), tt.name)
+		} else {
+			assert.Equal(t, (*SessionState)(nil), session, tt.name)
+			assert.Contains(t, err.Error(), "is not allowed", tt.name)
+			assert.Equal(t, false, p.ValidateSessionState(&SessionState{IdToken: idToken}), tt.name)
+		}
+	}
+}
+
+func TestOIDCProviderScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		scope    string
+		expected string
+	}{
+		{"default", "", "openid email profile"},
+		{"custom", "openid email offline_access groups", "openid email offline_access groups"},
+		{"openid added", "email api://orders", "openid email api://orders"},
+	}
+
+	for _, tt := range tests {
+		loginURL, _ := url.Parse("https://issuer.example.com/auth")
+		p := NewOIDCProvider(&ProviderData{
+			ClientID: testOIDCClientID,
+			LoginURL: loginURL,
+			Scope:    tt.scope,
+		})
+		assert.Equal(t, strings.Fields(tt.expected), p.Scopes, tt.name)
+
+		redirect, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "nonce:/"))
+		assert.Equal(t, nil, err, tt.name)
+		assert.Equal(t, tt.expected, redirect.Query().Get("scope"), tt.name)
+	}
+}
+
+func TestOIDCProviderCreateSessionStateUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		claim    string
+		claims   map[string]interface{}
+		expected string
+	}{
+		{"preferred_username", "preferred_username",
+			map[string]interface{}{"email": "jdoe@example.com", "preferred_username": "john.doe"}, "john.doe"},
+		{"email local part", "preferred_username",
+			map[string]interface{}{"email": "jdoe@example.com"}, "jdoe"},
+		{"custom claim", "uid",
+			map[string]interface{}{"email": "jdoe@example.com", "preferred_username": "john.doe", "uid": "u1234"}, "u1234"},
+	}
+
+	for _, tt := range tests {
+		p := newTestOIDCProvider()
+		p.UsernameClaim = tt.claim
+		idToken := newSignedTestJWT(t, tt.claims)
+
+		session, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+		assert.Equal(t, nil, err, tt.name)
+		assert.Equal(t, tt.expected, session.User, tt.name)
+		assert.Equal(t, "jdoe@example.com", session.Email, tt.name)
+	}
+}
+
+// newClientAssertionTokenServer only accepts requests authenticated with a
+// client assertion signed by testOIDCSigningKey
+func newClientAssertionTokenServer(forms *[]url.Values, response string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			*forms = append(*forms, r.PostForm)
+			jws, err := jose.ParseSigned(r.PostForm.Get("client_assertion"))
+			if err != nil || r.PostForm.Get("client_assertion_type") != clientAssertionType {
+				w.WriteHeader(401)
+				return
+			}
+			payload, err := jws.Verify(&testOIDCSigningKey.PublicKey)
+			var claims map[string]interface{}
+			if err != nil || json.Unmarshal(payload, &claims) != nil ||
+				claims["iss"] != testOIDCClientID || claims["aud"] != server.URL {
+				w.WriteHeader(401)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(response))
+		}))
+	return server
+}
+
+func TestOIDCProviderRedeemWithClientAssertion(t *testing.T) {
+	idToken := newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+	var forms []url.Values
+	server := newClientAssertionTokenServer(&forms, `{"access_token": "access-token", "token_type": "Bearer", `+
+		`"refresh_token": "refresh-token", "expires_in": 3600, "id_token": "`+idToken+`"}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.ClientJWTKey = testOIDCSigningKey
+
+	session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, "code1234", forms[0].Get("code"))
+	assert.Equal(t, testOIDCClientID, forms[0].Get("client_id"))
+	assert.Equal(t, "", forms[0].Get("client_secret"))
+}
+
+func TestOIDCProviderRefreshWithClientAssertion(t *testing.T) {
+	var forms []url.Values
+	server := newClientAssertionTokenServer(&forms,
+		`{"access_token": "new-access-token", "token_type": "Bearer", "expires_in": 3600}`)
+	defer server.Close()
+
+	p := newTestOIDCProvider()
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.ClientJWTKey = testOIDCSigningKey
+	session := &SessionState{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "new-access-token", session.AccessToken)
+	assert.Equal(t, "refresh-token", session.RefreshToken)
+	assert.Equal(t, "refresh_token", forms[0].Get("grant_type"))
+	assert.Equal(t, "refresh-token", forms[0].Get("refresh_token"))
+	assert.Equal(t, "", forms[0].Get("client_secret"))
+}
+
+func TestOIDCProviderRefreshRotatesRefreshToken(t *testing.T) {
+	for _, idToken := range []string{"", newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})} {
+		var refreshTokens []string
+		server := newRotatingTokenServer(&refreshTokens, idToken)
+
+		p := newTestOIDCProvider()
+		p.RedeemURL, _ = url.Parse(server.URL)
+		session := &SessionState{
+			Email:        "jdoe@example.com",
+			AccessToken:  "access-token",
+			RefreshToken: "refresh-token-0",
+			ExpiresOn:    time.Now().Add(-time.Minute),
+		}
+
+		refreshed, err := p.RefreshSessionIfNeeded(session)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, refreshed)
+		assert.Equal(t, "refresh-token-1", session.RefreshToken)
+
+		refreshed, err = p.RefreshSession(session)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, refreshed)
+		assert.Equal(t, "access-token-2", session.AccessToken)
+		assert.Equal(t, "refresh-token-2", session.RefreshToken)
+		assert.Equal(t, []string{"refresh-token-0", "refresh-token-1"}, refreshTokens)
+		server.Close()
+	}
+}
+
+func TestOIDCProviderSessionFromBearerToken(t *testing.T) {
+	p := newTestOIDCProvider()
+	rawToken := newSignedTestJWT(t, map[string]interface{}{
+		"email":  "janed@example.com",
+		"groups": []string{"admins"},
+	})
+
+	s, err := p.SessionFromBearerToken(rawToken)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "janed@example.com", s.Email)
+	assert.Equal(t, "janed", s.User)
+	assert.Equal(t, []string{"admins"}, s.Groups)
+	assert.Equal(t, rawToken, s.AccessToken)
+	assert.Equal(t, rawToken, s.IdToken)
+	assert.Equal(t, "", s.RefreshToken)
+	assert.False(t, s.IsExpired())
+}
+
+func TestOIDCProviderSessionFromBearerTokenExpired(t *testing.T) {
+	p := newTestOIDCProvider()
+	rawToken := newSignedTestJWT(t, map[string]interface{}{
+		"email": "janed@example.com",
+		"iat":   time.Now().Add(-2 * time.Hour).Unix(),
+		"exp":   time.Now().Add(-time.Hour).Unix(),
+	})
+
+	_, err := p.SessionFromBearerToken(rawToken)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "could not verify bearer token")
+}
+
+func TestOIDCProviderSessionFromBearerTokenUntrustedIssuer(t *testing.T) {
+	p := newTestOIDCProvider()
+	rawToken := newSignedTestJWT(t, map[string]interface{}{
+		"iss":   "https://untrusted.example.com",
+		"email": "janed@example.com",
+	})
+
+	_, err := p.SessionFromBearerToken(rawToken)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "could not verify bearer token")
+}
+
+func newTestBearerIssuer(issuer string, audiences ...string) *BearerIssuer {
+	return &BearerIssuer{
+		Verifier: oidc.NewVerifier(issuer,
+			&testKeySet{key: &testOIDCSigningKey.PublicKey},
+			&oidc.Config{SkipClientIDCheck: true}),
+		Audiences: audiences,
+	}
+}
+
+func TestOIDCProviderSessionFromBearerTokenExtraIssuers(t *testing.T) {
+	const machineIssuer = "https://machine.example.com"
+	p := newTestOIDCProvider()
+	p.ExtraBearerIssuers = map[string]*BearerIssuer{
+		machineIssuer: newTestBearerIssuer(machineIssuer, testOIDCClientID, "batch-jobs"),
+	}
+
+	tests := []struct {
+		name    string
+		iss     string
+		aud     string
+		message string
+	}{
+		{"primary issuer", testOIDCIssuer, testOIDCClientID, ""},
+		{"extra issuer", machineIssuer, testOIDCClientID, ""},
+		{"extra issuer second audience", machineIssuer, "batch-jobs", ""},
+		{"extra issuer wrong audience", machineIssuer, "someone-else", "is not allowed for issuer"},
+		{"primary issuer extra audience", testOIDCIssuer, "batch-jobs", "could not verify bearer token"},
+		{"unconfigured issuer", "https://untrusted.example.com", testOIDCClientID, "could not verify bearer token"},
+	}
+	for _, test := range tests {
+		rawToken := newSignedTestJWT(t, map[string]interface{}{
+			"iss":   test.iss,
+			"aud":   test.aud,
+			"email": "janed@example.com",
+		})
+		s, err := p.SessionFromBearerToken(rawToken)
+		if test.message == "" {
+			assert.Equal(t, nil, err, test.name)
+			assert.Equal(t, "janed@example.com", s.Email, test.name)
+			continue
+		}
+		assert.NotEqual(t, nil, err, test.name)
+		if err != nil {
+			assert.Contains(t, err.Error(), test.message, test.name)
+		}
+	}
+}
+
+func TestOIDCProviderSessionFromBearerTokenMalformed(t *testing.T) {
+	p := newTestOIDCProvider()
+	_, err := p.SessionFromBearerToken("not-a-jwt")
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "could not verify bearer token")
+}
+
+func TestOIDCProviderWithoutVerifier(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.Verifier = nil
+	idToken := newSignedTestJWT(t, map[string]interface{}{"email": "janed@example.com"})
+
+	_, err := p.createSessionState(newTestOAuth2Token(idToken), context.Background(), "")
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), ErrNoVerifier.Error())
+
+	_, err = p.SessionFromBearerToken(idToken)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), ErrNoVerifier.Error())
+
+	assert.False(t, p.ValidateSessionState(&SessionState{IdToken: idToken, AccessToken: "access-token"}))
+}
+
+func TestOIDCProviderGroupsFromAccessTokenWithoutVerifier(t *testing.T) {
+	p := newTestOIDCProvider()
+	p.GroupsFrom = "access_token"
+	idToken, err := p.Verifier.Verify(context.Background(),
+		newSignedTestJWT(t, map[string]interface{}{"email": "janed@example.com"}))
+	assert.Equal(t, nil, err)
+
+	p.Verifier = nil
+	_, err = p.sessionGroups(context.Background(), idToken, "access-token")
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), ErrNoVerifier.Error())
+}
+
+func TestBearerIssuerWithoutVerifier(t *testing.T) {
+	b := &BearerIssuer{Audiences: []string{testOIDCClientID}}
+	_, err := b.verify(context.Background(), "header.payload.sig")
+	assert.Equal(t, ErrNoVerifier, err)
+}
+
+func BenchmarkOIDCProviderGroupValidator(b *testing.B) {
+	p := newTestOIDCProvider()
+	p.Logger = NewLogger(ioutil.Discard, "[oidc] ")
+	required := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		required = append(required, fmt.Sprintf("required-%d", i))
+	}
+	p.SetGroupRestriction(required)
+
+	session := &SessionState{User: "janed"}
+	for i := 0; i < 20; i++ {
+		session.Groups = append(session.Groups, fmt.Sprintf("other-%d", i))
+	}
+	session.Groups = append(session.Groups, "required-49")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !p.ValidateGroup(session) {
+			b.Fatal("group check denied")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/bitly/oauth2_proxy/api"
+	"github.com/coreos/go-oidc"
+)
+
+// OktaProvider is an OpenID Connect provider for Okta. Okta leaves the groups
+// claim out of the token when the user is in many groups, so the groups can
+// also be read from Okta's users API.
+type OktaProvider struct {
+	*OIDCProvider
+
+	// FetchGroups looks the user's groups up at the users API when the
+	// token does not carry the groups claim.
+	FetchGroups bool
+	// APIURL is the base URL of the Okta org, e.g. https://example.okta.com.
+	APIURL *url.URL
+}
+
+func NewOktaProvider(p *ProviderData) *OktaProvider {
+	o := &OktaProvider{OIDCProvider: NewOIDCProvider(p)}
+	p.ProviderName = "Okta"
+	o.Logger = NewLogger(os.Stderr, "[okta] ")
+	o.groupsFallback = func(ctx context.Context, idToken *oidc.IDToken, accessToken string) ([]string, error) {
+		if !o.FetchGroups {
+			return []string{}, nil
+		}
+		o.Logger.Debugf(`msg="groups claim missing, fetching groups" subject=%q claim=%q`, idToken.Subject, o.GroupsClaim)
+		return o.fetchGroups(ctx, idToken.Subject, accessToken)
+	}
+	return o
+}
+
+// fetchGroups lists the names of the groups of the Okta user with the given
+// ID, authenticating with the user's access token.
+func (p *OktaProvider) fetchGroups(ctx context.Context, userID, accessToken string) ([]string, error) {
+	if p.APIURL == nil || p.APIURL.String() == "" {
+		return nil, fmt.Errorf("no okta api url configured")
+	}
+	endpoint := *p.APIURL
+	endpoint.Path = "/api/v1/users/" + url.PathEscape(userID) + "/groups"
+
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var response []struct {
+		Profile struct {
+			Name string `json:"name"`
+		} `json:"profile"`
+	}
+	if err := api.RequestJsonWithClient(p.httpClient(), req.WithContext(ctx), &response); err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(response))
+	for _, group := range response {
+		groups = append(groups, group.Profile.Name)
+	}
+	return groups, nil
+}
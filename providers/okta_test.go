@@ -0,0 +1,130 @@
+package providers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOktaProvider() *OktaProvider {
+	p := NewOktaProvider(newTestOIDCProviderData())
+	p.Verifier = newTestOIDCVerifier()
+	return p
+}
+
+// newTestOktaGroupsServer serves the groups of user 123456789 in the shape
+// of Okta's /api/v1/users/{id}/groups response.
+func newTestOktaGroupsServer(requests *int) *httptest.Server {
+	return newTestBearerAPIServer(requests, "/api/v1/users/123456789/groups", `[
+  {
+    "id": "00g1emaKYZTWRYYRRTSK",
+    "created": "2015-02-06T10:11:28.000Z",
+    "type": "BUILT_IN",
+    "profile": {"name": "Everyone", "description": "All users in your organization"}
+  },
+  {
+    "id": "00g1ljhbhYMRZHNKMUYT",
+    "created": "2015-10-20T18:12:41.000Z",
+    "type": "OKTA_GROUP",
+    "profile": {"name": "engineering", "description": "Engineering"}
+  }
+]`)
+}
+
+func TestOktaProviderDefaults(t *testing.T) {
+	p := newTestOktaProvider()
+	assert.Equal(t, "Okta", p.Data().ProviderName)
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+	assert.Equal(t, "groups", p.GroupsClaim)
+}
+
+func TestOktaProviderGroupsFromClaim(t *testing.T) {
+	requests := 0
+	server := newTestOktaGroupsServer(&requests)
+	defer server.Close()
+
+	p := newTestOktaProvider()
+	p.APIURL, _ = url.Parse(server.URL)
+	p.FetchGroups = true
+
+	session, err := newTestOIDCSession(t, p.OIDCProvider, map[string]interface{}{
+		"groups": []string{"admins"},
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins"}, session.Groups)
+	assert.Equal(t, 0, requests)
+}
+
+func TestOktaProviderGroupsFetched(t *testing.T) {
+	requests := 0
+	server := newTestOktaGroupsServer(&requests)
+	defer server.Close()
+
+	p := newTestOktaProvider()
+	p.APIURL, _ = url.Parse(server.URL)
+	p.FetchGroups = true
+
+	session, err := newTestOIDCSession(t, p.OIDCProvider, map[string]interface{}{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"Everyone", "engineering"}, session.Groups)
+	assert.Equal(t, 1, requests)
+}
+
+func TestOktaProviderGroupsNotFetchedByDefault(t *testing.T) {
+	requests := 0
+	server := newTestOktaGroupsServer(&requests)
+	defer server.Close()
+
+	p := newTestOktaProvider()
+	p.APIURL, _ = url.Parse(server.URL)
+
+	session, err := newTestOIDCSession(t, p.OIDCProvider, map[string]interface{}{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{}, session.Groups)
+	assert.Equal(t, 0, requests)
+}
+
+func TestOktaProviderGroupsFetchFailure(t *testing.T) {
+	requests := 0
+	server := newTestOktaGroupsServer(&requests)
+	defer server.Close()
+
+	p := newTestOktaProvider()
+	p.APIURL, _ = url.Parse(server.URL)
+	p.FetchGroups = true
+	p.SetGroupRestriction([]string{"engineering"})
+
+	session, err := newTestOIDCSession(t, p.OIDCProvider, map[string]interface{}{"sub": "unknown"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 0, len(session.Groups))
+	assert.Equal(t, false, p.ValidateGroup(session))
+}
+
+func TestOktaProviderRedeemFetchesGroups(t *testing.T) {
+	groupRequests := 0
+	groupServer := newTestOktaGroupsServer(&groupRequests)
+	defer groupServer.Close()
+
+	tokenRequests := 0
+	tokenServer := newTestTokenServer(&tokenRequests, func() string {
+		idToken := newSignedTestJWT(t, map[string]interface{}{"email": "jdoe@example.com"})
+		return `{"access_token": "access-token", "token_type": "Bearer", ` +
+			`"expires_in": 3600, "id_token": "` + idToken + `"}`
+	})
+	defer tokenServer.Close()
+
+	p := newTestOktaProvider()
+	p.RedeemURL, _ = url.Parse(tokenServer.URL)
+	p.APIURL, _ = url.Parse(groupServer.URL)
+	p.FetchGroups = true
+	p.SetGroupRestriction([]string{"engineering"})
+
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"Everyone", "engineering"}, session.Groups)
+	assert.Equal(t, true, p.ValidateGroup(session))
+	assert.Equal(t, 1, groupRequests)
+}
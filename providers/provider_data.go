@@ -1,9 +1,17 @@
 package providers
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"net/url"
+	"time"
 )
 
+// ErrRequestTimeout is returned when the identity provider does not answer
+// within RequestTimeout.
+var ErrRequestTimeout = errors.New("timed out waiting for the identity provider")
+
 type ProviderData struct {
 	ProviderName      string
 	ClientID          string
@@ -15,6 +23,43 @@ type ProviderData struct {
 	ValidateURL       *url.URL
 	Scope             string
 	ApprovalPrompt    string
+	// TokenRetries is how often a token endpoint call failing with a
+	// network error or a 5xx response is retried.
+	TokenRetries int
+	// TokenRetryBaseDelay is the delay before the first retry; it doubles
+	// with every further attempt.
+	TokenRetryBaseDelay time.Duration
+	// RequestTimeout bounds each call to the identity provider; zero means
+	// no timeout.
+	RequestTimeout time.Duration
+	// HTTPClient makes the calls to the identity provider; nil means
+	// http.DefaultClient.
+	HTTPClient *http.Client
 }
 
 func (p *ProviderData) Data() *ProviderData { return p }
+
+// httpClient returns HTTPClient, or http.DefaultClient if it is not set.
+func (p *ProviderData) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// requestContext returns the context for a call to the identity provider,
+// bounded by RequestTimeout.
+func (p *ProviderData) requestContext() (context.Context, context.CancelFunc) {
+	if p.RequestTimeout > 0 {
+		return context.WithTimeout(context.Background(), p.RequestTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// timeoutError replaces err with ErrRequestTimeout if ctx ran out of time.
+func timeoutError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrRequestTimeout
+	}
+	return err
+}
@@ -13,6 +13,21 @@ import (
 )
 
 func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err error) {
+	token, err := p.redeemToken(redirectURL, code)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionState{AccessToken: token.AccessToken}, nil
+}
+
+// tokenResponse holds the tokens of a token endpoint response.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// redeemToken exchanges the code at the token endpoint.
+func (p *ProviderData) redeemToken(redirectURL, code string) (token *tokenResponse, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -36,7 +51,7 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = p.tokenClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -48,19 +63,15 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = newTokenError(resp.StatusCode, body)
 		return
 	}
 
 	// blindly try json and x-www-form-urlencoded
-	var jsonResponse struct {
-		AccessToken string `json:"access_token"`
-	}
+	var jsonResponse tokenResponse
 	err = json.Unmarshal(body, &jsonResponse)
 	if err == nil {
-		s = &SessionState{
-			AccessToken: jsonResponse.AccessToken,
-		}
+		token = &jsonResponse
 		return
 	}
 
@@ -70,7 +81,10 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 		return
 	}
 	if a := v.Get("access_token"); a != "" {
-		s = &SessionState{AccessToken: a}
+		token = &tokenResponse{AccessToken: a, IDToken: v.Get("id_token")}
+	} else if v.Get("error") != "" {
+		// GitHub reports errors such as an expired code with a 200
+		err = newTokenError(resp.StatusCode, body)
 	} else {
 		err = fmt.Errorf("no access token found %s", body)
 	}
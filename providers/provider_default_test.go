@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -15,3 +18,61 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestRedeemTokenError(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		contentType   string
+		body          string
+		code          string
+		description   string
+		loginRequired bool
+	}{
+		{"json invalid_grant", 400, "application/json",
+			`{"error": "invalid_grant", "error_description": "Code expired"}`,
+			"invalid_grant", "Code expired", true},
+		{"json access_denied", 401, "application/json",
+			`{"error": "access_denied"}`, "access_denied", "", true},
+		{"json invalid_client", 401, "application/json",
+			`{"error": "invalid_client"}`, "invalid_client", "", false},
+		{"form encoded", 400, "application/x-www-form-urlencoded",
+			"error=invalid_grant&error_description=Bad+code", "invalid_grant", "Bad code", true},
+		{"form encoded with 200", 200, "application/x-www-form-urlencoded",
+			"error=bad_verification_code&error_description=The+code+is+incorrect+or+expired.",
+			"bad_verification_code", "The code is incorrect or expired.", false},
+		{"server error", 503, "text/html", "<h1>Service Unavailable</h1>", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", tt.contentType)
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.body))
+				}))
+			defer server.Close()
+
+			p := &ProviderData{}
+			p.RedeemURL, _ = url.Parse(server.URL)
+			session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+			assert.Equal(t, (*SessionState)(nil), session)
+			tokenErr, ok := err.(*TokenError)
+			if !assert.Equal(t, true, ok, "got %v", err) {
+				return
+			}
+			assert.Equal(t, tt.status, tokenErr.StatusCode)
+			assert.Equal(t, tt.code, tokenErr.Code)
+			assert.Equal(t, tt.description, tokenErr.Description)
+			assert.Equal(t, tt.loginRequired, tokenErr.LoginRequired())
+		})
+	}
+}
+
+func TestTokenErrorMessage(t *testing.T) {
+	err := &TokenError{StatusCode: 400, Code: "invalid_grant", Description: "Code expired"}
+	assert.Equal(t, "token endpoint returned 400: invalid_grant (Code expired)", err.Error())
+	err = &TokenError{StatusCode: 503}
+	assert.Equal(t, "token endpoint returned 503", err.Error())
+}
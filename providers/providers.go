@@ -17,6 +17,29 @@ type Provider interface {
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
 }
 
+// LogoutProvider is implemented by providers that can end the user's session
+// at the identity provider as well.
+type LogoutProvider interface {
+	// GetLogoutURL returns "" when the identity provider has no logout
+	// endpoint.
+	GetLogoutURL(s *SessionState, postLogoutRedirectURI string) string
+}
+
+// SessionRefresher is implemented by providers that can refresh a session's
+// tokens before they are due, which is done whenever the session cookie is
+// refreshed (-cookie-refresh).
+type SessionRefresher interface {
+	// RefreshSession returns false when the session has no refresh token.
+	RefreshSession(*SessionState) (bool, error)
+}
+
+// BearerTokenProvider is implemented by providers that can verify a JWT sent
+// in an Authorization: Bearer header and build a session from it, for
+// clients that already hold a token and can't go through the login redirect.
+type BearerTokenProvider interface {
+	SessionFromBearerToken(rawToken string) (*SessionState, error)
+}
+
 func New(provider string, p *ProviderData) Provider {
 	switch provider {
 	case "linkedin":
@@ -29,6 +52,10 @@ func New(provider string, p *ProviderData) Provider {
 		return NewAzureProvider(p)
 	case "gitlab":
 		return NewGitLabProvider(p)
+	case "keycloak":
+		return NewKeycloakProvider(p)
+	case "okta":
+		return NewOktaProvider(p)
 	case "oidc":
 		return NewOIDCProvider(p)
 	default:
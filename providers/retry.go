@@ -0,0 +1,81 @@
+package providers
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// retryTransport retries requests that fail with a network error or a 5xx
+// response, doubling the delay after every attempt. 4xx responses are
+// returned as is.
+type retryTransport struct {
+	base      http.RoundTripper
+	retries   int
+	baseDelay time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil {
+		// the body can't be replayed
+		return t.base.RoundTrip(req)
+	}
+
+	delay := t.baseDelay
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = new(http.Request)
+			*r = *req
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if attempt >= t.retries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// tokenClient returns the HTTP client used to call the token endpoint,
+// retrying transient failures as configured by TokenRetries.
+func (p *ProviderData) tokenClient() *http.Client {
+	return p.retryClient(p.TokenRetries)
+}
+
+// retryClient returns an HTTP client retrying transient failures the given
+// number of times, starting with a delay of TokenRetryBaseDelay.
+func (p *ProviderData) retryClient(retries int) *http.Client {
+	client := p.httpClient()
+	if retries <= 0 {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport: &retryTransport{
+			base:      base,
+			retries:   retries,
+			baseDelay: p.TokenRetryBaseDelay,
+		},
+		Timeout: client.Timeout,
+	}
+}
@@ -0,0 +1,83 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyServer fails the first `failures` requests with the given status
+func newFlakyServer(requests *int, failures int, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			if *requests <= failures {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+}
+
+func newTestRetryProviderData(server *httptest.Server, retries int) *ProviderData {
+	redeemURL, _ := url.Parse(server.URL)
+	return &ProviderData{
+		ClientID:            "client",
+		ClientSecret:        "secret",
+		RedeemURL:           redeemURL,
+		TokenRetries:        retries,
+		TokenRetryBaseDelay: time.Millisecond,
+	}
+}
+
+func TestRedeemRetriesServerErrors(t *testing.T) {
+	requests := 0
+	server := newFlakyServer(&requests, 2, 503, `{"access_token": "a1234"}`)
+	defer server.Close()
+
+	p := newTestRetryProviderData(server, 2)
+	session, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, 3, requests)
+}
+
+func TestRedeemGivesUpAfterRetries(t *testing.T) {
+	requests := 0
+	server := newFlakyServer(&requests, 5, 500, `{"access_token": "a1234"}`)
+	defer server.Close()
+
+	p := newTestRetryProviderData(server, 2)
+	_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 3, requests)
+}
+
+func TestRedeemDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	server := newFlakyServer(&requests, 2, 400, `{"access_token": "a1234"}`)
+	defer server.Close()
+
+	p := newTestRetryProviderData(server, 2)
+	_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestRedeemRetriesNetworkErrors(t *testing.T) {
+	requests := 0
+	server := newFlakyServer(&requests, 0, 200, `{"access_token": "a1234"}`)
+	server.Close()
+
+	p := newTestRetryProviderData(server, 2)
+	start := time.Now()
+	_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+	// two retries with 1ms and 2ms delays
+	assert.Equal(t, true, time.Since(start) >= 3*time.Millisecond)
+}
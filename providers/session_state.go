@@ -2,6 +2,7 @@ package providers
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +17,14 @@ type SessionState struct {
 	RefreshToken string
 	Email        string
 	User         string
+
+	// Groups are the user's groups as seen when the session was created or
+	// last refreshed.
+	Groups []string
+
+	// LastSeen is when the session was last used. It is only kept when
+	// sessions are signed out after being idle.
+	LastSeen time.Time
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -43,8 +52,8 @@ func (s *SessionState) String() string {
 }
 
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
-	if c == nil || s.AccessToken == "" {
-		return s.accountInfo(), nil
+	if c == nil || (s.AccessToken == "" && s.LastSeen.IsZero()) {
+		return s.plainString(), nil
 	}
 	return s.EncryptedString(c)
 }
@@ -53,6 +62,15 @@ func (s *SessionState) accountInfo() string {
 	return fmt.Sprintf("email:%s user:%s", s.Email, s.User)
 }
 
+// plainString is the account info followed by the groups, if any, for
+// sessions that are stored without a cipher.
+func (s *SessionState) plainString() string {
+	if len(s.Groups) == 0 {
+		return s.accountInfo()
+	}
+	return fmt.Sprintf("%s groups:%s", s.accountInfo(), encodeGroups(s.Groups))
+}
+
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 	var err error
 	if c == nil {
@@ -76,13 +94,49 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 			return "", err
 		}
 	}
-	return fmt.Sprintf("%s|%s|%s|%d|%s", s.accountInfo(), a, i, s.ExpiresOn.Unix(), r), nil
+	encoded := fmt.Sprintf("%s|%s|%s|%d|%s", s.accountInfo(), a, i, s.ExpiresOn.Unix(), r)
+	if len(s.Groups) == 0 && s.LastSeen.IsZero() {
+		// keep the 5 field form, which older versions can still read
+		return encoded, nil
+	}
+	g := ""
+	if len(s.Groups) > 0 {
+		if g, err = c.Encrypt(encodeGroups(s.Groups)); err != nil {
+			return "", err
+		}
+	}
+	if s.LastSeen.IsZero() {
+		return encoded + "|" + g, nil
+	}
+	return fmt.Sprintf("%s|%s|%d", encoded, g, s.LastSeen.Unix()), nil
+}
+
+// encodeGroups joins the groups with commas, escaping each name so that
+// names containing commas survive the round trip.
+func encodeGroups(groups []string) string {
+	escaped := make([]string, 0, len(groups))
+	for _, group := range groups {
+		escaped = append(escaped, url.QueryEscape(group))
+	}
+	return strings.Join(escaped, ",")
+}
+
+func decodeGroups(v string) ([]string, error) {
+	groups := []string{}
+	for _, group := range strings.Split(v, ",") {
+		group, err := url.QueryUnescape(group)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
 }
 
 func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	chunks := strings.Split(v, " ")
-	if len(chunks) != 2 {
-		return nil, fmt.Errorf("could not decode session state: expected 2 chunks got %d", len(chunks))
+	if len(chunks) != 2 && len(chunks) != 3 {
+		return nil, fmt.Errorf("could not decode session state: expected 2 or 3 chunks got %d", len(chunks))
 	}
 
 	email := strings.TrimPrefix(chunks[0], "email:")
@@ -90,18 +144,29 @@ func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	if user == "" {
 		user = strings.Split(email, "@")[0]
 	}
+	s = &SessionState{User: user, Email: email}
 
-	return &SessionState{User: user, Email: email}, nil
+	if len(chunks) == 3 {
+		if !strings.HasPrefix(chunks[2], "groups:") {
+			return nil, fmt.Errorf("could not decode session state: unexpected chunk %q", chunks[2])
+		}
+		if s.Groups, err = decodeGroups(strings.TrimPrefix(chunks[2], "groups:")); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
-	if c == nil {
+	// sessions without an access token are encoded plain even with a cipher
+	if c == nil || !strings.Contains(v, "|") {
 		return decodeSessionStatePlain(v)
 	}
 
+	// sessions without groups have 5 fields, sessions with a last seen time 7
 	chunks := strings.Split(v, "|")
-	if len(chunks) != 5 {
-		err = fmt.Errorf("invalid number of fields (got %d expected 5)", len(chunks))
+	if len(chunks) < 5 || len(chunks) > 7 {
+		err = fmt.Errorf("invalid number of fields (got %d expected 5, 6 or 7)", len(chunks))
 		return
 	}
 
@@ -131,5 +196,23 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 		}
 	}
 
+	if len(chunks) >= 6 && chunks[5] != "" {
+		g, err := c.Decrypt(chunks[5])
+		if err != nil {
+			return nil, err
+		}
+		if sessionState.Groups, err = decodeGroups(g); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(chunks) == 7 {
+		lastSeen, err := strconv.ParseInt(chunks[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last seen time %q", chunks[6])
+		}
+		sessionState.LastSeen = time.Unix(lastSeen, 0)
+	}
+
 	return sessionState, nil
 }
@@ -87,6 +87,110 @@ func TestSessionStateSerializationWithUser(t *testing.T) {
 	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
 }
 
+func TestSessionStateSerializationWithGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Groups:      []string{"admins", "devs, ops", "a|b", "100%"},
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5, strings.Count(encoded, "|"))
+	assert.NotContains(t, encoded, "admins")
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, s.Groups, ss.Groups)
+}
+
+func TestSessionStateDecodeWithoutGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+	}
+	// sessions without groups keep the 5 field form written by earlier
+	// versions
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, 0, len(ss.Groups))
+
+	_, err = DecodeSessionState(encoded+"||", c)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSessionStateSerializationWithLastSeen(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	lastSeen := time.Unix(1500000000, 0)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		LastSeen:    lastSeen,
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, 0, len(ss.Groups))
+	assert.Equal(t, lastSeen, ss.LastSeen)
+
+	s.Groups = []string{"admins"}
+	encoded, err = s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err = DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, lastSeen, ss.LastSeen)
+
+	_, err = DecodeSessionState(encoded+"x", c)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSessionStateWithoutTokensKeepsLastSeen(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{User: "jdoe", LastSeen: time.Unix(1500000000, 0)}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe", ss.User)
+	assert.Equal(t, "", ss.AccessToken)
+	assert.Equal(t, s.LastSeen, ss.LastSeen)
+}
+
+func TestSessionStateWithoutAccessTokenWithCipher(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{Email: "user@domain.com"}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user:", encoded)
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@domain.com", ss.Email)
+	assert.Equal(t, "user", ss.User)
+}
+
 func TestSessionStateSerializationNoCipher(t *testing.T) {
 	s := &SessionState{
 		Email:        "user@domain.com",
@@ -130,6 +234,39 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationNoCipherWithGroups(t *testing.T) {
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		Groups:      []string{"admins", "a,b c|d"},
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: groups:admins,a%2Cb+c%7Cd", encoded)
+
+	// the groups are kept along with the email, but not the token
+	ss, err := DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, "", ss.AccessToken)
+
+	_, err = DecodeSessionState("email:user@domain.com user: admins", nil)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSessionStateWithoutAccessTokenWithCipherKeepsGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{Email: "user@domain.com", Groups: []string{"admins"}}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Groups, ss.Groups)
+}
+
 func TestSessionStateAccountInfo(t *testing.T) {
 	s := &SessionState{
 		Email: "user@domain.com",
@@ -0,0 +1,59 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// TokenError is returned when the token endpoint refuses to redeem a code,
+// carrying the OAuth error response (RFC 6749 section 5.2).
+type TokenError struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *TokenError) Error() string {
+	msg := fmt.Sprintf("token endpoint returned %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += " (" + e.Description + ")"
+	}
+	return msg
+}
+
+// LoginRequired reports whether the code itself was rejected, e.g. because
+// it expired, was already used or the user declined, so that signing in
+// again fixes it. Any other error lies with the proxy or the provider.
+func (e *TokenError) LoginRequired() bool {
+	return e.Code == "invalid_grant" || e.Code == "access_denied"
+}
+
+// newTokenError parses an error response of the token endpoint, which is
+// JSON encoded by the spec but form encoded by some providers.
+func newTokenError(statusCode int, body []byte) *TokenError {
+	e := &TokenError{StatusCode: statusCode}
+	var jsonResponse struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err == nil {
+		e.Code, e.Description = jsonResponse.Error, jsonResponse.ErrorDescription
+	} else if v, err := url.ParseQuery(string(body)); err == nil {
+		e.Code, e.Description = v.Get("error"), v.Get("error_description")
+	}
+	return e
+}
+
+// AccountError is returned by Redeem when the user signed in but their account
+// may not log in, e.g. because it is outside the allowed hosted domain.
+type AccountError struct {
+	Reason string
+}
+
+func (e *AccountError) Error() string {
+	return e.Reason
+}
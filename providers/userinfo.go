@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"sync"
+	"time"
+)
+
+// userInfoCache remembers the emails recently looked up at the userinfo
+// endpoint, so that the rate limited endpoint is not asked again for the
+// same access token. Entries are keyed by a hash of the access token.
+type userInfoCache struct {
+	sync.Mutex
+	entries map[string]userInfoEntry
+}
+
+type userInfoEntry struct {
+	email   string
+	expires time.Time
+}
+
+func (c *userInfoCache) get(token string, now time.Time) (email string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[tokenCacheKey(token)]
+	if !ok || now.After(e.expires) {
+		return "", false
+	}
+	return e.email, true
+}
+
+func (c *userInfoCache) set(token string, email string, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]userInfoEntry)
+	}
+	for k, e := range c.entries {
+		if e.expires.Before(time.Now()) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[tokenCacheKey(token)] = userInfoEntry{email: email, expires: expires}
+}
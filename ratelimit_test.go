@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter(perMinute int) (*rateLimiter, *time.Time) {
+	l := newRateLimiter(perMinute)
+	now := time.Unix(1500000000, 0)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l, _ := newTestRateLimiter(3)
+	assert.Equal(t, true, l.Allow("1.2.3.4"))
+	assert.Equal(t, true, l.Allow("1.2.3.4"))
+	assert.Equal(t, true, l.Allow("1.2.3.4"))
+	assert.Equal(t, false, l.Allow("1.2.3.4"))
+	// other clients have their own bucket
+	assert.Equal(t, true, l.Allow("5.6.7.8"))
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l, now := newTestRateLimiter(6)
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, true, l.Allow("1.2.3.4"))
+	}
+	assert.Equal(t, false, l.Allow("1.2.3.4"))
+
+	*now = now.Add(5 * time.Second)
+	assert.Equal(t, false, l.Allow("1.2.3.4"))
+	*now = now.Add(5 * time.Second)
+	assert.Equal(t, true, l.Allow("1.2.3.4"))
+	assert.Equal(t, false, l.Allow("1.2.3.4"))
+
+	// an idle client never gets more than the burst
+	*now = now.Add(time.Hour)
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, true, l.Allow("1.2.3.4"))
+	}
+	assert.Equal(t, false, l.Allow("1.2.3.4"))
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l, now := newTestRateLimiter(60)
+	l.Allow("1.2.3.4")
+	*now = now.Add(30 * time.Second)
+	l.Allow("5.6.7.8")
+	assert.Equal(t, 2, len(l.buckets))
+
+	*now = now.Add(45 * time.Second)
+	l.Allow("5.6.7.8")
+	assert.Equal(t, 1, len(l.buckets))
+	_, ok := l.buckets["1.2.3.4"]
+	assert.Equal(t, false, ok)
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0)
+	assert.Equal(t, (*rateLimiter)(nil), l)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, true, l.Allow("1.2.3.4"))
+	}
+}
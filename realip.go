@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// realIPResolver determines the address of the client that made a request,
+// honoring a forwarded header such as X-Forwarded-For only when the request
+// arrived from a trusted proxy.
+type realIPResolver struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+// newRealIPResolver parses the trusted proxy list. Entries may be CIDR ranges
+// or bare addresses. With no trusted proxies every hop is trusted, which
+// matches the behaviour of reading the header unconditionally.
+func newRealIPResolver(header string, trustedProxies []string) (*realIPResolver, error) {
+	r := &realIPResolver{header: http.CanonicalHeaderKey(header)}
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, ipNet)
+	}
+	return r, nil
+}
+
+func (r *realIPResolver) isTrusted(addr string) bool {
+	if len(r.trusted) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made req. The forwarded
+// header is only consulted when the peer is trusted; its entries are then
+// walked from right to left and the first address that is not itself a
+// trusted proxy is returned, so a client can't spoof its address by
+// prepending entries to the chain.
+func (r *realIPResolver) ClientIP(req *http.Request) string {
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if r.header == "" || !r.isTrusted(remote) {
+		return remote
+	}
+	values := req.Header[r.header]
+	if len(values) == 0 {
+		return remote
+	}
+
+	var hops []string
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return remote
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+		if i == 0 || !r.isTrusted(hop) {
+			return hop
+		}
+	}
+	return remote
+}
+
+// RealIPHandler resolves the client address of each request once and makes
+// it available to the handlers below it through clientIP.
+func RealIPHandler(r *realIPResolver, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), clientIPKey{}, r.ClientIP(req))
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// clientIP returns the client address resolved by RealIPHandler, falling back
+// to X-Real-IP and the peer address for requests that didn't pass through it.
+func clientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	client := req.Header.Get("X-Real-IP")
+	if client == "" {
+		client = req.RemoteAddr
+	}
+	if c, _, err := net.SplitHostPort(client); err == nil {
+		client = c
+	}
+	return client
+}
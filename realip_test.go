@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRealIPResolver(t *testing.T, header string, trusted ...string) *realIPResolver {
+	r, err := newRealIPResolver(header, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRealIPResolverClientIP(t *testing.T) {
+	xff := newTestRealIPResolver(t, "X-Forwarded-For", "10.0.0.0/8", "192.168.1.1")
+
+	tests := []struct {
+		name     string
+		resolver *realIPResolver
+		remote   string
+		header   string
+		value    []string
+		expected string
+	}{
+		{"no header", xff, "10.0.0.1:1234", "", nil, "10.0.0.1"},
+		{"spoofed from untrusted peer", xff, "203.0.113.7:1234", "X-Forwarded-For", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"trusted proxy", xff, "10.0.0.1:1234", "X-Forwarded-For", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed through trusted proxy", xff, "10.0.0.1:1234", "X-Forwarded-For", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", xff, "10.0.0.1:1234", "X-Forwarded-For", []string{"1.2.3.4, 203.0.113.7, 192.168.1.1", "10.1.1.1"}, "203.0.113.7"},
+		{"only trusted proxies", xff, "10.0.0.1:1234", "X-Forwarded-For", []string{"10.2.2.2, 10.1.1.1"}, "10.2.2.2"},
+		{"entry with port", xff, "10.0.0.1:1234", "X-Forwarded-For", []string{"203.0.113.7:5678"}, "203.0.113.7"},
+		{"other header ignored", xff, "10.0.0.1:1234", "X-Real-IP", []string{"203.0.113.7"}, "10.0.0.1"},
+		{"x-real-ip trusted by default", newTestRealIPResolver(t, "X-Real-IP"), "10.0.0.1:1234", "X-Real-IP", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"header disabled", newTestRealIPResolver(t, ""), "10.0.0.1:1234", "X-Real-IP", []string{"203.0.113.7"}, "10.0.0.1"},
+		{"ipv6 peer", newTestRealIPResolver(t, "X-Forwarded-For", "::1"), "[::1]:1234", "X-Forwarded-For", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		for _, v := range test.value {
+			req.Header.Add(test.header, v)
+		}
+		assert.Equal(t, test.expected, test.resolver.ClientIP(req), test.name)
+	}
+}
+
+func TestNewRealIPResolverInvalid(t *testing.T) {
+	for _, trusted := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0"} {
+		_, err := newRealIPResolver("X-Forwarded-For", []string{trusted})
+		assert.NotEqual(t, nil, err, trusted)
+	}
+}
+
+func TestRealIPHandlerLogsResolvedClient(t *testing.T) {
+	resolver := newTestRealIPResolver(t, "X-Forwarded-For", "10.0.0.0/8")
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test"))
+	})
+
+	tests := []struct {
+		remote   string
+		expected string
+	}{
+		{"10.0.0.1:1234", "203.0.113.7"},
+		{"198.51.100.1:1234", "198.51.100.1"},
+	}
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		h := RealIPHandler(resolver, LoggingHandler(buf, upstream, true, "{{.Client}}"))
+
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.RemoteAddr = test.remote
+		req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, test.expected, strings.TrimSpace(buf.String()), test.remote)
+	}
+}
+
+func TestGetRemoteAddr(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1:1234", getRemoteAddr(req))
+
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	assert.Equal(t, `10.0.0.1:1234 ("203.0.113.7")`, getRemoteAddr(req))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// refreshResultTTL is how long the result of a refresh is handed to requests
+// still carrying the session with the old refresh token, such as the ones the
+// browser sent before it got the new session cookie.
+const refreshResultTTL = 10 * time.Second
+
+// refreshGroup makes the refreshes of the same session share one token
+// exchange, so that a refresh token the provider allows to be used only once
+// is redeemed only once. Sessions are told apart by their refresh token. The
+// zero value is ready to use.
+type refreshGroup struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+// refreshCall is a refresh in progress or one that finished less than
+// refreshResultTTL ago.
+type refreshCall struct {
+	done      chan struct{}
+	session   providers.SessionState
+	refreshed bool
+	err       error
+}
+
+// do calls refresh for session unless a session with the same refresh token is
+// being refreshed already, or was refreshed less than refreshResultTTL ago. In
+// that case it waits for that refresh and copies the refreshed session into
+// session.
+func (g *refreshGroup) do(session *providers.SessionState, refresh func(*providers.SessionState) (bool, error)) (bool, error) {
+	key := session.RefreshToken
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*refreshCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		if c.refreshed {
+			*session = c.session
+		}
+		return c.refreshed, c.err
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.refreshed, c.err = refresh(session)
+	if c.refreshed {
+		c.session = *session
+	}
+	close(c.done)
+
+	if c.refreshed {
+		time.AfterFunc(refreshResultTTL, func() { g.forget(key) })
+	} else {
+		// nothing to hand out, the next request checks again
+		g.forget(key)
+	}
+	return c.refreshed, c.err
+}
+
+func (g *refreshGroup) forget(key string) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+}
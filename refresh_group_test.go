@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+// CountingRefreshTestProvider refreshes expired sessions, taking a while to
+// do so like a token exchange with the provider would.
+type CountingRefreshTestProvider struct {
+	*TestProvider
+	exchanges int32
+}
+
+func (tp *CountingRefreshTestProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	if s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	atomic.AddInt32(&tp.exchanges, 1)
+	time.Sleep(50 * time.Millisecond)
+	s.AccessToken = "refreshed_access_token"
+	s.RefreshToken = "rotated_refresh_token"
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func TestConcurrentRequestsShareOneRefresh(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	provider := &CountingRefreshTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.provider = provider
+
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		RefreshToken: "my_refresh_token", ExpiresOn: time.Now().Add(-time.Minute)}))
+
+	const n = 10
+	var requests sync.WaitGroup
+	sessions := make([]*providers.SessionState, n)
+	for i := 0; i < n; i++ {
+		requests.Add(1)
+		go func(i int, req *http.Request) {
+			defer requests.Done()
+			var status int
+			sessions[i], status = pc_test.proxy.authenticate(httptest.NewRecorder(), req)
+			assert.Equal(t, http.StatusAccepted, status)
+		}(i, requestWithCookies(rw))
+	}
+	requests.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.exchanges))
+	for _, session := range sessions {
+		assert.Equal(t, "refreshed_access_token", session.AccessToken)
+		assert.Equal(t, "rotated_refresh_token", session.RefreshToken)
+	}
+}
+
+func TestRefreshGroupSharesErrors(t *testing.T) {
+	var g refreshGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	refresh := func(s *providers.SessionState) (bool, error) {
+		calls++
+		close(started)
+		<-release
+		return false, errors.New("invalid_grant")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := g.do(&providers.SessionState{RefreshToken: "my_refresh_token"}, refresh)
+		assert.Equal(t, "invalid_grant", err.Error())
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := g.do(&providers.SessionState{RefreshToken: "my_refresh_token"}, refresh)
+		assert.Equal(t, "invalid_grant", err.Error())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, calls)
+
+	// failures are not handed to later requests
+	refreshed, err := g.do(&providers.SessionState{RefreshToken: "my_refresh_token"},
+		func(s *providers.SessionState) (bool, error) { return true, nil })
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, nil, err)
+}
+
+func TestRefreshGroupKeepsSessionsApart(t *testing.T) {
+	var g refreshGroup
+	refresh := func(s *providers.SessionState) (bool, error) {
+		s.AccessToken = "refreshed_" + s.RefreshToken
+		return true, nil
+	}
+	a := &providers.SessionState{RefreshToken: "a"}
+	b := &providers.SessionState{RefreshToken: "b"}
+	g.do(a, refresh)
+	g.do(b, refresh)
+	assert.Equal(t, "refreshed_a", a.AccessToken)
+	assert.Equal(t, "refreshed_b", b.AccessToken)
+
+	// a request that still carries the old session gets the refreshed one
+	late := &providers.SessionState{RefreshToken: "a"}
+	refreshed, err := g.do(late, func(s *providers.SessionState) (bool, error) {
+		t.Fatal("refreshed twice")
+		return false, nil
+	})
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refreshed_a", late.AccessToken)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID that correlates a request across the proxy's
+// request log, its error pages and the upstream's logs.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength limits the request IDs taken from the client.
+const maxRequestIDLength = 128
+
+// RequestIDHandler makes sure every request carries a request ID before it is
+// logged or proxied. An ID sent along by a trusted proxy (see
+// -trusted-proxies) is kept, so that a load balancer's ID can be followed
+// through; any other request gets a new one. The ID is also returned to the
+// client.
+func RequestIDHandler(r *realIPResolver, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) || !r.isTrusted(peerAddr(req)) {
+			id = newRequestID()
+			req.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// requestID returns the request ID of req, or a new one for requests that
+// did not pass through RequestIDHandler.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "-"
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID accepts IDs of printable ASCII characters other than spaces,
+// so that a client can't break up log lines with the ID it sends.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func peerAddr(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func serveWithRequestID(t *testing.T, trustedProxies []string, remoteAddr string, id string) (received string, returned string) {
+	resolver, err := newRealIPResolver("X-Real-IP", trustedProxies)
+	assert.Equal(t, nil, err)
+	h := RequestIDHandler(resolver, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header.Get(RequestIDHeader)
+	}))
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	if id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return received, rw.HeaderMap.Get(RequestIDHeader)
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	received, returned := serveWithRequestID(t, nil, "10.0.0.1:4321", "")
+	assert.Regexp(t, uuidPattern, received)
+	assert.Equal(t, received, returned)
+
+	other, _ := serveWithRequestID(t, nil, "10.0.0.1:4321", "")
+	assert.NotEqual(t, received, other)
+}
+
+func TestRequestIDFromTrustedProxy(t *testing.T) {
+	trusted := []string{"10.0.0.0/8"}
+	received, returned := serveWithRequestID(t, trusted, "10.0.0.1:4321", "lb-1234")
+	assert.Equal(t, "lb-1234", received)
+	assert.Equal(t, "lb-1234", returned)
+
+	// without -trusted-proxies every peer is trusted
+	received, _ = serveWithRequestID(t, nil, "203.0.113.5:4321", "lb-1234")
+	assert.Equal(t, "lb-1234", received)
+}
+
+func TestRequestIDFromUntrustedClient(t *testing.T) {
+	received, returned := serveWithRequestID(t, []string{"10.0.0.0/8"}, "203.0.113.5:4321", "spoofed")
+	assert.Regexp(t, uuidPattern, received)
+	assert.Equal(t, received, returned)
+}
+
+func TestRequestIDInvalid(t *testing.T) {
+	for _, id := range []string{"with space", "line\nbreak", strings.Repeat("a", maxRequestIDLength+1)} {
+		received, _ := serveWithRequestID(t, nil, "10.0.0.1:4321", id)
+		assert.Regexp(t, uuidPattern, received, id)
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	resolver, _ := newRealIPResolver("X-Real-IP", nil)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test"))
+	})
+
+	buf := bytes.NewBuffer(nil)
+	h := RequestIDHandler(resolver, LoggingHandler(buf, ok, true, defaultRequestLoggingFormat))
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	req.RemoteAddr = "127.0.0.1:4321"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	id := rw.HeaderMap.Get(RequestIDHeader)
+	assert.Regexp(t, uuidPattern, id)
+	assert.Equal(t, true, strings.HasSuffix(buf.String(), " "+id+"\n"), buf.String())
+
+	buf.Reset()
+	h = RequestIDHandler(resolver, JSONLoggingHandler(buf, ok, true))
+	req, _ = http.NewRequest("GET", "/foo", nil)
+	req.RemoteAddr = "127.0.0.1:4321"
+	req.Header.Set(RequestIDHeader, "lb-1234")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var line map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "lb-1234", line["request_id"])
+}
+
+func TestRequestIDForwardedUpstream(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(RequestIDHeader)
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	h := RequestIDHandler(opts.realIP, proxy)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/app", nil)
+	req.RequestURI = "/app"
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Regexp(t, uuidPattern, received)
+	assert.Equal(t, received, rw.HeaderMap.Get(RequestIDHeader))
+}
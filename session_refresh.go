@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// backgroundRefresher refreshes stored sessions whose tokens are about to
+// expire off the request path (-session-background-refresh), so that requests
+// don't wait for the provider. Each session is refreshed by one goroutine at a
+// time.
+type backgroundRefresher struct {
+	// window is how long before the tokens expire a request starts the
+	// refresh.
+	window time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	// stopped is set on shutdown, after which no refreshes are started.
+	stopped bool
+	// wg tracks the running refreshes, for shutdown and tests to wait for.
+	wg sync.WaitGroup
+}
+
+func newBackgroundRefresher(window time.Duration) *backgroundRefresher {
+	if window <= 0 {
+		return nil
+	}
+	return &backgroundRefresher{window: window, inflight: make(map[string]bool)}
+}
+
+// due reports whether the tokens of session expire within the window. Expired
+// tokens are left to the refresh on the request, which can't use them.
+func (r *backgroundRefresher) due(session *providers.SessionState, now time.Time) bool {
+	if session.RefreshToken == "" || session.ExpiresOn.IsZero() {
+		return false
+	}
+	return session.ExpiresOn.After(now) && !session.ExpiresOn.After(now.Add(r.window))
+}
+
+// start runs refresh for the session stored under key in a new goroutine,
+// unless a refresh of it is already running or the refresher was stopped.
+func (r *backgroundRefresher) start(key string, refresh func(key string)) {
+	r.mu.Lock()
+	if r.inflight[key] || r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.inflight[key] = true
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mu.Lock()
+			delete(r.inflight, key)
+			r.mu.Unlock()
+		}()
+		refresh(key)
+	}()
+}
+
+// stop keeps new refreshes from starting and waits for the running ones to
+// finish, or for ctx to be done.
+func (r *backgroundRefresher) stop(ctx context.Context) error {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopBackgroundRefresh is called on shutdown to let the running background
+// refreshes store their sessions, so that the refreshed tokens aren't lost.
+func (p *OAuthProxy) StopBackgroundRefresh(ctx context.Context) error {
+	if p.backgroundRefresh == nil {
+		return nil
+	}
+	return p.backgroundRefresh.stop(ctx)
+}
+
+// refreshInBackground starts refreshing the request's stored session if its
+// tokens are about to expire, and reports whether they are being refreshed.
+// The request goes on with the current tokens.
+func (p *OAuthProxy) refreshInBackground(key string, session *providers.SessionState) bool {
+	if key == "" || !p.backgroundRefresh.due(session, time.Now()) {
+		return false
+	}
+	p.backgroundRefresh.start(key, p.refreshStoredSession)
+	return true
+}
+
+// refreshStoredSession refreshes the session stored under key and stores it
+// again under the same key, so that the session cookie stays valid.
+func (p *OAuthProxy) refreshStoredSession(key string) {
+	// another request may have refreshed the session since it was loaded
+	val, err := p.sessionStore.Load(key)
+	if err != nil {
+		log.Printf("background refresh: error loading session %s", err)
+		return
+	}
+	session, err := p.decodeSession(val)
+	if err != nil {
+		log.Printf("background refresh: error decoding session %s", err)
+		return
+	}
+	if !p.backgroundRefresh.due(session, time.Now()) {
+		return
+	}
+
+	if ok, err := p.refreshSession(session, true); err != nil {
+		// the request refreshes the session once the tokens have expired
+		log.Printf("background refresh: error refreshing access token %s %s", err, session)
+		return
+	} else if !ok {
+		return
+	}
+	if session.Email != "" && !p.Validator(session.Email) {
+		log.Printf("background refresh: Permission Denied: removing session %s", session)
+		if err := p.sessionStore.Clear(key); err != nil {
+			log.Printf("background refresh: error clearing session %s", err)
+		}
+		return
+	}
+
+	// the refresh was started by a request for the session
+	p.markSeen(session)
+	value, err := p.encodeSession(session)
+	if err != nil {
+		log.Printf("background refresh: error encoding session %s", err)
+		return
+	}
+	// don't bring back a session that was signed out of meanwhile
+	if _, err := p.sessionStore.Load(key); err != nil {
+		return
+	}
+	if err := p.sessionStore.Save(key, value, p.storedSessionExpiration(session)); err != nil {
+		log.Printf("background refresh: error saving session %s", err)
+		return
+	}
+	log.Printf("background refresh: refreshed %s", session)
+}
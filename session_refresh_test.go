@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+// BlockingRefreshTestProvider refreshes sessions once release is closed.
+type BlockingRefreshTestProvider struct {
+	*TestProvider
+	release   chan struct{}
+	refreshes int32
+}
+
+func (tp *BlockingRefreshTestProvider) RefreshSession(s *providers.SessionState) (bool, error) {
+	atomic.AddInt32(&tp.refreshes, 1)
+	<-tp.release
+	s.AccessToken = "refreshed_access_token"
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func newBackgroundRefreshTest(t *testing.T, mr *miniredis.Miniredis, expiresIn time.Duration) (*ProcessCookieTest, *BlockingRefreshTestProvider) {
+	pc_test := newTestRedisProxy(t, mr)
+	provider := &BlockingRefreshTestProvider{
+		TestProvider: pc_test.proxy.provider.(*TestProvider),
+		release:      make(chan struct{}),
+	}
+	pc_test.proxy.provider = provider
+	pc_test.proxy.backgroundRefresh = newBackgroundRefresher(5 * time.Minute)
+
+	session := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		RefreshToken: "my_refresh_token", ExpiresOn: time.Now().Add(expiresIn)}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	return pc_test, provider
+}
+
+func TestBackgroundRefreshUpdatesStoredSession(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test, provider := newBackgroundRefreshTest(t, mr, time.Minute)
+	close(provider.release)
+
+	// the request doesn't wait for the refresh
+	session, status := pc_test.proxy.authenticate(httptest.NewRecorder(), requestWithCookies(pc_test.rw))
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+	session, _, err = pc_test.proxy.LoadCookiedSession(requestWithCookies(pc_test.rw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refreshed_access_token", session.AccessToken)
+	assert.Equal(t, "my_refresh_token", session.RefreshToken)
+	assert.True(t, session.ExpiresOn.After(time.Now().Add(59*time.Minute)))
+}
+
+func TestBackgroundRefreshRunsOncePerSession(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test, provider := newBackgroundRefreshTest(t, mr, time.Minute)
+
+	var requests sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		requests.Add(1)
+		go func(req *http.Request) {
+			defer requests.Done()
+			assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), req))
+		}(requestWithCookies(pc_test.rw))
+	}
+	requests.Wait()
+	close(provider.release)
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+
+	// the refreshed session is not due any more
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), requestWithCookies(pc_test.rw)))
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+}
+
+func TestBackgroundRefreshSkipsSessionsNotDue(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test, provider := newBackgroundRefreshTest(t, mr, time.Hour)
+	close(provider.release)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), requestWithCookies(pc_test.rw)))
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&provider.refreshes))
+}
+
+func TestBackgroundRefreshDoesNotRestoreClearedSession(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test, provider := newBackgroundRefreshTest(t, mr, time.Minute)
+
+	req := requestWithCookies(pc_test.rw)
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), req))
+	// signing out while the refresh is running
+	pc_test.proxy.ClearSessionCookie(httptest.NewRecorder(), req)
+	close(provider.release)
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+	assert.Equal(t, 0, len(mr.Keys()))
+}
+
+func TestStopBackgroundRefreshWaitsForRunningRefresh(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test, provider := newBackgroundRefreshTest(t, mr, time.Minute)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), requestWithCookies(pc_test.rw)))
+	stopped := make(chan error, 1)
+	go func() { stopped <- pc_test.proxy.StopBackgroundRefresh(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the running refresh finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(provider.release)
+	assert.Equal(t, nil, <-stopped)
+
+	// the refreshed session was stored
+	session, _, err := pc_test.proxy.LoadCookiedSession(requestWithCookies(pc_test.rw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refreshed_access_token", session.AccessToken)
+
+	// and no refreshes start after stopping
+	pc_test.proxy.backgroundRefresh.start("other", func(string) { t.Error("refresh started after stop") })
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.refreshes))
+}
+
+func TestStopBackgroundRefreshTimeout(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test, provider := newBackgroundRefreshTest(t, mr, time.Minute)
+	defer close(provider.release)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), requestWithCookies(pc_test.rw)))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pc_test.proxy.StopBackgroundRefresh(ctx))
+}
+
+func TestBackgroundRefreshStoresRotatedRefreshToken(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test := newTestRedisProxy(t, mr)
+	pc_test.proxy.provider = &RotatingTestProvider{TestProvider: pc_test.proxy.provider.(*TestProvider)}
+	pc_test.proxy.backgroundRefresh = newBackgroundRefresher(5 * time.Minute)
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "access-token-0",
+		RefreshToken: "refresh-token-0", ExpiresOn: time.Now().Add(time.Minute)}))
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), requestWithCookies(pc_test.rw)))
+	pc_test.proxy.backgroundRefresh.wg.Wait()
+
+	// the session cookie still points at the stored session
+	session, _, err := pc_test.proxy.LoadCookiedSession(requestWithCookies(pc_test.rw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "access-token-1", session.AccessToken)
+	assert.Equal(t, "refresh-token-1", session.RefreshToken)
+}
+
+func TestSessionBackgroundRefreshOptions(t *testing.T) {
+	o := testOptions()
+	o.SessionBackgroundRefresh = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: session-background-refresh=-1m0s must not be negative")
+
+	o = testOptions()
+	o.Provider = "google"
+	o.SessionBackgroundRefresh = 5 * time.Minute
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: session-background-refresh requires session-store=redis")
+	assert.Contains(t, err.Error(), `invalid setting: session-background-refresh is not supported by provider="google"`)
+
+	server := newDiscoveryServer()
+	defer server.Close()
+	o = testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = server.URL
+	o.CookieSecret = "16 bytes AES-128"
+	o.SessionStore = "redis"
+	o.RedisConnectionURL = "redis://127.0.0.1:6379"
+	o.SessionBackgroundRefresh = 5 * time.Minute
+	assert.Equal(t, nil, o.Validate())
+}
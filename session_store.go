@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrSessionNotFound is returned by a SessionStore when no session is stored
+// under the key, e.g. because it expired.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore keeps encoded sessions on the server, so that the session
+// cookie only has to carry the key they are stored under.
+type SessionStore interface {
+	Save(key, value string, expiration time.Duration) error
+	Load(key string) (string, error)
+	Clear(key string) error
+}
+
+// RedisSessionStore is a SessionStore backed by Redis. Sessions expire from
+// Redis on their own once their expiration has passed.
+type RedisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisSessionStore creates a store for the Redis server at the given
+// redis:// URL. The connection is made when the first session is stored.
+func NewRedisSessionStore(connectionURL string) (*RedisSessionStore, error) {
+	opt, err := redis.ParseURL(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisSessionStore{
+		client: redis.NewClient(opt),
+		prefix: "oauth2_proxy-session-",
+	}, nil
+}
+
+func (s *RedisSessionStore) Save(key, value string, expiration time.Duration) error {
+	return s.client.Set(s.prefix+key, value, expiration).Err()
+}
+
+func (s *RedisSessionStore) Load(key string) (string, error) {
+	value, err := s.client.Get(s.prefix + key).Result()
+	if err == redis.Nil {
+		return "", ErrSessionNotFound
+	}
+	return value, err
+}
+
+func (s *RedisSessionStore) Clear(key string) error {
+	return s.client.Del(s.prefix + key).Err()
+}
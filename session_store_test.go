@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisSessionStore(t *testing.T) (*RedisSessionStore, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	store, err := NewRedisSessionStore("redis://" + mr.Addr())
+	assert.Equal(t, nil, err)
+	return store, mr
+}
+
+func TestRedisSessionStoreSaveAndLoad(t *testing.T) {
+	store, mr := newTestRedisSessionStore(t)
+	defer mr.Close()
+
+	assert.Equal(t, nil, store.Save("key", "session", time.Hour))
+	value, err := store.Load("key")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "session", value)
+	assert.Equal(t, time.Hour, mr.TTL("oauth2_proxy-session-key"))
+
+	_, err = store.Load("other")
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestRedisSessionStoreExpiry(t *testing.T) {
+	store, mr := newTestRedisSessionStore(t)
+	defer mr.Close()
+
+	assert.Equal(t, nil, store.Save("key", "session", time.Minute))
+	mr.FastForward(30 * time.Second)
+	_, err := store.Load("key")
+	assert.Equal(t, nil, err)
+
+	mr.FastForward(time.Minute)
+	_, err = store.Load("key")
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestRedisSessionStoreClear(t *testing.T) {
+	store, mr := newTestRedisSessionStore(t)
+	defer mr.Close()
+
+	assert.Equal(t, nil, store.Save("key", "session", time.Hour))
+	assert.Equal(t, nil, store.Clear("key"))
+	_, err := store.Load("key")
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestRedisSessionStoreUnreachable(t *testing.T) {
+	store, mr := newTestRedisSessionStore(t)
+	mr.Close()
+
+	assert.NotEqual(t, nil, store.Save("key", "session", time.Hour))
+	_, err := store.Load("key")
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, ErrSessionNotFound, err)
+}
+
+func TestNewRedisSessionStoreInvalidURL(t *testing.T) {
+	_, err := NewRedisSessionStore("http://127.0.0.1:6379")
+	assert.NotEqual(t, nil, err)
+}
+
+func newTestRedisProxy(t *testing.T, mr *miniredis.Miniredis) *ProcessCookieTest {
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "0123456789abcdefabcd"
+	pc_test.opts.EmailDomains = []string{"*"}
+	pc_test.opts.SessionStore = "redis"
+	pc_test.opts.RedisConnectionURL = "redis://" + mr.Addr()
+	assert.Equal(t, nil, pc_test.opts.Validate())
+
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+		return pc_test.validate_user
+	})
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+	pc_test.validate_user = true
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/", nil)
+	return &pc_test
+}
+
+// requestWithCookies returns a request carrying the cookies set on rw.
+func requestWithCookies(rw *httptest.ResponseRecorder) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Value != "" {
+			req.AddCookie(c)
+		}
+	}
+	return req
+}
+
+func TestRedisSessionStoreKeepsTokensOutOfTheCookie(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test := newTestRedisProxy(t, mr)
+
+	session := &providers.SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "my_access_token",
+		IdToken:      strings.Repeat("a", 8192),
+		RefreshToken: "my_refresh_token",
+		ExpiresOn:    time.Now().Add(time.Hour),
+	}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+
+	cookies := pc_test.rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.True(t, len(cookies[0].Value) < 256)
+	assert.Equal(t, 1, len(mr.Keys()))
+	// a session with a refresh token is kept for as long as the cookie
+	assert.Equal(t, pc_test.opts.CookieExpire, mr.TTL(mr.Keys()[0]))
+
+	loaded, _, err := pc_test.proxy.LoadCookiedSession(requestWithCookies(pc_test.rw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, session.Email, loaded.Email)
+	assert.Equal(t, session.AccessToken, loaded.AccessToken)
+	assert.Equal(t, session.IdToken, loaded.IdToken)
+	assert.Equal(t, session.RefreshToken, loaded.RefreshToken)
+}
+
+func TestRedisSessionStoreExpiresWithTheTokens(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test := newTestRedisProxy(t, mr)
+
+	session := &providers.SessionState{
+		Email:       "michael.bland@gsa.gov",
+		AccessToken: "my_access_token",
+		ExpiresOn:   time.Now().Add(time.Hour),
+	}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	ttl := mr.TTL(mr.Keys()[0])
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour)
+
+	mr.FastForward(2 * time.Hour)
+	_, _, err = pc_test.proxy.LoadCookiedSession(requestWithCookies(pc_test.rw))
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestRedisSessionStoreReusesKeyUntilLogin(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test := newTestRedisProxy(t, mr)
+
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	key := mr.Keys()[0]
+
+	// refreshing the session keeps its key
+	req := requestWithCookies(pc_test.rw)
+	session.AccessToken = "refreshed_access_token"
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(httptest.NewRecorder(), req, session))
+	assert.Equal(t, []string{key}, mr.Keys())
+
+	// signing out removes it
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ClearSessionCookie(rw, req)
+	assert.Equal(t, 0, len(mr.Keys()))
+
+	// and a new session gets a new key
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(httptest.NewRecorder(), req, session))
+	assert.Equal(t, 1, len(mr.Keys()))
+	assert.NotEqual(t, key, mr.Keys()[0])
+}
+
+func TestRedisSessionStoreIdleTimeout(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test := newTestRedisProxy(t, mr)
+	pc_test.proxy.SessionIdleTimeout = 30 * time.Minute
+
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	key := mr.Keys()[0]
+	assert.Equal(t, 30*time.Minute, mr.TTL(key))
+	req := requestWithCookies(pc_test.rw)
+
+	// a request right after doesn't store the session again
+	mr.FastForward(time.Minute)
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(httptest.NewRecorder(), req))
+	assert.Equal(t, 29*time.Minute, mr.TTL(key))
+
+	// a request 20 minutes after the last one keeps the session alive for
+	// another 30
+	session.LastSeen = time.Now().Add(-20 * time.Minute)
+	value, err := pc_test.proxy.encodeSession(session)
+	assert.Equal(t, nil, err)
+	mr.Set(key, value)
+	mr.SetTTL(key, 10*time.Minute)
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(rw, req))
+	assert.Equal(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+	assert.Equal(t, []string{key}, mr.Keys())
+	assert.Equal(t, 30*time.Minute, mr.TTL(key))
+
+	// and it is gone once nothing used it for 30 minutes
+	mr.FastForward(31 * time.Minute)
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(httptest.NewRecorder(), req))
+}
+
+func TestRedisSessionStoreIdleTimeoutKeepsRefreshedTokens(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	defer mr.Close()
+	pc_test := newTestRedisProxy(t, mr)
+	pc_test.proxy.SessionIdleTimeout = 30 * time.Minute
+
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov",
+		AccessToken: "my_access_token", RefreshToken: "my_refresh_token"}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	key := mr.Keys()[0]
+	req := requestWithCookies(pc_test.rw)
+	loaded, _, err := pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	loaded.LastSeen = time.Now().Add(-20 * time.Minute)
+
+	// the session is refreshed by another request while this one is served
+	session.AccessToken = "refreshed_access_token"
+	session.RefreshToken = "rotated_refresh_token"
+	session.LastSeen = time.Now().Add(-20 * time.Minute)
+	value, err := pc_test.proxy.encodeSession(session)
+	assert.Equal(t, nil, err)
+	mr.Set(key, value)
+
+	assert.Equal(t, nil, pc_test.proxy.touchSession(httptest.NewRecorder(), req, loaded, 0))
+	stored, _, err := pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refreshed_access_token", stored.AccessToken)
+	assert.Equal(t, "rotated_refresh_token", stored.RefreshToken)
+	assert.Equal(t, true, time.Now().Sub(stored.LastSeen) < time.Minute)
+}
+
+func TestSessionStoreOptions(t *testing.T) {
+	o := testOptions()
+	o.SessionStore = "memcached"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid setting: session-store="memcached" must be cookie or redis`)
+
+	o = testOptions()
+	o.SessionStore = "redis"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "missing setting: redis-connection-url")
+
+	o = testOptions()
+	o.SessionStore = "redis"
+	o.RedisConnectionURL = "redis://127.0.0.1:6379/0"
+	o.CookieSecret = "0123456789abcdefabcd"
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, nil, o.sessionStore)
+}
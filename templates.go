@@ -3,17 +3,28 @@ package main
 import (
 	"html/template"
 	"log"
+	"os"
 	"path"
 )
 
+// loadTemplates returns the default templates, with sign_in.html and
+// error.html replaced by the files of that name in dir where they exist. A
+// template that fails to parse is fatal, a missing one is not.
 func loadTemplates(dir string) *template.Template {
+	t := getTemplates()
 	if dir == "" {
-		return getTemplates()
+		return t
 	}
 	log.Printf("using custom template directory %q", dir)
-	t, err := template.New("").ParseFiles(path.Join(dir, "sign_in.html"), path.Join(dir, "error.html"))
-	if err != nil {
-		log.Fatalf("failed parsing template %s", err)
+	for _, name := range []string{"sign_in.html", "error.html"} {
+		file := path.Join(dir, name)
+		if _, err := os.Stat(file); err != nil {
+			log.Printf("using the default %s: %s", name, err)
+			continue
+		}
+		if _, err := t.ParseFiles(file); err != nil {
+			log.Fatalf("failed parsing template %s", err)
+		}
 	}
 	return t
 }
@@ -89,6 +100,11 @@ func getTemplates() *template.Template {
 		margin:0;
 		box-sizing: border-box;
 	}
+	.banner {
+		margin:20px auto;
+		max-width:400px;
+		font-weight:bold;
+	}
 	footer {
 		display:block;
 		font-size:10px;
@@ -109,6 +125,9 @@ func getTemplates() *template.Template {
 	</style>
 </head>
 <body>
+	{{ if .Banner }}
+	<div class="banner center">{{.Banner}}</div>
+	{{ end }}
 	<div class="signin center">
 	<form method="GET" action="{{.ProxyPrefix}}/start">
 	<input type="hidden" name="rd" value="{{.Redirect}}">
@@ -164,6 +183,7 @@ func getTemplates() *template.Template {
 <body>
 	<h2>{{.Title}}</h2>
 	<p>{{.Message}}</p>
+	{{ if .RequestID }}<p>Request ID: {{.RequestID}}</p>{{ end }}
 	<hr>
 	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
 </body>
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,3 +16,82 @@ func TestTemplatesCompile(t *testing.T) {
 	templates := getTemplates()
 	assert.NotEqual(t, templates, nil)
 }
+
+func newCustomTemplatesDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadTemplatesCustom(t *testing.T) {
+	dir := newCustomTemplatesDir(t, map[string]string{
+		"sign_in.html": `<p>Acme login with {{.ProviderName}} for {{.Redirect}}</p>`,
+		"error.html":   `<p>Acme error {{.Title}} at {{.Path}}</p>`,
+	})
+	defer os.RemoveAll(dir)
+
+	templates := loadTemplates(dir)
+	buf := bytes.NewBuffer(nil)
+	assert.Equal(t, nil, templates.ExecuteTemplate(buf, "sign_in.html",
+		map[string]string{"ProviderName": "Okta", "Redirect": "/app/<b>"}))
+	assert.Equal(t, "<p>Acme login with Okta for /app/&lt;b&gt;</p>", buf.String())
+
+	buf.Reset()
+	assert.Equal(t, nil, templates.ExecuteTemplate(buf, "error.html",
+		map[string]string{"Title": "403 Permission Denied", "Path": "/app"}))
+	assert.Equal(t, "<p>Acme error 403 Permission Denied at /app</p>", buf.String())
+}
+
+func TestLoadTemplatesMissingFileFallsBack(t *testing.T) {
+	dir := newCustomTemplatesDir(t, map[string]string{
+		"sign_in.html": `<p>Acme login</p>`,
+	})
+	defer os.RemoveAll(dir)
+
+	templates := loadTemplates(dir)
+	buf := bytes.NewBuffer(nil)
+	assert.Equal(t, nil, templates.ExecuteTemplate(buf, "sign_in.html", nil))
+	assert.Equal(t, "<p>Acme login</p>", buf.String())
+
+	buf.Reset()
+	assert.Equal(t, nil, templates.ExecuteTemplate(buf, "error.html",
+		map[string]string{"Title": "500 Internal Error", "ProxyPrefix": "/oauth2"}))
+	assert.Contains(t, buf.String(), "<h2>500 Internal Error</h2>")
+}
+
+func TestLoadTemplatesMissingDirFallsBack(t *testing.T) {
+	templates := loadTemplates(filepath.Join(os.TempDir(), "no-such-templates-dir"))
+	buf := bytes.NewBuffer(nil)
+	assert.Equal(t, nil, templates.ExecuteTemplate(buf, "error.html",
+		map[string]string{"Title": "500 Internal Error", "ProxyPrefix": "/oauth2"}))
+	assert.Contains(t, buf.String(), "<h2>500 Internal Error</h2>")
+}
+
+func TestCustomErrorPage(t *testing.T) {
+	dir := newCustomTemplatesDir(t, map[string]string{
+		"error.html": `{{.ProviderName}}: {{.Title}} at {{.Path}}: {{.Message}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.CustomTemplatesDir = dir
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback", nil)
+	proxy.ErrorPage(rw, req, 403, "Permission Denied", "Invalid State")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "Google: 403 Permission Denied at /oauth2/callback: Invalid State", rw.Body.String())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// UpstreamErrorPage is the ErrorHandler of the upstream reverse proxies. It
+// logs why the upstream could not be reached and renders the error page with
+// a request ID to quote, instead of an empty 502 response.
+func (p *OAuthProxy) UpstreamErrorPage(rw http.ResponseWriter, req *http.Request, err error) {
+	id := requestID(req)
+	log.Printf("%s upstream %s error (%s): %v request_id=%s",
+		getRemoteAddr(req), req.URL.Host, upstreamErrorCategory(err), err, id)
+	rw.Header().Set(RequestIDHeader, id)
+	p.renderErrorPage(rw, req, http.StatusBadGateway, "Bad Gateway",
+		"The application is not reachable at the moment, please try again later.", id)
+}
+
+// upstreamErrorCategory tells why a request to the upstream failed: "dns"
+// when its host name did not resolve, "connection refused" when nothing
+// listens at its address, "timeout" when it did not answer in time (see
+// -upstream-timeout and -upstream-dial-timeout), "canceled" when the client
+// went away and "other" for anything else.
+func upstreamErrorCategory(err error) string {
+	if opErr, ok := err.(*net.OpError); ok {
+		if _, ok := opErr.Err.(*net.DNSError); ok {
+			return "dns"
+		}
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			return "connection refused"
+		}
+	}
+	switch err := err.(type) {
+	case *net.DNSError:
+		return "dns"
+	case net.Error:
+		if err.Timeout() {
+			return "timeout"
+		}
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return "timeout"
+	case context.Canceled:
+		return "canceled"
+	}
+	return "other"
+}
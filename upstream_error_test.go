@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newUnreachableUpstreamProxy(t *testing.T) *OAuthProxy {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// nothing listens at the address once the server is closed
+	upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestUpstreamErrorPage(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	proxy := newUnreachableUpstreamProxy(t)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/app", nil)
+	req.RequestURI = "/app"
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	id := rw.HeaderMap.Get(RequestIDHeader)
+	assert.Equal(t, 36, len(id))
+	assert.Contains(t, rw.Body.String(), "<h2>502 Bad Gateway</h2>")
+	assert.Contains(t, rw.Body.String(), "Request ID: "+id)
+	assert.Contains(t, logs.String(), "error (connection refused)")
+	assert.Contains(t, logs.String(), "request_id="+id)
+}
+
+func TestUpstreamErrorPageKeepsRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	proxy := newUnreachableUpstreamProxy(t)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/app", nil)
+	req.RequestURI = "/app"
+	req.Header.Set(RequestIDHeader, "lb-1234")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, "lb-1234", rw.HeaderMap.Get(RequestIDHeader))
+	assert.Contains(t, rw.Body.String(), "Request ID: lb-1234")
+	assert.Contains(t, logs.String(), "request_id=lb-1234")
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorCategory(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "app.invalid"}}, "dns"},
+		{&net.DNSError{Err: "no such host", Name: "app.invalid"}, "dns"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection refused"},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, "timeout"},
+		{timeoutError{}, "timeout"},
+		{context.DeadlineExceeded, "timeout"},
+		{context.Canceled, "canceled"},
+		{errors.New("unexpected EOF"), "other"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, upstreamErrorCategory(tt.err), tt.err.Error())
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// loadUpstreamTLSConfig builds the TLS configuration for connections to HTTPS
+// upstreams: certFile and keyFile hold the client certificate presented to
+// upstreams that require mutual TLS, and caFiles the PEM encoded certificates
+// the upstream certificate is verified against, in addition to the system
+// roots only if withSystemRoots is set. Each of them may be empty.
+func loadUpstreamTLSConfig(certFile, keyFile string, caFiles []string, withSystemRoots bool) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("upstream-tls-cert and upstream-tls-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load upstream client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(caFiles) > 0 {
+		pool, err := loadCAPool("upstream", caFiles, withSystemRoots)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
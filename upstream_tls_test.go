@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestPEM(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "oauth2_proxy_tls_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	return f.Name()
+}
+
+// newTestClientCert writes a self-signed client certificate and its key to
+// temporary files and returns a pool that trusts it.
+func newTestClientCert(t *testing.T) (certFile string, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "oauth2_proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return writeTestPEM(t, "CERTIFICATE", der), writeTestPEM(t, "EC PRIVATE KEY", keyDER), pool
+}
+
+// newMutualTLSUpstream starts an upstream that requires a client certificate
+// trusted by clientCAs and returns it with the path of its CA file.
+func newMutualTLSUpstream(t *testing.T, clientCAs *x509.CertPool) (*httptest.Server, string) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	upstream.StartTLS()
+	return upstream, writeTestPEM(t, "CERTIFICATE", upstream.Certificate().Raw)
+}
+
+func newUpstreamTLSTest(t *testing.T, upstream *httptest.Server, certFile, keyFile, caFile string) *httptest.ResponseRecorder {
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.UpstreamTLSCert = certFile
+	opts.UpstreamTLSKey = keyFile
+	opts.UpstreamTLSCA = caFile
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"/.*"}
+	return requestTLSUpstream(t, upstream, opts)
+}
+
+// requestTLSUpstream proxies a request to upstream with opts.
+func requestTLSUpstream(t *testing.T, upstream *httptest.Server, opts *Options) *httptest.ResponseRecorder {
+	assert.Equal(t, nil, opts.Validate())
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RequestURI = "/"
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	certFile, keyFile, pool := newTestClientCert(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	upstream, caFile := newMutualTLSUpstream(t, pool)
+	defer upstream.Close()
+	defer os.Remove(caFile)
+
+	rw := newUpstreamTLSTest(t, upstream, certFile, keyFile, caFile)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "hello oauth2_proxy", rw.Body.String())
+}
+
+func TestUpstreamMutualTLSWithoutClientCert(t *testing.T) {
+	certFile, keyFile, pool := newTestClientCert(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	upstream, caFile := newMutualTLSUpstream(t, pool)
+	defer upstream.Close()
+	defer os.Remove(caFile)
+
+	rw := newUpstreamTLSTest(t, upstream, "", "", caFile)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestUpstreamTLSUntrustedClientCert(t *testing.T) {
+	certFile, keyFile, _ := newTestClientCert(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	_, _, otherPool := newTestClientCert(t)
+	upstream, caFile := newMutualTLSUpstream(t, otherPool)
+	defer upstream.Close()
+	defer os.Remove(caFile)
+
+	rw := newUpstreamTLSTest(t, upstream, certFile, keyFile, caFile)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestLoadUpstreamTLSConfigErrors(t *testing.T) {
+	certFile, keyFile, _ := newTestClientCert(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	_, err := loadUpstreamTLSConfig(certFile, "", nil, false)
+	assert.Equal(t, "upstream-tls-cert and upstream-tls-key must be given together", err.Error())
+
+	_, err = loadUpstreamTLSConfig(certFile, "/nonexistent/key.pem", nil, false)
+	assert.Contains(t, err.Error(), "could not load upstream client certificate")
+
+	_, err = loadUpstreamTLSConfig("", "", []string{"/nonexistent/ca.pem"}, false)
+	assert.Contains(t, err.Error(), "could not read upstream CA file")
+
+	_, err = loadUpstreamTLSConfig("", "", []string{keyFile}, false)
+	assert.Contains(t, err.Error(), "no certificates found in upstream CA file")
+
+	config, err := loadUpstreamTLSConfig(certFile, keyFile, []string{certFile}, false)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(config.Certificates))
+	assert.NotEqual(t, (*x509.CertPool)(nil), config.RootCAs)
+}
+
+func TestUpstreamTLSOptionErrors(t *testing.T) {
+	o := testOptions()
+	o.UpstreamTLSKey = "/nonexistent/key.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: upstream-tls-cert and upstream-tls-key must be given together")
+}
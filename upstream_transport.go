@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// newUpstreamTransport is the transport shared by the HTTP(S) upstreams. It
+// starts from the settings of http.DefaultTransport, but keeps as many idle
+// connections per host as in total, as there is usually a single upstream
+// and the default of two makes busy proxies open a new connection for most
+// requests.
+func newUpstreamTransport(o *Options) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   o.UpstreamDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          o.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   o.UpstreamMaxIdleConns,
+		MaxConnsPerHost:       o.UpstreamMaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: o.UpstreamTimeout,
+		TLSClientConfig:       o.upstreamTLS,
+	}
+}
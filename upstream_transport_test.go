@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTransportDefaults(t *testing.T) {
+	transport := newUpstreamTransport(NewOptions())
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 100, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 0, transport.MaxConnsPerHost)
+	assert.Equal(t, time.Duration(0), transport.ResponseHeaderTimeout)
+}
+
+func TestUpstreamTransportOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamTimeout = 5 * time.Second
+	o.UpstreamDialTimeout = 2 * time.Second
+	o.UpstreamMaxIdleConns = 50
+	o.UpstreamMaxConnsPerHost = 20
+	assert.Equal(t, nil, o.Validate())
+
+	transport := newUpstreamTransport(o)
+	assert.Equal(t, 5*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, 50, transport.MaxIdleConns)
+	assert.Equal(t, 50, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 20, transport.MaxConnsPerHost)
+
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+	handler, _ := proxy.serveMux.(*http.ServeMux).Handler(&http.Request{Method: "GET", URL: &url.URL{Path: "/"}})
+	upstream := handler.(*UpstreamProxy).handler.(*WebsocketReverseProxy)
+	used := upstream.Transport.(*http.Transport)
+	assert.Equal(t, 5*time.Second, used.ResponseHeaderTimeout)
+	assert.Equal(t, 20, used.MaxConnsPerHost)
+}
+
+func TestUpstreamTransportNegativeOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamTimeout = -time.Second
+	o.UpstreamDialTimeout = -time.Second
+	o.UpstreamMaxIdleConns = -1
+	o.UpstreamMaxConnsPerHost = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid setting: upstream-timeout=-1s must not be negative")
+	assert.Contains(t, err.Error(), "invalid setting: upstream-dial-timeout=-1s must not be negative")
+	assert.Contains(t, err.Error(), "invalid setting: upstream-max-idle-conns=-1 must not be negative")
+	assert.Contains(t, err.Error(), "invalid setting: upstream-max-conns-per-host=-1 must not be negative")
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.UpstreamTimeout = 100 * time.Millisecond
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"/.*"}
+	assert.Equal(t, nil, opts.Validate())
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for path, expected := range map[string]int{"/fast": 200, "/slow": http.StatusBadGateway} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RequestURI = path
+		start := time.Now()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, expected, rw.Code, path)
+		assert.Equal(t, true, time.Since(start) < 2*time.Second, path)
+	}
+}
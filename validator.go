@@ -69,6 +69,11 @@ func newValidatorImpl(domains []string, usersFile string,
 			allowAll = true
 			continue
 		}
+		if strings.HasPrefix(domain, ".") {
+			// ".example.com" matches the subdomains of example.com
+			domains[i] = strings.ToLower(domain)
+			continue
+		}
 		domains[i] = fmt.Sprintf("@%s", strings.ToLower(domain))
 	}
 
@@ -97,6 +97,69 @@ func TestValidatorSingleDomain(t *testing.T) {
 	}
 }
 
+func TestValidatorDomainIsExact(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string(nil))
+	domains := []string{"example.com"}
+	validator := vt.NewValidator(domains, nil)
+
+	if validator("foo.bar@eng.example.com") {
+		t.Error("email from subdomain should not validate")
+	}
+	if validator("foo.bar@badexample.com") {
+		t.Error("email from domain with same suffix should not validate")
+	}
+	if validator("foo.bar@example.com.evil.org") {
+		t.Error("email from domain with same prefix should not validate")
+	}
+	if validator("") {
+		t.Error("empty email should not validate")
+	}
+}
+
+func TestValidatorSubdomains(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string(nil))
+	domains := []string{".Example.com"}
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("foo.bar@eng.example.com") {
+		t.Error("email from subdomain should validate")
+	}
+	if !validator("foo.bar@a.b.example.com") {
+		t.Error("email from nested subdomain should validate")
+	}
+	if validator("foo.bar@example.com") {
+		t.Error("email from the domain itself should not validate")
+	}
+	if validator("foo.bar@badexample.com") {
+		t.Error("email from domain with same suffix should not validate")
+	}
+}
+
+func TestValidatorAllDomains(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string(nil))
+	domains := []string{"example.com", "*"}
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("foo.bar@example.com") {
+		t.Error("email should validate")
+	}
+	if !validator("foo.bar@example.org") {
+		t.Error("email from any domain should validate")
+	}
+	if validator("") {
+		t.Error("empty email should not validate")
+	}
+}
+
 func TestValidatorMultipleEmailsMultipleDomains(t *testing.T) {
 	vt := NewValidatorTest(t)
 	defer vt.TearDown()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"log"
 	"net"
@@ -15,6 +16,9 @@ import (
 type WebsocketReverseProxy struct {
 	*httputil.ReverseProxy
 	Upstream string
+	// TLSClientConfig is used for WebSocket connections to HTTPS upstreams,
+	// like the Transport of the ReverseProxy for other requests.
+	TLSClientConfig *tls.Config
 }
 
 func NewWebsocketReverseProxy(target *url.URL) *WebsocketReverseProxy {
@@ -38,10 +42,15 @@ func (p *WebsocketReverseProxy) hijackWebsocket(rw http.ResponseWriter, req *htt
 		return
 	}
 
-	conn, bufrw, err := highjacker.Hijack()
-	defer conn.Close()
+	// run the director on a copy so the handshake gets the same host and
+	// path rewriting as plain requests to the upstream
+	outreq := new(http.Request)
+	*outreq = *req
+	outURL := *req.URL
+	outreq.URL = &outURL
+	p.Director(outreq)
 
-	conn2, err := net.Dial("tcp", p.Upstream)
+	conn2, err := dialUpstream(outreq.URL, p.TLSClientConfig)
 	if err != nil {
 		log.Printf("couldn't connect to backend websocket server: %v", err)
 		http.Error(rw, "couldn't connect to backend server", http.StatusServiceUnavailable)
@@ -49,7 +58,15 @@ func (p *WebsocketReverseProxy) hijackWebsocket(rw http.ResponseWriter, req *htt
 	}
 	defer conn2.Close()
 
-	err = req.Write(conn2)
+	conn, bufrw, err := highjacker.Hijack()
+	if err != nil {
+		log.Printf("hijacking websocket connection failed: %v", err)
+		http.Error(rw, "couldn't hijack connection", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	err = outreq.Write(conn2)
 	if err != nil {
 		log.Printf("writing WebSocket request to backend server failed: %v", err)
 		return
@@ -58,23 +75,37 @@ func (p *WebsocketReverseProxy) hijackWebsocket(rw http.ResponseWriter, req *htt
 	bufferedBidirCopy(conn, bufrw, conn2, bufio.NewReadWriter(bufio.NewReader(conn2), bufio.NewWriter(conn2)))
 }
 
-func websocketUpgradeRequest(req *http.Request) bool {
-	connection_headers, ok := req.Header["Connection"]
-	if !ok || len(connection_headers) <= 0 {
-		return false
+func dialUpstream(u *url.URL, config *tls.Config) (net.Conn, error) {
+	host := u.Host
+	if u.Scheme == "https" {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "443")
+		}
+		return tls.Dial("tcp", host, config)
 	}
-
-	connection_header := connection_headers[0]
-	if strings.ToLower(connection_header) != "upgrade" {
-		return false
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
 	}
+	return net.Dial("tcp", host)
+}
 
-	upgrade_headers, ok := req.Header["Upgrade"]
-	if !ok || len(upgrade_headers) <= 0 {
-		return false
-	}
+func websocketUpgradeRequest(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") &&
+		headerHasToken(req.Header, "Upgrade", "websocket")
+}
 
-	return strings.ToLower(upgrade_headers[0]) == "websocket"
+// headerHasToken reports whether one of the comma separated values of the
+// header equals token, ignoring case. Browsers send e.g.
+// "Connection: keep-alive, Upgrade".
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func bufferedCopy(dest *bufio.ReadWriter, src *bufio.ReadWriter) {